@@ -0,0 +1,197 @@
+// Package admin provides an HTTP API for operators to inspect and kill connections and pollers,
+// and to manage the to-device messages queued for devices.
+// It is served on its own bind address and protected by a shared secret, so it should never be
+// exposed to clients.
+package admin
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"github.com/matrix-org/sliding-sync/internal"
+	"github.com/matrix-org/sliding-sync/state"
+	"github.com/matrix-org/sliding-sync/sync2"
+	"github.com/matrix-org/sliding-sync/sync3"
+	"github.com/rs/zerolog/log"
+)
+
+// ConnMap is the subset of *sync3.ConnMap used by the admin API.
+type ConnMap interface {
+	ConnInfos(userID string) []sync3.ConnInfo
+	CloseConnsForUsers(userIDs []string) (closed int)
+}
+
+// PollerMap is the subset of *sync2.PollerMap used by the admin API.
+type PollerMap interface {
+	PollerInfos() []sync2.PollerInfo
+	ExpirePollers(pids []sync2.PollerID) int
+}
+
+// ToDeviceQueues is the subset of *state.ToDeviceTable used by the admin API.
+type ToDeviceQueues interface {
+	Queue(userID, deviceID string) (state.ToDeviceQueue, error)
+	ClearQueue(userID, deviceID string) (int64, error)
+}
+
+type handler struct {
+	secret   string
+	conns    ConnMap
+	pollers  PollerMap
+	toDevice ToDeviceQueues
+}
+
+// NewHandler returns the admin API. Every request must have an `Authorization: Bearer <secret>`
+// header. The routes are:
+//
+//	GET    /admin/v1/conns[?user_id=]         list connections, optionally for one user
+//	DELETE /admin/v1/conns/{userID}           close every connection for this user
+//	GET    /admin/v1/pollers                  list running pollers
+//	DELETE /admin/v1/pollers/{userID}         expire every poller for this user
+//	DELETE /admin/v1/pollers/{userID}/{deviceID}
+//	GET    /admin/v1/to_device/{userID}/{deviceID}  describe the device's queued to-device messages
+//	DELETE /admin/v1/to_device/{userID}/{deviceID}  delete the device's queued to-device messages
+//
+// Instances which only serve clients or only run pollers pass nil for the part they don't have,
+// and the routes for it are not served.
+func NewHandler(secret string, conns ConnMap, pollers PollerMap, toDevice ToDeviceQueues) http.Handler {
+	h := &handler{
+		secret:   secret,
+		conns:    conns,
+		pollers:  pollers,
+		toDevice: toDevice,
+	}
+	r := mux.NewRouter()
+	if conns != nil {
+		r.HandleFunc("/admin/v1/conns", h.listConns).Methods("GET")
+		r.HandleFunc("/admin/v1/conns/{userID}", h.closeConns).Methods("DELETE")
+	}
+	if pollers != nil {
+		r.HandleFunc("/admin/v1/pollers", h.listPollers).Methods("GET")
+		r.HandleFunc("/admin/v1/pollers/{userID}", h.expirePollers).Methods("DELETE")
+		r.HandleFunc("/admin/v1/pollers/{userID}/{deviceID}", h.expirePollers).Methods("DELETE")
+	}
+	if toDevice != nil {
+		r.HandleFunc("/admin/v1/to_device/{userID}/{deviceID}", h.toDeviceQueue).Methods("GET")
+		r.HandleFunc("/admin/v1/to_device/{userID}/{deviceID}", h.clearToDeviceQueue).Methods("DELETE")
+	}
+	return h.authenticate(r)
+}
+
+func (h *handler) authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		token, ok := strings.CutPrefix(req.Header.Get("Authorization"), "Bearer ")
+		if !ok {
+			writeError(w, &internal.HandlerError{
+				StatusCode: 401,
+				ErrCode:    "M_MISSING_TOKEN",
+				Err:        fmt.Errorf("missing admin secret"),
+			})
+			return
+		}
+		if subtle.ConstantTimeCompare([]byte(token), []byte(h.secret)) != 1 {
+			log.Warn().Str("remote", req.RemoteAddr).Msg("admin API request with bad secret")
+			writeError(w, &internal.HandlerError{
+				StatusCode: 403,
+				ErrCode:    "M_FORBIDDEN",
+				Err:        fmt.Errorf("bad admin secret"),
+			})
+			return
+		}
+		next.ServeHTTP(w, req)
+	})
+}
+
+func (h *handler) listConns(w http.ResponseWriter, req *http.Request) {
+	writeJSON(w, struct {
+		Conns []sync3.ConnInfo `json:"conns"`
+	}{
+		Conns: h.conns.ConnInfos(req.URL.Query().Get("user_id")),
+	})
+}
+
+func (h *handler) closeConns(w http.ResponseWriter, req *http.Request) {
+	userID := mux.Vars(req)["userID"]
+	closed := h.conns.CloseConnsForUsers([]string{userID})
+	log.Info().Str("user", userID).Int("closed", closed).Msg("admin API closed connections")
+	writeJSON(w, struct {
+		Closed int `json:"closed"`
+	}{
+		Closed: closed,
+	})
+}
+
+func (h *handler) listPollers(w http.ResponseWriter, req *http.Request) {
+	writeJSON(w, struct {
+		Pollers []sync2.PollerInfo `json:"pollers"`
+	}{
+		Pollers: h.pollers.PollerInfos(),
+	})
+}
+
+func (h *handler) expirePollers(w http.ResponseWriter, req *http.Request) {
+	vars := mux.Vars(req)
+	userID, deviceID := vars["userID"], vars["deviceID"]
+	var pids []sync2.PollerID
+	for _, info := range h.pollers.PollerInfos() {
+		if info.UserID == userID && (deviceID == "" || info.DeviceID == deviceID) {
+			pids = append(pids, sync2.PollerID{UserID: info.UserID, DeviceID: info.DeviceID})
+		}
+	}
+	expired := h.pollers.ExpirePollers(pids)
+	log.Info().Str("user", userID).Str("device", deviceID).Int("expired", expired).Msg("admin API expired pollers")
+	writeJSON(w, struct {
+		Expired int `json:"expired"`
+	}{
+		Expired: expired,
+	})
+}
+
+func (h *handler) toDeviceQueue(w http.ResponseWriter, req *http.Request) {
+	vars := mux.Vars(req)
+	queue, err := h.toDevice.Queue(vars["userID"], vars["deviceID"])
+	if err != nil {
+		writeError(w, &internal.HandlerError{
+			StatusCode: 500,
+			Err:        fmt.Errorf("failed to load to-device queue: %w", err),
+		})
+		return
+	}
+	writeJSON(w, queue)
+}
+
+func (h *handler) clearToDeviceQueue(w http.ResponseWriter, req *http.Request) {
+	vars := mux.Vars(req)
+	userID, deviceID := vars["userID"], vars["deviceID"]
+	deleted, err := h.toDevice.ClearQueue(userID, deviceID)
+	if err != nil {
+		writeError(w, &internal.HandlerError{
+			StatusCode: 500,
+			Err:        fmt.Errorf("failed to clear to-device queue: %w", err),
+		})
+		return
+	}
+	log.Info().Str("user", userID).Str("device", deviceID).Int64("deleted", deleted).Msg("admin API cleared to-device queue")
+	writeJSON(w, struct {
+		Deleted int64 `json:"deleted"`
+	}{
+		Deleted: deleted,
+	})
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(200)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Warn().Err(err).Msg("failed to write admin API response")
+	}
+}
+
+func writeError(w http.ResponseWriter, herr *internal.HandlerError) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(herr.StatusCode)
+	w.Write(herr.JSON())
+}
@@ -0,0 +1,191 @@
+package admin
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/sliding-sync/state"
+	"github.com/matrix-org/sliding-sync/sync2"
+	"github.com/matrix-org/sliding-sync/sync3"
+)
+
+const secret = "s3cr3t"
+
+type mockConnMap struct {
+	infos  []sync3.ConnInfo
+	closed []string
+}
+
+func (m *mockConnMap) ConnInfos(userID string) (infos []sync3.ConnInfo) {
+	for _, info := range m.infos {
+		if userID == "" || info.UserID == userID {
+			infos = append(infos, info)
+		}
+	}
+	return
+}
+
+func (m *mockConnMap) CloseConnsForUsers(userIDs []string) int {
+	m.closed = append(m.closed, userIDs...)
+	return len(m.ConnInfos(userIDs[0]))
+}
+
+type mockPollerMap struct {
+	infos   []sync2.PollerInfo
+	expired []sync2.PollerID
+}
+
+func (m *mockPollerMap) PollerInfos() []sync2.PollerInfo {
+	return m.infos
+}
+
+func (m *mockPollerMap) ExpirePollers(pids []sync2.PollerID) int {
+	m.expired = append(m.expired, pids...)
+	return len(pids)
+}
+
+type mockToDeviceQueues struct {
+	queues  map[[2]string]state.ToDeviceQueue
+	cleared [][2]string
+}
+
+func (m *mockToDeviceQueues) Queue(userID, deviceID string) (state.ToDeviceQueue, error) {
+	queue, ok := m.queues[[2]string{userID, deviceID}]
+	if !ok {
+		queue = state.ToDeviceQueue{UserID: userID, DeviceID: deviceID, DepthByType: map[string]int64{}}
+	}
+	return queue, nil
+}
+
+func (m *mockToDeviceQueues) ClearQueue(userID, deviceID string) (int64, error) {
+	m.cleared = append(m.cleared, [2]string{userID, deviceID})
+	return m.queues[[2]string{userID, deviceID}].Depth, nil
+}
+
+func doRequest(t *testing.T, h http.Handler, method, path, token string, wantCode int) map[string]json.RawMessage {
+	t.Helper()
+	req := httptest.NewRequest(method, path, nil)
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	if w.Code != wantCode {
+		t.Fatalf("%s %s: got HTTP %d want %d: %s", method, path, w.Code, wantCode, w.Body.String())
+	}
+	var body map[string]json.RawMessage
+	if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+		t.Fatalf("%s %s: response is not JSON: %s", method, path, err)
+	}
+	return body
+}
+
+func TestAdminAuth(t *testing.T) {
+	h := NewHandler(secret, &mockConnMap{}, &mockPollerMap{}, nil)
+	body := doRequest(t, h, "GET", "/admin/v1/conns", "", 401)
+	if string(body["errcode"]) != `"M_MISSING_TOKEN"` {
+		t.Errorf("missing token: got errcode %s", body["errcode"])
+	}
+	body = doRequest(t, h, "GET", "/admin/v1/conns", "wrong", 403)
+	if string(body["errcode"]) != `"M_FORBIDDEN"` {
+		t.Errorf("bad token: got errcode %s", body["errcode"])
+	}
+	doRequest(t, h, "GET", "/admin/v1/conns", secret, 200)
+}
+
+func TestAdminConns(t *testing.T) {
+	conns := &mockConnMap{
+		infos: []sync3.ConnInfo{
+			{UserID: "@alice:localhost", DeviceID: "A", CID: "room-list", Lists: map[string]sync3.SliceRanges{"a": {{0, 20}}}},
+			{UserID: "@bob:localhost", DeviceID: "B", CID: "encryption"},
+		},
+	}
+	h := NewHandler(secret, conns, &mockPollerMap{}, nil)
+
+	body := doRequest(t, h, "GET", "/admin/v1/conns?user_id=@alice:localhost", secret, 200)
+	var got []sync3.ConnInfo
+	if err := json.Unmarshal(body["conns"], &got); err != nil {
+		t.Fatalf("failed to unmarshal conns: %s", err)
+	}
+	if !reflect.DeepEqual(got, conns.infos[:1]) {
+		t.Errorf("list conns: got %+v want %+v", got, conns.infos[:1])
+	}
+
+	body = doRequest(t, h, "DELETE", "/admin/v1/conns/@bob:localhost", secret, 200)
+	if string(body["closed"]) != "1" {
+		t.Errorf("close conns: got closed=%s want 1", body["closed"])
+	}
+	if !reflect.DeepEqual(conns.closed, []string{"@bob:localhost"}) {
+		t.Errorf("close conns: closed %v", conns.closed)
+	}
+}
+
+func TestAdminPollers(t *testing.T) {
+	pollers := &mockPollerMap{
+		infos: []sync2.PollerInfo{
+			{UserID: "@alice:localhost", DeviceID: "A", Since: "s1"},
+			{UserID: "@alice:localhost", DeviceID: "B", Since: "s2"},
+			{UserID: "@bob:localhost", DeviceID: "A", Since: "s3"},
+		},
+	}
+	h := NewHandler(secret, &mockConnMap{}, pollers, nil)
+
+	body := doRequest(t, h, "GET", "/admin/v1/pollers", secret, 200)
+	var got []sync2.PollerInfo
+	if err := json.Unmarshal(body["pollers"], &got); err != nil {
+		t.Fatalf("failed to unmarshal pollers: %s", err)
+	}
+	if !reflect.DeepEqual(got, pollers.infos) {
+		t.Errorf("list pollers: got %+v want %+v", got, pollers.infos)
+	}
+
+	doRequest(t, h, "DELETE", "/admin/v1/pollers/@alice:localhost/B", secret, 200)
+	body = doRequest(t, h, "DELETE", "/admin/v1/pollers/@bob:localhost", secret, 200)
+	if string(body["expired"]) != "1" {
+		t.Errorf("expire pollers: got expired=%s want 1", body["expired"])
+	}
+	want := []sync2.PollerID{
+		{UserID: "@alice:localhost", DeviceID: "B"},
+		{UserID: "@bob:localhost", DeviceID: "A"},
+	}
+	if !reflect.DeepEqual(pollers.expired, want) {
+		t.Errorf("expire pollers: got %v want %v", pollers.expired, want)
+	}
+}
+
+func TestAdminToDevice(t *testing.T) {
+	queue := state.ToDeviceQueue{
+		UserID:          "@alice:localhost",
+		DeviceID:        "A",
+		Depth:           3,
+		DepthByType:     map[string]int64{"m.room.encrypted": 2, "m.key.verification.request": 1},
+		UnackedPosition: 42,
+		Oldest:          time.UnixMilli(1700000000000).UTC(),
+	}
+	toDevice := &mockToDeviceQueues{
+		queues: map[[2]string]state.ToDeviceQueue{{"@alice:localhost", "A"}: queue},
+	}
+	h := NewHandler(secret, nil, nil, toDevice)
+
+	body := doRequest(t, h, "GET", "/admin/v1/to_device/@alice:localhost/A", secret, 200)
+	b, _ := json.Marshal(body)
+	var got state.ToDeviceQueue
+	if err := json.Unmarshal(b, &got); err != nil {
+		t.Fatalf("failed to unmarshal queue: %s", err)
+	}
+	if !reflect.DeepEqual(got, queue) {
+		t.Errorf("get queue: got %+v want %+v", got, queue)
+	}
+
+	body = doRequest(t, h, "DELETE", "/admin/v1/to_device/@alice:localhost/A", secret, 200)
+	if string(body["deleted"]) != "3" {
+		t.Errorf("clear queue: got deleted=%s want 3", body["deleted"])
+	}
+	if want := [][2]string{{"@alice:localhost", "A"}}; !reflect.DeepEqual(toDevice.cleared, want) {
+		t.Errorf("clear queue: cleared %v want %v", toDevice.cleared, want)
+	}
+}
@@ -0,0 +1,71 @@
+// Command syncv3-replay replays connection recordings made with SYNCV3_RECORD_DIR, and reports any
+// responses which come out differently. Use it to reproduce list bugs reported by clients, and to
+// check that a fix changes the responses in the way you expect.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/matrix-org/sliding-sync/sync3/handler"
+	"github.com/rs/zerolog"
+)
+
+func main() {
+	verbose := flag.Bool("v", false, "print every replayed response")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [-v] recording.jsonl...\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	// the proxy's own logging is just noise here
+	zerolog.SetGlobalLevel(zerolog.Disabled)
+
+	failed := false
+	for _, path := range flag.Args() {
+		ok, err := replay(path, *verbose)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %s\n", path, err)
+			os.Exit(1)
+		}
+		failed = failed || !ok
+	}
+	if failed {
+		os.Exit(1)
+	}
+}
+
+// replay replays a single recording, returning false if any response came out differently.
+func replay(path string, verbose bool) (bool, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+	result, err := handler.Replay(context.Background(), f)
+	if err != nil {
+		return false, err
+	}
+	fmt.Printf("%s: %s replayed %d responses, %d differ\n", path, result.Conn.String(), len(result.Responses), len(result.Mismatches))
+	mismatches := make(map[int][]string, len(result.Mismatches))
+	for _, m := range result.Mismatches {
+		mismatches[m.Response] = m.Diffs
+	}
+	for i, res := range result.Responses {
+		if verbose {
+			data, _ := json.Marshal(res)
+			fmt.Printf("  response %d: %s\n", i, data)
+		}
+		for _, diff := range mismatches[i] {
+			fmt.Printf("  response %d: %s\n", i, diff)
+		}
+	}
+	return len(result.Mismatches) == 0, nil
+}
@@ -22,7 +22,10 @@ import (
 
 	syncv3 "github.com/matrix-org/sliding-sync"
 	"github.com/matrix-org/sliding-sync/internal"
+	"github.com/matrix-org/sliding-sync/sqlutil"
+	"github.com/matrix-org/sliding-sync/state"
 	"github.com/matrix-org/sliding-sync/sync2"
+	"github.com/matrix-org/sliding-sync/sync3/handler"
 )
 
 var GitCommit string
@@ -56,12 +59,40 @@ const (
 	EnvIdleTimeoutSecs        = "SYNCV3_DB_IDLE_TIMEOUT_SECS"
 	EnvHTTPTimeoutSecs        = "SYNCV3_HTTP_TIMEOUT_SECS"
 	EnvHTTPInitialTimeoutSecs = "SYNCV3_HTTP_INITIAL_TIMEOUT_SECS"
+	EnvPresence               = "SYNCV3_PRESENCE"
+	EnvWebSockets             = "SYNCV3_WEBSOCKETS"
+	EnvAdminBindAddr          = "SYNCV3_ADMIN_BINDADDR"
+	EnvAdminSecret            = "SYNCV3_ADMIN_SECRET"
+	EnvCheckpointConns        = "SYNCV3_CHECKPOINT_CONNS"
+	EnvPubSubPostgres         = "SYNCV3_PUBSUB_POSTGRES"
+	EnvRole                   = "SYNCV3_ROLE"
+	EnvRateLimits             = "SYNCV3_RATE_LIMITS"
+	EnvRetentionDays          = "SYNCV3_RETENTION_DAYS"
+	EnvRetentionEvents        = "SYNCV3_RETENTION_EVENTS_PER_ROOM"
+	EnvRetentionUnjoined      = "SYNCV3_RETENTION_UNJOINED_ROOMS"
+	EnvHomeservers            = "SYNCV3_HOMESERVERS"
+	EnvHomeserverHosts        = "SYNCV3_HOMESERVER_HOSTS"
+	EnvRecordDir              = "SYNCV3_RECORD_DIR"
+	EnvRecordUsers            = "SYNCV3_RECORD_USERS"
+	EnvToDeviceTTLDays        = "SYNCV3_TO_DEVICE_TTL_DAYS"
+	EnvToDeviceMaxPerDevice   = "SYNCV3_TO_DEVICE_MAX_PER_DEVICE"
+	EnvWebhookURL             = "SYNCV3_WEBHOOK_URL"
+	EnvWebhookSecret          = "SYNCV3_WEBHOOK_SECRET"
+	EnvAuth                   = "SYNCV3_AUTH"
+	EnvAuthIntrospectionURL   = "SYNCV3_AUTH_INTROSPECTION_URL"
+	EnvAuthClientID           = "SYNCV3_AUTH_CLIENT_ID"
+	EnvAuthClientSecret       = "SYNCV3_AUTH_CLIENT_SECRET"
+	EnvAuthJWKSFile           = "SYNCV3_AUTH_JWKS_FILE"
+	EnvAuthIssuer             = "SYNCV3_AUTH_ISSUER"
+	EnvAuthServerName         = "SYNCV3_AUTH_SERVER_NAME"
+	EnvAuthTokenTTLSecs       = "SYNCV3_AUTH_TOKEN_TTL_SECS"
+	EnvAuthRejectedTTLSecs    = "SYNCV3_AUTH_REJECTED_TTL_SECS"
 )
 
 var helpMsg = fmt.Sprintf(`
 Environment var
-%s     Required. The destination homeserver to talk to (CS API HTTPS URL) e.g 'https://matrix-client.matrix.org' (Supports unix socket: /path/to/socket)
-%s         Required. The postgres connection string: https://www.postgresql.org/docs/current/libpq-connect.html#LIBPQ-CONNSTRING
+%s     Required. The destination homeserver to talk to (CS API HTTPS URL) e.g 'https://matrix-client.matrix.org' (Supports unix socket: /path/to/socket). Users on servers not listed in %s are sent here.
+%s         Required. The postgres connection string: https://www.postgresql.org/docs/current/libpq-connect.html#LIBPQ-CONNSTRING or 'sqlite:/path/to/syncv3.db' to use SQLite.
 %s     Required. A secret to use to encrypt access tokens. Must remain the same for the lifetime of the database.
 %s   Default: 0.0.0.0:8008.  The interface and port to listen on. (Supports unix socket: /path/to/socket)
 %s   Default: unset. Path to a certificate file to serve to HTTPS clients. Specifying this enables TLS on the bound address.
@@ -78,8 +109,41 @@ Environment var
 %s Default: 3600. The maximum amount of time a database connection may be idle, in seconds. 0 means no limit.
 %s Default: 300. The timeout in seconds for normal HTTP requests.
 %s Default: 1800. The timeout in seconds for initial sync requests.
-`, EnvServer, EnvDB, EnvSecret, EnvBindAddr, EnvTLSCert, EnvTLSKey, EnvPPROF, EnvPrometheus, EnvOTLP, EnvOTLPUsername, EnvOTLPPassword,
-	EnvSentryDsn, EnvLogLevel, EnvMaxConns, EnvPlainOutput, EnvIdleTimeoutSecs, EnvHTTPTimeoutSecs, EnvHTTPInitialTimeoutSecs)
+%s Default: unset. If set to 1, pollers will request presence from the upstream homeserver and serve it via the presence extension.
+%s Default: unset. If set to 1, clients may upgrade the sync endpoint to a WebSocket and receive responses as they happen.
+%s Default: unset. The bind addr for the admin API e.g '127.0.0.1:8009'. If not set, does not listen. Requires the admin secret.
+%s Default: unset. The bearer token which must be sent on every admin API request.
+%s Default: unset. If set to 1, connection state is saved to the database so clients can keep their ?pos= across a restart.
+%s Default: unset. If set to 1, instances talk over Postgres LISTEN/NOTIFY so several instances can share one database.
+%s Default: all. Which half of the proxy to run: 'all', 'poller' (run pollers only) or 'api' (serve clients only). 'poller' and 'api' require %s.
+%s Default: unset. Rate limits for the sync endpoint as a comma separated list of scope=requests_per_sec/burst e.g 'device=2/10,initial_user=0.1/5'. Scopes are user, device and conn, plus initial_user, initial_device and initial_conn for initial syncs.
+%s Default: unset. If set, timeline events older than this many days are purged from the database. Current room state is kept.
+%s Default: unset. If set, all but this many of the most recent timeline events in each room are purged from the database.
+%s Default: unset. If set to 1, the timelines of rooms which no proxy user is joined to are purged from the database.
+%s Default: unset. More homeservers to serve, as a comma separated list of server_name=url e.g 'example.org=https://matrix.example.org,example.com=http://localhost:8008'. Users are sent to the homeserver for the server name in their user ID. All homeservers share the same database, so their data is not isolated.
+%s Default: unset. Which homeserver new access tokens are checked against, by the Host the request was made to, as a comma separated list of host=server_name e.g 'sync.example.org=example.org'. Unmapped hosts use %s.
+%s Default: unset. A directory to record sync connections to, for debugging with syncv3-replay. Each connection gets its own file, which includes its requests and responses.
+%s Default: unset. If set, only these users' connections are recorded, as a comma separated list of user IDs.
+%s Default: unset. If set, to-device messages which have been queued for longer than this many days are deleted.
+%s Default: unset. If set, devices can have at most this many to-device messages queued. The oldest are dropped first, keeping key shares for as long as possible.
+%s Default: unset. A URL to POST to whenever a user's highlight or notification count in a room goes up. Requires the webhook secret.
+%s Default: unset. The secret to sign webhook requests with. Each request has an X-Sliding-Sync-Signature header containing the HMAC-SHA256 of the body.
+%s Default: whoami. How access tokens the proxy hasn't seen before are identified: 'whoami' (ask the homeserver), 'introspection' (OAuth 2.0 token introspection, for MSC3861 homeservers) or 'jwt' (check the token is a JWT signed by a key in a JWKS file).
+%s Default: unset. The OAuth 2.0 token introspection endpoint. Required for 'introspection'.
+%s Default: unset. The client ID to authenticate to the introspection endpoint with, using HTTP Basic auth.
+%s Default: unset. The client secret to authenticate to the introspection endpoint with.
+%s Default: unset. Path to a JWKS file with the keys which sign access tokens. Required for 'jwt'.
+%s Default: unset. If set, JWT access tokens must have this issuer.
+%s Default: unset. The server name of users who are only identified by their localpart, when the token was sent to the default homeserver.
+%s Default: 0. If set, identified access tokens are checked again after this many seconds. 0 means they are trusted until they expire, or until the homeserver rejects them.
+%s Default: 0. If set, rejected access tokens are rejected without checking them again for this many seconds.
+`, EnvServer, EnvHomeservers, EnvDB, EnvSecret, EnvBindAddr, EnvTLSCert, EnvTLSKey, EnvPPROF, EnvPrometheus, EnvOTLP, EnvOTLPUsername, EnvOTLPPassword,
+	EnvSentryDsn, EnvLogLevel, EnvMaxConns, EnvPlainOutput, EnvIdleTimeoutSecs, EnvHTTPTimeoutSecs, EnvHTTPInitialTimeoutSecs, EnvPresence, EnvWebSockets,
+	EnvAdminBindAddr, EnvAdminSecret, EnvCheckpointConns, EnvPubSubPostgres, EnvRole, EnvPubSubPostgres,
+	EnvRateLimits, EnvRetentionDays, EnvRetentionEvents, EnvRetentionUnjoined, EnvHomeservers, EnvHomeserverHosts, EnvServer,
+	EnvRecordDir, EnvRecordUsers, EnvToDeviceTTLDays, EnvToDeviceMaxPerDevice,
+	EnvWebhookURL, EnvWebhookSecret, EnvAuth, EnvAuthIntrospectionURL, EnvAuthClientID, EnvAuthClientSecret,
+	EnvAuthJWKSFile, EnvAuthIssuer, EnvAuthServerName, EnvAuthTokenTTLSecs, EnvAuthRejectedTTLSecs)
 
 func defaulting(in, dft string) string {
 	if in == "" {
@@ -118,6 +182,34 @@ func main() {
 		EnvIdleTimeoutSecs:        defaulting(os.Getenv(EnvIdleTimeoutSecs), "3600"),
 		EnvHTTPTimeoutSecs:        defaulting(os.Getenv(EnvHTTPTimeoutSecs), "300"),
 		EnvHTTPInitialTimeoutSecs: defaulting(os.Getenv(EnvHTTPInitialTimeoutSecs), "1800"),
+		EnvPresence:               os.Getenv(EnvPresence),
+		EnvWebSockets:             os.Getenv(EnvWebSockets),
+		EnvAdminBindAddr:          os.Getenv(EnvAdminBindAddr),
+		EnvAdminSecret:            os.Getenv(EnvAdminSecret),
+		EnvCheckpointConns:        os.Getenv(EnvCheckpointConns),
+		EnvPubSubPostgres:         os.Getenv(EnvPubSubPostgres),
+		EnvRole:                   defaulting(os.Getenv(EnvRole), syncv3.RoleAll),
+		EnvRateLimits:             os.Getenv(EnvRateLimits),
+		EnvRetentionDays:          defaulting(os.Getenv(EnvRetentionDays), "0"),
+		EnvRetentionEvents:        defaulting(os.Getenv(EnvRetentionEvents), "0"),
+		EnvRetentionUnjoined:      os.Getenv(EnvRetentionUnjoined),
+		EnvHomeservers:            os.Getenv(EnvHomeservers),
+		EnvHomeserverHosts:        os.Getenv(EnvHomeserverHosts),
+		EnvRecordDir:              os.Getenv(EnvRecordDir),
+		EnvRecordUsers:            os.Getenv(EnvRecordUsers),
+		EnvToDeviceTTLDays:        defaulting(os.Getenv(EnvToDeviceTTLDays), "0"),
+		EnvToDeviceMaxPerDevice:   defaulting(os.Getenv(EnvToDeviceMaxPerDevice), "0"),
+		EnvWebhookURL:             os.Getenv(EnvWebhookURL),
+		EnvWebhookSecret:          os.Getenv(EnvWebhookSecret),
+		EnvAuth:                   defaulting(os.Getenv(EnvAuth), "whoami"),
+		EnvAuthIntrospectionURL:   os.Getenv(EnvAuthIntrospectionURL),
+		EnvAuthClientID:           os.Getenv(EnvAuthClientID),
+		EnvAuthClientSecret:       os.Getenv(EnvAuthClientSecret),
+		EnvAuthJWKSFile:           os.Getenv(EnvAuthJWKSFile),
+		EnvAuthIssuer:             os.Getenv(EnvAuthIssuer),
+		EnvAuthServerName:         os.Getenv(EnvAuthServerName),
+		EnvAuthTokenTTLSecs:       defaulting(os.Getenv(EnvAuthTokenTTLSecs), "0"),
+		EnvAuthRejectedTTLSecs:    defaulting(os.Getenv(EnvAuthRejectedTTLSecs), "0"),
 	}
 	requiredEnvVars := []string{EnvServer, EnvDB, EnvSecret, EnvBindAddr}
 	for _, requiredEnvVar := range requiredEnvVars {
@@ -133,6 +225,24 @@ func main() {
 		fmt.Printf("\nboth %s and %s must be set together\n", EnvTLSCert, EnvTLSKey)
 		os.Exit(1)
 	}
+	if args[EnvAdminBindAddr] != "" && args[EnvAdminSecret] == "" {
+		fmt.Print(helpMsg)
+		fmt.Printf("\n%s must be set to use %s\n", EnvAdminSecret, EnvAdminBindAddr)
+		os.Exit(1)
+	}
+	switch args[EnvRole] {
+	case syncv3.RoleAll:
+	case syncv3.RolePoller, syncv3.RoleAPI:
+		if args[EnvPubSubPostgres] != "1" {
+			fmt.Print(helpMsg)
+			fmt.Printf("\n%s must be set to 1 to use %s=%s\n", EnvPubSubPostgres, EnvRole, args[EnvRole])
+			os.Exit(1)
+		}
+	default:
+		fmt.Print(helpMsg)
+		fmt.Printf("\ninvalid value for %s: %s\n", EnvRole, args[EnvRole])
+		os.Exit(1)
+	}
 	// pprof
 	if args[EnvPPROF] != "" {
 		go func() {
@@ -231,6 +341,86 @@ func main() {
 	if err != nil {
 		panic("invalid value for " + EnvHTTPInitialTimeoutSecs + ": " + args[EnvHTTPInitialTimeoutSecs])
 	}
+	retentionDays, err := strconv.Atoi(args[EnvRetentionDays])
+	if err != nil || retentionDays < 0 {
+		panic("invalid value for " + EnvRetentionDays + ": " + args[EnvRetentionDays])
+	}
+	retentionEvents, err := strconv.Atoi(args[EnvRetentionEvents])
+	if err != nil || retentionEvents < 0 {
+		panic("invalid value for " + EnvRetentionEvents + ": " + args[EnvRetentionEvents])
+	}
+	toDeviceTTLDays, err := strconv.Atoi(args[EnvToDeviceTTLDays])
+	if err != nil || toDeviceTTLDays < 0 {
+		panic("invalid value for " + EnvToDeviceTTLDays + ": " + args[EnvToDeviceTTLDays])
+	}
+	toDeviceMaxPerDevice, err := strconv.Atoi(args[EnvToDeviceMaxPerDevice])
+	if err != nil || toDeviceMaxPerDevice < 0 {
+		panic("invalid value for " + EnvToDeviceMaxPerDevice + ": " + args[EnvToDeviceMaxPerDevice])
+	}
+	var rateLimits *handler.RateLimits
+	if args[EnvRateLimits] != "" {
+		limits, err := handler.ParseRateLimits(args[EnvRateLimits])
+		if err != nil {
+			panic("invalid value for " + EnvRateLimits + ": " + err.Error())
+		}
+		rateLimits = &limits
+	}
+	homeservers, err := sync2.ParseMapping(args[EnvHomeservers])
+	if err != nil {
+		panic("invalid value for " + EnvHomeservers + ": " + err.Error())
+	}
+	homeserverHosts, err := sync2.ParseMapping(args[EnvHomeserverHosts])
+	if err != nil {
+		panic("invalid value for " + EnvHomeserverHosts + ": " + err.Error())
+	}
+	if args[EnvWebhookURL] != "" && args[EnvWebhookSecret] == "" {
+		panic(EnvWebhookURL + " requires " + EnvWebhookSecret)
+	}
+	authTokenTTLSecs, err := strconv.Atoi(args[EnvAuthTokenTTLSecs])
+	if err != nil || authTokenTTLSecs < 0 {
+		panic("invalid value for " + EnvAuthTokenTTLSecs + ": " + args[EnvAuthTokenTTLSecs])
+	}
+	authRejectedTTLSecs, err := strconv.Atoi(args[EnvAuthRejectedTTLSecs])
+	if err != nil || authRejectedTTLSecs < 0 {
+		panic("invalid value for " + EnvAuthRejectedTTLSecs + ": " + args[EnvAuthRejectedTTLSecs])
+	}
+	authOpts := handler.AuthOptions{
+		TokenTTL:         time.Duration(authTokenTTLSecs) * time.Second,
+		RejectedTokenTTL: time.Duration(authRejectedTTLSecs) * time.Second,
+	}
+	switch args[EnvAuth] {
+	case "whoami":
+		authOpts.Authenticator = handler.WhoAmIAuthenticator{}
+	case "introspection":
+		if args[EnvAuthIntrospectionURL] == "" {
+			panic(EnvAuth + "=introspection requires " + EnvAuthIntrospectionURL)
+		}
+		authOpts.Authenticator = &handler.IntrospectionAuthenticator{
+			Endpoint:     args[EnvAuthIntrospectionURL],
+			ClientID:     args[EnvAuthClientID],
+			ClientSecret: args[EnvAuthClientSecret],
+			ServerName:   args[EnvAuthServerName],
+		}
+	case "jwt":
+		if args[EnvAuthJWKSFile] == "" {
+			panic(EnvAuth + "=jwt requires " + EnvAuthJWKSFile)
+		}
+		jwtAuth, err := handler.LoadJWTAuthenticator(args[EnvAuthJWKSFile])
+		if err != nil {
+			panic("invalid value for " + EnvAuthJWKSFile + ": " + err.Error())
+		}
+		jwtAuth.Issuer = args[EnvAuthIssuer]
+		jwtAuth.ServerName = args[EnvAuthServerName]
+		authOpts.Authenticator = jwtAuth
+	default:
+		panic("invalid value for " + EnvAuth + ": " + args[EnvAuth])
+	}
+	var recordUsers []string
+	for _, userID := range strings.Split(args[EnvRecordUsers], ",") {
+		if userID = strings.TrimSpace(userID); userID != "" {
+			recordUsers = append(recordUsers, userID)
+		}
+	}
 	h2, h3 := syncv3.Setup(args[EnvServer], args[EnvDB], args[EnvSecret], syncv3.Opts{
 		AddPrometheusMetrics:  args[EnvPrometheus] != "",
 		DBMaxConns:            maxConnsInt,
@@ -238,10 +428,41 @@ func main() {
 		MaxTransactionIDDelay: time.Second,
 		HTTPTimeout:           time.Duration(httpTimeoutSecs) * time.Second,
 		HTTPLongTimeout:       time.Duration(httpLongTimeoutSecs) * time.Second,
+		EnablePresence:        args[EnvPresence] == "1",
+		EnableWebSockets:      args[EnvWebSockets] == "1",
+		AdminBindAddr:         args[EnvAdminBindAddr],
+		AdminSecret:           args[EnvAdminSecret],
+		CheckpointConnections: args[EnvCheckpointConns] == "1",
+		PostgresPubSub:        args[EnvPubSubPostgres] == "1",
+		Role:                  args[EnvRole],
+		RateLimits:            rateLimits,
+		Retention: state.RetentionPolicy{
+			MaxAge:             time.Duration(retentionDays) * 24 * time.Hour,
+			MaxEventsPerRoom:   retentionEvents,
+			PurgeUnjoinedRooms: args[EnvRetentionUnjoined] == "1",
+		},
+		Homeservers:     homeservers,
+		HomeserverHosts: homeserverHosts,
+		RecordDir:       args[EnvRecordDir],
+		RecordUsers:     recordUsers,
+		ToDeviceLimits: state.ToDeviceLimits{
+			TTL:          time.Duration(toDeviceTTLDays) * 24 * time.Hour,
+			MaxPerDevice: toDeviceMaxPerDevice,
+		},
+		WebhookURL:    args[EnvWebhookURL],
+		WebhookSecret: args[EnvWebhookSecret],
+		Auth:          authOpts,
 	})
 
-	go h2.StartV2Pollers()
-	go h2.Store.Cleaner(time.Hour)
+	if h2 != nil {
+		go h2.StartV2Pollers()
+		go h2.Store.Cleaner(time.Hour)
+	}
+	if h3 == nil {
+		// poller instances don't serve clients
+		WaitForShutdown(args[EnvSentryDsn] != "")
+		return
+	}
 	if args[EnvOTLP] != "" {
 		h3 = otelhttp.NewHandler(h3, "Sync")
 	}
@@ -304,10 +525,14 @@ func executeMigrations() {
 
 	command := args[1]
 
-	db, err := goose.OpenDBWithDriver("postgres", envArgs[EnvDB])
+	db, err := sqlutil.Open(envArgs[EnvDB])
 	if err != nil {
 		log.Fatal().Err(err).Msgf("goose: failed to open DB: %v\n", err)
 	}
+	migrationsDir, err := syncv3.Migrations(db)
+	if err != nil {
+		log.Fatal().Err(err).Msgf("goose: failed to set dialect: %v\n", err)
+	}
 
 	defer func() {
 		if err := db.Close(); err != nil {
@@ -320,8 +545,7 @@ func executeMigrations() {
 		arguments = append(arguments, args[2:]...)
 	}
 
-	goose.SetBaseFS(syncv3.EmbedMigrations)
-	if err := goose.Run(command, db, "state/migrations", arguments...); err != nil {
+	if err := goose.Run(command, db.DB, migrationsDir, arguments...); err != nil {
 		log.Fatal().Err(err).Msgf("goose %v: %v", command, err)
 	}
 }
@@ -15,6 +15,8 @@ type HandlerError struct {
 	StatusCode int
 	Err        error
 	ErrCode    string
+	// RetryAfterMS is set on M_LIMIT_EXCEEDED and 503 errors to tell the client when to try again
+	RetryAfterMS int64
 }
 
 func (e *HandlerError) Error() string {
@@ -26,14 +28,16 @@ func (e *HandlerError) Unwrap() error {
 }
 
 type jsonError struct {
-	Err  string `json:"error"`
-	Code string `json:"errcode,omitempty"`
+	Err          string `json:"error"`
+	Code         string `json:"errcode,omitempty"`
+	RetryAfterMS int64  `json:"retry_after_ms,omitempty"`
 }
 
 func (e HandlerError) JSON() []byte {
 	je := jsonError{
-		Err:  e.Error(),
-		Code: e.ErrCode,
+		Err:          e.Error(),
+		Code:         e.ErrCode,
+		RetryAfterMS: e.RetryAfterMS,
 	}
 	b, _ := json.Marshal(je)
 	return b
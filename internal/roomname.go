@@ -34,6 +34,13 @@ type RoomMetadata struct {
 	CanonicalAlias string
 	JoinCount      int
 	InviteCount    int
+	// The contents of the m.room.topic, m.room.join_rules, m.room.history_visibility and
+	// m.room.guest_access state events, for clients which want a summary of the room
+	// without asking for the state events themselves.
+	Topic             string
+	JoinRule          string
+	HistoryVisibility string
+	GuestAccess       string
 	// LastMessageTimestamp is the origin_server_ts of the event most recently seen in
 	// this room. Because events arrive at the upstream homeserver out-of-order (and
 	// because origin_server_ts is an untrusted event field), this timestamp can
@@ -109,6 +116,15 @@ func (m *RoomMetadata) SameRoomName(other *RoomMetadata) bool {
 		sameHeroNames(m.Heroes, other.Heroes))
 }
 
+// SameSummary checks if the topic, join rule, history visibility or guest access have changed
+// between the two metadatas. Returns true if there are no changes.
+func (m *RoomMetadata) SameSummary(other *RoomMetadata) bool {
+	return (m.Topic == other.Topic &&
+		m.JoinRule == other.JoinRule &&
+		m.HistoryVisibility == other.HistoryVisibility &&
+		m.GuestAccess == other.GuestAccess)
+}
+
 func (m *RoomMetadata) SameJoinCount(other *RoomMetadata) bool {
 	return m.JoinCount == other.JoinCount
 }
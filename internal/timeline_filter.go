@@ -0,0 +1,104 @@
+package internal
+
+import (
+	"encoding/json"
+	"strings"
+
+	"github.com/tidwall/gjson"
+)
+
+// TimelineFilter restricts which events are sent in a room's timeline. The fields have the same
+// meaning as the equivalents in a sync v2 RoomEventFilter. A nil *TimelineFilter includes everything.
+type TimelineFilter struct {
+	// Event types to include. A '*' matches any sequence of characters e.g "m.call.*".
+	Types []string `json:"types"`
+	// Event types to exclude. Takes precedence over Types.
+	NotTypes []string `json:"not_types,omitempty"`
+	// Senders to include.
+	Senders []string `json:"senders"`
+	// Senders to exclude. Takes precedence over Senders.
+	NotSenders []string `json:"not_senders,omitempty"`
+	// If true, only include events with a content.url. If false, only include events without one.
+	ContainsURL *bool `json:"contains_url,omitempty"`
+}
+
+// Filters returns true if this filter may exclude events.
+func (f *TimelineFilter) Filters() bool {
+	if f == nil {
+		return false
+	}
+	return f.Types != nil || len(f.NotTypes) > 0 || f.Senders != nil || len(f.NotSenders) > 0 || f.ContainsURL != nil
+}
+
+// Same returns true if both filters include exactly the same events.
+func (f *TimelineFilter) Same(other *TimelineFilter) bool {
+	if !f.Filters() || !other.Filters() {
+		return f.Filters() == other.Filters()
+	}
+	a, err := json.Marshal(f)
+	if err != nil {
+		return false
+	}
+	b, err := json.Marshal(other)
+	if err != nil {
+		return false
+	}
+	return string(a) == string(b)
+}
+
+// Include returns true if the event passes this filter.
+func (f *TimelineFilter) Include(ev json.RawMessage) bool {
+	if !f.Filters() {
+		return true
+	}
+	parsed := gjson.ParseBytes(ev)
+	return f.include(parsed.Get("type").Str, parsed.Get("sender").Str, parsed.Get("content.url").Type == gjson.String)
+}
+
+func (f *TimelineFilter) include(evType, sender string, hasURL bool) bool {
+	if !includeType(f.Types, f.NotTypes, evType) {
+		return false
+	}
+	for _, s := range f.NotSenders {
+		if s == sender {
+			return false
+		}
+	}
+	if f.Senders != nil {
+		found := false
+		for _, s := range f.Senders {
+			if s == sender {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	if f.ContainsURL != nil && *f.ContainsURL != hasURL {
+		return false
+	}
+	return true
+}
+
+// matchesWildcard returns true if the pattern matches the whole of s, where '*' in the pattern
+// matches any sequence of characters.
+func matchesWildcard(pattern, s string) bool {
+	parts := strings.Split(pattern, "*")
+	if len(parts) == 1 {
+		return pattern == s
+	}
+	if !strings.HasPrefix(s, parts[0]) {
+		return false
+	}
+	s = s[len(parts[0]):]
+	for _, part := range parts[1 : len(parts)-1] {
+		i := strings.Index(s, part)
+		if i < 0 {
+			return false
+		}
+		s = s[i+len(part):]
+	}
+	return strings.HasSuffix(s, parts[len(parts)-1])
+}
@@ -0,0 +1,52 @@
+package internal
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestTimelineFilterInclude(t *testing.T) {
+	boolTrue := true
+	boolFalse := false
+	message := json.RawMessage(`{"type":"m.room.message","sender":"@alice:localhost","content":{"body":"hi"}}`)
+	image := json.RawMessage(`{"type":"m.room.message","sender":"@bob:localhost","content":{"url":"mxc://localhost/abc"}}`)
+	invite := json.RawMessage(`{"type":"m.call.invite","sender":"@bob:localhost","content":{}}`)
+	testCases := []struct {
+		name   string
+		filter *TimelineFilter
+		want   []bool // message, image, invite
+	}{
+		{name: "nil filter", filter: nil, want: []bool{true, true, true}},
+		{name: "empty filter", filter: &TimelineFilter{}, want: []bool{true, true, true}},
+		{name: "types", filter: &TimelineFilter{Types: []string{"m.room.message"}}, want: []bool{true, true, false}},
+		{name: "wildcard types", filter: &TimelineFilter{Types: []string{"m.call.*"}}, want: []bool{false, false, true}},
+		{name: "empty types", filter: &TimelineFilter{Types: []string{}}, want: []bool{false, false, false}},
+		{name: "not_types wins", filter: &TimelineFilter{Types: []string{"*"}, NotTypes: []string{"m.room.*"}}, want: []bool{false, false, true}},
+		{name: "senders", filter: &TimelineFilter{Senders: []string{"@bob:localhost"}}, want: []bool{false, true, true}},
+		{name: "not_senders", filter: &TimelineFilter{NotSenders: []string{"@bob:localhost"}}, want: []bool{true, false, false}},
+		{name: "contains_url", filter: &TimelineFilter{ContainsURL: &boolTrue}, want: []bool{false, true, false}},
+		{name: "not contains_url", filter: &TimelineFilter{ContainsURL: &boolFalse}, want: []bool{true, false, true}},
+	}
+	for _, tc := range testCases {
+		for i, ev := range []json.RawMessage{message, image, invite} {
+			if got := tc.filter.Include(ev); got != tc.want[i] {
+				t.Errorf("%s: Include(%s) got %v want %v", tc.name, string(ev), got, tc.want[i])
+			}
+		}
+	}
+}
+
+func TestTimelineFilterSame(t *testing.T) {
+	a := &TimelineFilter{Types: []string{"m.room.message"}}
+	b := &TimelineFilter{Types: []string{"m.room.message"}}
+	c := &TimelineFilter{Types: []string{}}
+	if !a.Same(b) {
+		t.Errorf("identical filters were not the same")
+	}
+	if a.Same(c) || c.Same(nil) {
+		t.Errorf("different filters were the same")
+	}
+	if !(*TimelineFilter)(nil).Same(&TimelineFilter{}) {
+		t.Errorf("nil filter was not the same as an empty filter")
+	}
+}
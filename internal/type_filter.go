@@ -0,0 +1,86 @@
+package internal
+
+import (
+	"strconv"
+	"strings"
+)
+
+// TypeFilter restricts events by their type. A '*' matches any sequence of characters e.g
+// "m.secret_storage.*". A nil *TypeFilter includes everything.
+type TypeFilter struct {
+	// Event types to include. nil includes all types, whereas an empty list includes none.
+	Types []string `json:"types"`
+	// Event types to exclude. Takes precedence over Types.
+	NotTypes []string `json:"not_types,omitempty"`
+}
+
+// Filters returns true if this filter may exclude events.
+func (f *TypeFilter) Filters() bool {
+	return f != nil && (f.Types != nil || len(f.NotTypes) > 0)
+}
+
+// Include returns true if events of this type pass the filter.
+func (f *TypeFilter) Include(evType string) bool {
+	if !f.Filters() {
+		return true
+	}
+	return includeType(f.Types, f.NotTypes, evType)
+}
+
+// SQL returns a condition on this column which only matches the types which pass the filter,
+// along with its arguments. Parameters are numbered from $firstParam. Returns "TRUE" if the
+// filter does not filter.
+func (f *TypeFilter) SQL(column string, firstParam int) (cond string, args []interface{}) {
+	if !f.Filters() {
+		return "TRUE", nil
+	}
+	matchAny := func(patterns []string) string {
+		conds := make([]string, len(patterns))
+		for i, pattern := range patterns {
+			param := "$" + strconv.Itoa(firstParam+len(args))
+			if strings.Contains(pattern, "*") {
+				conds[i] = column + " LIKE " + param + ` ESCAPE '\'`
+				args = append(args, likePattern(pattern))
+			} else {
+				// an equality check can use an index
+				conds[i] = column + " = " + param
+				args = append(args, pattern)
+			}
+		}
+		return "(" + strings.Join(conds, " OR ") + ")"
+	}
+	var conds []string
+	if f.Types != nil {
+		if len(f.Types) == 0 {
+			return "FALSE", nil
+		}
+		conds = append(conds, matchAny(f.Types))
+	}
+	if len(f.NotTypes) > 0 {
+		conds = append(conds, "NOT "+matchAny(f.NotTypes))
+	}
+	return strings.Join(conds, " AND "), args
+}
+
+func includeType(types, notTypes []string, evType string) bool {
+	for _, t := range notTypes {
+		if matchesWildcard(t, evType) {
+			return false
+		}
+	}
+	if types == nil {
+		return true
+	}
+	for _, t := range types {
+		if matchesWildcard(t, evType) {
+			return true
+		}
+	}
+	return false
+}
+
+// likePattern converts a '*' wildcard pattern into a LIKE pattern escaped with '\'.
+func likePattern(pattern string) string {
+	escaped := strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(pattern)
+	return strings.ReplaceAll(escaped, "*", "%")
+}
@@ -0,0 +1,56 @@
+package internal
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestTypeFilterInclude(t *testing.T) {
+	evTypes := []string{"m.direct", "m.secret_storage.key.abc", "im.vector.setting.breadcrumbs"}
+	testCases := []struct {
+		name   string
+		filter *TypeFilter
+		want   []bool
+	}{
+		{name: "nil filter", filter: nil, want: []bool{true, true, true}},
+		{name: "empty filter", filter: &TypeFilter{}, want: []bool{true, true, true}},
+		{name: "types", filter: &TypeFilter{Types: []string{"m.direct"}}, want: []bool{true, false, false}},
+		{name: "empty types", filter: &TypeFilter{Types: []string{}}, want: []bool{false, false, false}},
+		{name: "wildcard not_types", filter: &TypeFilter{NotTypes: []string{"m.secret_storage.*", "im.vector.*"}}, want: []bool{true, false, false}},
+		{name: "not_types wins", filter: &TypeFilter{Types: []string{"m.*"}, NotTypes: []string{"m.secret_storage.*"}}, want: []bool{true, false, false}},
+	}
+	for _, tc := range testCases {
+		for i, evType := range evTypes {
+			if got := tc.filter.Include(evType); got != tc.want[i] {
+				t.Errorf("%s: Include(%s) got %v want %v", tc.name, evType, got, tc.want[i])
+			}
+		}
+	}
+}
+
+func TestTypeFilterSQL(t *testing.T) {
+	testCases := []struct {
+		filter   *TypeFilter
+		wantCond string
+		wantArgs []interface{}
+	}{
+		{filter: nil, wantCond: "TRUE"},
+		{filter: &TypeFilter{Types: []string{}}, wantCond: "FALSE"},
+		{
+			filter:   &TypeFilter{Types: []string{"m.direct", "m.push_rules"}},
+			wantCond: "(type = $3 OR type = $4)",
+			wantArgs: []interface{}{"m.direct", "m.push_rules"},
+		},
+		{
+			filter:   &TypeFilter{Types: []string{"m.*"}, NotTypes: []string{"m.secret_storage.*"}},
+			wantCond: `(type LIKE $3 ESCAPE '\') AND NOT (type LIKE $4 ESCAPE '\')`,
+			wantArgs: []interface{}{"m.%", `m.secret\_storage.%`},
+		},
+	}
+	for _, tc := range testCases {
+		cond, args := tc.filter.SQL("type", 3)
+		if cond != tc.wantCond || !reflect.DeepEqual(args, tc.wantArgs) {
+			t.Errorf("SQL(%+v): got %q %v want %q %v", tc.filter, cond, args, tc.wantCond, tc.wantArgs)
+		}
+	}
+}
@@ -8,3 +8,34 @@ type Receipt struct {
 	ThreadID  string `db:"thread_id"`
 	IsPrivate bool
 }
+
+type Presence struct {
+	UserID          string `db:"user_id"`
+	Presence        string `db:"presence"`
+	StatusMsg       string `db:"status_msg"`
+	CurrentlyActive bool   `db:"currently_active"`
+	// LastActiveTS is the unix millisecond timestamp the user was last active at. The
+	// v2 API sends a relative last_active_ago, which we convert on the way in and out.
+	LastActiveTS int64 `db:"last_active_ts"`
+}
+
+// UnreadCounts are the unread counts for a single thread in a room.
+type UnreadCounts struct {
+	HighlightCount    int `json:"highlight_count" db:"highlight_count"`
+	NotificationCount int `json:"notification_count" db:"notification_count"`
+}
+
+// SameThreadUnreadCounts returns true if both maps of thread root -> counts are equal. A nil map
+// is the same as an empty map.
+func SameThreadUnreadCounts(a, b map[string]UnreadCounts) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for threadID, counts := range a {
+		other, ok := b[threadID]
+		if !ok || other != counts {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,175 @@
+// Package notifier tells an HTTP webhook when users get new notifications, so other services can
+// alert them without running a sync loop of their own.
+package notifier
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// SignatureHeader is the request header carrying the HMAC-SHA256 of the request body, keyed with
+// the webhook secret, as "sha256=<hex>". Receivers should compute the same and compare them in
+// constant time.
+const SignatureHeader = "X-Sliding-Sync-Signature"
+
+// Notification is the JSON body sent to the webhook when a user's highlight or notification count
+// in a room goes up.
+type Notification struct {
+	UserID            string `json:"user_id"`
+	RoomID            string `json:"room_id"`
+	RoomName          string `json:"room_name"`
+	HighlightCount    int    `json:"highlight_count"`
+	NotificationCount int    `json:"notification_count"`
+	// The latest timeline event in the room when the count went up, if known.
+	Event *Event `json:"event,omitempty"`
+	// When the proxy saw the count go up, in milliseconds since the epoch. Receivers can use this
+	// to reject old notifications which are replayed to them.
+	TS int64 `json:"ts"`
+}
+
+// Event identifies the event which is likely to have caused a notification.
+type Event struct {
+	EventID string `json:"event_id"`
+	Type    string `json:"type"`
+	Sender  string `json:"sender"`
+}
+
+// Webhook POSTs notifications to a URL. Deliveries which fail because of the network, a 5xx or a
+// 429 are retried with exponential backoff, other failures are dropped. Notifications are queued
+// and sent in the background, so Notify never blocks the caller.
+type Webhook struct {
+	// How many times to try to deliver each notification.
+	MaxAttempts int
+	// How long to wait before the first retry. This doubles for every retry after that.
+	RetryInterval time.Duration
+
+	url    string
+	secret []byte
+	client *http.Client
+	queue  chan Notification
+	stop   chan struct{}
+	wg     sync.WaitGroup
+}
+
+// NewWebhook makes a Webhook which sends notifications to this URL, signed with this secret.
+// Call Start to begin sending them.
+func NewWebhook(url, secret string) *Webhook {
+	return &Webhook{
+		MaxAttempts:   5,
+		RetryInterval: time.Second,
+		url:           url,
+		secret:        []byte(secret),
+		client:        &http.Client{Timeout: 10 * time.Second},
+		queue:         make(chan Notification, 1000),
+		stop:          make(chan struct{}),
+	}
+}
+
+// Start sends queued notifications using this many concurrent workers.
+func (w *Webhook) Start(workers int) {
+	for i := 0; i < workers; i++ {
+		w.wg.Add(1)
+		go w.worker()
+	}
+}
+
+// Notify queues a notification to be sent. If the queue is full, the notification is dropped.
+func (w *Webhook) Notify(n Notification) {
+	select {
+	case w.queue <- n:
+	default:
+		log.Warn().Str("user", n.UserID).Str("room", n.RoomID).Msg("Webhook: queue is full, dropping notification")
+	}
+}
+
+// Close stops sending notifications. Notifications which haven't been sent yet are dropped.
+func (w *Webhook) Close() {
+	close(w.stop)
+	w.wg.Wait()
+}
+
+func (w *Webhook) worker() {
+	defer w.wg.Done()
+	for {
+		select {
+		case n := <-w.queue:
+			w.deliver(n)
+		case <-w.stop:
+			return
+		}
+	}
+}
+
+// deliver sends the notification, retrying until it succeeds, MaxAttempts is reached or Close is called.
+func (w *Webhook) deliver(n Notification) {
+	body, err := json.Marshal(n)
+	if err != nil {
+		log.Err(err).Str("user", n.UserID).Str("room", n.RoomID).Msg("Webhook: failed to marshal notification")
+		return
+	}
+	backoff := w.RetryInterval
+	for attempt := 1; ; attempt++ {
+		retry, err := w.send(body)
+		if err == nil {
+			return
+		}
+		if !retry || attempt >= w.MaxAttempts {
+			log.Warn().Err(err).Str("user", n.UserID).Str("room", n.RoomID).Int("attempts", attempt).Msg("Webhook: failed to send notification")
+			return
+		}
+		select {
+		case <-time.After(backoff):
+		case <-w.stop:
+			return
+		}
+		backoff *= 2
+	}
+}
+
+// send makes a single request to the webhook. Returns whether a failed request is worth retrying.
+func (w *Webhook) send(body []byte) (retry bool, err error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		// don't hold up Close for a slow webhook
+		select {
+		case <-w.stop:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	req, err := http.NewRequestWithContext(ctx, "POST", w.url, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(SignatureHeader, Sign(w.secret, body))
+	res, err := w.client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	defer res.Body.Close()
+	_, _ = io.Copy(io.Discard, res.Body)
+	if res.StatusCode/100 == 2 {
+		return false, nil
+	}
+	return res.StatusCode == 429 || res.StatusCode >= 500, fmt.Errorf("webhook responded with HTTP %d", res.StatusCode)
+}
+
+// Sign returns the value of the SignatureHeader for this request body.
+func Sign(secret, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
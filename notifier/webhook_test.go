@@ -0,0 +1,103 @@
+package notifier
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestWebhook(t *testing.T) {
+	secret := "s3cr3t"
+	var mu sync.Mutex
+	var got []Notification
+	attempts := 0
+	received := make(chan struct{}, 10)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body, _ := io.ReadAll(req.Body)
+		if sig := req.Header.Get(SignatureHeader); sig != Sign([]byte(secret), body) {
+			t.Errorf("bad signature %q", sig)
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		attempts++
+		// fail the first attempt, so it has to be retried
+		if attempts == 1 {
+			w.WriteHeader(503)
+			return
+		}
+		var n Notification
+		if err := json.Unmarshal(body, &n); err != nil {
+			t.Errorf("body is not a notification: %s", err)
+		}
+		got = append(got, n)
+		received <- struct{}{}
+	}))
+	defer srv.Close()
+
+	hook := NewWebhook(srv.URL, secret)
+	hook.RetryInterval = time.Millisecond
+	hook.Start(1)
+	defer hook.Close()
+	want := Notification{
+		UserID:            "@alice:localhost",
+		RoomID:            "!a:localhost",
+		RoomName:          "Room A",
+		HighlightCount:    1,
+		NotificationCount: 2,
+		Event:             &Event{EventID: "$a", Type: "m.room.message", Sender: "@bob:localhost"},
+		TS:                1700000000000,
+	}
+	hook.Notify(want)
+	select {
+	case <-received:
+	case <-time.After(time.Second):
+		t.Fatalf("timed out waiting for the webhook to be called")
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if attempts != 2 {
+		t.Errorf("got %d attempts want 2", attempts)
+	}
+	if len(got) != 1 || !reflect.DeepEqual(got[0], want) {
+		t.Errorf("got notifications %+v want %+v", got, want)
+	}
+}
+
+func TestWebhookGivesUp(t *testing.T) {
+	testCases := []struct {
+		name         string
+		statusCode   int
+		wantAttempts int
+	}{
+		{name: "client errors are not retried", statusCode: 400, wantAttempts: 1},
+		{name: "server errors are retried up to MaxAttempts", statusCode: 500, wantAttempts: 3},
+		{name: "rate limiting is retried up to MaxAttempts", statusCode: 429, wantAttempts: 3},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			var mu sync.Mutex
+			attempts := 0
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				mu.Lock()
+				attempts++
+				mu.Unlock()
+				w.WriteHeader(tc.statusCode)
+			}))
+			defer srv.Close()
+			hook := NewWebhook(srv.URL, "secret")
+			hook.MaxAttempts = 3
+			hook.RetryInterval = time.Millisecond
+			hook.deliver(Notification{UserID: "@alice:localhost", RoomID: "!a:localhost"})
+			mu.Lock()
+			defer mu.Unlock()
+			if attempts != tc.wantAttempts {
+				t.Errorf("got %d attempts want %d", attempts, tc.wantAttempts)
+			}
+		})
+	}
+}
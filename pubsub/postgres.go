@@ -0,0 +1,239 @@
+package pubsub
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/getsentry/sentry-go"
+	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
+	"github.com/rs/zerolog/log"
+)
+
+// Postgres rejects NOTIFY payloads of 8000 bytes or more. Larger payloads are written to a table
+// and the notification refers to the row instead.
+const maxNotifyBytes = 7900
+
+// How long spilled payloads are kept for. Listeners which take longer than this to read a
+// notification will miss the payload.
+const spilledPayloadTTL = 10 * time.Minute
+
+// postgresEnvelope is the body of a NOTIFY. Exactly one of Data or Ref is set.
+type postgresEnvelope struct {
+	Type string          `json:"t"`
+	Data json.RawMessage `json:"d,omitempty"`
+	Ref  int64           `json:"r,omitempty"`
+}
+
+// PostgresPubSub is a Notifier and Listener which sends payloads over Postgres LISTEN/NOTIFY,
+// so several proxy instances sharing one database can see each other's payloads. Every listener
+// on a channel sees every payload, including payloads it notified itself. Payloads are delivered
+// in the order they were notified by a single goroutine, but there are no ordering guarantees
+// between goroutines or instances.
+type PostgresPubSub struct {
+	db      *sqlx.DB
+	connStr string
+
+	mu        *sync.Mutex
+	listeners []*pq.Listener
+	closed    bool
+	lastClean time.Time
+}
+
+func NewPostgresPubSub(db *sqlx.DB, connStr string) *PostgresPubSub {
+	// make sure tables are made
+	db.MustExec(`
+	CREATE TABLE IF NOT EXISTS syncv3_pubsub_payloads (
+		id BIGSERIAL PRIMARY KEY,
+		data BYTEA NOT NULL,
+		created_ts BIGINT NOT NULL
+	);
+	`)
+	return &PostgresPubSub{
+		db:      db,
+		connStr: connStr,
+		mu:      &sync.Mutex{},
+	}
+}
+
+// channel names are namespaced so they can't collide with anything else using this database
+func postgresChannel(chanName string) string {
+	return "syncv3_" + chanName
+}
+
+func (ps *PostgresPubSub) Notify(chanName string, p Payload) error {
+	data, err := json.Marshal(p)
+	if err != nil {
+		return fmt.Errorf("failed to marshal payload %v: %w", p.Type(), err)
+	}
+	env := postgresEnvelope{
+		Type: p.Type(),
+		Data: data,
+	}
+	body, err := json.Marshal(env)
+	if err != nil {
+		return fmt.Errorf("failed to marshal envelope %v: %w", p.Type(), err)
+	}
+	if len(body) > maxNotifyBytes {
+		env.Data = nil
+		if env.Ref, err = ps.spill(data); err != nil {
+			return fmt.Errorf("failed to store payload %v: %w", p.Type(), err)
+		}
+		if body, err = json.Marshal(env); err != nil {
+			return fmt.Errorf("failed to marshal envelope %v: %w", p.Type(), err)
+		}
+	}
+	_, err = ps.db.Exec(`SELECT pg_notify($1, $2)`, postgresChannel(chanName), string(body))
+	if err != nil {
+		return fmt.Errorf("failed to notify payload %v: %w", p.Type(), err)
+	}
+	return nil
+}
+
+// spill stores a payload which is too large to NOTIFY, returning its ID. Old payloads are
+// cleaned up at most once a minute.
+func (ps *PostgresPubSub) spill(data []byte) (id int64, err error) {
+	now := time.Now()
+	err = ps.db.QueryRow(`INSERT INTO syncv3_pubsub_payloads(data, created_ts) VALUES($1, $2) RETURNING id`,
+		data, now.UnixMilli()).Scan(&id)
+	if err != nil {
+		return 0, err
+	}
+	ps.mu.Lock()
+	shouldClean := now.Sub(ps.lastClean) > time.Minute
+	if shouldClean {
+		ps.lastClean = now
+	}
+	ps.mu.Unlock()
+	if shouldClean {
+		_, err = ps.db.Exec(`DELETE FROM syncv3_pubsub_payloads WHERE created_ts < $1`, now.Add(-spilledPayloadTTL).UnixMilli())
+		if err != nil {
+			log.Warn().Err(err).Msg("PostgresPubSub: failed to clean spilled payloads")
+		}
+	}
+	return id, nil
+}
+
+// Listen blocks until Close is called, calling fn for each payload on this channel. Payloads
+// notified whilst the connection to the database is down are lost.
+func (ps *PostgresPubSub) Listen(chanName string, fn func(p Payload)) error {
+	channel := postgresChannel(chanName)
+	l := pq.NewListener(ps.connStr, time.Second, time.Minute, func(ev pq.ListenerEventType, err error) {
+		switch ev {
+		case pq.ListenerEventConnectionAttemptFailed, pq.ListenerEventDisconnected:
+			log.Warn().Err(err).Str("chan", channel).Msg("PostgresPubSub: lost connection to database")
+		case pq.ListenerEventReconnected:
+			log.Warn().Str("chan", channel).Msg("PostgresPubSub: reconnected to database, payloads may have been missed")
+		}
+	})
+	ps.mu.Lock()
+	if ps.closed {
+		ps.mu.Unlock()
+		l.Close()
+		return nil
+	}
+	ps.listeners = append(ps.listeners, l)
+	ps.mu.Unlock()
+	if err := l.Listen(channel); err != nil {
+		return fmt.Errorf("failed to LISTEN on %s: %w", channel, err)
+	}
+	for n := range l.Notify {
+		if n == nil {
+			continue // sent after a reconnection
+		}
+		p, err := ps.decode(n.Extra)
+		if err != nil {
+			log.Err(err).Str("chan", channel).Msg("PostgresPubSub: failed to decode payload")
+			sentry.CaptureException(err)
+			continue
+		}
+		fn(p)
+	}
+	return nil
+}
+
+func (ps *PostgresPubSub) decode(body string) (Payload, error) {
+	var env postgresEnvelope
+	if err := json.Unmarshal([]byte(body), &env); err != nil {
+		return nil, err
+	}
+	p := newPayload(env.Type)
+	if p == nil {
+		return nil, fmt.Errorf("unknown payload type %q", env.Type)
+	}
+	data := []byte(env.Data)
+	if env.Ref != 0 {
+		if err := ps.db.QueryRow(`SELECT data FROM syncv3_pubsub_payloads WHERE id=$1`, env.Ref).Scan(&data); err != nil {
+			return nil, fmt.Errorf("failed to load payload %v ref %d: %w", env.Type, env.Ref, err)
+		}
+	}
+	if err := json.Unmarshal(data, p); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal payload %v: %w", env.Type, err)
+	}
+	return p, nil
+}
+
+// Close stops all listeners. It is safe to call more than once, which happens when the same
+// PostgresPubSub is used as both a Notifier and a Listener.
+func (ps *PostgresPubSub) Close() error {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	if ps.closed {
+		return nil
+	}
+	ps.closed = true
+	for _, l := range ps.listeners {
+		l.Close()
+	}
+	return nil
+}
+
+// newPayload returns an empty payload of this type, or nil if the type is unknown. Every payload
+// sent over a PostgresPubSub must be listed here.
+func newPayload(payloadType string) Payload {
+	switch payloadType {
+	case "V2Initialise":
+		return &V2Initialise{}
+	case "V2Accumulate":
+		return &V2Accumulate{}
+	case "V2TransactionID":
+		return &V2TransactionID{}
+	case "V2UnreadCounts":
+		return &V2UnreadCounts{}
+	case "V2AccountData":
+		return &V2AccountData{}
+	case "V2LeaveRoom":
+		return &V2LeaveRoom{}
+	case "V2InviteRoom":
+		return &V2InviteRoom{}
+	case "V2KnockRoom":
+		return &V2KnockRoom{}
+	case "V2InitialSyncComplete":
+		return &V2InitialSyncComplete{}
+	case "V2DeviceData":
+		return &V2DeviceData{}
+	case "V2Typing":
+		return &V2Typing{}
+	case "V2Receipt":
+		return &V2Receipt{}
+	case "V2Presence":
+		return &V2Presence{}
+	case "V2DeviceMessages":
+		return &V2DeviceMessages{}
+	case "V2ExpiredToken":
+		return &V2ExpiredToken{}
+	case "V2StateRedaction":
+		return &V2StateRedaction{}
+	case "V2InvalidateRoom":
+		return &V2InvalidateRoom{}
+	case "V2UpstreamHealth":
+		return &V2UpstreamHealth{}
+	case "V3EnsurePolling":
+		return &V3EnsurePolling{}
+	case "V3ExpiredToken":
+		return &V3ExpiredToken{}
+	}
+	return nil
+}
@@ -0,0 +1,58 @@
+package pubsub
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	"github.com/matrix-org/sliding-sync/internal"
+)
+
+// Test that every payload survives the trip through a Postgres notification.
+func TestPostgresPayloadRoundTrip(t *testing.T) {
+	highlight := 2
+	payloads := []Payload{
+		&V2Initialise{RoomID: "!a", SnapshotNID: 5},
+		&V2Accumulate{RoomID: "!a", PrevBatch: "p", EventNIDs: []int64{1, 2, 3}},
+		&V2TransactionID{EventID: "$e", RoomID: "!a", UserID: "@a", DeviceID: "D", TransactionID: "t", NID: 4},
+		&V2UnreadCounts{UserID: "@a", RoomID: "!a", HighlightCount: &highlight, ThreadUnreadCounts: map[string]internal.UnreadCounts{
+			"$root": {HighlightCount: 1, NotificationCount: 3},
+		}},
+		&V2AccountData{UserID: "@a", RoomID: "!a", Types: []string{"m.tag"}},
+		&V2LeaveRoom{UserID: "@a", RoomID: "!a", LeaveEvent: json.RawMessage(`{"type":"m.room.member"}`)},
+		&V2InviteRoom{UserID: "@a", RoomID: "!a"},
+		&V2KnockRoom{UserID: "@a", RoomID: "!a"},
+		&V2InitialSyncComplete{UserID: "@a", DeviceID: "D", Success: true},
+		&V2DeviceData{UserIDToDeviceIDs: map[string][]string{"@a": {"D"}}},
+		&V2Typing{RoomID: "!a", EphemeralEvent: json.RawMessage(`{"type":"m.typing"}`)},
+		&V2Receipt{RoomID: "!a", Receipts: []internal.Receipt{{RoomID: "!a", EventID: "$e", UserID: "@a", TS: 1, IsPrivate: true}}},
+		&V2Presence{Presence: internal.Presence{UserID: "@a", Presence: "online"}},
+		&V2DeviceMessages{UserID: "@a", DeviceID: "D"},
+		&V2ExpiredToken{UserID: "@a", DeviceID: "D"},
+		&V2StateRedaction{RoomID: "!a"},
+		&V2InvalidateRoom{RoomID: "!a"},
+		&V2UpstreamHealth{Degraded: true, RetryAfterMS: 10000},
+		&V3EnsurePolling{UserID: "@a", DeviceID: "D", AccessTokenHash: "h"},
+	}
+	ps := &PostgresPubSub{}
+	for _, p := range payloads {
+		data, err := json.Marshal(p)
+		if err != nil {
+			t.Fatalf("%s: failed to marshal: %s", p.Type(), err)
+		}
+		body, err := json.Marshal(postgresEnvelope{Type: p.Type(), Data: data})
+		if err != nil {
+			t.Fatalf("%s: failed to marshal envelope: %s", p.Type(), err)
+		}
+		got, err := ps.decode(string(body))
+		if err != nil {
+			t.Fatalf("%s: failed to decode: %s", p.Type(), err)
+		}
+		if !reflect.DeepEqual(got, p) {
+			t.Errorf("%s: got %+v want %+v", p.Type(), got, p)
+		}
+	}
+	if _, err := ps.decode(`{"t":"V2Unknown","d":{}}`); err == nil {
+		t.Errorf("decoding an unknown payload type did not fail")
+	}
+}
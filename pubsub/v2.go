@@ -17,16 +17,19 @@ type V2Listener interface {
 	OnTransactionID(p *V2TransactionID)
 	OnAccountData(p *V2AccountData)
 	OnInvite(p *V2InviteRoom)
+	OnKnock(p *V2KnockRoom)
 	OnLeftRoom(p *V2LeaveRoom)
 	OnUnreadCounts(p *V2UnreadCounts)
 	OnInitialSyncComplete(p *V2InitialSyncComplete)
 	OnDeviceData(p *V2DeviceData)
 	OnTyping(p *V2Typing)
 	OnReceipt(p *V2Receipt)
+	OnPresence(p *V2Presence)
 	OnDeviceMessages(p *V2DeviceMessages)
 	OnExpiredToken(p *V2ExpiredToken)
 	OnInvalidateRoom(p *V2InvalidateRoom)
 	OnStateRedaction(p *V2StateRedaction)
+	OnUpstreamHealth(p *V2UpstreamHealth)
 }
 
 type V2Initialise struct {
@@ -63,6 +66,8 @@ type V2UnreadCounts struct {
 	RoomID            string
 	HighlightCount    *int
 	NotificationCount *int
+	// thread root -> counts. Replaces all existing thread counts for this room.
+	ThreadUnreadCounts map[string]internal.UnreadCounts
 }
 
 func (*V2UnreadCounts) Type() string { return "V2UnreadCounts" }
@@ -90,6 +95,13 @@ type V2InviteRoom struct {
 
 func (*V2InviteRoom) Type() string { return "V2InviteRoom" }
 
+type V2KnockRoom struct {
+	UserID string
+	RoomID string
+}
+
+func (*V2KnockRoom) Type() string { return "V2KnockRoom" }
+
 type V2InitialSyncComplete struct {
 	UserID   string
 	DeviceID string
@@ -118,6 +130,12 @@ type V2Receipt struct {
 
 func (*V2Receipt) Type() string { return "V2Receipt" }
 
+type V2Presence struct {
+	Presence internal.Presence
+}
+
+func (*V2Presence) Type() string { return "V2Presence" }
+
 type V2DeviceMessages struct {
 	UserID   string
 	DeviceID string
@@ -149,6 +167,18 @@ type V2InvalidateRoom struct {
 
 func (*V2InvalidateRoom) Type() string { return "V2InvalidateRoom" }
 
+// V2UpstreamHealth is emitted when the pollers' circuit breaker for an upstream homeserver
+// opens or closes.
+type V2UpstreamHealth struct {
+	// the server name of the homeserver, or "" for the default homeserver
+	ServerName string
+	Degraded   bool
+	// how long until the pollers try the homeserver again
+	RetryAfterMS int64
+}
+
+func (*V2UpstreamHealth) Type() string { return "V2UpstreamHealth" }
+
 type V2Sub struct {
 	listener Listener
 	receiver V2Listener
@@ -179,6 +209,8 @@ func (v *V2Sub) onMessage(p Payload) {
 		v.receiver.OnAccountData(pl)
 	case *V2InviteRoom:
 		v.receiver.OnInvite(pl)
+	case *V2KnockRoom:
+		v.receiver.OnKnock(pl)
 	case *V2LeaveRoom:
 		v.receiver.OnLeftRoom(pl)
 	case *V2UnreadCounts:
@@ -189,6 +221,8 @@ func (v *V2Sub) onMessage(p Payload) {
 		v.receiver.OnDeviceData(pl)
 	case *V2Typing:
 		v.receiver.OnTyping(pl)
+	case *V2Presence:
+		v.receiver.OnPresence(pl)
 	case *V2DeviceMessages:
 		v.receiver.OnDeviceMessages(pl)
 	case *V2ExpiredToken:
@@ -197,6 +231,8 @@ func (v *V2Sub) onMessage(p Payload) {
 		v.receiver.OnInvalidateRoom(pl)
 	case *V2StateRedaction:
 		v.receiver.OnStateRedaction(pl)
+	case *V2UpstreamHealth:
+		v.receiver.OnUpstreamHealth(pl)
 	default:
 		log.Warn().Str("type", p.Type()).Msg("V2Sub: unhandled payload type")
 	}
@@ -10,6 +10,7 @@ const ChanV3 = "v3ch"
 // V3Listener describes the messages that incoming sliding sync requests will publish.
 type V3Listener interface {
 	EnsurePolling(p *V3EnsurePolling)
+	ExpireToken(p *V3ExpiredToken)
 }
 
 type V3EnsurePolling struct {
@@ -22,6 +23,16 @@ type V3EnsurePolling struct {
 
 func (*V3EnsurePolling) Type() string { return "V3EnsurePolling" }
 
+// V3ExpiredToken is sent when the authenticator rejects an access token which we had stored, so
+// that it is cleaned up in the same way as a token which the homeserver rejected whilst polling.
+type V3ExpiredToken struct {
+	UserID          string
+	DeviceID        string
+	AccessTokenHash string
+}
+
+func (*V3ExpiredToken) Type() string { return "V3ExpiredToken" }
+
 type V3Sub struct {
 	listener Listener
 	receiver V3Listener
@@ -42,6 +53,8 @@ func (v *V3Sub) onMessage(p Payload) {
 	switch pl := p.(type) {
 	case *V3EnsurePolling:
 		v.receiver.EnsurePolling(pl)
+	case *V3ExpiredToken:
+		v.receiver.ExpireToken(pl)
 	default:
 		log.Warn().Str("type", p.Type()).Msg("V3Sub: unhandled payload type")
 	}
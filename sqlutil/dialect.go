@@ -0,0 +1,68 @@
+package sqlutil
+
+// Dialect writes the parts of queries which differ between Postgres and SQLite. Tables write
+// everything else in the SQL both databases understand.
+type Dialect struct {
+	sqlite bool
+}
+
+// DialectOf returns the dialect spoken by this database or transaction.
+func DialectOf(db interface{ DriverName() string }) Dialect {
+	return Dialect{sqlite: IsSQLite(db)}
+}
+
+// Any returns a condition which is true if expr is an element of array, which is either an array
+// column or a parameter written by pq.Array.
+func (d Dialect) Any(expr, array string) string {
+	if d.sqlite {
+		return expr + " IN (SELECT value FROM json_each(pg_array_json(" + array + ")))"
+	}
+	return expr + " = ANY(" + array + ")"
+}
+
+// ForUpdate returns the clause which locks the rows returned by a SELECT until the transaction ends.
+// SQLite has no row locks. Writes lock the whole database, and a transaction which read rows that
+// another transaction has since written fails when it tries to write, rather than overwriting them.
+func (d Dialect) ForUpdate() string {
+	if d.sqlite {
+		return ""
+	}
+	return " FOR UPDATE"
+}
+
+// CreateSequence returns the statement which creates this sequence for SequenceKey, if the database
+// needs one.
+func (d Dialect) CreateSequence(seq string) string {
+	if d.sqlite {
+		return ""
+	}
+	return "CREATE SEQUENCE IF NOT EXISTS " + seq + ";"
+}
+
+// SequenceKey returns the type of a primary key column which is assigned the next number in the
+// sequence when a row is inserted. SQLite has no sequences, so it uses an AUTOINCREMENT key, which
+// also never reuses numbers.
+func (d Dialect) SequenceKey(seq string) string {
+	if d.sqlite {
+		return "INTEGER PRIMARY KEY AUTOINCREMENT"
+	}
+	return "BIGINT PRIMARY KEY NOT NULL DEFAULT nextval('" + seq + "')"
+}
+
+// Timestamp returns the type of a column holding a time.Time. The sqlite driver only scans columns
+// declared as TIMESTAMP into a time.Time.
+func (d Dialect) Timestamp() string {
+	if d.sqlite {
+		return "TIMESTAMP"
+	}
+	return "TIMESTAMP WITH TIME ZONE"
+}
+
+// Array returns the type of a column holding an array of elemType. SQLite stores the array literal
+// written by pq.Array as text.
+func (d Dialect) Array(elemType string) string {
+	if d.sqlite {
+		return "TEXT"
+	}
+	return elemType + "[]"
+}
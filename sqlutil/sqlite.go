@@ -0,0 +1,214 @@
+package sqlutil
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	_ "github.com/lib/pq"
+	"modernc.org/sqlite"
+)
+
+// SQLite support. The tables are written for Postgres, and use a Dialect for the few constructs
+// which SQLite spells differently. Arrays are stored as Postgres array literals in TEXT columns,
+// which is what pq.Array writes and scans, so SQLite gets array_cat() and pg_array_json() functions
+// to work with them.
+
+const (
+	DriverPostgres = "postgres"
+	DriverSQLite   = "syncv3-sqlite"
+	// SQLiteURIPrefix marks a database URI as an SQLite database file, e.g. sqlite:/var/lib/syncv3.db
+	SQLiteURIPrefix = "sqlite:"
+)
+
+// Open a database. URIs starting with SQLiteURIPrefix open an SQLite database, anything else is
+// treated as a Postgres connection string.
+func Open(uri string) (*sqlx.DB, error) {
+	if !strings.HasPrefix(uri, SQLiteURIPrefix) {
+		return sqlx.Open(DriverPostgres, uri)
+	}
+	dsn := strings.TrimPrefix(uri, SQLiteURIPrefix)
+	if strings.Contains(dsn, "?") {
+		dsn += "&"
+	} else {
+		dsn += "?"
+	}
+	// WAL lets readers carry on whilst a transaction is writing. Writers queue up on the lock
+	// rather than failing immediately. LIKE is case sensitive in Postgres.
+	dsn += "_pragma=busy_timeout(30000)&_pragma=journal_mode(WAL)&_pragma=synchronous(NORMAL)" +
+		"&_pragma=case_sensitive_like(1)&_time_format=sqlite"
+	return sqlx.Open(DriverSQLite, dsn)
+}
+
+// IsSQLite returns true if this database or transaction is backed by SQLite.
+func IsSQLite(db interface{ DriverName() string }) bool {
+	return db.DriverName() == DriverSQLite
+}
+
+func init() {
+	// The functions must be registered before the sqlite driver opens any connections.
+	sqlite.MustRegisterDeterministicScalarFunction("pg_array_json", 1, pgArrayJSON)
+	sqlite.MustRegisterDeterministicScalarFunction("array_cat", 2, pgArrayCat)
+	// sql.Open doesn't connect, it just looks up the driver registered by the sqlite package.
+	db, err := sql.Open("sqlite", "")
+	if err != nil {
+		panic(err)
+	}
+	sql.Register(DriverSQLite, &sqliteDriver{db.Driver()})
+	// modernc.org/sqlite binds numbered parameters ($1) in quadratic time, which is very slow for
+	// bulk inserts, so queries built by sqlx use anonymous parameters (?) instead.
+	sqlx.BindDriver(DriverSQLite, sqlx.QUESTION)
+}
+
+type sqliteDriverConn interface {
+	driver.Conn
+	driver.ConnBeginTx
+	driver.ConnPrepareContext
+	driver.ExecerContext
+	driver.QueryerContext
+}
+
+type sqliteDriver struct {
+	driver.Driver
+}
+
+func (d *sqliteDriver) Open(name string) (driver.Conn, error) {
+	conn, err := d.Driver.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	c, ok := conn.(sqliteDriverConn)
+	if !ok {
+		conn.Close()
+		return nil, fmt.Errorf("sqlite driver returned unsupported connection %T", conn)
+	}
+	return &sqliteConn{c}, nil
+}
+
+// sqliteConn converts arguments to match how pq stores them. The sqlite driver stores a nil []byte
+// as NULL, whereas pq stores an empty BYTEA. Times are stored as text, so they are converted to UTC
+// to make sure they compare correctly.
+type sqliteConn struct {
+	sqliteDriverConn
+}
+
+func (c *sqliteConn) CheckNamedValue(nv *driver.NamedValue) (err error) {
+	nv.Value, err = driver.DefaultParameterConverter.ConvertValue(nv.Value)
+	if err != nil {
+		return err
+	}
+	switch v := nv.Value.(type) {
+	case []byte:
+		if v == nil {
+			nv.Value = []byte{}
+		}
+	case time.Time:
+		nv.Value = v.UTC()
+	}
+	return nil
+}
+
+// pg_array_json(arr) converts a Postgres array literal into a JSON array, for use with json_each().
+func pgArrayJSON(ctx *sqlite.FunctionContext, args []driver.Value) (driver.Value, error) {
+	elems, err := parsePGArray(args[0])
+	if err != nil {
+		return nil, err
+	}
+	if elems == nil {
+		elems = []interface{}{}
+	}
+	b, err := json.Marshal(elems)
+	return string(b), err
+}
+
+var pgArrayEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`)
+
+// array_cat(a, b) concatenates two Postgres array literals.
+func pgArrayCat(ctx *sqlite.FunctionContext, args []driver.Value) (driver.Value, error) {
+	a, err := parsePGArray(args[0])
+	if err != nil {
+		return nil, err
+	}
+	b, err := parsePGArray(args[1])
+	if err != nil {
+		return nil, err
+	}
+	var sb strings.Builder
+	sb.WriteByte('{')
+	for i, elem := range append(a, b...) {
+		if i > 0 {
+			sb.WriteByte(',')
+		}
+		switch e := elem.(type) {
+		case nil:
+			sb.WriteString("NULL")
+		case int64:
+			sb.WriteString(strconv.FormatInt(e, 10))
+		case string:
+			sb.WriteByte('"')
+			sb.WriteString(pgArrayEscaper.Replace(e))
+			sb.WriteByte('"')
+		}
+	}
+	sb.WriteByte('}')
+	return sb.String(), nil
+}
+
+// parsePGArray parses a one-dimensional Postgres array literal e.g. {1,2,3} or {"a","b"}. Unquoted
+// integers are returned as int64, NULLs as nil and everything else as strings.
+func parsePGArray(val driver.Value) ([]interface{}, error) {
+	var s string
+	switch v := val.(type) {
+	case nil:
+		return nil, nil
+	case string:
+		s = v
+	case []byte:
+		s = string(v)
+	default:
+		return nil, fmt.Errorf("pg array: unexpected type %T", val)
+	}
+	if len(s) < 2 || s[0] != '{' || s[len(s)-1] != '}' {
+		return nil, fmt.Errorf("pg array: malformed literal %q", s)
+	}
+	s = s[1 : len(s)-1]
+	var elems []interface{}
+	for len(s) > 0 {
+		if s[0] == '"' {
+			var sb strings.Builder
+			i := 1
+			for ; i < len(s) && s[i] != '"'; i++ {
+				if s[i] == '\\' && i+1 < len(s) {
+					i++
+				}
+				sb.WriteByte(s[i])
+			}
+			if i >= len(s) {
+				return nil, fmt.Errorf("pg array: unterminated string in %q", s)
+			}
+			elems = append(elems, sb.String())
+			s = s[i+1:]
+		} else {
+			end := strings.IndexByte(s, ',')
+			if end == -1 {
+				end = len(s)
+			}
+			token := s[:end]
+			if n, err := strconv.ParseInt(token, 10, 64); err == nil {
+				elems = append(elems, n)
+			} else if strings.EqualFold(token, "NULL") {
+				elems = append(elems, nil)
+			} else {
+				elems = append(elems, token)
+			}
+			s = s[end:]
+		}
+		s = strings.TrimPrefix(s, ",")
+	}
+	return elems, nil
+}
@@ -0,0 +1,69 @@
+package sqlutil
+
+import (
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/lib/pq"
+)
+
+func TestSQLiteDialect(t *testing.T) {
+	db, err := Open(SQLiteURIPrefix + filepath.Join(t.TempDir(), "dialect.db"))
+	if err != nil {
+		t.Fatalf("failed to open db: %s", err)
+	}
+	defer db.Close()
+	d := DialectOf(db)
+	db.MustExec(`
+	` + d.CreateSequence("test_seq") + `
+	CREATE TABLE test (
+		id ` + d.SequenceKey("test_seq") + `,
+		a ` + d.Array("BIGINT") + ` NOT NULL,
+		b ` + d.Array("BIGINT") + ` NOT NULL,
+		data BYTEA NOT NULL
+	);`)
+	var ids []int64
+	for _, arrays := range [][2][]int64{{{1, 2}, {3}}, {{4}, {}}} {
+		var id int64
+		err = db.QueryRow(`INSERT INTO test(a, b, data) VALUES($1, $2, $3) RETURNING id`, pq.Int64Array(arrays[0]), pq.Int64Array(arrays[1]), []byte(nil)).Scan(&id)
+		if err != nil {
+			t.Fatalf("failed to insert: %s", err)
+		}
+		ids = append(ids, id)
+	}
+	if ids[0] != 1 || ids[1] != 2 {
+		t.Errorf("got ids %v want [1 2]", ids)
+	}
+	var got []int64
+	err = db.Select(&got, `SELECT id FROM test WHERE `+d.Any("3", "array_cat(a, b)")+` OR `+d.Any("id", "$1")+` ORDER BY id`, pq.Int64Array([]int64{2}))
+	if err != nil {
+		t.Fatalf("failed to select: %s", err)
+	}
+	if !reflect.DeepEqual(got, []int64{1, 2}) {
+		t.Errorf("got ids %v want [1 2]", got)
+	}
+}
+
+func TestParsePGArray(t *testing.T) {
+	testCases := []struct {
+		input string
+		want  []interface{}
+	}{
+		{input: "{}", want: []interface{}{}},
+		{input: "{1,2,3}", want: []interface{}{int64(1), int64(2), int64(3)}},
+		{input: `{"$a:b","with \"quotes\"",NULL,plain}`, want: []interface{}{"$a:b", `with "quotes"`, nil, "plain"}},
+	}
+	for _, tc := range testCases {
+		got, err := parsePGArray(tc.input)
+		if err != nil {
+			t.Fatalf("parsePGArray(%q) returned error: %s", tc.input, err)
+		}
+		if len(got) == 0 && len(tc.want) == 0 {
+			continue
+		}
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("parsePGArray(%q): got %#v want %#v", tc.input, got, tc.want)
+		}
+	}
+}
@@ -5,6 +5,7 @@ import (
 
 	"github.com/jmoiron/sqlx"
 	"github.com/lib/pq"
+	"github.com/matrix-org/sliding-sync/internal"
 	"github.com/matrix-org/sliding-sync/sqlutil"
 )
 
@@ -22,6 +23,21 @@ type AccountData struct {
 type AccountDataTable struct{}
 
 func NewAccountDataTable(db *sqlx.DB) *AccountDataTable {
+	if sqlutil.IsSQLite(db) {
+		// SQLite has no sequences, so the id is an AUTOINCREMENT key which is reassigned by
+		// replacing the row whenever the data changes.
+		db.MustExec(`
+		CREATE TABLE IF NOT EXISTS syncv3_account_data (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			user_id TEXT NOT NULL,
+			room_id TEXT NOT NULL, -- optional if global
+			type TEXT NOT NULL,
+			data BLOB NOT NULL,
+			UNIQUE(user_id, room_id, type)
+		);
+		`)
+		return &AccountDataTable{}
+	}
 	// make sure tables are made
 	db.MustExec(`
 	CREATE SEQUENCE IF NOT EXISTS syncv3_account_data_seq;
@@ -53,11 +69,17 @@ func (t *AccountDataTable) Insert(txn *sqlx.Tx, accDatas []AccountData) ([]Accou
 	for _, ad := range keys {
 		dedupedAccountData = append(dedupedAccountData, *ad)
 	}
-	chunks := sqlutil.Chunkify(4, MaxPostgresParameters, AccountDataChunker(dedupedAccountData))
-	for _, chunk := range chunks {
-		_, err := txn.NamedExec(`
+	query := `
 		INSERT INTO syncv3_account_data (user_id, room_id, type, data)
-        VALUES (:user_id, :room_id, :type, :data) ON CONFLICT (user_id, room_id, type) DO UPDATE SET data = EXCLUDED.data, id=nextval('syncv3_account_data_seq')`, chunk)
+        VALUES (:user_id, :room_id, :type, :data) ON CONFLICT (user_id, room_id, type) DO UPDATE SET data = EXCLUDED.data, id=nextval('syncv3_account_data_seq')`
+	if sqlutil.IsSQLite(txn) {
+		query = `
+		INSERT OR REPLACE INTO syncv3_account_data (user_id, room_id, type, data)
+		VALUES (:user_id, :room_id, :type, :data)`
+	}
+	chunks := sqlutil.Chunkify(4, maxParameters(txn), AccountDataChunker(dedupedAccountData))
+	for _, chunk := range chunks {
+		_, err := txn.NamedExec(query, chunk)
 		if err != nil {
 			return nil, err
 		}
@@ -67,7 +89,7 @@ func (t *AccountDataTable) Insert(txn *sqlx.Tx, accDatas []AccountData) ([]Accou
 
 func (t *AccountDataTable) Select(txn *sqlx.Tx, userID string, eventTypes []string, roomID string) (datas []AccountData, err error) {
 	err = txn.Select(&datas, `SELECT id, user_id, room_id, type, data FROM syncv3_account_data
-	WHERE user_id=$1 AND type=ANY($2) AND room_id=$3`, userID, pq.StringArray(eventTypes), roomID)
+	WHERE user_id=$1 AND `+sqlutil.DialectOf(txn).Any("type", "$2")+` AND room_id=$3`, userID, pq.StringArray(eventTypes), roomID)
 	return
 }
 
@@ -77,14 +99,17 @@ func (t *AccountDataTable) SelectWithType(txn *sqlx.Tx, userID, evType string) (
 	return
 }
 
-func (t *AccountDataTable) SelectMany(txn *sqlx.Tx, userID string, roomIDs ...string) (datas []AccountData, err error) {
+// SelectMany returns this user's account data which passes the filter. If roomIDs is empty, global
+// account data is returned, else the account data for these rooms.
+func (t *AccountDataTable) SelectMany(txn *sqlx.Tx, userID string, filter *internal.TypeFilter, roomIDs ...string) (datas []AccountData, err error) {
+	typeCond, typeArgs := filter.SQL("type", 3)
 	if len(roomIDs) == 0 {
 		err = txn.Select(&datas, `SELECT id, user_id, room_id, type, data FROM syncv3_account_data
-		WHERE user_id=$1 AND room_id = $2`, userID, AccountDataGlobalRoom)
+		WHERE user_id=$1 AND room_id = $2 AND `+typeCond, append([]interface{}{userID, AccountDataGlobalRoom}, typeArgs...)...)
 		return
 	}
 	err = txn.Select(&datas, `SELECT id, user_id, room_id, type, data FROM syncv3_account_data
-	WHERE user_id=$1 AND room_id=ANY($2)`, userID, pq.StringArray(roomIDs))
+	WHERE user_id=$1 AND `+sqlutil.DialectOf(txn).Any("room_id", "$2")+` AND `+typeCond, append([]interface{}{userID, pq.StringArray(roomIDs)}, typeArgs...)...)
 	return
 }
 
@@ -5,6 +5,7 @@ import (
 	"sort"
 	"testing"
 
+	"github.com/matrix-org/sliding-sync/internal"
 	"github.com/matrix-org/sliding-sync/sync2"
 )
 
@@ -48,6 +49,7 @@ func TestAccountData(t *testing.T) {
 	if err != nil {
 		t.Fatalf("failed to start txn: %s", err)
 	}
+	defer txn.Rollback()
 	alice := "@alice_TestAccountData:localhost"
 	roomA := "!TestAccountData_A:localhost"
 	roomB := "!TestAccountData_B:localhost"
@@ -124,7 +126,7 @@ func TestAccountData(t *testing.T) {
 	wantDatas := []AccountData{
 		accountData[4], accountData[5],
 	}
-	gotDatas, err := table.SelectMany(txn, alice)
+	gotDatas, err := table.SelectMany(txn, alice, nil)
 	if err != nil {
 		t.Fatalf("SelectMany: %s", err)
 	}
@@ -134,14 +136,14 @@ func TestAccountData(t *testing.T) {
 	wantDatas = []AccountData{
 		accountData[6],
 	}
-	gotDatas, err = table.SelectMany(txn, alice, roomA)
+	gotDatas, err = table.SelectMany(txn, alice, nil, roomA)
 	if err != nil {
 		t.Fatalf("SelectMany: %s", err)
 	}
 	assertAccountDatasEqual(t, "SelectMany", gotDatas, wantDatas)
 
 	// Select all room events for unknown user
-	gotDatas, err = table.SelectMany(txn, "@someone-else:localhost", roomA)
+	gotDatas, err = table.SelectMany(txn, "@someone-else:localhost", nil, roomA)
 	if err != nil {
 		t.Fatalf("SelectMany: %s", err)
 	}
@@ -171,6 +173,53 @@ func TestAccountData(t *testing.T) {
 
 }
 
+func TestAccountDataTypeFilter(t *testing.T) {
+	db, close := connectToDB(t)
+	defer close()
+	txn, err := db.Beginx()
+	if err != nil {
+		t.Fatalf("failed to start txn: %s", err)
+	}
+	defer txn.Rollback()
+	alice := "@alice_TestAccountDataTypeFilter:localhost"
+	roomA := "!TestAccountDataTypeFilter_A:localhost"
+	table := NewAccountDataTable(db)
+	direct := AccountData{UserID: alice, RoomID: AccountDataGlobalRoom, Type: "m.direct", Data: []byte(`{}`)}
+	secret := AccountData{UserID: alice, RoomID: AccountDataGlobalRoom, Type: "m.secret_storage.key.abc", Data: []byte(`{}`)}
+	// '_' must not act as a LIKE wildcard
+	notSecret := AccountData{UserID: alice, RoomID: AccountDataGlobalRoom, Type: "m.secretXstorage.key", Data: []byte(`{}`)}
+	tag := AccountData{UserID: alice, RoomID: roomA, Type: "m.tag", Data: []byte(`{}`)}
+	setting := AccountData{UserID: alice, RoomID: roomA, Type: "im.vector.setting.x", Data: []byte(`{}`)}
+	if _, err = table.Insert(txn, []AccountData{direct, secret, notSecret, tag, setting}); err != nil {
+		t.Fatalf("Insert: %s", err)
+	}
+
+	testCases := []struct {
+		name    string
+		filter  *internal.TypeFilter
+		roomIDs []string
+		want    []AccountData
+	}{
+		{name: "nil filter", filter: nil, want: []AccountData{direct, secret, notSecret}},
+		{name: "types", filter: &internal.TypeFilter{Types: []string{"m.direct"}}, want: []AccountData{direct}},
+		{name: "empty types", filter: &internal.TypeFilter{Types: []string{}}, want: []AccountData{}},
+		{name: "wildcard not_types", filter: &internal.TypeFilter{NotTypes: []string{"m.secret_storage.*"}}, want: []AccountData{direct, notSecret}},
+		{
+			name:   "wildcard types and not_types",
+			filter: &internal.TypeFilter{Types: []string{"m.*"}, NotTypes: []string{"m.secret_storage.*"}},
+			want:   []AccountData{direct, notSecret},
+		},
+		{name: "room account data", filter: &internal.TypeFilter{NotTypes: []string{"im.vector.*"}}, roomIDs: []string{roomA}, want: []AccountData{tag}},
+	}
+	for _, tc := range testCases {
+		gotDatas, err := table.SelectMany(txn, alice, tc.filter, tc.roomIDs...)
+		if err != nil {
+			t.Fatalf("%s: SelectMany: %s", tc.name, err)
+		}
+		assertAccountDatasEqual(t, tc.name, gotDatas, tc.want)
+	}
+}
+
 func TestAccountDataIDIncrements(t *testing.T) {
 	db, close := connectToDB(t)
 	defer close()
@@ -178,6 +227,7 @@ func TestAccountDataIDIncrements(t *testing.T) {
 	if err != nil {
 		t.Fatalf("failed to start txn: %s", err)
 	}
+	defer txn.Rollback()
 	alice := "@alice_TestAccountDataIDIncrements:localhost"
 	roomA := "!TestAccountData_A:localhost"
 	//roomB := "!TestAccountData_B:localhost"
@@ -204,7 +254,7 @@ func TestAccountDataIDIncrements(t *testing.T) {
 	gots, err = table.Select(txn, alice, []string{eventType}, roomA)
 	assertNoError(t, err)
 	assertAccountDatasEqual(t, "Select", gots, []AccountData{data})
-	gots, err = table.SelectMany(txn, alice, roomA)
+	gots, err = table.SelectMany(txn, alice, nil, roomA)
 	assertNoError(t, err)
 	assertAccountDatasEqual(t, "SelectMany", gots, []AccountData{data})
 	// now replace the data, which should update the id
@@ -220,7 +270,7 @@ func TestAccountDataIDIncrements(t *testing.T) {
 	}
 	data.ID = gots[0].ID
 	assertAccountDatasEqual(t, "Select", gots, []AccountData{data})
-	gots, err = table.SelectMany(txn, alice, roomA)
+	gots, err = table.SelectMany(txn, alice, nil, roomA)
 	assertNoError(t, err)
 	assertAccountDatasEqual(t, "SelectMany", gots, []AccountData{data})
 	gots, err = table.SelectWithType(txn, alice, eventType)
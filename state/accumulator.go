@@ -30,6 +30,7 @@ type Accumulator struct {
 	snapshotTable *SnapshotTable
 	spacesTable   *SpacesTable
 	invitesTable  *InvitesTable
+	knocksTable   *KnocksTable
 	entityName    string
 }
 
@@ -41,6 +42,7 @@ func NewAccumulator(db *sqlx.DB) *Accumulator {
 		snapshotTable: NewSnapshotsTable(db),
 		spacesTable:   NewSpacesTable(db),
 		invitesTable:  NewInvitesTable(db),
+		knocksTable:   NewKnocksTable(db),
 		entityName:    "server",
 	}
 }
@@ -294,6 +296,9 @@ func (a *Accumulator) Initialise(roomID string, state []json.RawMessage) (Initia
 		if err = a.invitesTable.RemoveSupersededInvites(txn, roomID, events); err != nil {
 			return fmt.Errorf("RemoveSupersededInvites: %w", err)
 		}
+		if err = a.knocksTable.RemoveSupersededKnocks(txn, roomID, events); err != nil {
+			return fmt.Errorf("RemoveSupersededKnocks: %w", err)
+		}
 
 		if err = a.spacesTable.HandleSpaceUpdates(txn, events); err != nil {
 			return fmt.Errorf("HandleSpaceUpdates: %s", err)
@@ -537,12 +542,13 @@ func (a *Accumulator) Accumulate(txn *sqlx.Tx, userID, roomID string, timeline s
 		for eventID := range redactTheseEventIDs {
 			redactedEventIDs = append(redactedEventIDs, eventID)
 		}
+		d := sqlutil.DialectOf(txn)
 		var currentStateRedactions int
 		err = txn.Get(&currentStateRedactions, `
 			SELECT COUNT(*)
 			FROM syncv3_events
-			    JOIN syncv3_snapshots ON event_nid = ANY (ARRAY_CAT(events, membership_events))
-			WHERE snapshot_id = $1 AND event_id = ANY($2)
+			    JOIN syncv3_snapshots ON `+d.Any("event_nid", "ARRAY_CAT(events, membership_events)")+`
+			WHERE snapshot_id = $1 AND `+d.Any("event_id", "$2")+`
 		`, snapID, pq.StringArray(redactedEventIDs))
 		if err != nil {
 			return AccumulateResult{}, err
@@ -553,6 +559,9 @@ func (a *Accumulator) Accumulate(txn *sqlx.Tx, userID, roomID string, timeline s
 	if err = a.invitesTable.RemoveSupersededInvites(txn, roomID, postInsertEvents); err != nil {
 		return AccumulateResult{}, fmt.Errorf("RemoveSupersededInvites: %w", err)
 	}
+	if err = a.knocksTable.RemoveSupersededKnocks(txn, roomID, postInsertEvents); err != nil {
+		return AccumulateResult{}, fmt.Errorf("RemoveSupersededKnocks: %w", err)
+	}
 
 	if err = a.spacesTable.HandleSpaceUpdates(txn, postInsertEvents); err != nil {
 		return AccumulateResult{}, fmt.Errorf("HandleSpaceUpdates: %s", err)
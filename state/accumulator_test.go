@@ -117,13 +117,19 @@ func TestAccumulatorInitialise(t *testing.T) {
 	assertValue(t, "res.AddedEvents", res.AddedEvents, true)
 	assertValue(t, "res.ReplacedExistingSnapshot", res.ReplacedExistingSnapshot, true)
 
-	snapID2, err := accumulator.roomsTable.CurrentAfterSnapshotID(txn, roomID)
+	// use a new txn, as SQLite transactions do not see rows committed after they started
+	txn2, err := accumulator.db.Beginx()
+	if err != nil {
+		t.Fatalf("failed to start assert txn: %s", err)
+	}
+	defer txn2.Rollback()
+	snapID2, err := accumulator.roomsTable.CurrentAfterSnapshotID(txn2, roomID)
 	assertNoError(t, err)
 	if snapID2 == snapID1 || snapID2 == 0 {
 		t.Errorf("Expected snapID2 (%d) to be neither snapID1 (%d) nor 0", snapID2, snapID1)
 	}
 
-	row, err = accumulator.snapshotTable.Select(txn, snapID2)
+	row, err = accumulator.snapshotTable.Select(txn2, snapID2)
 	assertNoError(t, err)
 	assertValue(t, "len(row.MembershipEvents)", len(row.MembershipEvents), 1)
 	assertValue(t, "len(row.OtherEvents)", len(row.OtherEvents), 3)
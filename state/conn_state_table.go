@@ -0,0 +1,82 @@
+package state
+
+import (
+	"database/sql"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// ConnCheckpoint is the persisted state of a sliding sync connection. Data is opaque to this
+// table: it is written and interpreted by the sync3 handler.
+type ConnCheckpoint struct {
+	UserID    string `db:"user_id"`
+	DeviceID  string `db:"device_id"`
+	ConnID    string `db:"conn_id"`
+	Pos       int64  `db:"pos"`
+	Data      []byte `db:"data"`
+	UpdatedAt int64  `db:"updated_ts"`
+}
+
+// ConnStateTable stores the latest checkpoint for each connection, so a connection can be
+// resumed with its existing ?pos= after the proxy restarts.
+type ConnStateTable struct {
+	db *sqlx.DB
+}
+
+func NewConnStateTable(db *sqlx.DB) *ConnStateTable {
+	// make sure tables are made
+	db.MustExec(`
+	CREATE TABLE IF NOT EXISTS syncv3_conn_checkpoints (
+		user_id TEXT NOT NULL,
+		device_id TEXT NOT NULL,
+		conn_id TEXT NOT NULL,
+		pos BIGINT NOT NULL,
+		data BYTEA NOT NULL,
+		updated_ts BIGINT NOT NULL,
+		UNIQUE(user_id, device_id, conn_id)
+	);
+	`)
+	return &ConnStateTable{db}
+}
+
+// Upsert replaces the checkpoint for this connection.
+func (t *ConnStateTable) Upsert(cp ConnCheckpoint) error {
+	if cp.UpdatedAt == 0 {
+		cp.UpdatedAt = time.Now().UnixMilli()
+	}
+	_, err := t.db.NamedExec(`
+	INSERT INTO syncv3_conn_checkpoints(user_id, device_id, conn_id, pos, data, updated_ts)
+	VALUES(:user_id, :device_id, :conn_id, :pos, :data, :updated_ts)
+	ON CONFLICT (user_id, device_id, conn_id) DO UPDATE SET
+		pos = EXCLUDED.pos, data = EXCLUDED.data, updated_ts = EXCLUDED.updated_ts`, cp)
+	return err
+}
+
+// Select the checkpoint for this connection. Returns nil if there is no checkpoint.
+func (t *ConnStateTable) Select(userID, deviceID, connID string) (*ConnCheckpoint, error) {
+	var cp ConnCheckpoint
+	err := t.db.Get(&cp, `SELECT user_id, device_id, conn_id, pos, data, updated_ts FROM syncv3_conn_checkpoints
+	WHERE user_id=$1 AND device_id=$2 AND conn_id=$3`, userID, deviceID, connID)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &cp, nil
+}
+
+// Delete the checkpoint for this connection, if there is one.
+func (t *ConnStateTable) Delete(userID, deviceID, connID string) error {
+	_, err := t.db.Exec(`DELETE FROM syncv3_conn_checkpoints WHERE user_id=$1 AND device_id=$2 AND conn_id=$3`,
+		userID, deviceID, connID)
+	return err
+}
+
+// Clean removes checkpoints which have not been updated since boundaryTime. These connections
+// would have expired anyway, so they can never be resumed.
+func (t *ConnStateTable) Clean(boundaryTime time.Time) error {
+	_, err := t.db.Exec(`DELETE FROM syncv3_conn_checkpoints WHERE updated_ts <= $1`, boundaryTime.UnixMilli())
+	return err
+}
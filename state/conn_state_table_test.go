@@ -0,0 +1,46 @@
+package state
+
+import (
+	"testing"
+	"time"
+)
+
+func TestConnStateTable(t *testing.T) {
+	db, close := connectToDB(t)
+	defer close()
+	table := NewConnStateTable(db)
+	alice := "@TestConnStateTable_alice:localhost"
+
+	cp, err := table.Select(alice, "A", "room-list")
+	assertNoError(t, err)
+	if cp != nil {
+		t.Fatalf("Select: got checkpoint %+v for unknown conn, want nil", cp)
+	}
+
+	assertNoError(t, table.Upsert(ConnCheckpoint{UserID: alice, DeviceID: "A", ConnID: "room-list", Pos: 5, Data: []byte(`{"v":5}`)}))
+	assertNoError(t, table.Upsert(ConnCheckpoint{UserID: alice, DeviceID: "A", ConnID: "encryption", Pos: 2, Data: []byte(`{"v":2}`)}))
+	assertNoError(t, table.Upsert(ConnCheckpoint{UserID: alice, DeviceID: "A", ConnID: "room-list", Pos: 7, Data: []byte(`{"v":7}`)}))
+
+	cp, err = table.Select(alice, "A", "room-list")
+	assertNoError(t, err)
+	if cp == nil || cp.Pos != 7 || string(cp.Data) != `{"v":7}` {
+		t.Fatalf("Select: got %+v want pos 7", cp)
+	}
+	if cp.UpdatedAt == 0 {
+		t.Errorf("Select: updated_ts was not set")
+	}
+
+	assertNoError(t, table.Delete(alice, "A", "room-list"))
+	cp, err = table.Select(alice, "A", "room-list")
+	assertNoError(t, err)
+	if cp != nil {
+		t.Fatalf("Select: got %+v after Delete, want nil", cp)
+	}
+
+	assertNoError(t, table.Clean(time.Now().Add(time.Minute)))
+	cp, err = table.Select(alice, "A", "encryption")
+	assertNoError(t, err)
+	if cp != nil {
+		t.Fatalf("Select: got %+v after Clean, want nil", cp)
+	}
+}
@@ -33,10 +33,12 @@ func NewDeviceDataTable(db *sqlx.DB) *DeviceDataTable {
 		data BYTEA NOT NULL,
 		UNIQUE(user_id, device_id)
 	);
-	-- Set the fillfactor to 90%, to allow for HOT updates (e.g. we only
-	-- change the data, not anything indexed like the id)
-	ALTER TABLE syncv3_device_data SET (fillfactor = 90);
 	`)
+	if !sqlutil.IsSQLite(db) {
+		// Set the fillfactor to 90%, to allow for HOT updates (e.g. we only
+		// change the data, not anything indexed like the id)
+		db.MustExec(`ALTER TABLE syncv3_device_data SET (fillfactor = 90);`)
+	}
 	return &DeviceDataTable{
 		db:              db,
 		deviceListTable: NewDeviceListTable(db),
@@ -49,7 +51,7 @@ func (t *DeviceDataTable) Select(userID, deviceID string, swap bool) (result *in
 	err = sqlutil.WithTransaction(t.db, func(txn *sqlx.Tx) error {
 		// grab otk counts and fallback key types
 		var row DeviceDataRow
-		err = txn.Get(&row, `SELECT data FROM syncv3_device_data WHERE user_id=$1 AND device_id=$2 FOR UPDATE`, userID, deviceID)
+		err = txn.Get(&row, `SELECT data FROM syncv3_device_data WHERE user_id=$1 AND device_id=$2`+sqlutil.DialectOf(txn).ForUpdate(), userID, deviceID)
 		if err != nil {
 			if err == sql.ErrNoRows {
 				// if there is no device data for this user, it's not an error.
@@ -115,7 +117,7 @@ func (t *DeviceDataTable) Upsert(userID, deviceID string, keys internal.DeviceKe
 		}
 		// select what already exists
 		var row DeviceDataRow
-		err = txn.Get(&row, `SELECT data FROM syncv3_device_data WHERE user_id=$1 AND device_id=$2 FOR UPDATE`, userID, deviceID)
+		err = txn.Get(&row, `SELECT data FROM syncv3_device_data WHERE user_id=$1 AND device_id=$2`+sqlutil.DialectOf(txn).ForUpdate(), userID, deviceID)
 		if err != nil && err != sql.ErrNoRows {
 			return err
 		}
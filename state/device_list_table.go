@@ -38,10 +38,12 @@ func NewDeviceListTable(db *sqlx.DB) *DeviceListTable {
 	);
 	-- make an index so selecting all the rows is faster
 	CREATE INDEX IF NOT EXISTS syncv3_device_list_updates_bucket_idx ON syncv3_device_list_updates(user_id, device_id, bucket);
-	-- Set the fillfactor to 90%, to allow for HOT updates (e.g. we only
-	-- change the data, not anything indexed like the id)
-	ALTER TABLE syncv3_device_list_updates SET (fillfactor = 90);
 	`)
+	if !sqlutil.IsSQLite(db) {
+		// Set the fillfactor to 90%, to allow for HOT updates (e.g. we only
+		// change the data, not anything indexed like the id)
+		db.MustExec(`ALTER TABLE syncv3_device_list_updates SET (fillfactor = 90);`)
+	}
 	return &DeviceListTable{
 		db: db,
 	}
@@ -76,7 +78,7 @@ func (t *DeviceListTable) UpsertTx(txn *sqlx.Tx, userID, deviceID string, device
 			Bucket:       BucketNew,
 		})
 	}
-	chunks := sqlutil.Chunkify(5, MaxPostgresParameters, DeviceListChunker(deviceListRows))
+	chunks := sqlutil.Chunkify(5, maxParameters(txn), DeviceListChunker(deviceListRows))
 	for _, chunk := range chunks {
 		_, err := txn.NamedExec(`
 						INSERT INTO syncv3_device_list_updates(user_id, device_id, target_user_id, target_state, bucket)
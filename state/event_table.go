@@ -113,11 +113,12 @@ type EventTable struct {
 
 // NewEventTable makes a new EventTable
 func NewEventTable(db *sqlx.DB) *EventTable {
+	d := sqlutil.DialectOf(db)
 	// make sure tables are made
 	db.MustExec(`
-	CREATE SEQUENCE IF NOT EXISTS syncv3_event_nids_seq;
+	` + d.CreateSequence("syncv3_event_nids_seq") + `
 	CREATE TABLE IF NOT EXISTS syncv3_events (
-		event_nid BIGINT PRIMARY KEY NOT NULL DEFAULT nextval('syncv3_event_nids_seq'),
+		event_nid ` + d.SequenceKey("syncv3_event_nids_seq") + `,
 		event_id TEXT NOT NULL UNIQUE,
 		before_state_snapshot_id BIGINT NOT NULL DEFAULT 0,
 		-- which nid gets replaced in the snapshot with event_nid
@@ -175,7 +176,7 @@ func (t *EventTable) Insert(txn *sqlx.Tx, events []Event, checkFields bool) (map
 		}
 		events[i].JSON = js
 	}
-	chunks := sqlutil.Chunkify(9, MaxPostgresParameters, EventChunker(events))
+	chunks := sqlutil.Chunkify(9, maxParameters(txn), EventChunker(events))
 	var eventID string
 	var eventNID int64
 	for _, chunk := range chunks {
@@ -225,7 +226,7 @@ func (t *EventTable) SelectByNIDs(txn *sqlx.Tx, verifyAll bool, nids []int64) (e
 	}
 	return t.selectAny(txn, wanted, `
 	SELECT event_nid, event_id, event, event_type, state_key, room_id, before_state_snapshot_id, membership, event_replaces_nid, missing_previous FROM syncv3_events
-	WHERE event_nid = ANY ($1) ORDER BY event_nid ASC;`, pq.Int64Array(nids))
+	WHERE `+sqlutil.DialectOf(t.db).Any("event_nid", "$1")+` ORDER BY event_nid ASC;`, pq.Int64Array(nids))
 }
 
 // SelectByIDs fetches all events with the given event IDs from the DB as Event structs.
@@ -239,7 +240,7 @@ func (t *EventTable) SelectByIDs(txn *sqlx.Tx, verifyAll bool, ids []string) (ev
 	}
 	return t.selectAny(txn, wanted, `
 	SELECT event_nid, event_id, event, event_type, state_key, room_id, before_state_snapshot_id, membership, missing_previous FROM syncv3_events
-	WHERE event_id = ANY ($1) ORDER BY event_nid ASC;`, pq.StringArray(ids))
+	WHERE `+sqlutil.DialectOf(t.db).Any("event_id", "$1")+` ORDER BY event_nid ASC;`, pq.StringArray(ids))
 }
 
 // SelectNIDsByIDs does just that. Returns a map from event ID to nid, with a key-value
@@ -252,7 +253,7 @@ func (t *EventTable) SelectNIDsByIDs(txn *sqlx.Tx, ids []string) (nids map[strin
 		NID int64  `db:"event_nid"`
 		ID  string `db:"event_id"`
 	}{}
-	err = txn.Select(&rows, "SELECT event_nid, event_id FROM syncv3_events WHERE event_id = ANY ($1);", pq.StringArray(ids))
+	err = txn.Select(&rows, "SELECT event_nid, event_id FROM syncv3_events WHERE "+sqlutil.DialectOf(txn).Any("event_id", "$1")+";", pq.StringArray(ids))
 	for _, row := range rows {
 		result[row.ID] = row.NID
 	}
@@ -267,7 +268,7 @@ func (t *EventTable) SelectStrippedEventsByNIDs(txn *sqlx.Tx, verifyAll bool, ni
 	// don't include the 'event' column
 	return t.selectAny(txn, wanted, `
 	SELECT event_nid, event_id, event_type, state_key, room_id, before_state_snapshot_id FROM syncv3_events
-	WHERE event_nid = ANY ($1) ORDER BY event_nid ASC;`, pq.Int64Array(nids))
+	WHERE `+sqlutil.DialectOf(t.db).Any("event_nid", "$1")+` ORDER BY event_nid ASC;`, pq.Int64Array(nids))
 }
 
 func (t *EventTable) SelectStrippedEventsByIDs(txn *sqlx.Tx, verifyAll bool, ids []string) (StrippedEvents, error) {
@@ -278,7 +279,7 @@ func (t *EventTable) SelectStrippedEventsByIDs(txn *sqlx.Tx, verifyAll bool, ids
 	// don't include the 'event' column
 	return t.selectAny(txn, wanted, `
 	SELECT event_nid, event_id, event_type, state_key, room_id, before_state_snapshot_id FROM syncv3_events
-	WHERE event_id = ANY ($1) ORDER BY event_nid ASC;`, pq.StringArray(ids))
+	WHERE `+sqlutil.DialectOf(t.db).Any("event_id", "$1")+` ORDER BY event_nid ASC;`, pq.StringArray(ids))
 
 }
 
@@ -293,6 +294,13 @@ func (t *EventTable) SelectUnknownEventIDs(txn *sqlx.Tx, maybeUnknownEventIDs []
 	SELECT event_id
 	FROM maybe_unknown_events LEFT JOIN syncv3_events USING(event_id)
 	WHERE event_nid IS NULL;`
+	if sqlutil.IsSQLite(txn) {
+		queryStr = `
+		WITH maybe_unknown_events(event_id) AS (SELECT value FROM json_each(pg_array_json($1)))
+		SELECT event_id
+		FROM maybe_unknown_events LEFT JOIN syncv3_events USING(event_id)
+		WHERE event_nid IS NULL;`
+	}
 
 	var unknownEventIDs []string
 	if err := txn.Select(&unknownEventIDs, queryStr, pq.StringArray(maybeUnknownEventIDs)); err != nil {
@@ -321,9 +329,7 @@ func (t *EventTable) UpdateBeforeSnapshotID(txn *sqlx.Tx, eventNID, snapID, repl
 //  2. Fetches the highest event_nid before or equal to $2 for each room in room_ids (`max_ev_nid` CTE)
 //  3. Fetches the latest events for each room using the data provided from room_ids and max_ev_nid (the `evs` LATERAL)
 func (t *EventTable) LatestEventInRooms(txn *sqlx.Tx, roomIDs []string, highestNID int64) (events []Event, err error) {
-	err = txn.Select(
-		&events,
-		`
+	query := `
 WITH room_ids AS (
     select unnest($1::text[]) AS room_id
 ),
@@ -340,9 +346,19 @@ FROM room_ids,
          SELECT event_nid, room_id, event_replaces_nid, before_state_snapshot_id, event_type, state_key, event
          FROM syncv3_events e
          WHERE e.event_nid = max_ev_nid.max AND room_ids.room_id = e.room_id
-         ) AS evs`,
-		pq.StringArray(roomIDs), highestNID,
-	)
+         ) AS evs`
+	if sqlutil.IsSQLite(txn) {
+		// SQLite has no LATERAL joins, so use a correlated subquery for the max NID instead.
+		query = `
+WITH room_ids AS (
+    SELECT value AS room_id FROM json_each(pg_array_json($1))
+)
+SELECT e.event_nid, e.room_id, e.event_replaces_nid, e.before_state_snapshot_id, e.event_type, e.state_key, e.event
+FROM room_ids JOIN syncv3_events e ON e.event_nid = (
+    SELECT max(event_nid) FROM syncv3_events WHERE room_id = room_ids.room_id AND event_nid <= $2
+)`
+	}
+	err = txn.Select(&events, query, pq.StringArray(roomIDs), highestNID)
 	if err == sql.ErrNoRows {
 		err = nil
 	}
@@ -357,9 +373,7 @@ FROM room_ids,
 //  2. Fetches the latest eventNIDs for each room using the data provided from room_ids (the `evs` LATERAL)
 func (t *EventTable) LatestEventNIDInRooms(txn *sqlx.Tx, roomIDs []string, highestNID int64) (roomToNID map[string]int64, err error) {
 	var events []Event
-	err = txn.Select(
-		&events,
-		`
+	query := `
 WITH room_ids AS (
     select unnest($1::text[]) AS room_id
 )
@@ -367,9 +381,14 @@ SELECT evs.event_nid, room_id
 FROM room_ids, 
     LATERAL (
             SELECT max(event_nid) event_nid FROM syncv3_events e WHERE e.room_id = room_ids.room_id AND event_nid <= $2
-            ) AS evs WHERE event_nid IS NOT NULL;`,
-		pq.StringArray(roomIDs), highestNID,
-	)
+            ) AS evs WHERE event_nid IS NOT NULL;`
+	if sqlutil.IsSQLite(txn) {
+		query = `
+SELECT max(event_nid) AS event_nid, room_id FROM syncv3_events
+WHERE room_id IN (SELECT value FROM json_each(pg_array_json($1))) AND event_nid <= $2
+GROUP BY room_id;`
+	}
+	err = txn.Select(&events, query, pq.StringArray(roomIDs), highestNID)
 	if err == sql.ErrNoRows {
 		err = nil
 	}
@@ -447,7 +466,7 @@ func (t *EventTable) selectLatestEventByTypeInAllRooms(txn *sqlx.Tx) ([]Event, e
 	//	2. Gets all rooms as the `room_ids` CTE
 	// 	3. Gets the latest event_nid for each event_type and room as the `max_by_ev_type` CTE
 	//	4. Queries the required data using the event_nids provided by the `max_by_ev_type` CTE
-	rows, err := txn.Query(`
+	query := `
 WITH event_types AS (
     WITH RECURSIVE t AS (
         (SELECT event_type FROM syncv3_events ORDER BY event_type LIMIT 1)  -- parentheses required
@@ -464,8 +483,15 @@ WITH event_types AS (
     LATERAL ( SELECT max(event_nid) as max FROM syncv3_events e WHERE e.room_id = room_ids.room_id AND e.event_type = event_types.event_type ) AS m
 )
 SELECT room_id, event_nid, event FROM syncv3_events, max_by_ev_type WHERE event_nid = max_by_ev_type.max
-`,
-	)
+`
+	if sqlutil.IsSQLite(txn) {
+		// SQLite takes the bare event column from the row with the max event_nid in each group.
+		query = `
+SELECT room_id, max(event_nid), event FROM syncv3_events
+WHERE room_id IN (SELECT room_id FROM syncv3_rooms)
+GROUP BY room_id, event_type`
+	}
+	rows, err := txn.Query(query)
 	if err != nil {
 		return nil, err
 	}
@@ -526,7 +552,7 @@ func (t *EventTable) SelectClosestPrevBatchByID(roomID string, eventID string) (
 	err = t.db.QueryRow(
 		`SELECT prev_batch FROM syncv3_events WHERE prev_batch IS NOT NULL AND room_id=$1 AND event_nid >= (
 			SELECT event_nid FROM syncv3_events WHERE event_id = $2
-		) LIMIT 1`, roomID, eventID,
+		) ORDER BY event_nid ASC LIMIT 1`, roomID, eventID,
 	).Scan(&prevBatch)
 	if err == sql.ErrNoRows {
 		err = nil
@@ -538,7 +564,7 @@ func (t *EventTable) SelectClosestPrevBatchByID(roomID string, eventID string) (
 // is no closest.
 func (t *EventTable) SelectClosestPrevBatch(txn *sqlx.Tx, roomID string, eventNID int64) (prevBatch string, err error) {
 	err = txn.QueryRow(
-		`SELECT prev_batch FROM syncv3_events WHERE prev_batch IS NOT NULL AND room_id=$1 AND event_nid >= $2 LIMIT 1`, roomID, eventNID,
+		`SELECT prev_batch FROM syncv3_events WHERE prev_batch IS NOT NULL AND room_id=$1 AND event_nid >= $2 ORDER BY event_nid ASC LIMIT 1`, roomID, eventNID,
 	).Scan(&prevBatch)
 	if err == sql.ErrNoRows {
 		err = nil
@@ -546,6 +572,104 @@ func (t *EventTable) SelectClosestPrevBatch(txn *sqlx.Tx, roomID string, eventNI
 	return
 }
 
+// SelectNIDForPrevBatch returns the earliest event in this room which carries this prev_batch token,
+// and whether that event follows a gap in the timeline. Returns 0 if no event has this token.
+func (t *EventTable) SelectNIDForPrevBatch(txn *sqlx.Tx, roomID, prevBatch string) (nid int64, missingPrevious bool, err error) {
+	err = txn.QueryRow(
+		`SELECT event_nid, missing_previous FROM syncv3_events WHERE room_id=$1 AND prev_batch=$2 ORDER BY event_nid ASC LIMIT 1`,
+		roomID, prevBatch,
+	).Scan(&nid, &missingPrevious)
+	if err == sql.ErrNoRows {
+		err = nil
+	}
+	return
+}
+
+// SelectLatestPrevBatchNIDsBefore returns, for each room, the most recent event which carries a
+// prev_batch token and was sent before this timestamp.
+func (t *EventTable) SelectLatestPrevBatchNIDsBefore(txn *sqlx.Tx, originServerTS int64) (map[string]int64, error) {
+	ts := `(convert_from(event, 'UTF8')::jsonb->>'origin_server_ts')::BIGINT`
+	if sqlutil.IsSQLite(txn) {
+		ts = `json_extract(CAST(event AS TEXT), '$.origin_server_ts')`
+	}
+	return t.selectRoomNIDs(txn, `SELECT room_id, max(event_nid) FROM syncv3_events
+		WHERE prev_batch IS NOT NULL AND `+ts+` < $1 GROUP BY room_id`, originServerTS)
+}
+
+// SelectNthLatestTimelineNIDs returns, for each room with at least n timeline events, the NID of the
+// nth most recent one.
+func (t *EventTable) SelectNthLatestTimelineNIDs(txn *sqlx.Tx, n int) (map[string]int64, error) {
+	return t.selectRoomNIDs(txn, `SELECT room_id, event_nid FROM (
+		SELECT room_id, event_nid, ROW_NUMBER() OVER (PARTITION BY room_id ORDER BY event_nid DESC) AS row_num
+		FROM syncv3_events WHERE is_state=FALSE
+	) AS ranked WHERE row_num = $1`, n)
+}
+
+func (t *EventTable) selectRoomNIDs(txn *sqlx.Tx, query string, args ...interface{}) (map[string]int64, error) {
+	rows, err := txn.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	result := make(map[string]int64)
+	for rows.Next() {
+		var roomID string
+		var nid int64
+		if err = rows.Scan(&roomID, &nid); err != nil {
+			return nil, err
+		}
+		result[roomID] = nid
+	}
+	return result, rows.Err()
+}
+
+// SelectRoomsWithJoinedUsers returns the rooms which any of these users are currently joined to.
+func (t *EventTable) SelectRoomsWithJoinedUsers(txn *sqlx.Tx, userIDs []string) (roomIDs []string, err error) {
+	err = txn.Select(&roomIDs, `SELECT DISTINCT room_id FROM syncv3_events WHERE event_nid IN (
+		SELECT max(event_nid) FROM syncv3_events WHERE event_type='m.room.member' AND `+sqlutil.DialectOf(txn).Any("state_key", "$1")+`
+		GROUP BY room_id, state_key
+	) AND (membership='join' OR membership='_join')`, pq.StringArray(userIDs))
+	return
+}
+
+// SelectLatestPrevBatchNID returns the most recent event in this room with a prev_batch token and
+// a NID <= upperInclusive, or 0 if there is no such event.
+func (t *EventTable) SelectLatestPrevBatchNID(txn *sqlx.Tx, roomID string, upperInclusive int64) (nid int64, err error) {
+	err = txn.QueryRow(
+		`SELECT event_nid FROM syncv3_events WHERE room_id=$1 AND prev_batch IS NOT NULL AND event_nid <= $2
+		ORDER BY event_nid DESC LIMIT 1`, roomID, upperInclusive,
+	).Scan(&nid)
+	if err == sql.ErrNoRows {
+		err = nil
+	}
+	return
+}
+
+// SelectLatestNIDForEachType returns the NID of the most recent event of each type in this room.
+func (t *EventTable) SelectLatestNIDForEachType(txn *sqlx.Tx, roomID string) (nids []int64, err error) {
+	err = txn.Select(&nids, `SELECT max(event_nid) FROM syncv3_events WHERE room_id=$1 GROUP BY event_type`, roomID)
+	return
+}
+
+// DeleteBefore deletes the events in this room with a NID below beforeNID, except for keepNIDs.
+// Returns the number of events deleted and the size of their JSON in bytes.
+func (t *EventTable) DeleteBefore(txn *sqlx.Tx, roomID string, beforeNID int64, keepNIDs []int64) (numEvents, numBytes int64, err error) {
+	where := `WHERE room_id=$1 AND event_nid < $2 AND NOT (` + sqlutil.DialectOf(txn).Any("event_nid", "$3") + `)`
+	args := []interface{}{roomID, beforeNID, pq.Int64Array(keepNIDs)}
+	err = txn.QueryRow(`SELECT count(*), COALESCE(SUM(LENGTH(event)), 0) FROM syncv3_events `+where, args...).Scan(&numEvents, &numBytes)
+	if err != nil || numEvents == 0 {
+		return
+	}
+	_, err = txn.Exec(`DELETE FROM syncv3_events `+where, args...)
+	return
+}
+
+// SetMissingPrevious marks this event as following a gap in the timeline.
+func (t *EventTable) SetMissingPrevious(txn *sqlx.Tx, eventNID int64) error {
+	_, err := txn.Exec(`UPDATE syncv3_events SET missing_previous=TRUE WHERE event_nid=$1`, eventNID)
+	return err
+}
+
 func (t *EventTable) SelectCreateEvent(txn *sqlx.Tx, roomID string) (json.RawMessage, error) {
 	var evJSON []byte
 	// there is only 1 create event
@@ -6,6 +6,7 @@ import (
 	"github.com/lib/pq"
 
 	"github.com/jmoiron/sqlx"
+	"github.com/matrix-org/sliding-sync/sqlutil"
 )
 
 // InvitesTable stores invites for each user.
@@ -83,7 +84,7 @@ func (t *InvitesTable) RemoveSupersededInvites(txn *sqlx.Tx, roomID string, newE
 
 	_, err := txn.Exec(`
 		DELETE FROM syncv3_invites
-		WHERE user_id = ANY($1) AND room_id = $2
+		WHERE `+sqlutil.DialectOf(txn).Any("user_id", "$1")+` AND room_id = $2
 	`, pq.StringArray(usersToRemove), roomID)
 
 	return err
@@ -0,0 +1,81 @@
+package state
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/matrix-org/sliding-sync/sqlutil"
+)
+
+func TestKnocksTable(t *testing.T) {
+	db, close := connectToDB(t)
+	defer close()
+	table := NewKnocksTable(db)
+	alice := "@TestKnocksTable_alice:localhost"
+	bob := "@TestKnocksTable_bob:localhost"
+	roomA := "!TestKnocksTable_a:localhost"
+	roomB := "!TestKnocksTable_b:localhost"
+	knockStateA := []json.RawMessage{[]byte(`{"foo":"bar"}`)}
+	knockStateB := []json.RawMessage{[]byte(`{"foo":"bar"}`), []byte(`{"baz":"quuz"}`)}
+
+	for _, k := range []struct {
+		userID, roomID string
+		knockState     []json.RawMessage
+	}{
+		{alice, roomA, knockStateA},
+		{alice, roomB, knockStateB},
+		{bob, roomA, knockStateA},
+		// knocking again replaces the knock state
+		{bob, roomA, knockStateB},
+	} {
+		if err := table.InsertKnock(k.userID, k.roomID, k.knockState); err != nil {
+			t.Fatalf("failed to InsertKnock: %s", err)
+		}
+	}
+	assertKnocks(t, table, alice, map[string][]json.RawMessage{roomA: knockStateA, roomB: knockStateB})
+	assertKnocks(t, table, bob, map[string][]json.RawMessage{roomA: knockStateB})
+	assertKnocks(t, table, "no one", map[string][]json.RawMessage{})
+	bobKnock, err := table.SelectKnockState(bob, roomA)
+	if err != nil {
+		t.Fatalf("failed to SelectKnockState: %s", err)
+	}
+	if !reflect.DeepEqual(bobKnock, knockStateB) {
+		t.Errorf("SelectKnockState: got %v want %v", bobKnock, knockStateB)
+	}
+
+	// bob's knock is rescinded
+	if err = table.RemoveKnock(bob, roomA); err != nil {
+		t.Fatalf("failed to RemoveKnock: %s", err)
+	}
+	assertKnocks(t, table, bob, map[string][]json.RawMessage{})
+
+	// alice is let into room A, and knocks again after leaving room B
+	err = sqlutil.WithTransaction(db, func(txn *sqlx.Tx) error {
+		if err := table.RemoveSupersededKnocks(txn, roomA, []Event{
+			{Type: "m.room.member", StateKey: alice, Membership: "invite", RoomID: roomA},
+		}); err != nil {
+			return err
+		}
+		return table.RemoveSupersededKnocks(txn, roomB, []Event{
+			{Type: "m.room.member", StateKey: alice, Membership: "leave", RoomID: roomB},
+			{Type: "m.room.member", StateKey: alice, Membership: "knock", RoomID: roomB},
+		})
+	})
+	if err != nil {
+		t.Fatalf("failed to RemoveSupersededKnocks: %s", err)
+	}
+	assertKnocks(t, table, alice, map[string][]json.RawMessage{roomB: knockStateB})
+}
+
+func assertKnocks(t *testing.T, table *KnocksTable, user string, expected map[string][]json.RawMessage) {
+	t.Helper()
+	knocks, err := table.SelectAllKnocksForUser(user)
+	if err != nil {
+		t.Fatalf("failed to SelectAllKnocksForUser: %s", err)
+	}
+	if !reflect.DeepEqual(knocks, expected) {
+		t.Fatalf("got %v knocks, want %v", knocks, expected)
+	}
+}
@@ -3,10 +3,12 @@ package migrations
 import (
 	"context"
 	"encoding/json"
+	"strings"
 	"testing"
 
 	"github.com/jmoiron/sqlx"
 	_ "github.com/lib/pq"
+	"github.com/matrix-org/sliding-sync/sqlutil"
 	"github.com/matrix-org/sliding-sync/testutils"
 )
 
@@ -14,6 +16,9 @@ var postgresConnectionString = "user=xxxxx dbname=syncv3_test sslmode=disable"
 
 func connectToDB(t *testing.T) (*sqlx.DB, func()) {
 	postgresConnectionString = testutils.PrepareDBConnectionString()
+	if strings.HasPrefix(postgresConnectionString, sqlutil.SQLiteURIPrefix) {
+		t.Skip("these migrations only run on Postgres, SQLite has its own in migrations/sqlite")
+	}
 	db, err := sqlx.Open("postgres", postgresConnectionString)
 	if err != nil {
 		t.Fatalf("failed to open SQL db: %s", err)
@@ -0,0 +1,14 @@
+-- +goose Up
+-- Messages queued before this migration are treated as if they were queued by it, so they are not
+-- all expired the first time the cleaner runs. The default is evaluated once, then reset to match
+-- the table created by state.NewToDeviceTable.
+ALTER TABLE IF EXISTS syncv3_to_device_messages
+    ADD COLUMN IF NOT EXISTS inserted_ts BIGINT NOT NULL DEFAULT (EXTRACT(EPOCH FROM NOW()) * 1000)::BIGINT;
+ALTER TABLE IF EXISTS syncv3_to_device_messages
+    ALTER COLUMN inserted_ts SET DEFAULT 0;
+CREATE INDEX IF NOT EXISTS syncv3_to_device_messages_inserted_idx ON syncv3_to_device_messages(inserted_ts);
+
+-- +goose Down
+DROP INDEX IF EXISTS syncv3_to_device_messages_inserted_idx;
+ALTER TABLE IF EXISTS syncv3_to_device_messages
+    DROP COLUMN IF EXISTS inserted_ts;
@@ -0,0 +1,7 @@
+-- +goose Up
+ALTER TABLE IF EXISTS syncv3_sync2_tokens
+    ADD COLUMN IF NOT EXISTS expires_ts BIGINT NOT NULL DEFAULT 0;
+
+-- +goose Down
+ALTER TABLE IF EXISTS syncv3_sync2_tokens
+    DROP COLUMN IF EXISTS expires_ts;
@@ -0,0 +1,7 @@
+-- +goose Up
+-- The SQLite tables are created with their current schema by state.NewStorage and sync2.NewStore,
+-- so there is nothing to migrate yet. Later SQLite-specific migrations go in this directory.
+SELECT 1;
+
+-- +goose Down
+SELECT 1;
@@ -0,0 +1,40 @@
+// Package sqlite contains the Go migrations for SQLite databases. It is separate from the Postgres
+// migrations as goose only runs Go migrations which are in the directory being migrated.
+package sqlite
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"github.com/pressly/goose/v3"
+)
+
+func init() {
+	goose.AddMigrationContext(upToDeviceInsertedTS, downToDeviceInsertedTS)
+}
+
+func upToDeviceInsertedTS(ctx context.Context, tx *sql.Tx) error {
+	added, err := addColumn(ctx, tx, "syncv3_to_device_messages", "inserted_ts", "BIGINT NOT NULL DEFAULT 0")
+	if err != nil {
+		return err
+	}
+	if added {
+		// treat messages queued before this migration as if they were queued by it
+		_, err = tx.ExecContext(ctx, `UPDATE syncv3_to_device_messages SET inserted_ts = $1`, time.Now().UnixMilli())
+		if err != nil {
+			return err
+		}
+	}
+	_, err = tx.ExecContext(ctx, `CREATE INDEX IF NOT EXISTS syncv3_to_device_messages_inserted_idx ON syncv3_to_device_messages(inserted_ts)`)
+	return err
+}
+
+func downToDeviceInsertedTS(ctx context.Context, tx *sql.Tx) error {
+	_, err := tx.ExecContext(ctx, `DROP INDEX IF EXISTS syncv3_to_device_messages_inserted_idx`)
+	if err != nil {
+		return err
+	}
+	_, err = tx.ExecContext(ctx, `ALTER TABLE syncv3_to_device_messages DROP COLUMN inserted_ts`)
+	return err
+}
@@ -0,0 +1,67 @@
+package sqlite
+
+import (
+	"context"
+	"encoding/json"
+	"path/filepath"
+	"testing"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/matrix-org/sliding-sync/sqlutil"
+	"github.com/matrix-org/sliding-sync/state"
+)
+
+func TestToDeviceInsertedTSMigration(t *testing.T) {
+	ctx := context.Background()
+	db, err := sqlutil.Open("sqlite:" + filepath.Join(t.TempDir(), "syncv3_test.db"))
+	if err != nil {
+		t.Fatalf("failed to open SQL db: %s", err)
+	}
+	defer db.Close()
+
+	// Create the table in the old format, without inserted_ts
+	_, err = db.Exec(`CREATE TABLE syncv3_to_device_messages (
+		position INTEGER PRIMARY KEY,
+		user_id TEXT NOT NULL,
+		device_id TEXT NOT NULL,
+		event_type TEXT NOT NULL,
+		sender TEXT NOT NULL,
+		message TEXT NOT NULL,
+		unique_key TEXT,
+		action SMALLINT DEFAULT 0
+	);
+	INSERT INTO syncv3_to_device_messages(user_id, device_id, event_type, sender, message)
+	VALUES ('@alice:localhost', 'A', 'm.room_key', '@bob:localhost', '{}');`)
+	if err != nil {
+		t.Fatalf("failed to create old table: %s", err)
+	}
+	migrate := func() {
+		t.Helper()
+		err = sqlutil.WithTransaction(db, func(tx *sqlx.Tx) error {
+			return upToDeviceInsertedTS(ctx, tx.Tx)
+		})
+		if err != nil {
+			t.Fatalf("failed to migrate: %s", err)
+		}
+	}
+	migrate()
+	var insertedTS int64
+	if err = db.QueryRow(`SELECT inserted_ts FROM syncv3_to_device_messages`).Scan(&insertedTS); err != nil {
+		t.Fatalf("failed to select inserted_ts: %s", err)
+	}
+	if insertedTS == 0 {
+		t.Fatalf("existing message was not given an inserted_ts")
+	}
+	// the migration is a no-op for tables which already have the column
+	migrate()
+	table := state.NewToDeviceTable(db)
+	if _, err = table.InsertMessages("@alice:localhost", "A", []json.RawMessage{json.RawMessage(`{"type":"m.room_key"}`)}); err != nil {
+		t.Fatalf("InsertMessages after migrating: %s", err)
+	}
+
+	if err = sqlutil.WithTransaction(db, func(tx *sqlx.Tx) error {
+		return downToDeviceInsertedTS(ctx, tx.Tx)
+	}); err != nil {
+		t.Fatalf("failed to migrate down: %s", err)
+	}
+}
@@ -0,0 +1,22 @@
+package sqlite
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/pressly/goose/v3"
+)
+
+func init() {
+	goose.AddMigrationContext(upTokensExpiry, downTokensExpiry)
+}
+
+func upTokensExpiry(ctx context.Context, tx *sql.Tx) error {
+	_, err := addColumn(ctx, tx, "syncv3_sync2_tokens", "expires_ts", "BIGINT NOT NULL DEFAULT 0")
+	return err
+}
+
+func downTokensExpiry(ctx context.Context, tx *sql.Tx) error {
+	_, err := tx.ExecContext(ctx, `ALTER TABLE syncv3_sync2_tokens DROP COLUMN expires_ts`)
+	return err
+}
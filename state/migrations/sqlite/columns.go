@@ -0,0 +1,20 @@
+package sqlite
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+)
+
+// addColumn adds a column to a table, unless the table already has it. SQLite has no
+// ADD COLUMN IF NOT EXISTS, and databases created after a column was added to the Go table
+// constructors already have it. Returns true if the column was added.
+func addColumn(ctx context.Context, tx *sql.Tx, table, column, definition string) (added bool, err error) {
+	var exists bool
+	err = tx.QueryRowContext(ctx, `SELECT COUNT(*) > 0 FROM pragma_table_info($1) WHERE name = $2`, table, column).Scan(&exists)
+	if err != nil || exists {
+		return false, err
+	}
+	_, err = tx.ExecContext(ctx, fmt.Sprintf(`ALTER TABLE %s ADD COLUMN %s %s`, table, column, definition))
+	return err == nil, err
+}
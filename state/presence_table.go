@@ -0,0 +1,118 @@
+package state
+
+import (
+	"database/sql"
+	"encoding/json"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
+	"github.com/matrix-org/sliding-sync/internal"
+	"github.com/matrix-org/sliding-sync/sqlutil"
+)
+
+type presenceEvent struct {
+	Type    string          `json:"type"`
+	Sender  string          `json:"sender"`
+	Content presenceContent `json:"content"`
+}
+
+type presenceContent struct {
+	Presence        string `json:"presence"`
+	StatusMsg       string `json:"status_msg,omitempty"`
+	CurrentlyActive bool   `json:"currently_active,omitempty"`
+	LastActiveAgo   int64  `json:"last_active_ago,omitempty"`
+}
+
+// PresenceTable stores the latest known presence for each user. Presence is shared by all
+// pollers, so there is only ever one row per user.
+type PresenceTable struct {
+	db *sqlx.DB
+}
+
+func NewPresenceTable(db *sqlx.DB) *PresenceTable {
+	// make sure tables are made
+	db.MustExec(`
+	CREATE TABLE IF NOT EXISTS syncv3_presence (
+		user_id TEXT NOT NULL PRIMARY KEY,
+		presence TEXT NOT NULL,
+		status_msg TEXT NOT NULL DEFAULT '',
+		currently_active BOOLEAN NOT NULL DEFAULT FALSE,
+		last_active_ts BIGINT NOT NULL DEFAULT 0
+	);
+	`)
+	return &PresenceTable{db}
+}
+
+// Upsert the presence for a user. Returns true if the presence was changed. Only a change to
+// the presence state, status message or currently_active flag counts as a change: the
+// last_active_ts alone is not enough, as every poller sees a slightly different value for
+// the same update.
+func (t *PresenceTable) Upsert(p internal.Presence) (changed bool, err error) {
+	var userID string
+	err = t.db.QueryRow(`
+	INSERT INTO syncv3_presence(user_id, presence, status_msg, currently_active, last_active_ts)
+	VALUES($1, $2, $3, $4, $5)
+	ON CONFLICT (user_id) DO UPDATE SET
+		presence = EXCLUDED.presence, status_msg = EXCLUDED.status_msg,
+		currently_active = EXCLUDED.currently_active, last_active_ts = EXCLUDED.last_active_ts
+	WHERE syncv3_presence.presence != EXCLUDED.presence OR syncv3_presence.status_msg != EXCLUDED.status_msg
+		OR syncv3_presence.currently_active != EXCLUDED.currently_active
+	RETURNING user_id`,
+		p.UserID, p.Presence, p.StatusMsg, p.CurrentlyActive, p.LastActiveTS,
+	).Scan(&userID)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// SelectPresence returns the presence for the given users. Users without any stored presence
+// are omitted from the result.
+func (t *PresenceTable) SelectPresence(userIDs []string) (presences []internal.Presence, err error) {
+	err = t.db.Select(&presences, `SELECT user_id, presence, status_msg, currently_active, last_active_ts
+	FROM syncv3_presence WHERE `+sqlutil.DialectOf(t.db).Any("user_id", "$1"), pq.StringArray(userIDs))
+	return
+}
+
+// PackPresenceIntoEvent creates an m.presence event suitable for sending down client connections.
+// The last_active_ago is calculated relative to nowMs.
+func PackPresenceIntoEvent(p internal.Presence, nowMs int64) (json.RawMessage, error) {
+	ev := presenceEvent{
+		Type:   "m.presence",
+		Sender: p.UserID,
+		Content: presenceContent{
+			Presence:        p.Presence,
+			StatusMsg:       p.StatusMsg,
+			CurrentlyActive: p.CurrentlyActive,
+		},
+	}
+	if p.LastActiveTS > 0 && nowMs > p.LastActiveTS {
+		ev.Content.LastActiveAgo = nowMs - p.LastActiveTS
+	}
+	return json.Marshal(ev)
+}
+
+// UnpackPresenceFromEvent parses an m.presence event from a v2 sync response. The relative
+// last_active_ago is converted into an absolute timestamp using nowMs.
+func UnpackPresenceFromEvent(ev json.RawMessage, nowMs int64) (p internal.Presence, ok bool, err error) {
+	var pe presenceEvent
+	if err = json.Unmarshal(ev, &pe); err != nil {
+		return p, false, err
+	}
+	if pe.Type != "m.presence" || pe.Sender == "" || pe.Content.Presence == "" {
+		return p, false, nil
+	}
+	p = internal.Presence{
+		UserID:          pe.Sender,
+		Presence:        pe.Content.Presence,
+		StatusMsg:       pe.Content.StatusMsg,
+		CurrentlyActive: pe.Content.CurrentlyActive,
+	}
+	if pe.Content.LastActiveAgo > 0 {
+		p.LastActiveTS = nowMs - pe.Content.LastActiveAgo
+	}
+	return p, true, nil
+}
@@ -0,0 +1,87 @@
+package state
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/matrix-org/sliding-sync/internal"
+	"github.com/tidwall/gjson"
+)
+
+func TestPresenceTable(t *testing.T) {
+	db, close := connectToDB(t)
+	defer close()
+	table := NewPresenceTable(db)
+	alice := "@TestPresenceTable_alice:localhost"
+	bob := "@TestPresenceTable_bob:localhost"
+
+	online := internal.Presence{
+		UserID:          alice,
+		Presence:        "online",
+		CurrentlyActive: true,
+		LastActiveTS:    1000,
+	}
+	changed, err := table.Upsert(online)
+	assertNoError(t, err)
+	if !changed {
+		t.Fatalf("Upsert: new presence was not marked as changed")
+	}
+	// the same presence seen by another poller, with a slightly different last active time
+	dupe := online
+	dupe.LastActiveTS = 1005
+	changed, err = table.Upsert(dupe)
+	assertNoError(t, err)
+	if changed {
+		t.Fatalf("Upsert: duplicate presence was marked as changed")
+	}
+	away := internal.Presence{
+		UserID:       alice,
+		Presence:     "unavailable",
+		StatusMsg:    "lunch",
+		LastActiveTS: 2000,
+	}
+	changed, err = table.Upsert(away)
+	assertNoError(t, err)
+	if !changed {
+		t.Fatalf("Upsert: updated presence was not marked as changed")
+	}
+
+	got, err := table.SelectPresence([]string{alice, bob})
+	assertNoError(t, err)
+	want := []internal.Presence{away}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("SelectPresence: got %+v want %+v", got, want)
+	}
+}
+
+func TestPresencePackUnpack(t *testing.T) {
+	ev := []byte(`{"type":"m.presence","sender":"@alice:localhost","content":{"presence":"online","currently_active":true,"last_active_ago":300}}`)
+	p, ok, err := UnpackPresenceFromEvent(ev, 10000)
+	assertNoError(t, err)
+	if !ok {
+		t.Fatalf("UnpackPresenceFromEvent: failed to unpack valid presence event")
+	}
+	want := internal.Presence{
+		UserID:          "@alice:localhost",
+		Presence:        "online",
+		CurrentlyActive: true,
+		LastActiveTS:    9700,
+	}
+	if !reflect.DeepEqual(p, want) {
+		t.Fatalf("UnpackPresenceFromEvent: got %+v want %+v", p, want)
+	}
+	packed, err := PackPresenceIntoEvent(p, 10500)
+	assertNoError(t, err)
+	if got := gjson.GetBytes(packed, "content.last_active_ago").Int(); got != 800 {
+		t.Errorf("PackPresenceIntoEvent: got last_active_ago %d want 800", got)
+	}
+	if got := gjson.GetBytes(packed, "sender").Str; got != want.UserID {
+		t.Errorf("PackPresenceIntoEvent: got sender %s want %s", got, want.UserID)
+	}
+
+	_, ok, err = UnpackPresenceFromEvent([]byte(`{"type":"m.typing","content":{}}`), 10000)
+	assertNoError(t, err)
+	if ok {
+		t.Errorf("UnpackPresenceFromEvent: unpacked a non-presence event")
+	}
+}
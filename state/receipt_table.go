@@ -94,21 +94,22 @@ func (t *ReceiptTable) Insert(roomID string, ephEvent json.RawMessage) (receipts
 // e.g to pull out profile information for users read receipts. Call PackReceiptsIntoEDU when sending to clients.
 func (t *ReceiptTable) SelectReceiptsForEvents(roomID string, eventIDs []string) (receipts []internal.Receipt, err error) {
 	err = t.db.Select(&receipts, `SELECT room_id, event_id, user_id, ts, thread_id FROM syncv3_receipts
-		WHERE room_id=$1 AND event_id = ANY($2)`, roomID, pq.StringArray(eventIDs))
+		WHERE room_id=$1 AND `+sqlutil.DialectOf(t.db).Any("event_id", "$2"), roomID, pq.StringArray(eventIDs))
 	return
 }
 
 // Select all (including private) receipts for this user in these rooms.
 func (t *ReceiptTable) SelectReceiptsForUser(roomIDs []string, userID string) (receiptsByRoom map[string][]internal.Receipt, err error) {
+	d := sqlutil.DialectOf(t.db)
 	var receipts []internal.Receipt
 	err = t.db.Select(&receipts, `SELECT room_id, event_id, user_id, ts, thread_id FROM syncv3_receipts
-	WHERE room_id=ANY($1) AND user_id = $2`, pq.StringArray(roomIDs), userID)
+	WHERE `+d.Any("room_id", "$1")+` AND user_id = $2`, pq.StringArray(roomIDs), userID)
 	if err != nil {
 		return nil, err
 	}
 	var privReceipts []internal.Receipt
 	err = t.db.Select(&privReceipts, `SELECT room_id, event_id, user_id, ts, thread_id FROM syncv3_receipts_private
-	WHERE room_id=ANY($1) AND user_id = $2`, pq.StringArray(roomIDs), userID)
+	WHERE `+d.Any("room_id", "$1")+` AND user_id = $2`, pq.StringArray(roomIDs), userID)
 	if err != nil {
 		return nil, err
 	}
@@ -129,7 +130,7 @@ func (t *ReceiptTable) bulkInsert(tableName string, txn *sqlx.Tx, receipts []int
 	if len(receipts) == 0 {
 		return
 	}
-	chunks := sqlutil.Chunkify(5, MaxPostgresParameters, ReceiptChunker(receipts))
+	chunks := sqlutil.Chunkify(5, maxParameters(txn), ReceiptChunker(receipts))
 	var eventID string
 	var roomID string
 	var threadID string
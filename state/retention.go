@@ -0,0 +1,157 @@
+package state
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/matrix-org/sliding-sync/sqlutil"
+	"github.com/rs/zerolog/log"
+)
+
+// Event retention. Left alone, syncv3_events grows forever, even for rooms nobody syncs any more.
+// A RetentionPolicy picks a point in each room's timeline; older events are purged, except for:
+//   - events referenced by a state snapshot, so the current state (and recent historical state)
+//     can still be calculated,
+//   - the latest event of each type, which LatestEventsByType room metadata is built from.
+//
+// The purge point is always moved back to an event carrying a prev_batch token, which is kept
+// and marked as following a gap. Clients paginating back past it are handed over to the
+// homeserver using that token, so they don't miss any of the purged events.
+
+// RetentionPolicy controls which timeline events are purged by Storage.Purge. Events are purged
+// if any of the rules match them. The zero value purges nothing.
+type RetentionPolicy struct {
+	// Purge events older than this.
+	MaxAge time.Duration
+	// Purge all but this many of the most recent timeline events in each room.
+	MaxEventsPerRoom int
+	// Purge the timeline of rooms which none of ProxyUsers are joined to.
+	PurgeUnjoinedRooms bool
+	// ProxyUsers returns the users who sync via the proxy. Required for PurgeUnjoinedRooms.
+	ProxyUsers func() ([]string, error)
+}
+
+func (p RetentionPolicy) Enabled() bool {
+	return p.MaxAge > 0 || p.MaxEventsPerRoom > 0 || (p.PurgeUnjoinedRooms && p.ProxyUsers != nil)
+}
+
+// PurgeResult reports what Storage.Purge reclaimed.
+type PurgeResult struct {
+	Rooms  int
+	Events int64
+	// the size of the purged events' JSON
+	Bytes int64
+}
+
+// Purge deletes old timeline events according to the policy.
+func (s *Storage) Purge(policy RetentionPolicy) (result PurgeResult, err error) {
+	purgeBefore, err := s.purgePoints(policy)
+	if err != nil {
+		return result, err
+	}
+	// purge each room in its own transaction, so we don't hold locks on the events table for too long
+	for roomID, upperInclusive := range purgeBefore {
+		numEvents, numBytes, err := s.purgeRoom(roomID, upperInclusive)
+		if err != nil {
+			return result, fmt.Errorf("failed to purge room %s: %w", roomID, err)
+		}
+		if numEvents > 0 {
+			result.Rooms++
+			result.Events += numEvents
+			result.Bytes += numBytes
+		}
+	}
+	return result, nil
+}
+
+// purgeRoom purges events in this room before the latest prev_batch anchor at or before upperInclusive.
+func (s *Storage) purgeRoom(roomID string, upperInclusive int64) (numEvents, numBytes int64, err error) {
+	err = sqlutil.WithTransaction(s.DB, func(txn *sqlx.Tx) error {
+		anchorNID, err := s.EventsTable.SelectLatestPrevBatchNID(txn, roomID, upperInclusive)
+		if err != nil || anchorNID == 0 {
+			return err
+		}
+		keepNIDs, err := s.Accumulator.snapshotTable.SelectEventNIDsInRoom(txn, roomID)
+		if err != nil {
+			return fmt.Errorf("failed to select snapshot NIDs: %w", err)
+		}
+		latestByType, err := s.EventsTable.SelectLatestNIDForEachType(txn, roomID)
+		if err != nil {
+			return fmt.Errorf("failed to select latest events by type: %w", err)
+		}
+		keepNIDs = append(keepNIDs, latestByType...)
+		numEvents, numBytes, err = s.EventsTable.DeleteBefore(txn, roomID, anchorNID, keepNIDs)
+		if err != nil || numEvents == 0 {
+			return err
+		}
+		return s.EventsTable.SetMissingPrevious(txn, anchorNID)
+	})
+	return
+}
+
+// purgePoints returns the NID for each room at or before which events may be purged.
+func (s *Storage) purgePoints(policy RetentionPolicy) (map[string]int64, error) {
+	purgeBefore := make(map[string]int64)
+	merge := func(roomToNID map[string]int64) {
+		for roomID, nid := range roomToNID {
+			if nid > purgeBefore[roomID] {
+				purgeBefore[roomID] = nid
+			}
+		}
+	}
+	var proxyUsers []string
+	if policy.PurgeUnjoinedRooms && policy.ProxyUsers != nil {
+		var err error
+		proxyUsers, err = policy.ProxyUsers()
+		if err != nil {
+			return nil, fmt.Errorf("failed to load proxy users: %w", err)
+		}
+	}
+	err := sqlutil.WithTransaction(s.DB, func(txn *sqlx.Tx) error {
+		if policy.MaxAge > 0 {
+			roomToNID, err := s.EventsTable.SelectLatestPrevBatchNIDsBefore(txn, time.Now().Add(-policy.MaxAge).UnixMilli())
+			if err != nil {
+				return fmt.Errorf("failed to select events by age: %w", err)
+			}
+			merge(roomToNID)
+		}
+		if policy.MaxEventsPerRoom > 0 {
+			roomToNID, err := s.EventsTable.SelectNthLatestTimelineNIDs(txn, policy.MaxEventsPerRoom)
+			if err != nil {
+				return fmt.Errorf("failed to select events by count: %w", err)
+			}
+			merge(roomToNID)
+		}
+		if policy.PurgeUnjoinedRooms && policy.ProxyUsers != nil {
+			roomToNID, err := s.Accumulator.roomsTable.AllLatestNIDs(txn)
+			if err != nil {
+				return fmt.Errorf("failed to select rooms: %w", err)
+			}
+			joinedRoomIDs, err := s.EventsTable.SelectRoomsWithJoinedUsers(txn, proxyUsers)
+			if err != nil {
+				return fmt.Errorf("failed to select joined rooms: %w", err)
+			}
+			for _, roomID := range joinedRoomIDs {
+				delete(roomToNID, roomID)
+			}
+			merge(roomToNID)
+		}
+		return nil
+	})
+	return purgeBefore, err
+}
+
+func (s *Storage) purgeOldEvents() {
+	if !s.Retention.Enabled() {
+		return
+	}
+	start := time.Now()
+	result, err := s.Purge(s.Retention)
+	logger := log.Info()
+	if err != nil {
+		logger = log.Warn().Err(err)
+	}
+	logger.Int("rooms", result.Rooms).Int64("events", result.Events).Int64("bytes", result.Bytes).
+		Dur("duration", time.Since(start)).Msg("Purged old events")
+}
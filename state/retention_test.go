@@ -0,0 +1,171 @@
+package state
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/matrix-org/sliding-sync/sqlutil"
+	"github.com/matrix-org/sliding-sync/sync2"
+	"github.com/matrix-org/sliding-sync/testutils"
+	"github.com/tidwall/gjson"
+)
+
+func TestStoragePurge(t *testing.T) {
+	store := NewStorage(postgresConnectionString)
+	defer store.Teardown()
+	aliceRoom := "!TestStoragePurge_alice:localhost"
+	bobRoom := "!TestStoragePurge_bob:localhost"
+	alice := "@alice_TestStoragePurge:localhost"
+	bob := "@bob_TestStoragePurge:localhost"
+
+	message := func(body string, ts time.Time) json.RawMessage {
+		return testutils.NewEvent(t, "m.room.message", alice, map[string]interface{}{"body": body}, testutils.WithTimestamp(ts))
+	}
+	accumulate := func(roomID string, prevBatch string, events ...json.RawMessage) {
+		t.Helper()
+		_, err := store.Accumulate(alice, roomID, sync2.TimelineResponse{Events: events, PrevBatch: prevBatch})
+		if err != nil {
+			t.Fatalf("failed to accumulate: %s", err)
+		}
+	}
+	for roomID, creator := range map[string]string{aliceRoom: alice, bobRoom: bob} {
+		_, err := store.Initialise(roomID, []json.RawMessage{
+			testutils.NewStateEvent(t, "m.room.create", "", creator, map[string]interface{}{"creator": creator}),
+			testutils.NewJoinEvent(t, creator),
+		})
+		if err != nil {
+			t.Fatalf("failed to initialise: %s", err)
+		}
+	}
+	now := time.Now()
+	topic := testutils.NewStateEvent(t, "m.room.topic", "", alice, map[string]interface{}{"topic": "old"}, testutils.WithTimestamp(now.Add(-10*24*time.Hour)))
+	custom := testutils.NewEvent(t, "com.example.custom", alice, map[string]interface{}{}, testutils.WithTimestamp(now.Add(-10*24*time.Hour)))
+	msg1 := message("1", now.Add(-10*24*time.Hour))
+	msg3 := message("3", now.Add(-5*24*time.Hour))
+	msg4 := message("4", now.Add(-5*24*time.Hour))
+	accumulate(aliceRoom, "batch A", topic, custom, msg1, message("2", now.Add(-10*24*time.Hour)))
+	accumulate(aliceRoom, "batch B", msg3, msg4)
+	accumulate(aliceRoom, "batch C", message("5", now), message("6", now))
+	msgA := message("a", now)
+	msgC := message("c", now)
+	accumulate(bobRoom, "batch X", msgA, message("b", now))
+	accumulate(bobRoom, "batch Y", msgC)
+
+	nids := make(map[string]int64)
+	err := sqlutil.WithTransaction(store.DB, func(txn *sqlx.Tx) (err error) {
+		nids, err = store.EventsTable.SelectNIDsByIDs(txn, []string{
+			eventID(topic), eventID(msg1), eventID(msg3), eventID(msg4), eventID(msgA), eventID(msgC),
+		})
+		return err
+	})
+	if err != nil {
+		t.Fatalf("SelectNIDsByIDs: %s", err)
+	}
+
+	t.Log("Each rule picks the point in each room's timeline to purge before.")
+	testCases := []struct {
+		name   string
+		policy RetentionPolicy
+		want   map[string]int64
+	}{
+		{
+			name:   "by age, back to the latest prev_batch which is old enough",
+			policy: RetentionPolicy{MaxAge: 3 * 24 * time.Hour},
+			want:   map[string]int64{aliceRoom: nids[eventID(msg3)]},
+		},
+		{
+			name:   "by count",
+			policy: RetentionPolicy{MaxEventsPerRoom: 3},
+			want:   map[string]int64{aliceRoom: nids[eventID(msg4)], bobRoom: nids[eventID(msgA)]},
+		},
+		{
+			name: "unjoined rooms",
+			policy: RetentionPolicy{PurgeUnjoinedRooms: true, ProxyUsers: func() ([]string, error) {
+				return []string{alice}, nil
+			}},
+			want: map[string]int64{bobRoom: nids[eventID(msgC)]},
+		},
+	}
+	for _, tc := range testCases {
+		points, err := store.purgePoints(tc.policy)
+		if err != nil {
+			t.Fatalf("%s: purgePoints: %s", tc.name, err)
+		}
+		got := map[string]int64{}
+		for _, roomID := range []string{aliceRoom, bobRoom} {
+			if nid, ok := points[roomID]; ok {
+				got[roomID] = nid
+			}
+		}
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%s: got purge points %v want %v", tc.name, got, tc.want)
+		}
+	}
+
+	t.Log("Purge Alice's room before message 4, which is moved back to the prev_batch on message 3.")
+	numEvents, numBytes, err := store.purgeRoom(aliceRoom, nids[eventID(msg4)])
+	if err != nil {
+		t.Fatalf("purgeRoom: %s", err)
+	}
+	if numEvents != 2 || numBytes == 0 {
+		t.Fatalf("purgeRoom: got %d events (%d bytes) want 2 events", numEvents, numBytes)
+	}
+	err = sqlutil.WithTransaction(store.DB, func(txn *sqlx.Tx) error {
+		events, err := store.EventsTable.SelectByIDs(txn, false, []string{eventID(topic), eventID(custom), eventID(msg1)})
+		if err != nil {
+			return err
+		}
+		var gotIDs []string
+		for _, ev := range events {
+			gotIDs = append(gotIDs, ev.ID)
+		}
+		// the topic is in the current state, and the custom event is the latest of its type
+		if !reflect.DeepEqual(gotIDs, []string{eventID(topic), eventID(custom)}) {
+			t.Errorf("got remaining events %v want topic and custom events", gotIDs)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("SelectByIDs: %s", err)
+	}
+
+	t.Log("Backfill stops at message 3, and hands over to the homeserver with its prev_batch.")
+	latest, err := store.LatestEventNID()
+	if err != nil {
+		t.Fatalf("LatestEventNID: %s", err)
+	}
+	page, err := store.Backfill(alice, aliceRoom, latest+1, 10)
+	if err != nil {
+		t.Fatalf("Backfill: %s", err)
+	}
+	var bodies []string
+	for _, ev := range page.Events {
+		bodies = append(bodies, gjson.GetBytes(ev, "content.body").Str)
+	}
+	if !reflect.DeepEqual(bodies, []string{"6", "5", "4", "3"}) || page.Complete || page.PrevBatch != "batch B" {
+		t.Fatalf("Backfill: got %v complete=%v prev_batch=%q want [6 5 4 3] complete=false prev_batch=batch B", bodies, page.Complete, page.PrevBatch)
+	}
+
+	t.Log("Purge Bob's room, which keeps the latest message.")
+	numEvents, _, err = store.purgeRoom(bobRoom, nids[eventID(msgC)])
+	if err != nil {
+		t.Fatalf("purgeRoom: %s", err)
+	}
+	if numEvents != 2 {
+		t.Fatalf("purgeRoom: got %d events want 2", numEvents)
+	}
+	numEvents, _, err = store.purgeRoom(bobRoom, nids[eventID(msgC)])
+	if err != nil {
+		t.Fatalf("purgeRoom: %s", err)
+	}
+	if numEvents != 0 {
+		t.Fatalf("purgeRoom: purging again deleted %d events, want 0", numEvents)
+	}
+}
+
+func eventID(ev json.RawMessage) string {
+	return gjson.GetBytes(ev, "event_id").Str
+}
@@ -6,6 +6,7 @@ import (
 
 	"github.com/jmoiron/sqlx"
 	"github.com/lib/pq"
+	"github.com/matrix-org/sliding-sync/sqlutil"
 )
 
 type RoomInfo struct {
@@ -92,7 +93,26 @@ func (t *RoomsTable) Upsert(txn *sqlx.Tx, info RoomInfo, snapshotID, latestNID i
 
 func (t *RoomsTable) LatestNIDs(txn *sqlx.Tx, roomIDs []string) (nids map[string]int64, err error) {
 	nids = make(map[string]int64, len(roomIDs))
-	rows, err := txn.Query(`SELECT room_id, latest_nid FROM syncv3_rooms WHERE room_id = ANY($1)`, pq.StringArray(roomIDs))
+	rows, err := txn.Query(`SELECT room_id, latest_nid FROM syncv3_rooms WHERE `+sqlutil.DialectOf(txn).Any("room_id", "$1"), pq.StringArray(roomIDs))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var roomID string
+	var latestNID int64
+	for rows.Next() {
+		if err = rows.Scan(&roomID, &latestNID); err != nil {
+			return nil, err
+		}
+		nids[roomID] = latestNID
+	}
+	return
+}
+
+// AllLatestNIDs returns the latest event NID for every room.
+func (t *RoomsTable) AllLatestNIDs(txn *sqlx.Tx) (nids map[string]int64, err error) {
+	nids = make(map[string]int64)
+	rows, err := txn.Query(`SELECT room_id, latest_nid FROM syncv3_rooms`)
 	if err != nil {
 		return nil, err
 	}
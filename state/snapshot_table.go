@@ -5,6 +5,7 @@ import (
 
 	"github.com/jmoiron/sqlx"
 	"github.com/lib/pq"
+	"github.com/matrix-org/sliding-sync/sqlutil"
 )
 
 type SnapshotRow struct {
@@ -21,14 +22,15 @@ type SnapshotTable struct {
 }
 
 func NewSnapshotsTable(db *sqlx.DB) *SnapshotTable {
+	d := sqlutil.DialectOf(db)
 	// make sure tables are made
 	db.MustExec(`
-	CREATE SEQUENCE IF NOT EXISTS syncv3_snapshots_seq;
+	` + d.CreateSequence("syncv3_snapshots_seq") + `
 	CREATE TABLE IF NOT EXISTS syncv3_snapshots (
-		snapshot_id BIGINT PRIMARY KEY DEFAULT nextval('syncv3_snapshots_seq'),
+		snapshot_id ` + d.SequenceKey("syncv3_snapshots_seq") + `,
 		room_id TEXT NOT NULL,
-		events BIGINT[] NOT NULL,
-		membership_events BIGINT[] NOT NULL,
+		events ` + d.Array("BIGINT") + ` NOT NULL,
+		membership_events ` + d.Array("BIGINT") + ` NOT NULL,
 		UNIQUE(snapshot_id, room_id)
 	);
 	`)
@@ -56,6 +58,21 @@ func (t *SnapshotTable) CurrentSnapshots(txn *sqlx.Tx) (map[string][]int64, erro
 	return result, nil
 }
 
+// SelectEventNIDsInRoom returns every event NID referenced by any snapshot of this room.
+func (s *SnapshotTable) SelectEventNIDsInRoom(txn *sqlx.Tx, roomID string) ([]int64, error) {
+	var rows []SnapshotRow
+	err := txn.Select(&rows, `SELECT events, membership_events FROM syncv3_snapshots WHERE room_id = $1`, roomID)
+	if err != nil {
+		return nil, err
+	}
+	var nids []int64
+	for _, row := range rows {
+		nids = append(nids, row.OtherEvents...)
+		nids = append(nids, row.MembershipEvents...)
+	}
+	return nids, nil
+}
+
 // Select a row based on its snapshot ID.
 func (s *SnapshotTable) Select(txn *sqlx.Tx, snapshotID int64) (row SnapshotRow, err error) {
 	if snapshotID == 0 {
@@ -85,7 +102,7 @@ func (s *SnapshotTable) Insert(txn *sqlx.Tx, row *SnapshotRow) error {
 
 // Delete the snapshot IDs given
 func (s *SnapshotTable) Delete(txn *sqlx.Tx, snapshotIDs []int64) error {
-	query, args, err := sqlx.In(`DELETE FROM syncv3_snapshots WHERE snapshot_id = ANY(?)`, pq.Int64Array(snapshotIDs))
+	query, args, err := sqlx.In(`DELETE FROM syncv3_snapshots WHERE `+sqlutil.DialectOf(txn).Any("snapshot_id", "?"), pq.Int64Array(snapshotIDs))
 	if err != nil {
 		return err
 	}
@@ -34,11 +34,16 @@ func NewSpaceRelationFromEvent(ev Event) (sr *SpaceRelation, isDeleted bool) {
 	}
 	switch ev.Type {
 	case "m.space.child":
+		// the spec calls this "order", but older events may use "ordering"
+		ordering := event.Get("content.order")
+		if !ordering.Exists() {
+			ordering = event.Get("content.ordering")
+		}
 		return &SpaceRelation{
 			Parent:      ev.RoomID,
 			Child:       ev.StateKey,
 			Relation:    RelationMSpaceChild,
-			Ordering:    event.Get("content.ordering").Str,
+			Ordering:    ordering.Str,
 			IsSuggested: event.Get("content.suggested").Bool(),
 		}, !event.Get("content.via").IsArray()
 	case "m.space.parent":
@@ -76,7 +81,7 @@ func (t *SpacesTable) BulkInsert(txn *sqlx.Tx, relations []SpaceRelation) error
 	if len(relations) == 0 {
 		return nil
 	}
-	chunks := sqlutil.Chunkify(5, MaxPostgresParameters, SpaceRelationChunker(relations))
+	chunks := sqlutil.Chunkify(5, maxParameters(txn), SpaceRelationChunker(relations))
 	for _, chunk := range chunks {
 		_, err := txn.NamedExec(`
 		INSERT INTO syncv3_spaces (parent, child, relation, ordering, suggested)
@@ -108,7 +113,7 @@ func (t *SpacesTable) BulkDelete(txn *sqlx.Tx, relations []SpaceRelation) error
 func (t *SpacesTable) SelectChildren(txn *sqlx.Tx, spaces []string) (map[string][]SpaceRelation, error) {
 	result := make(map[string][]SpaceRelation)
 	var data []SpaceRelation
-	err := txn.Select(&data, `SELECT parent, child, relation, ordering, suggested FROM syncv3_spaces WHERE parent = ANY($1)`, pq.StringArray(spaces))
+	err := txn.Select(&data, `SELECT parent, child, relation, ordering, suggested FROM syncv3_spaces WHERE `+sqlutil.DialectOf(txn).Any("parent", "$1"), pq.StringArray(spaces))
 	if err != nil {
 		return nil, err
 	}
@@ -119,6 +124,16 @@ func (t *SpacesTable) SelectChildren(txn *sqlx.Tx, spaces []string) (map[string]
 	return result, nil
 }
 
+// SelectGraph returns the m.space.child events in these spaces, and the m.space.parent events
+// in these spaces, so the relations are only those which these spaces claim for themselves.
+func (t *SpacesTable) SelectGraph(txn *sqlx.Tx, spaces []string) (relations []SpaceRelation, err error) {
+	d := sqlutil.DialectOf(txn)
+	err = txn.Select(&relations, `SELECT parent, child, relation, ordering, suggested FROM syncv3_spaces
+	WHERE (relation = $1 AND `+d.Any("parent", "$2")+`) OR (relation = $3 AND `+d.Any("child", "$2")+`)`,
+		RelationMSpaceChild, pq.StringArray(spaces), RelationMSpaceParent)
+	return
+}
+
 func (t *SpacesTable) HandleSpaceUpdates(txn *sqlx.Tx, events []Event) error {
 	// pull out relations, and bucket them so the last event wins to ensure we always use the latest
 	// values in case someone repeatedly adds/removes the same space
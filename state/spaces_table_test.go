@@ -103,6 +103,39 @@ func TestSpacesTable(t *testing.T) {
 	}
 }
 
+func TestSpacesTableSelectGraph(t *testing.T) {
+	db, close := connectToDB(t)
+	defer close()
+	txn, err := db.Beginx()
+	if err != nil {
+		t.Fatalf("failed to start txn: %s", err)
+	}
+	defer txn.Rollback()
+	table := NewSpacesTable(db)
+
+	space := "!TestSpacesTableSelectGraph_space"
+	subspace := "!TestSpacesTableSelectGraph_subspace"
+	otherSpace := "!TestSpacesTableSelectGraph_other"
+	room := "!TestSpacesTableSelectGraph_room"
+	spaceHasSubspace := SpaceRelation{Parent: space, Child: subspace, Relation: RelationMSpaceChild, Ordering: "a"}
+	subspaceHasRoom := SpaceRelation{Parent: subspace, Child: room, Relation: RelationMSpaceChild}
+	subspaceClaimsSpace := SpaceRelation{Parent: space, Child: subspace, Relation: RelationMSpaceParent}
+	// claimed by the room, not by the space, so it isn't part of the space's graph
+	roomClaimsSpace := SpaceRelation{Parent: space, Child: room, Relation: RelationMSpaceParent}
+	otherHasSpace := SpaceRelation{Parent: otherSpace, Child: space, Relation: RelationMSpaceChild}
+	noError(t, table.BulkInsert(txn, []SpaceRelation{
+		spaceHasSubspace, subspaceHasRoom, subspaceClaimsSpace, roomClaimsSpace, otherHasSpace,
+	}))
+
+	got, err := table.SelectGraph(txn, []string{space, subspace})
+	noError(t, err)
+	matchAnyOrder(t, got, []SpaceRelation{spaceHasSubspace, subspaceHasRoom, subspaceClaimsSpace})
+
+	got, err = table.SelectGraph(txn, []string{space})
+	noError(t, err)
+	matchAnyOrder(t, got, []SpaceRelation{spaceHasSubspace})
+}
+
 func TestNewSpaceRelationFromEvent(t *testing.T) {
 	testCases := []struct {
 		event        Event
@@ -141,6 +174,22 @@ func TestNewSpaceRelationFromEvent(t *testing.T) {
 				IsSuggested: true,
 			},
 		},
+		// child: with the order key from the spec
+		{
+			event: Event{
+				Type:     "m.space.child",
+				StateKey: "!child",
+				RoomID:   "!parent",
+				JSON:     json.RawMessage(`{"type":"m.space.child","state_key":"!child","room_id":"!parent","content":{"via":["example.com"],"order":"def"}}`),
+			},
+			wantDeleted: false,
+			wantRelation: &SpaceRelation{
+				Parent:   "!parent",
+				Child:    "!child",
+				Relation: RelationMSpaceChild,
+				Ordering: "def",
+			},
+		},
 		// child: redacted
 		{
 			event: Event{
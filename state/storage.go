@@ -24,12 +24,27 @@ import (
 // Max number of parameters in a single SQL command
 const MaxPostgresParameters = 65535
 
+// Max number of parameters in a single SQLite command. SQLite allows up to 32766, but the driver
+// binds parameters in quadratic time, so bulk inserts are faster as more, smaller statements.
+const MaxSQLiteParameters = 999
+
+func maxParameters(txn *sqlx.Tx) int {
+	if sqlutil.IsSQLite(txn) {
+		return MaxSQLiteParameters
+	}
+	return MaxPostgresParameters
+}
+
 // StartupSnapshot represents a snapshot of startup data for the sliding sync HTTP API instances
 type StartupSnapshot struct {
 	GlobalMetadata   map[string]internal.RoomMetadata // room_id -> metadata
 	AllJoinedMembers map[string][]string              // room_id -> [user_id]
 }
 
+// When a timeline filter is applied, the most events we will look at per room is this many times
+// the timeline limit. This stops rarely matching filters from scanning entire rooms.
+const maxTimelineFilterScanFactor = 10
+
 type LatestEvents struct {
 	Timeline  []json.RawMessage
 	PrevBatch string
@@ -59,17 +74,22 @@ type Storage struct {
 	UnreadTable       *UnreadTable
 	AccountDataTable  *AccountDataTable
 	InvitesTable      *InvitesTable
+	KnocksTable       *KnocksTable
 	TransactionsTable *TransactionsTable
 	DeviceDataTable   *DeviceDataTable
 	ReceiptTable      *ReceiptTable
+	PresenceTable     *PresenceTable
+	ConnStateTable    *ConnStateTable
 	DB                *sqlx.DB
 	MaxTimelineLimit  int
-	shutdownCh        chan struct{}
-	shutdown          bool
+	// Retention controls which old events are purged by the Cleaner
+	Retention  RetentionPolicy
+	shutdownCh chan struct{}
+	shutdown   bool
 }
 
 func NewStorage(postgresURI string) *Storage {
-	db, err := sqlx.Open("postgres", postgresURI)
+	db, err := sqlutil.Open(postgresURI)
 	if err != nil {
 		sentry.CaptureException(err)
 		// TODO: if we panic(), will sentry have a chance to flush the event?
@@ -86,19 +106,28 @@ func NewStorageWithDB(db *sqlx.DB, addPrometheusMetrics bool) *Storage {
 		snapshotTable: NewSnapshotsTable(db),
 		spacesTable:   NewSpacesTable(db),
 		invitesTable:  NewInvitesTable(db),
+		knocksTable:   NewKnocksTable(db),
 		entityName:    "server",
 	}
 
+	toDeviceTable := NewToDeviceTable(db)
+	if addPrometheusMetrics {
+		toDeviceTable.addPrometheusMetrics()
+	}
+
 	return &Storage{
 		Accumulator:       acc,
-		ToDeviceTable:     NewToDeviceTable(db),
+		ToDeviceTable:     toDeviceTable,
 		UnreadTable:       NewUnreadTable(db),
 		EventsTable:       acc.eventsTable,
 		AccountDataTable:  NewAccountDataTable(db),
 		InvitesTable:      acc.invitesTable,
+		KnocksTable:       acc.knocksTable,
 		TransactionsTable: NewTransactionsTable(db),
 		DeviceDataTable:   NewDeviceDataTable(db),
 		ReceiptTable:      NewReceiptTable(db),
+		PresenceTable:     NewPresenceTable(db),
+		ConnStateTable:    NewConnStateTable(db),
 		DB:                db,
 		MaxTimelineLimit:  50,
 		shutdownCh:        make(chan struct{}),
@@ -125,11 +154,12 @@ func (s *Storage) RoomAccountDatasWithType(userID, eventType string) (data []Acc
 	return
 }
 
-// Pull out all account data for this user. If roomIDs is empty, global account data is returned.
-// If roomIDs is non-empty, all account data for these rooms are extracted.
-func (s *Storage) AccountDatas(userID string, roomIDs ...string) (datas []AccountData, err error) {
+// Pull out all account data for this user which passes the filter, which may be nil. If roomIDs is
+// empty, global account data is returned. If roomIDs is non-empty, all account data for these rooms
+// are extracted.
+func (s *Storage) AccountDatas(userID string, filter *internal.TypeFilter, roomIDs ...string) (datas []AccountData, err error) {
 	err = sqlutil.WithTransaction(s.Accumulator.db, func(txn *sqlx.Tx) error {
-		datas, err = s.AccountDataTable.SelectMany(txn, userID, roomIDs...)
+		datas, err = s.AccountDataTable.SelectMany(txn, userID, filter, roomIDs...)
 		return err
 	})
 	return
@@ -161,6 +191,16 @@ func (s *Storage) PrepareSnapshot(txn *sqlx.Tx) (tableName string, err error) {
 	// each event NID is queried using a btree index, rather than doing a seq scan as this query will pull
 	// out ~50% of the rows in syncv3_events.
 	tempTableName := "temp_snapshot"
+	if sqlutil.IsSQLite(txn) {
+		// SQLite keeps temporary tables until the connection closes, so replace any previous one.
+		_, err = txn.Exec(
+			`DROP TABLE IF EXISTS temp.` + tempTableName + `;
+			CREATE TEMP TABLE ` + tempTableName + ` AS SELECT value AS membership_nid FROM syncv3_snapshots
+			JOIN syncv3_rooms ON syncv3_snapshots.snapshot_id = syncv3_rooms.current_snapshot_id,
+			json_each(pg_array_json(membership_events))`,
+		)
+		return tempTableName, err
+	}
 	_, err = txn.Exec(
 		`SELECT UNNEST(membership_events) AS membership_nid INTO TEMP ` + tempTableName + ` FROM syncv3_snapshots
 		JOIN syncv3_rooms ON syncv3_snapshots.snapshot_id = syncv3_rooms.current_snapshot_id`,
@@ -236,9 +276,10 @@ func (s *Storage) MetadataForAllRooms(txn *sqlx.Tx, tempTableName string, result
 		result[ev.RoomID] = metadata
 	}
 
-	// Select the name / canonical alias for all rooms
+	// Select the name / canonical alias / summary fields for all rooms
 	roomIDToStateEvents, err := s.currentNotMembershipStateEventsInAllRooms(txn, []string{
 		"m.room.name", "m.room.canonical_alias", "m.room.avatar",
+		"m.room.topic", "m.room.join_rules", "m.room.history_visibility", "m.room.guest_access",
 	})
 	if err != nil {
 		return fmt.Errorf("failed to load state events for all rooms: %s", err)
@@ -246,12 +287,24 @@ func (s *Storage) MetadataForAllRooms(txn *sqlx.Tx, tempTableName string, result
 	for roomID, stateEvents := range roomIDToStateEvents {
 		metadata := loadMetadata(roomID)
 		for _, ev := range stateEvents {
-			if ev.Type == "m.room.name" && ev.StateKey == "" {
+			if ev.StateKey != "" {
+				continue
+			}
+			switch ev.Type {
+			case "m.room.name":
 				metadata.NameEvent = gjson.ParseBytes(ev.JSON).Get("content.name").Str
-			} else if ev.Type == "m.room.canonical_alias" && ev.StateKey == "" {
+			case "m.room.canonical_alias":
 				metadata.CanonicalAlias = gjson.ParseBytes(ev.JSON).Get("content.alias").Str
-			} else if ev.Type == "m.room.avatar" && ev.StateKey == "" {
+			case "m.room.avatar":
 				metadata.AvatarEvent = gjson.ParseBytes(ev.JSON).Get("content.url").Str
+			case "m.room.topic":
+				metadata.Topic = gjson.ParseBytes(ev.JSON).Get("content.topic").Str
+			case "m.room.join_rules":
+				metadata.JoinRule = gjson.ParseBytes(ev.JSON).Get("content.join_rule").Str
+			case "m.room.history_visibility":
+				metadata.HistoryVisibility = gjson.ParseBytes(ev.JSON).Get("content.history_visibility").Str
+			case "m.room.guest_access":
+				metadata.GuestAccess = gjson.ParseBytes(ev.JSON).Get("content.guest_access").Str
 			}
 		}
 		result[roomID] = metadata
@@ -314,9 +367,12 @@ func (s *Storage) ResetMetadataState(metadata *internal.RoomMetadata) error {
     )
 	SELECT event_id, event_type, state_key, event, membership
 	FROM syncv3_events JOIN snapshot ON (
-		event_nid = ANY (ARRAY_CAT(events, membership_events))
+		`+sqlutil.DialectOf(s.DB).Any("event_nid", "ARRAY_CAT(events, membership_events)")+`
 	)
-	WHERE (event_type IN ('m.room.name', 'm.room.avatar', 'm.room.canonical_alias', 'm.room.encryption') AND state_key = '')
+	WHERE (event_type IN (
+		'm.room.name', 'm.room.avatar', 'm.room.canonical_alias', 'm.room.encryption',
+		'm.room.topic', 'm.room.join_rules', 'm.room.history_visibility', 'm.room.guest_access'
+	) AND state_key = '')
 	   OR (event_type = 'm.room.member' AND membership IN ('join', '_join', 'invite', '_invite'))
 	ORDER BY event_nid ASC
 	;`, metadata.RoomID)
@@ -339,6 +395,14 @@ func (s *Storage) ResetMetadataState(metadata *internal.RoomMetadata) error {
 			metadata.CanonicalAlias = gjson.GetBytes(ev.JSON, "content.alias").Str
 		case "m.room.encryption":
 			metadata.Encrypted = true
+		case "m.room.topic":
+			metadata.Topic = gjson.GetBytes(ev.JSON, "content.topic").Str
+		case "m.room.join_rules":
+			metadata.JoinRule = gjson.GetBytes(ev.JSON, "content.join_rule").Str
+		case "m.room.history_visibility":
+			metadata.HistoryVisibility = gjson.GetBytes(ev.JSON, "content.history_visibility").Str
+		case "m.room.guest_access":
+			metadata.GuestAccess = gjson.GetBytes(ev.JSON, "content.guest_access").Str
 		case "m.room.member":
 			heroMemberships.append(&events[i])
 			switch ev.Membership {
@@ -397,7 +461,7 @@ func (s *Storage) FetchMemberships(roomID string) (joins, invites, leaves []stri
 	)
 	SELECT state_key, membership
 	FROM syncv3_events JOIN snapshot ON (
-		event_nid = ANY( membership_nids )
+		`+sqlutil.DialectOf(s.DB).Any("event_nid", "membership_nids")+`
 	)
 	`, roomID)
 	if err != nil {
@@ -425,14 +489,56 @@ func (s *Storage) FetchMemberships(roomID string) (joins, invites, leaves []stri
 	return
 }
 
+// PresenceForJoinedMembers returns the stored presence of every user who is currently joined to
+// at least one of the given rooms. Each user appears at most once in the result.
+func (s *Storage) PresenceForJoinedMembers(roomIDs []string) (presences []internal.Presence, err error) {
+	if len(roomIDs) == 0 {
+		return nil, nil
+	}
+	d := sqlutil.DialectOf(s.DB)
+	err = s.DB.Select(&presences, `
+	WITH snapshots(membership_nids) AS (
+		SELECT membership_events
+		FROM syncv3_snapshots
+			JOIN syncv3_rooms ON snapshot_id = current_snapshot_id
+		WHERE `+d.Any("syncv3_rooms.room_id", "$1")+`
+	), members(user_id) AS (
+		SELECT DISTINCT state_key
+		FROM syncv3_events JOIN snapshots ON (
+			`+d.Any("event_nid", "membership_nids")+`
+		)
+		WHERE membership = 'join' OR membership = '_join'
+	)
+	SELECT syncv3_presence.user_id, presence, status_msg, currently_active, last_active_ts
+	FROM syncv3_presence JOIN members ON syncv3_presence.user_id = members.user_id
+	`, pq.StringArray(roomIDs))
+	return
+}
+
+// SpaceGraph returns the m.space.child and m.space.parent events in these spaces.
+func (s *Storage) SpaceGraph(spaceRoomIDs []string) (relations []SpaceRelation, err error) {
+	if len(spaceRoomIDs) == 0 {
+		return nil, nil
+	}
+	err = sqlutil.WithTransaction(s.DB, func(txn *sqlx.Tx) error {
+		relations, err = s.Accumulator.spacesTable.SelectGraph(txn, spaceRoomIDs)
+		return err
+	})
+	return
+}
+
 // Returns all current NOT MEMBERSHIP state events matching the event types given in all rooms. Returns a map of
 // room ID to events in that room.
 func (s *Storage) currentNotMembershipStateEventsInAllRooms(txn *sqlx.Tx, eventTypes []string) (map[string][]Event, error) {
+	currentNIDs := `SELECT UNNEST(events) FROM syncv3_snapshots`
+	if sqlutil.IsSQLite(txn) {
+		currentNIDs = `SELECT value FROM syncv3_snapshots, json_each(pg_array_json(events))`
+	}
 	query, args, err := sqlx.In(
 		`SELECT syncv3_events.room_id, syncv3_events.event_type, syncv3_events.state_key, syncv3_events.event FROM syncv3_events
 		WHERE syncv3_events.event_type IN (?)
 		AND syncv3_events.event_nid IN (
-			SELECT UNNEST(events) FROM syncv3_snapshots WHERE syncv3_snapshots.snapshot_id IN (SELECT current_snapshot_id FROM syncv3_rooms)
+			`+currentNIDs+` WHERE syncv3_snapshots.snapshot_id IN (SELECT current_snapshot_id FROM syncv3_rooms)
 		)`,
 		eventTypes,
 	)
@@ -642,14 +748,15 @@ func (s *Storage) RoomStateAfterEventPosition(ctx context.Context, roomIDs []str
 			// We're using a CTE here, since unnestting the nids is quite expensive. Using the array as is
 			// and using ANY() instead performs quite well (e.g. 86k membership events and 130ms execution time, vs
 			// the previous query with unnest took 2.5s)
+			d := sqlutil.DialectOf(txn)
 			query, args, err := sqlx.In(
 				`
 				WITH nids AS (
-    				SELECT `+nidcols+` AS allNids FROM syncv3_snapshots WHERE syncv3_snapshots.snapshot_id = ANY(?)
+    				SELECT `+nidcols+` AS allNids FROM syncv3_snapshots WHERE `+d.Any("syncv3_snapshots.snapshot_id", "?")+`
 				)
 				SELECT syncv3_events.event_nid, syncv3_events.room_id, syncv3_events.event_type, syncv3_events.state_key, syncv3_events.event
 				FROM syncv3_events, nids
-				WHERE (`+strings.Join(wheres, " OR ")+`) AND syncv3_events.event_nid = ANY(nids.allNids)
+				WHERE (`+strings.Join(wheres, " OR ")+`) AND `+d.Any("syncv3_events.event_nid", "nids.allNids")+`
 				ORDER BY syncv3_events.event_nid ASC`,
 				args...,
 			)
@@ -704,9 +811,10 @@ func (s *Storage) RoomStateAfterEventPosition(ctx context.Context, roomIDs []str
 // LatestEventsInRooms returns the most recent events
 // - in the given rooms
 // - that the user has permission to see
-// - with NIDs <= `to`.
+// - with NIDs <= `to`
+// - which pass the filter, if one is given.
 // Up to `limit` events are chosen per room. This limit be itself be limited according to MaxTimelineLimit.
-func (s *Storage) LatestEventsInRooms(userID string, roomIDs []string, to int64, limit int) (map[string]*LatestEvents, error) {
+func (s *Storage) LatestEventsInRooms(userID string, roomIDs []string, to int64, limit int, filter *internal.TimelineFilter) (map[string]*LatestEvents, error) {
 	roomIDToRange, err := s.visibleEventNIDsBetweenForRooms(userID, roomIDs, 0, to)
 	if err != nil {
 		return nil, err
@@ -720,20 +828,38 @@ func (s *Storage) LatestEventsInRooms(userID string, roomIDs []string, to int64,
 			var earliestEventNID int64
 			var latestEventNID int64
 			var roomEvents []json.RawMessage
-			// the most recent event will be first
-			events, err := s.EventsTable.SelectLatestEventsBetween(txn, roomID, r[0]-1, r[1], limit)
-			if err != nil {
-				return fmt.Errorf("room %s failed to SelectEventsBetween: %s", roomID, err)
-			}
-			for _, ev := range events {
-				if latestEventNID == 0 { // set first time and never again
-					latestEventNID = ev.NID
+			upperInclusive := r[1]
+			numScanned := 0
+			for len(roomEvents) < limit {
+				// the most recent event will be first
+				events, err := s.EventsTable.SelectLatestEventsBetween(txn, roomID, r[0]-1, upperInclusive, limit)
+				if err != nil {
+					return fmt.Errorf("room %s failed to SelectEventsBetween: %s", roomID, err)
 				}
-				roomEvents = append(roomEvents, ev.JSON)
-				earliestEventNID = ev.NID
-				if len(roomEvents) >= limit {
+				for _, ev := range events {
+					if latestEventNID == 0 { // set first time and never again
+						latestEventNID = ev.NID
+					}
+					// this is the earliest event we've looked at, not the earliest we are returning,
+					// so the prev_batch token skips over filtered events
+					earliestEventNID = ev.NID
+					if !filter.Include(ev.JSON) {
+						continue
+					}
+					roomEvents = append(roomEvents, ev.JSON)
+					if len(roomEvents) >= limit {
+						break
+					}
+				}
+				numScanned += len(events)
+				// Keep paginating backwards to fill up the timeline if events were filtered out,
+				// unless there are no more events, there is a gap in the timeline, or we've looked
+				// at enough events already.
+				if !filter.Filters() || len(events) < limit || events[len(events)-1].MissingPrevious ||
+					numScanned >= limit*maxTimelineFilterScanFactor {
 					break
 				}
+				upperInclusive = earliestEventNID - 1
 			}
 			// we want the most recent event to be last, so reverse the slice now in-place.
 			slices.Reverse(roomEvents)
@@ -788,6 +914,19 @@ func (s *Storage) RemoveInaccessibleStateSnapshots() error {
 	  DELETE FROM syncv3_snapshots USING ranked_snapshots
 	  WHERE syncv3_snapshots.snapshot_id = ranked_snapshots.snapshot_id
 	  AND ranked_snapshots.row_num > %d;`, numToKeep)
+	if sqlutil.IsSQLite(s.DB) {
+		// SQLite has no DELETE ... USING
+		awfulQuery = fmt.Sprintf(`WITH ranked_snapshots AS (
+		SELECT
+		  snapshot_id,
+		  ROW_NUMBER() OVER (PARTITION BY room_id ORDER BY snapshot_id DESC) AS row_num
+		FROM
+		  syncv3_snapshots
+	  )
+	  DELETE FROM syncv3_snapshots WHERE snapshot_id IN (
+		SELECT snapshot_id FROM ranked_snapshots WHERE row_num > %d
+	  );`, numToKeep)
+	}
 
 	result, err := s.DB.Exec(awfulQuery)
 	if err != nil {
@@ -810,6 +949,76 @@ func (s *Storage) GetClosestPrevBatch(roomID string, eventNID int64) (prevBatch
 	return
 }
 
+// Backfill is a page of older timeline events, see Storage.Backfill.
+type Backfill struct {
+	// Events in reverse timeline order, newest first.
+	Events []json.RawMessage
+	// EarliestNID is the NID of the last (oldest) event in Events, or 0 if Events is empty.
+	EarliestNID int64
+	// Complete is true if Events is a full page with no gap in the timeline, so the next page can
+	// also be served from the proxy. If false, older events must come from the homeserver.
+	Complete bool
+	// PrevBatch is the homeserver token to carry on from if the page is not Complete. May be empty
+	// if the proxy has no token.
+	PrevBatch string
+}
+
+// Backfill returns up to `limit` timeline events in this room before beforeNID which the user has
+// permission to see. The page stops early at the first gap in the timeline, or when the user's
+// visible range ends: the proxy does not know history visibility, so the homeserver has to decide
+// whether the user can see any further back.
+func (s *Storage) Backfill(userID, roomID string, beforeNID int64, limit int) (*Backfill, error) {
+	roomIDToRange, err := s.visibleEventNIDsBetweenForRooms(userID, []string{roomID}, 0, beforeNID-1)
+	if err != nil {
+		return nil, err
+	}
+	var result Backfill
+	err = sqlutil.WithTransaction(s.DB, func(txn *sqlx.Tx) error {
+		if r, ok := roomIDToRange[roomID]; ok && r[1] > 0 {
+			events, err := s.EventsTable.SelectLatestEventsBetween(txn, roomID, r[0]-1, r[1], limit)
+			if err != nil {
+				return fmt.Errorf("failed to SelectLatestEventsBetween: %w", err)
+			}
+			for _, ev := range events {
+				result.Events = append(result.Events, ev.JSON)
+			}
+			if len(events) > 0 {
+				earliest := events[len(events)-1]
+				result.EarliestNID = earliest.NID
+				result.Complete = len(events) == limit && !earliest.MissingPrevious
+			}
+		}
+		if result.Complete {
+			return nil
+		}
+		from := beforeNID
+		if result.EarliestNID != 0 {
+			from = result.EarliestNID
+		}
+		result.PrevBatch, err = s.EventsTable.SelectClosestPrevBatch(txn, roomID, from)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+// PrevBatchPosition returns the NID of the event carrying this homeserver prev_batch token, so
+// Backfill can serve the events before the token. Returns 0 if the proxy can't serve those events,
+// either because it doesn't know the token or because the token marks a gap.
+func (s *Storage) PrevBatchPosition(roomID, prevBatch string) (beforeNID int64, err error) {
+	err = sqlutil.WithTransaction(s.DB, func(txn *sqlx.Tx) error {
+		nid, missingPrevious, err := s.EventsTable.SelectNIDForPrevBatch(txn, roomID, prevBatch)
+		if err != nil || missingPrevious {
+			return err
+		}
+		beforeNID = nid
+		return nil
+	})
+	return
+}
+
 // visibleEventNIDsBetweenForRooms determines which events a given user has permission to see.
 // It accepts a nid range [from, to]. For each given room, it calculates the NID range
 // [A1, B1] within [from, to] in which the user has permission to see events.
@@ -1082,18 +1291,41 @@ Loop:
 				log.Warn().Err(err).Msg("failed to clean txn ID table")
 				sentry.CaptureException(err)
 			}
+			if err = s.ConnStateTable.Clean(boundaryTime); err != nil {
+				log.Warn().Err(err).Msg("failed to clean conn checkpoints table")
+				sentry.CaptureException(err)
+			}
 			// we also want to clean up stale state snapshots which are inaccessible, to
 			// keep the size of the syncv3_snapshots table low.
 			if err = s.RemoveInaccessibleStateSnapshots(); err != nil {
 				log.Warn().Err(err).Msg("failed to remove inaccessible state snapshots")
 				sentry.CaptureException(err)
 			}
+			// purge after removing snapshots, so events which only old snapshots needed are purged
+			s.purgeOldEvents()
+			s.purgeExpiredToDeviceMessages()
 		case <-s.shutdownCh:
 			break Loop
 		}
 	}
 }
 
+// purgeExpiredToDeviceMessages deletes to-device messages which have been queued for longer than
+// the ToDeviceTable's TTL.
+func (s *Storage) purgeExpiredToDeviceMessages() {
+	ttl := s.ToDeviceTable.Limits.TTL
+	if ttl <= 0 {
+		return
+	}
+	deleted, err := s.ToDeviceTable.DeleteExpiredMessages(time.Now().Add(-ttl))
+	if err != nil {
+		log.Warn().Err(err).Msg("failed to delete expired to-device messages")
+		sentry.CaptureException(err)
+		return
+	}
+	log.Info().Int64("deleted", deleted).Str("ttl", ttl.String()).Msg("Deleted expired to-device messages")
+}
+
 func (s *Storage) LatestEventNIDInRooms(roomIDs []string, highestNID int64) (roomToNID map[string]int64, err error) {
 	roomToNID = make(map[string]int64)
 	err = sqlutil.WithTransaction(s.Accumulator.db, func(txn *sqlx.Tx) error {
@@ -1187,6 +1419,7 @@ func (s *Storage) Teardown() {
 		s.shutdown = true
 		close(s.shutdownCh)
 	}
+	s.ToDeviceTable.removePrometheusMetrics()
 
 	err := s.Accumulator.db.Close()
 	if err != nil {
@@ -580,6 +580,165 @@ func TestStorageLatestEventsInRoomsPrevBatch(t *testing.T) {
 	}
 }
 
+func TestStorageLatestEventsInRoomsTimelineFilter(t *testing.T) {
+	store := NewStorage(postgresConnectionString)
+	defer store.Teardown()
+	roomID := "!TestStorageLatestEventsInRoomsTimelineFilter:localhost"
+	alice := "@alice_TestStorageLatestEventsInRoomsTimelineFilter:localhost"
+	_, err := store.Initialise(roomID, []json.RawMessage{
+		testutils.NewStateEvent(t, "m.room.create", "", alice, map[string]interface{}{"creator": alice}),
+		testutils.NewJoinEvent(t, alice),
+	})
+	if err != nil {
+		t.Fatalf("failed to initialise: %s", err)
+	}
+	// A timeline's prev_batch is stored on its first event, and the earliest message returned
+	// gets the closest token at or after it. Message 1 comes in an earlier sync, so the token for
+	// the page of messages 2 and 3 is on message 2, and paginating with it cannot skip message 1.
+	_, err = store.Accumulate(alice, roomID, sync2.TimelineResponse{
+		Events: []json.RawMessage{
+			testutils.NewEvent(t, "m.room.message", alice, map[string]interface{}{"body": "1"}),
+		},
+		PrevBatch: "batch1",
+	})
+	if err != nil {
+		t.Fatalf("failed to accumulate: %s", err)
+	}
+	// the messages are buried under lots of reactions, so filtering has to paginate back to find them
+	timeline := []json.RawMessage{
+		testutils.NewEvent(t, "m.room.message", alice, map[string]interface{}{"body": "2"}),
+		testutils.NewEvent(t, "m.room.message", alice, map[string]interface{}{"body": "3"}),
+	}
+	for i := 0; i < 5; i++ {
+		timeline = append(timeline, testutils.NewEvent(t, "m.reaction", alice, map[string]interface{}{}))
+	}
+	_, err = store.Accumulate(alice, roomID, sync2.TimelineResponse{Events: timeline, PrevBatch: "batch"})
+	if err != nil {
+		t.Fatalf("failed to accumulate: %s", err)
+	}
+	to, err := store.LatestEventNID()
+	if err != nil {
+		t.Fatalf("LatestEventNID: %s", err)
+	}
+
+	filter := &internal.TimelineFilter{Types: []string{"m.room.message"}}
+	result, err := store.LatestEventsInRooms(alice, []string{roomID}, to, 2, filter)
+	if err != nil {
+		t.Fatalf("LatestEventsInRooms: %s", err)
+	}
+	got := result[roomID]
+	if got == nil {
+		t.Fatalf("LatestEventsInRooms: no result for room")
+	}
+	var bodies []string
+	for _, ev := range got.Timeline {
+		bodies = append(bodies, gjson.GetBytes(ev, "content.body").Str)
+	}
+	if !reflect.DeepEqual(bodies, []string{"2", "3"}) {
+		t.Errorf("LatestEventsInRooms: got bodies %v want [2 3]", bodies)
+	}
+	if got.LatestNID != to {
+		t.Errorf("LatestEventsInRooms: got LatestNID %d want %d", got.LatestNID, to)
+	}
+	if got.PrevBatch != "batch" {
+		t.Errorf("LatestEventsInRooms: got PrevBatch %q want %q", got.PrevBatch, "batch")
+	}
+
+	// nothing matches, but the latest NID must still be set so live events are deduplicated
+	filter = &internal.TimelineFilter{Senders: []string{"@nobody:localhost"}}
+	result, err = store.LatestEventsInRooms(alice, []string{roomID}, to, 2, filter)
+	if err != nil {
+		t.Fatalf("LatestEventsInRooms: %s", err)
+	}
+	if len(result[roomID].Timeline) != 0 {
+		t.Errorf("LatestEventsInRooms: got %d events, want none", len(result[roomID].Timeline))
+	}
+	if result[roomID].LatestNID != to {
+		t.Errorf("LatestEventsInRooms: got LatestNID %d want %d", result[roomID].LatestNID, to)
+	}
+}
+
+func TestStorageBackfill(t *testing.T) {
+	store := NewStorage(postgresConnectionString)
+	defer store.Teardown()
+	roomID := "!TestStorageBackfill:localhost"
+	alice := "@alice_TestStorageBackfill:localhost"
+	_, err := store.Initialise(roomID, []json.RawMessage{
+		testutils.NewStateEvent(t, "m.room.create", "", alice, map[string]interface{}{"creator": alice}),
+		testutils.NewJoinEvent(t, alice),
+	})
+	if err != nil {
+		t.Fatalf("failed to initialise: %s", err)
+	}
+	for i, prevBatch := range []string{"batch A", "batch B"} {
+		_, err = store.Accumulate(alice, roomID, sync2.TimelineResponse{
+			Events: []json.RawMessage{
+				testutils.NewEvent(t, "m.room.message", alice, map[string]interface{}{"body": fmt.Sprintf("%d", i*2+1)}),
+				testutils.NewEvent(t, "m.room.message", alice, map[string]interface{}{"body": fmt.Sprintf("%d", i*2+2)}),
+			},
+			PrevBatch: prevBatch,
+			Limited:   i == 0,
+		})
+		if err != nil {
+			t.Fatalf("failed to accumulate: %s", err)
+		}
+	}
+	latest, err := store.LatestEventNID()
+	if err != nil {
+		t.Fatalf("LatestEventNID: %s", err)
+	}
+	bodies := func(b *Backfill) (got []string) {
+		for _, ev := range b.Events {
+			got = append(got, gjson.GetBytes(ev, "content.body").Str)
+		}
+		return
+	}
+
+	// a full page can be served from the proxy
+	page, err := store.Backfill(alice, roomID, latest+1, 3)
+	if err != nil {
+		t.Fatalf("Backfill: %s", err)
+	}
+	if !reflect.DeepEqual(bodies(page), []string{"4", "3", "2"}) || !page.Complete {
+		t.Fatalf("Backfill: got %v complete=%v want [4 3 2] complete=true", bodies(page), page.Complete)
+	}
+
+	// the next page runs out of events, so it must point at the homeserver
+	page, err = store.Backfill(alice, roomID, page.EarliestNID, 3)
+	if err != nil {
+		t.Fatalf("Backfill: %s", err)
+	}
+	if !reflect.DeepEqual(bodies(page), []string{"1"}) || page.Complete {
+		t.Fatalf("Backfill: got %v complete=%v want [1] complete=false", bodies(page), page.Complete)
+	}
+	if page.PrevBatch != "batch A" {
+		t.Fatalf("Backfill: got PrevBatch %q want %q", page.PrevBatch, "batch A")
+	}
+
+	// the proxy can serve the events before "batch B", but not before "batch A" as it marks the
+	// start of the proxy's timeline
+	beforeNID, err := store.PrevBatchPosition(roomID, "batch B")
+	if err != nil {
+		t.Fatalf("PrevBatchPosition: %s", err)
+	}
+	page, err = store.Backfill(alice, roomID, beforeNID, 10)
+	if err != nil {
+		t.Fatalf("Backfill: %s", err)
+	}
+	if !reflect.DeepEqual(bodies(page), []string{"2", "1"}) {
+		t.Fatalf("Backfill before batch B: got %v want [2 1]", bodies(page))
+	}
+	for _, prevBatch := range []string{"batch A", "unknown"} {
+		beforeNID, err = store.PrevBatchPosition(roomID, prevBatch)
+		if err != nil {
+			t.Fatalf("PrevBatchPosition: %s", err)
+		}
+		if beforeNID != 0 {
+			t.Errorf("PrevBatchPosition(%s): got %d want 0", prevBatch, beforeNID)
+		}
+	}
+}
+
 func TestGlobalSnapshot(t *testing.T) {
 	alice := "@TestGlobalSnapshot_alice:localhost"
 	bob := "@TestGlobalSnapshot_bob:localhost"
@@ -604,6 +763,10 @@ func TestGlobalSnapshot(t *testing.T) {
 			testutils.NewStateEvent(t, "m.room.create", "", bob, map[string]interface{}{"creator": bob, "type": roomType}),
 			testutils.NewJoinEvent(t, bob),
 			testutils.NewStateEvent(t, "m.room.name", "", alice, map[string]interface{}{"name": "My Room"}),
+			testutils.NewStateEvent(t, "m.room.topic", "", bob, map[string]interface{}{"topic": "Bob's room"}),
+			testutils.NewStateEvent(t, "m.room.join_rules", "", bob, map[string]interface{}{"join_rule": "public"}),
+			testutils.NewStateEvent(t, "m.room.history_visibility", "", bob, map[string]interface{}{"history_visibility": "world_readable"}),
+			testutils.NewStateEvent(t, "m.room.guest_access", "", bob, map[string]interface{}{"guest_access": "can_join"}),
 		},
 		roomAliceBob: {
 			testutils.NewStateEvent(t, "m.room.create", "", bob, map[string]interface{}{"creator": bob}),
@@ -657,6 +820,10 @@ func TestGlobalSnapshot(t *testing.T) {
 			LastMessageTimestamp: gjson.ParseBytes(roomIDToEventMap[roomBob][len(roomIDToEventMap[roomBob])-1]).Get("origin_server_ts").Uint(),
 			Heroes:               []internal.Hero{{ID: bob}},
 			NameEvent:            "My Room",
+			Topic:                "Bob's room",
+			JoinRule:             "public",
+			HistoryVisibility:    "world_readable",
+			GuestAccess:          "can_join",
 			RoomType:             &roomType,
 			ChildSpaceRooms:      make(map[string]struct{}),
 		},
@@ -1100,14 +1267,18 @@ func assertRoomMetadata(t *testing.T, got, want internal.RoomMetadata) {
 	assertValue(t, "CanonicalAlias", got.CanonicalAlias, want.CanonicalAlias)
 	assertValue(t, "ChildSpaceRooms", got.ChildSpaceRooms, want.ChildSpaceRooms)
 	assertValue(t, "Encrypted", got.Encrypted, want.Encrypted)
+	assertValue(t, "GuestAccess", got.GuestAccess, want.GuestAccess)
 	assertValue(t, "Heroes", sortHeroes(got.Heroes), sortHeroes(want.Heroes))
+	assertValue(t, "HistoryVisibility", got.HistoryVisibility, want.HistoryVisibility)
 	assertValue(t, "InviteCount", got.InviteCount, want.InviteCount)
 	assertValue(t, "JoinCount", got.JoinCount, want.JoinCount)
+	assertValue(t, "JoinRule", got.JoinRule, want.JoinRule)
 	assertValue(t, "LastMessageTimestamp", got.LastMessageTimestamp, want.LastMessageTimestamp)
 	assertValue(t, "NameEvent", got.NameEvent, want.NameEvent)
 	assertValue(t, "PredecessorRoomID", got.PredecessorRoomID, want.PredecessorRoomID)
 	assertValue(t, "RoomID", got.RoomID, want.RoomID)
 	assertValue(t, "RoomType", got.RoomType, want.RoomType)
+	assertValue(t, "Topic", got.Topic, want.Topic)
 	assertValue(t, "TypingEvent", got.TypingEvent, want.TypingEvent)
 	assertValue(t, "UpgradedRoomID", got.UpgradedRoomID, want.UpgradedRoomID)
 }
@@ -4,10 +4,13 @@ import (
 	"database/sql"
 	"encoding/json"
 	"fmt"
+	"sync"
+	"time"
 
 	"github.com/jmoiron/sqlx"
 	"github.com/lib/pq"
 	"github.com/matrix-org/sliding-sync/sqlutil"
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/rs/zerolog/log"
 	"github.com/tidwall/gjson"
 )
@@ -17,9 +20,55 @@ const (
 	ActionCancel  = 2
 )
 
+// keyShareTypes are the to-device event types which carry room keys. Dropping one of these can
+// leave the device unable to decrypt messages, so they are the last to go when a queue is full.
+var keyShareTypes = []string{"m.room_key", "m.forwarded_room_key"}
+
+// ToDeviceLimits stop messages piling up for devices which never sync again. The zero value
+// imposes no limits.
+type ToDeviceLimits struct {
+	// Messages which have been queued for longer than this are deleted by Storage.Cleaner.
+	TTL time.Duration
+	// The most messages to queue for each device. When a device has more than this, the oldest
+	// messages are dropped, starting with those which aren't key shares.
+	MaxPerDevice int
+}
+
+// ToDeviceQueue describes the messages queued for a device.
+type ToDeviceQueue struct {
+	UserID   string `json:"user_id"`
+	DeviceID string `json:"device_id"`
+	// the number of queued messages, in total and for each event type
+	Depth       int64            `json:"depth"`
+	DepthByType map[string]int64 `json:"depth_by_type"`
+	// The position up to which messages have been sent to the device, but not yet acknowledged.
+	UnackedPosition int64 `json:"unacked_position"`
+	// When the oldest message was queued. Zero if there are no messages.
+	Oldest time.Time `json:"oldest"`
+}
+
 // ToDeviceTable stores to_device messages for devices.
 type ToDeviceTable struct {
-	db *sqlx.DB
+	db      *sqlx.DB
+	Limits  ToDeviceLimits
+	metrics *toDeviceMetrics
+
+	// At least as many messages as are queued for each device, so that the queue only needs
+	// counting when it may have grown past Limits.MaxPerDevice. Messages for a device are only
+	// queued by its poller, and everything else only removes messages, so this can't fall below
+	// the real depth.
+	depthsMu *sync.Mutex
+	depths   map[toDeviceQueueKey]int64
+}
+
+type toDeviceQueueKey struct {
+	userID   string
+	deviceID string
+}
+
+type toDeviceMetrics struct {
+	queueDepth prometheus.Histogram
+	dropped    *prometheus.CounterVec
 }
 
 type ToDeviceRow struct {
@@ -31,6 +80,8 @@ type ToDeviceRow struct {
 	Sender    string  `db:"sender"`
 	UniqueKey *string `db:"unique_key"`
 	Action    int     `db:"action"`
+	// when the message was queued, in milliseconds since the epoch
+	InsertedTS int64 `db:"inserted_ts"`
 }
 
 type ToDeviceRowChunker []ToDeviceRow
@@ -43,11 +94,12 @@ func (c ToDeviceRowChunker) Subslice(i, j int) sqlutil.Chunker {
 }
 
 func NewToDeviceTable(db *sqlx.DB) *ToDeviceTable {
+	d := sqlutil.DialectOf(db)
 	// make sure tables are made
 	db.MustExec(`
-	CREATE SEQUENCE IF NOT EXISTS syncv3_to_device_messages_seq;
+	` + d.CreateSequence("syncv3_to_device_messages_seq") + `
 	CREATE TABLE IF NOT EXISTS syncv3_to_device_messages (
-		position BIGINT NOT NULL PRIMARY KEY DEFAULT nextval('syncv3_to_device_messages_seq'),
+		position ` + d.SequenceKey("syncv3_to_device_messages_seq") + `,
 		user_id TEXT NOT NULL,
 		device_id TEXT NOT NULL,
 		event_type TEXT NOT NULL,
@@ -55,19 +107,58 @@ func NewToDeviceTable(db *sqlx.DB) *ToDeviceTable {
 		message TEXT NOT NULL,
 		-- nullable as these fields are not on all to-device events
 		unique_key TEXT,
-		action SMALLINT DEFAULT 0 -- 0 means unknown
+		action SMALLINT DEFAULT 0, -- 0 means unknown
+		inserted_ts BIGINT NOT NULL DEFAULT 0
 	);
 	CREATE TABLE IF NOT EXISTS syncv3_to_device_ack_pos (
 		user_id TEXT NOT NULL,
 		device_id TEXT NOT NULL,
-		PRIMARY KEY (user_id, device_id),
-		unack_pos BIGINT NOT NULL
+		unack_pos BIGINT NOT NULL,
+		PRIMARY KEY (user_id, device_id)
 	);
 	CREATE INDEX IF NOT EXISTS syncv3_to_device_messages_device_idx ON syncv3_to_device_messages(device_id);
 	CREATE INDEX IF NOT EXISTS syncv3_to_device_messages_ukey_idx ON syncv3_to_device_messages(unique_key, device_id);
 	CREATE INDEX IF NOT EXISTS syncv3_to_device_messages_pos_device_idx ON syncv3_to_device_messages(position, device_id);
 	`)
-	return &ToDeviceTable{db}
+	return &ToDeviceTable{
+		db:       db,
+		depthsMu: &sync.Mutex{},
+		depths:   make(map[toDeviceQueueKey]int64),
+	}
+}
+
+func (t *ToDeviceTable) addPrometheusMetrics() {
+	t.metrics = &toDeviceMetrics{
+		queueDepth: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Namespace: "sliding_sync",
+			Subsystem: "to_device",
+			Name:      "queue_depth",
+			Help:      "The number of to-device messages queued for a device, observed whenever the queue is counted: the first time messages are queued for it, and whenever it may be over the limit.",
+			Buckets:   []float64{1, 10, 100, 1000, 10000, 100000},
+		}),
+		dropped: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "sliding_sync",
+			Subsystem: "to_device",
+			Name:      "dropped",
+			Help:      "Total number of to-device messages dropped before being sent, by reason: 'expired' or 'queue_full'.",
+		}, []string{"reason"}),
+	}
+	prometheus.MustRegister(t.metrics.queueDepth, t.metrics.dropped)
+}
+
+func (t *ToDeviceTable) removePrometheusMetrics() {
+	if t.metrics == nil {
+		return
+	}
+	prometheus.Unregister(t.metrics.queueDepth)
+	prometheus.Unregister(t.metrics.dropped)
+	t.metrics = nil
+}
+
+func (t *ToDeviceTable) countDropped(reason string, n int64) {
+	if t.metrics != nil && n > 0 {
+		t.metrics.dropped.WithLabelValues(reason).Add(float64(n))
+	}
 }
 
 func (t *ToDeviceTable) SetUnackedPosition(userID, deviceID string, pos int64) error {
@@ -91,6 +182,64 @@ func (t *ToDeviceTable) DeleteAllMessagesForDevice(userID, deviceID string) erro
 	return err
 }
 
+// ClearQueue deletes every message queued for this device, returning how many were deleted.
+// Unlike DeleteAllMessagesForDevice, the device's unacked position is kept, so it carries on
+// from where it was with an empty queue.
+func (t *ToDeviceTable) ClearQueue(userID, deviceID string) (int64, error) {
+	result, err := t.db.Exec(`DELETE FROM syncv3_to_device_messages WHERE user_id = $1 AND device_id = $2`, userID, deviceID)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+// DeleteExpiredMessages deletes messages which were queued before boundaryTime, for every device.
+// Returns how many were deleted.
+func (t *ToDeviceTable) DeleteExpiredMessages(boundaryTime time.Time) (int64, error) {
+	result, err := t.db.Exec(`DELETE FROM syncv3_to_device_messages WHERE inserted_ts < $1`, boundaryTime.UnixMilli())
+	if err != nil {
+		return 0, err
+	}
+	deleted, err := result.RowsAffected()
+	t.countDropped("expired", deleted)
+	return deleted, err
+}
+
+// Queue describes the messages queued for this device.
+func (t *ToDeviceTable) Queue(userID, deviceID string) (queue ToDeviceQueue, err error) {
+	queue = ToDeviceQueue{
+		UserID:      userID,
+		DeviceID:    deviceID,
+		DepthByType: make(map[string]int64),
+	}
+	err = t.db.QueryRow(`SELECT unack_pos FROM syncv3_to_device_ack_pos WHERE user_id=$1 AND device_id=$2`, userID, deviceID).Scan(&queue.UnackedPosition)
+	if err != nil && err != sql.ErrNoRows {
+		return queue, fmt.Errorf("unable to select unacked pos: %s", err)
+	}
+	var rows []struct {
+		Type   string `db:"event_type"`
+		Count  int64  `db:"count"`
+		Oldest int64  `db:"oldest"`
+	}
+	err = t.db.Select(&rows, `SELECT event_type, COUNT(*) AS count, MIN(inserted_ts) AS oldest FROM syncv3_to_device_messages
+	WHERE user_id = $1 AND device_id = $2 GROUP BY event_type`, userID, deviceID)
+	if err != nil {
+		return queue, err
+	}
+	var oldest int64
+	for _, row := range rows {
+		queue.Depth += row.Count
+		queue.DepthByType[row.Type] = row.Count
+		if oldest == 0 || row.Oldest < oldest {
+			oldest = row.Oldest
+		}
+	}
+	if oldest > 0 {
+		queue.Oldest = time.UnixMilli(oldest)
+	}
+	return queue, nil
+}
+
 // Messages fetches up to `limit` to-device messages for this device, starting from and excluding `from`.
 // Returns the fetches messages ordered by ascending position, as well as the position of the last to-device message
 // fetched.
@@ -133,14 +282,16 @@ func (t *ToDeviceTable) InsertMessages(userID, deviceID string, msgs []json.RawM
 		allCancels := make(map[string]struct{})
 
 		rows := make([]ToDeviceRow, len(msgs))
+		now := time.Now().UnixMilli()
 		for i := range msgs {
 			m := gjson.ParseBytes(msgs[i])
 			rows[i] = ToDeviceRow{
-				UserID:   userID,
-				DeviceID: deviceID,
-				Message:  string(msgs[i]),
-				Type:     m.Get("type").Str,
-				Sender:   m.Get("sender").Str,
+				UserID:     userID,
+				DeviceID:   deviceID,
+				Message:    string(msgs[i]),
+				Type:       m.Get("type").Str,
+				Sender:     m.Get("sender").Str,
+				InsertedTS: now,
 			}
 			msgId := m.Get(`content.org\.matrix\.msgid`).Str
 			if msgId != "" {
@@ -168,7 +319,7 @@ func (t *ToDeviceTable) InsertMessages(userID, deviceID string, msgs []json.RawM
 		if len(cancels) > 0 {
 			var cancelled []string
 			// delete action: request events which have the same unique key, for this device inbox, only if they are not sent to the client already (unacked)
-			err = txn.Select(&cancelled, `DELETE FROM syncv3_to_device_messages WHERE unique_key = ANY($1) AND user_id = $2 AND device_id = $3 AND position > $4 RETURNING unique_key`,
+			err = txn.Select(&cancelled, `DELETE FROM syncv3_to_device_messages WHERE `+sqlutil.DialectOf(txn).Any("unique_key", "$1")+` AND user_id = $2 AND device_id = $3 AND position > $4 RETURNING unique_key`,
 				pq.StringArray(cancels), userID, deviceID, unackPos)
 			if err != nil {
 				return fmt.Errorf("failed to delete cancelled events: %s", err)
@@ -202,10 +353,10 @@ func (t *ToDeviceTable) InsertMessages(userID, deviceID string, msgs []json.RawM
 			return nil
 		}
 
-		chunks := sqlutil.Chunkify(7, MaxPostgresParameters, ToDeviceRowChunker(rows))
+		chunks := sqlutil.Chunkify(8, maxParameters(txn), ToDeviceRowChunker(rows))
 		for _, chunk := range chunks {
-			result, err := txn.NamedQuery(`INSERT INTO syncv3_to_device_messages (user_id, device_id, message, event_type, sender, action, unique_key)
-        VALUES (:user_id, :device_id, :message, :event_type, :sender, :action, :unique_key) RETURNING position`, chunk)
+			result, err := txn.NamedQuery(`INSERT INTO syncv3_to_device_messages (user_id, device_id, message, event_type, sender, action, unique_key, inserted_ts)
+        VALUES (:user_id, :device_id, :message, :event_type, :sender, :action, :unique_key, :inserted_ts) RETURNING position`, chunk)
 			if err != nil {
 				return err
 			}
@@ -217,7 +368,68 @@ func (t *ToDeviceTable) InsertMessages(userID, deviceID string, msgs []json.RawM
 			}
 			result.Close()
 		}
-		return nil
+		return t.enforceMaxPerDevice(txn, userID, deviceID, len(rows))
 	})
 	return lastPos, err
 }
+
+// enforceMaxPerDevice drops the oldest messages for this device if it has more than
+// Limits.MaxPerDevice queued, now that numQueued more have been queued. Messages which aren't key
+// shares are dropped first.
+func (t *ToDeviceTable) enforceMaxPerDevice(txn *sqlx.Tx, userID, deviceID string, numQueued int) error {
+	if t.Limits.MaxPerDevice <= 0 && t.metrics == nil {
+		return nil
+	}
+	key := toDeviceQueueKey{userID: userID, deviceID: deviceID}
+	t.depthsMu.Lock()
+	maxDepth, known := t.depths[key]
+	maxDepth += int64(numQueued)
+	if known && (t.Limits.MaxPerDevice <= 0 || maxDepth <= int64(t.Limits.MaxPerDevice)) {
+		// the queue can't be over the limit, so there is no need to count it
+		t.depths[key] = maxDepth
+		t.depthsMu.Unlock()
+		return nil
+	}
+	t.depthsMu.Unlock()
+
+	var depth int64
+	err := txn.QueryRow(`SELECT COUNT(*) FROM syncv3_to_device_messages WHERE user_id = $1 AND device_id = $2`, userID, deviceID).Scan(&depth)
+	if err != nil {
+		return fmt.Errorf("failed to count queued messages: %s", err)
+	}
+	excess := depth - int64(t.Limits.MaxPerDevice)
+	if t.Limits.MaxPerDevice <= 0 || excess <= 0 {
+		t.setDepth(key, depth)
+		if t.metrics != nil {
+			t.metrics.queueDepth.Observe(float64(depth))
+		}
+		return nil
+	}
+	// false sorts before true, so this picks messages which aren't key shares first
+	result, err := txn.Exec(`DELETE FROM syncv3_to_device_messages WHERE position IN (
+		SELECT position FROM syncv3_to_device_messages WHERE user_id = $1 AND device_id = $2
+		ORDER BY (`+sqlutil.DialectOf(txn).Any("event_type", "$3")+`) ASC, position ASC LIMIT $4
+	)`, userID, deviceID, pq.StringArray(keyShareTypes), excess)
+	if err != nil {
+		return fmt.Errorf("failed to drop messages over the limit: %s", err)
+	}
+	dropped, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	log.Warn().Str("user", userID).Str("device", deviceID).Int64("dropped", dropped).Int("limit", t.Limits.MaxPerDevice).Msg(
+		"ToDeviceTable: too many to-device messages queued, dropped the oldest",
+	)
+	t.countDropped("queue_full", dropped)
+	t.setDepth(key, depth-dropped)
+	if t.metrics != nil {
+		t.metrics.queueDepth.Observe(float64(depth - dropped))
+	}
+	return nil
+}
+
+func (t *ToDeviceTable) setDepth(key toDeviceQueueKey, depth int64) {
+	t.depthsMu.Lock()
+	t.depths[key] = depth
+	t.depthsMu.Unlock()
+}
@@ -3,7 +3,10 @@ package state
 import (
 	"bytes"
 	"encoding/json"
+	"fmt"
+	"reflect"
 	"testing"
+	"time"
 
 	"github.com/tidwall/gjson"
 )
@@ -280,6 +283,127 @@ func TestToDeviceTableBytesInEqualBytesOut(t *testing.T) {
 	}
 }
 
+// Test that devices can't queue more than MaxPerDevice messages, and that key shares are kept in
+// preference to other messages.
+func TestToDeviceTableMaxPerDevice(t *testing.T) {
+	db, close := connectToDB(t)
+	defer close()
+	table := NewToDeviceTable(db)
+	table.Limits.MaxPerDevice = 4
+	userID := "@TestToDeviceTableMaxPerDevice:localhost"
+	deviceID := "MAX"
+	msg := func(eventType string, i int) json.RawMessage {
+		return json.RawMessage(fmt.Sprintf(`{"sender":"@bob:localhost","type":"%s","content":{"i":%d}}`, eventType, i))
+	}
+	_, err := table.InsertMessages(userID, deviceID, []json.RawMessage{
+		msg("m.room.encrypted", 0), msg("m.key.verification.request", 1), msg("m.room_key", 2),
+	})
+	if err != nil {
+		t.Fatalf("InsertMessages: %s", err)
+	}
+	// 3 over the limit: the 3 oldest messages which aren't key shares go
+	_, err = table.InsertMessages(userID, deviceID, []json.RawMessage{
+		msg("m.forwarded_room_key", 3), msg("m.room.encrypted", 4), msg("m.key.verification.request", 5), msg("m.room.encrypted", 6),
+	})
+	if err != nil {
+		t.Fatalf("InsertMessages: %s", err)
+	}
+	gotMsgs, _, err := table.Messages(userID, deviceID, 0, 100)
+	if err != nil {
+		t.Fatalf("Messages: %s", err)
+	}
+	var got []int64
+	for _, m := range gotMsgs {
+		got = append(got, gjson.GetBytes(m, "content.i").Int())
+	}
+	if want := []int64{2, 3, 5, 6}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("Messages: got %v want %v", got, want)
+	}
+
+	queue, err := table.Queue(userID, deviceID)
+	if err != nil {
+		t.Fatalf("Queue: %s", err)
+	}
+	wantDepths := map[string]int64{"m.room.encrypted": 1, "m.key.verification.request": 1, "m.room_key": 1, "m.forwarded_room_key": 1}
+	if queue.Depth != 4 || !reflect.DeepEqual(queue.DepthByType, wantDepths) {
+		t.Errorf("Queue: got depth %d %v want 4 %v", queue.Depth, queue.DepthByType, wantDepths)
+	}
+	if time.Since(queue.Oldest) > time.Minute {
+		t.Errorf("Queue: got oldest %v want around now", queue.Oldest)
+	}
+
+	deleted, err := table.ClearQueue(userID, deviceID)
+	if err != nil || deleted != 4 {
+		t.Fatalf("ClearQueue: got (%d, %v) want 4 deleted", deleted, err)
+	}
+	if queue, err = table.Queue(userID, deviceID); err != nil || queue.Depth != 0 || !queue.Oldest.IsZero() {
+		t.Fatalf("Queue after ClearQueue: got %+v, %v want an empty queue", queue, err)
+	}
+
+	// The table still thinks 4 messages may be queued, so these are counted rather than
+	// assumed to take the queue over the limit.
+	_, err = table.InsertMessages(userID, deviceID, []json.RawMessage{
+		msg("m.room.encrypted", 7), msg("m.room.encrypted", 8),
+	})
+	if err != nil {
+		t.Fatalf("InsertMessages: %s", err)
+	}
+	if queue, err = table.Queue(userID, deviceID); err != nil || queue.Depth != 2 {
+		t.Fatalf("Queue after ClearQueue and InsertMessages: got %+v, %v want depth 2", queue, err)
+	}
+	key := toDeviceQueueKey{userID: userID, deviceID: deviceID}
+	if depth := table.depths[key]; depth != 2 {
+		t.Errorf("got running depth %d want 2", depth)
+	}
+	// 2 more fit under the limit, so they are added to the running depth without counting the
+	// queue, even though it has been cleared since
+	if _, err = table.ClearQueue(userID, deviceID); err != nil {
+		t.Fatalf("ClearQueue: %s", err)
+	}
+	_, err = table.InsertMessages(userID, deviceID, []json.RawMessage{
+		msg("m.room.encrypted", 9), msg("m.room.encrypted", 10),
+	})
+	if err != nil {
+		t.Fatalf("InsertMessages: %s", err)
+	}
+	if depth := table.depths[key]; depth != 4 {
+		t.Errorf("got running depth %d want 4", depth)
+	}
+}
+
+func TestToDeviceTableDeleteExpiredMessages(t *testing.T) {
+	db, close := connectToDB(t)
+	defer close()
+	table := NewToDeviceTable(db)
+	userID := "@TestToDeviceTableDeleteExpiredMessages:localhost"
+	msgs := []json.RawMessage{
+		json.RawMessage(`{"sender":"@bob:localhost","type":"m.room_key","content":{}}`),
+	}
+	for _, deviceID := range []string{"OLD", "NEW"} {
+		if _, err := table.InsertMessages(userID, deviceID, msgs); err != nil {
+			t.Fatalf("InsertMessages: %s", err)
+		}
+	}
+	_, err := db.Exec(`UPDATE syncv3_to_device_messages SET inserted_ts = $1 WHERE user_id = $2 AND device_id = 'OLD'`,
+		time.Now().Add(-48*time.Hour).UnixMilli(), userID)
+	if err != nil {
+		t.Fatalf("failed to age messages: %s", err)
+	}
+	deleted, err := table.DeleteExpiredMessages(time.Now().Add(-24 * time.Hour))
+	if err != nil || deleted != 1 {
+		t.Fatalf("DeleteExpiredMessages: got (%d, %v) want 1 deleted", deleted, err)
+	}
+	for deviceID, wantDepth := range map[string]int64{"OLD": 0, "NEW": 1} {
+		queue, err := table.Queue(userID, deviceID)
+		if err != nil {
+			t.Fatalf("Queue: %s", err)
+		}
+		if queue.Depth != wantDepth {
+			t.Errorf("Queue(%s): got depth %d want %d", deviceID, queue.Depth, wantDepth)
+		}
+	}
+}
+
 func TestMsgID(t *testing.T) {
 	data := json.RawMessage(`{
 		"content": {
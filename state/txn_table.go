@@ -5,6 +5,7 @@ import (
 
 	"github.com/jmoiron/sqlx"
 	"github.com/lib/pq"
+	"github.com/matrix-org/sliding-sync/sqlutil"
 )
 
 type txnRow struct {
@@ -63,7 +64,7 @@ func (t *TransactionsTable) Clean(boundaryTime time.Time) error {
 func (t *TransactionsTable) Select(userID, deviceID string, eventIDs []string) (map[string]string, error) {
 	result := make(map[string]string, len(eventIDs))
 	var rows []txnRow
-	err := t.db.Select(&rows, `SELECT event_id, txn_id FROM syncv3_txns WHERE user_id=$1 AND device_id=$2 and event_id=ANY($3)`, userID, deviceID, pq.StringArray(eventIDs))
+	err := t.db.Select(&rows, `SELECT event_id, txn_id FROM syncv3_txns WHERE user_id=$1 AND device_id=$2 and `+sqlutil.DialectOf(t.db).Any("event_id", "$3"), userID, deviceID, pq.StringArray(eventIDs))
 	if err != nil {
 		return nil, err
 	}
@@ -5,6 +5,7 @@ import (
 
 	"github.com/jmoiron/sqlx"
 	"github.com/lib/pq"
+	"github.com/matrix-org/sliding-sync/sqlutil"
 )
 
 // TypingTable stores who is currently typing
@@ -15,6 +16,18 @@ type TypingTable struct {
 }
 
 func NewTypingTable(db *sqlx.DB) *TypingTable {
+	if sqlutil.IsSQLite(db) {
+		// SQLite has no sequences, so the stream_id is an AUTOINCREMENT key which is reassigned by
+		// replacing the row whenever the room's typing users change.
+		db.MustExec(`
+		CREATE TABLE IF NOT EXISTS syncv3_typing (
+			stream_id INTEGER PRIMARY KEY AUTOINCREMENT,
+			room_id TEXT NOT NULL UNIQUE,
+			user_ids TEXT NOT NULL
+		);
+		`)
+		return &TypingTable{db}
+	}
 	// make sure tables are made
 	db.MustExec(`
 	CREATE SEQUENCE IF NOT EXISTS syncv3_typing_seq;
@@ -42,11 +55,13 @@ func (t *TypingTable) SetTyping(roomID string, userIDs []string) (position int64
 	if userIDs == nil {
 		userIDs = []string{}
 	}
-	err = t.db.QueryRow(`
+	query := `
 		INSERT INTO syncv3_typing(room_id, user_ids) VALUES($1, $2)
-		ON CONFLICT (room_id) DO UPDATE SET user_ids = $2, stream_id = nextval('syncv3_typing_seq') RETURNING stream_id`,
-		roomID, pq.Array(userIDs),
-	).Scan(&position)
+		ON CONFLICT (room_id) DO UPDATE SET user_ids = $2, stream_id = nextval('syncv3_typing_seq') RETURNING stream_id`
+	if sqlutil.IsSQLite(t.db) {
+		query = `INSERT OR REPLACE INTO syncv3_typing(room_id, user_ids) VALUES($1, $2) RETURNING stream_id`
+	}
+	err = t.db.QueryRow(query, roomID, pq.Array(userIDs)).Scan(&position)
 	return position, err
 }
 
@@ -2,9 +2,11 @@ package state
 
 import (
 	"github.com/jmoiron/sqlx"
+	"github.com/matrix-org/sliding-sync/internal"
+	"github.com/matrix-org/sliding-sync/sqlutil"
 )
 
-// UnreadTable stores unread counts per-user
+// UnreadTable stores unread counts per-user, for each room and for each thread in a room.
 type UnreadTable struct {
 	db *sqlx.DB
 }
@@ -19,6 +21,15 @@ func NewUnreadTable(db *sqlx.DB) *UnreadTable {
 		highlight_count BIGINT NOT NULL DEFAULT 0,
 		UNIQUE(user_id, room_id)
 	);
+	-- only threads with unread notifications have rows
+	CREATE TABLE IF NOT EXISTS syncv3_unread_threads (
+		room_id TEXT NOT NULL,
+		user_id TEXT NOT NULL,
+		thread_id TEXT NOT NULL,
+		notification_count BIGINT NOT NULL DEFAULT 0,
+		highlight_count BIGINT NOT NULL DEFAULT 0,
+		UNIQUE(user_id, room_id, thread_id)
+	);
 	`)
 	return &UnreadTable{db}
 }
@@ -74,3 +85,53 @@ func (t *UnreadTable) UpdateUnreadCounters(userID, roomID string, highlightCount
 	}
 	return err
 }
+
+// SelectAllThreadCountsForUser returns room ID -> thread ID -> counts for every thread with unread
+// notifications.
+func (t *UnreadTable) SelectAllThreadCountsForUser(userID string) (map[string]map[string]internal.UnreadCounts, error) {
+	rows, err := t.db.Query(
+		`SELECT room_id, thread_id, notification_count, highlight_count FROM syncv3_unread_threads WHERE user_id=$1`,
+		userID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	result := make(map[string]map[string]internal.UnreadCounts)
+	for rows.Next() {
+		var roomID, threadID string
+		var counts internal.UnreadCounts
+		if err := rows.Scan(&roomID, &threadID, &counts.NotificationCount, &counts.HighlightCount); err != nil {
+			return nil, err
+		}
+		if result[roomID] == nil {
+			result[roomID] = make(map[string]internal.UnreadCounts)
+		}
+		result[roomID][threadID] = counts
+	}
+	return result, rows.Err()
+}
+
+// UpdateThreadUnreadCounters replaces the thread counts for this user in this room. Threads which
+// are not in threadCounts, or have zero counts, are deleted.
+func (t *UnreadTable) UpdateThreadUnreadCounters(userID, roomID string, threadCounts map[string]internal.UnreadCounts) error {
+	return sqlutil.WithTransaction(t.db, func(txn *sqlx.Tx) error {
+		_, err := txn.Exec(`DELETE FROM syncv3_unread_threads WHERE user_id=$1 AND room_id=$2`, userID, roomID)
+		if err != nil {
+			return err
+		}
+		for threadID, counts := range threadCounts {
+			if counts.HighlightCount == 0 && counts.NotificationCount == 0 {
+				continue
+			}
+			_, err = txn.Exec(
+				`INSERT INTO syncv3_unread_threads(room_id, user_id, thread_id, notification_count, highlight_count) VALUES($1, $2, $3, $4, $5)`,
+				roomID, userID, threadID, counts.NotificationCount, counts.HighlightCount,
+			)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
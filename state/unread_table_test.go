@@ -1,7 +1,10 @@
 package state
 
 import (
+	"reflect"
 	"testing"
+
+	"github.com/matrix-org/sliding-sync/internal"
 )
 
 func TestUnreadTable(t *testing.T) {
@@ -60,6 +63,45 @@ func TestUnreadTable(t *testing.T) {
 	}
 }
 
+func TestUnreadTableThreads(t *testing.T) {
+	db, close := connectToDB(t)
+	defer close()
+	table := NewUnreadTable(db)
+	userID := "@TestUnreadTableThreads:localhost"
+	roomA := "!TestUnreadTableThreadsA:localhost"
+	roomB := "!TestUnreadTableThreadsB:localhost"
+
+	assertNoError(t, table.UpdateThreadUnreadCounters(userID, roomA, map[string]internal.UnreadCounts{
+		"$thread1": {HighlightCount: 1, NotificationCount: 2},
+		"$thread2": {NotificationCount: 3},
+	}))
+	assertNoError(t, table.UpdateThreadUnreadCounters(userID, roomB, map[string]internal.UnreadCounts{
+		"$thread3": {NotificationCount: 1},
+	}))
+	// replaces the existing threads: thread1 is read, thread2 has a zero count so is dropped
+	assertNoError(t, table.UpdateThreadUnreadCounters(userID, roomA, map[string]internal.UnreadCounts{
+		"$thread2": {},
+		"$thread4": {HighlightCount: 5, NotificationCount: 5},
+	}))
+	got, err := table.SelectAllThreadCountsForUser(userID)
+	assertNoError(t, err)
+	want := map[string]map[string]internal.UnreadCounts{
+		roomA: {"$thread4": {HighlightCount: 5, NotificationCount: 5}},
+		roomB: {"$thread3": {NotificationCount: 1}},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("SelectAllThreadCountsForUser: got %+v want %+v", got, want)
+	}
+
+	// clearing all threads in a room removes the room
+	assertNoError(t, table.UpdateThreadUnreadCounters(userID, roomB, nil))
+	got, err = table.SelectAllThreadCountsForUser(userID)
+	assertNoError(t, err)
+	if _, exists := got[roomB]; exists {
+		t.Errorf("SelectAllThreadCountsForUser: room B still has threads: %+v", got[roomB])
+	}
+}
+
 func assertUnread(t *testing.T, table *UnreadTable, userID, roomID string, wantHighight, wantNotif int) {
 	t.Helper()
 	gotHighlight, gotNotif, err := table.SelectUnreadCounters(userID, roomID)
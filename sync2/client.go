@@ -29,6 +29,9 @@ type Client interface {
 	// homeserver supports Matrix >= 1.1.)
 	WhoAmI(ctx context.Context, accessToken string) (userID, deviceID string, err error)
 	DoSyncV2(ctx context.Context, accessToken, since string, isFirst bool, toDeviceOnly bool) (*SyncResponse, int, error)
+	// Messages pages backwards through a room's timeline from the given /messages or prev_batch
+	// token, or from the most recent event if from is empty.
+	Messages(ctx context.Context, accessToken, roomID, from string, limit int) (*MessagesResponse, int, error)
 }
 
 // HTTPClient represents a Sync v2 Client.
@@ -37,6 +40,9 @@ type HTTPClient struct {
 	Client            *http.Client
 	LongTimeoutClient *http.Client
 	DestinationServer string
+	// EnablePresence opts in to receiving presence from the upstream homeserver. If false,
+	// all presence is filtered out of sync v2 responses.
+	EnablePresence bool
 }
 
 func NewHTTPClient(shortTimeout, longTimeout time.Duration, destHomeServer string) *HTTPClient {
@@ -144,6 +150,37 @@ func (v *HTTPClient) DoSyncV2(ctx context.Context, accessToken, since string, is
 	}
 }
 
+// Messages performs a backwards /messages request. Returns the response and the response status
+// code or an error.
+func (v *HTTPClient) Messages(ctx context.Context, accessToken, roomID, from string, limit int) (*MessagesResponse, int, error) {
+	qps := url.Values{}
+	qps.Set("dir", "b")
+	qps.Set("limit", fmt.Sprintf("%d", limit))
+	if from != "" {
+		qps.Set("from", from)
+	}
+	messagesURL := fmt.Sprintf("%s/_matrix/client/v3/rooms/%s/messages?%s", v.DestinationServer, url.PathEscape(roomID), qps.Encode())
+	req, err := http.NewRequestWithContext(ctx, "GET", messagesURL, nil)
+	if err != nil {
+		return nil, 0, fmt.Errorf("Messages: NewRequest failed: %w", err)
+	}
+	req.Header.Set("User-Agent", "sync-v3-proxy-"+ProxyVersion)
+	req.Header.Set("Authorization", "Bearer "+accessToken)
+	res, err := v.Client.Do(req)
+	if err != nil {
+		return nil, 0, fmt.Errorf("Messages: request failed: %w", err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != 200 {
+		return nil, res.StatusCode, fmt.Errorf("Messages: response returned %s", res.Status)
+	}
+	var mr MessagesResponse
+	if err := json.NewDecoder(res.Body).Decode(&mr); err != nil {
+		return nil, 0, fmt.Errorf("Messages: response body decode JSON failed: %w", err)
+	}
+	return &mr, 200, nil
+}
+
 func (v *HTTPClient) createSyncURL(since string, isFirst, toDeviceOnly bool) string {
 	qps := "?"
 	if isFirst { // first time polling for v2-sync in this process
@@ -169,7 +206,8 @@ func (v *HTTPClient) createSyncURL(since string, isFirst, toDeviceOnly bool) str
 		timelineLimit = 1
 	}
 	room := map[string]interface{}{}
-	room["timeline"] = map[string]interface{}{"limit": timelineLimit}
+	// ask for notification counts per thread as well as for the whole room
+	room["timeline"] = map[string]interface{}{"limit": timelineLimit, "unread_thread_notifications": true}
 
 	if toDeviceOnly {
 		// no rooms match this filter, so we get everything but room data
@@ -177,8 +215,10 @@ func (v *HTTPClient) createSyncURL(since string, isFirst, toDeviceOnly bool) str
 	}
 	filter := map[string]interface{}{
 		"room": room,
-		// filter out all presence events (remove this once/if the proxy handles presence)
-		"presence": map[string]interface{}{"not_types": []string{"*"}},
+	}
+	if !v.EnablePresence {
+		// filter out all presence events, as nobody is going to consume them
+		filter["presence"] = map[string]interface{}{"not_types": []string{"*"}}
 	}
 	filterJSON, _ := json.Marshal(filter)
 	qps += "&filter=" + url.QueryEscape(string(filterJSON))
@@ -205,6 +245,7 @@ type SyncResponse struct {
 type SyncRoomsResponse struct {
 	Join   map[string]SyncV2JoinResponse   `json:"join"`
 	Invite map[string]SyncV2InviteResponse `json:"invite"`
+	Knock  map[string]SyncV2KnockResponse  `json:"knock"`
 	Leave  map[string]SyncV2LeaveResponse  `json:"leave"`
 }
 
@@ -215,6 +256,27 @@ type SyncV2JoinResponse struct {
 	Ephemeral           EventsResponse      `json:"ephemeral"`
 	AccountData         EventsResponse      `json:"account_data"`
 	UnreadNotifications UnreadNotifications `json:"unread_notifications"`
+	// thread root event ID -> counts, for threads with unread notifications
+	UnreadThreadNotifications map[string]UnreadNotifications `json:"unread_thread_notifications,omitempty"`
+}
+
+// ThreadUnreadCounts returns the unread counts for each thread in this room.
+func (r SyncV2JoinResponse) ThreadUnreadCounts() map[string]internal.UnreadCounts {
+	if len(r.UnreadThreadNotifications) == 0 {
+		return nil
+	}
+	counts := make(map[string]internal.UnreadCounts, len(r.UnreadThreadNotifications))
+	for threadID, n := range r.UnreadThreadNotifications {
+		var c internal.UnreadCounts
+		if n.HighlightCount != nil {
+			c.HighlightCount = *n.HighlightCount
+		}
+		if n.NotificationCount != nil {
+			c.NotificationCount = *n.NotificationCount
+		}
+		counts[threadID] = c
+	}
+	return counts
 }
 
 type UnreadNotifications struct {
@@ -237,6 +299,21 @@ type SyncV2InviteResponse struct {
 	InviteState EventsResponse `json:"invite_state"`
 }
 
+// SyncV2KnockResponse represents a /sync response for a room which is under the 'knock' key.
+type SyncV2KnockResponse struct {
+	KnockState EventsResponse `json:"knock_state"`
+}
+
+// MessagesResponse is a /messages response.
+type MessagesResponse struct {
+	// Events in reverse timeline order, as we only page backwards.
+	Chunk []json.RawMessage `json:"chunk"`
+	Start string            `json:"start"`
+	// End is omitted when there are no more events.
+	End   string            `json:"end,omitempty"`
+	State []json.RawMessage `json:"state,omitempty"`
+}
+
 // LeaveResponse represents a /sync response for a room which is under the 'leave' key.
 type SyncV2LeaveResponse struct {
 	State struct {
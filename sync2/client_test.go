@@ -1,8 +1,12 @@
 package sync2
 
 import (
+	"encoding/json"
 	"net/url"
+	"reflect"
 	"testing"
+
+	"github.com/matrix-org/sliding-sync/internal"
 )
 
 func TestSyncURL(t *testing.T) {
@@ -21,55 +25,55 @@ func TestSyncURL(t *testing.T) {
 			since:        "",
 			isFirst:      false,
 			toDeviceOnly: false,
-			wantURL:      wantBaseURL + `?timeout=30000&set_presence=offline&filter=` + url.QueryEscape(`{"presence":{"not_types":["*"]},"room":{"timeline":{"limit":1}}}`),
+			wantURL:      wantBaseURL + `?timeout=30000&set_presence=offline&filter=` + url.QueryEscape(`{"presence":{"not_types":["*"]},"room":{"timeline":{"limit":1,"unread_thread_notifications":true}}}`),
 		},
 		{
 			since:        "",
 			isFirst:      true,
 			toDeviceOnly: false,
-			wantURL:      wantBaseURL + `?timeout=0&set_presence=offline&filter=` + url.QueryEscape(`{"presence":{"not_types":["*"]},"room":{"timeline":{"limit":1}}}`),
+			wantURL:      wantBaseURL + `?timeout=0&set_presence=offline&filter=` + url.QueryEscape(`{"presence":{"not_types":["*"]},"room":{"timeline":{"limit":1,"unread_thread_notifications":true}}}`),
 		},
 		{
 			since:        "",
 			isFirst:      false,
 			toDeviceOnly: true,
-			wantURL:      wantBaseURL + `?timeout=30000&set_presence=offline&filter=` + url.QueryEscape(`{"presence":{"not_types":["*"]},"room":{"rooms":[],"timeline":{"limit":1}}}`),
+			wantURL:      wantBaseURL + `?timeout=30000&set_presence=offline&filter=` + url.QueryEscape(`{"presence":{"not_types":["*"]},"room":{"rooms":[],"timeline":{"limit":1,"unread_thread_notifications":true}}}`),
 		},
 		{
 			since:        "",
 			isFirst:      true,
 			toDeviceOnly: true,
-			wantURL:      wantBaseURL + `?timeout=0&set_presence=offline&filter=` + url.QueryEscape(`{"presence":{"not_types":["*"]},"room":{"rooms":[],"timeline":{"limit":1}}}`),
+			wantURL:      wantBaseURL + `?timeout=0&set_presence=offline&filter=` + url.QueryEscape(`{"presence":{"not_types":["*"]},"room":{"rooms":[],"timeline":{"limit":1,"unread_thread_notifications":true}}}`),
 		},
 		{
 			since:        "112233",
 			isFirst:      false,
 			toDeviceOnly: false,
-			wantURL:      wantBaseURL + `?timeout=30000&since=112233&set_presence=offline&filter=` + url.QueryEscape(`{"presence":{"not_types":["*"]},"room":{"timeline":{"limit":50}}}`),
+			wantURL:      wantBaseURL + `?timeout=30000&since=112233&set_presence=offline&filter=` + url.QueryEscape(`{"presence":{"not_types":["*"]},"room":{"timeline":{"limit":50,"unread_thread_notifications":true}}}`),
 		},
 		{
 			since:        "112233",
 			isFirst:      true,
 			toDeviceOnly: false,
-			wantURL:      wantBaseURL + `?timeout=0&since=112233&set_presence=offline&filter=` + url.QueryEscape(`{"presence":{"not_types":["*"]},"room":{"timeline":{"limit":50}}}`),
+			wantURL:      wantBaseURL + `?timeout=0&since=112233&set_presence=offline&filter=` + url.QueryEscape(`{"presence":{"not_types":["*"]},"room":{"timeline":{"limit":50,"unread_thread_notifications":true}}}`),
 		},
 		{
 			since:        "112233",
 			isFirst:      false,
 			toDeviceOnly: true,
-			wantURL:      wantBaseURL + `?timeout=30000&since=112233&set_presence=offline&filter=` + url.QueryEscape(`{"presence":{"not_types":["*"]},"room":{"rooms":[],"timeline":{"limit":50}}}`),
+			wantURL:      wantBaseURL + `?timeout=30000&since=112233&set_presence=offline&filter=` + url.QueryEscape(`{"presence":{"not_types":["*"]},"room":{"rooms":[],"timeline":{"limit":50,"unread_thread_notifications":true}}}`),
 		},
 		{
 			since:        "112233",
 			isFirst:      true,
 			toDeviceOnly: true,
-			wantURL:      wantBaseURL + `?timeout=0&since=112233&set_presence=offline&filter=` + url.QueryEscape(`{"presence":{"not_types":["*"]},"room":{"rooms":[],"timeline":{"limit":50}}}`),
+			wantURL:      wantBaseURL + `?timeout=0&since=112233&set_presence=offline&filter=` + url.QueryEscape(`{"presence":{"not_types":["*"]},"room":{"rooms":[],"timeline":{"limit":50,"unread_thread_notifications":true}}}`),
 		},
 		{
 			since:        "112233#145",
 			isFirst:      true,
 			toDeviceOnly: true,
-			wantURL:      wantBaseURL + `?timeout=0&since=112233%23145&set_presence=offline&filter=` + url.QueryEscape(`{"presence":{"not_types":["*"]},"room":{"rooms":[],"timeline":{"limit":50}}}`),
+			wantURL:      wantBaseURL + `?timeout=0&since=112233%23145&set_presence=offline&filter=` + url.QueryEscape(`{"presence":{"not_types":["*"]},"room":{"rooms":[],"timeline":{"limit":50,"unread_thread_notifications":true}}}`),
 		},
 	}
 	for i, tc := range testCases {
@@ -78,4 +82,35 @@ func TestSyncURL(t *testing.T) {
 			t.Errorf("Case %d/%d: got %v want %v", i+1, len(testCases), gotURL, tc.wantURL)
 		}
 	}
+
+	// presence is only requested when enabled
+	client.EnablePresence = true
+	wantURL := wantBaseURL + `?timeout=30000&since=112233&set_presence=offline&filter=` + url.QueryEscape(`{"room":{"timeline":{"limit":50,"unread_thread_notifications":true}}}`)
+	gotURL := client.createSyncURL("112233", false, false)
+	if gotURL != wantURL {
+		t.Errorf("EnablePresence: got %v want %v", gotURL, wantURL)
+	}
+}
+
+func TestThreadUnreadCounts(t *testing.T) {
+	var room SyncV2JoinResponse
+	if err := json.Unmarshal([]byte(`{
+		"unread_notifications": {"highlight_count": 0, "notification_count": 1},
+		"unread_thread_notifications": {
+			"$root1": {"highlight_count": 2, "notification_count": 3},
+			"$root2": {"notification_count": 4}
+		}
+	}`), &room); err != nil {
+		t.Fatalf("failed to unmarshal: %s", err)
+	}
+	want := map[string]internal.UnreadCounts{
+		"$root1": {HighlightCount: 2, NotificationCount: 3},
+		"$root2": {NotificationCount: 4},
+	}
+	if got := room.ThreadUnreadCounts(); !reflect.DeepEqual(got, want) {
+		t.Errorf("ThreadUnreadCounts: got %+v want %+v", got, want)
+	}
+	if got := (SyncV2JoinResponse{}).ThreadUnreadCounts(); got != nil {
+		t.Errorf("ThreadUnreadCounts with no threads: got %+v want nil", got)
+	}
 }
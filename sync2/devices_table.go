@@ -22,8 +22,8 @@ func NewDevicesTable(db *sqlx.DB) *DevicesTable {
 	CREATE TABLE IF NOT EXISTS syncv3_sync2_devices (
 		user_id TEXT NOT NULL,
 		device_id TEXT NOT NULL,
-		PRIMARY KEY (user_id, device_id),
-		since TEXT NOT NULL
+		since TEXT NOT NULL,
+		PRIMARY KEY (user_id, device_id)
 	);`)
 
 	return &DevicesTable{
@@ -59,9 +59,15 @@ func (t *DevicesTable) FindOldDevices(inactivityPeriod time.Duration) (devices [
 	err = t.db.Select(&devices, `
 		SELECT user_id, device_id
 		FROM syncv3_sync2_devices JOIN syncv3_sync2_tokens USING(user_id, device_id)
-		GROUP BY (user_id, device_id)
+		GROUP BY user_id, device_id
 		HAVING MAX(last_seen) < $1
 	`, time.Now().Add(-inactivityPeriod),
 	)
 	return
 }
+
+// AllUserIDs returns every user with a device on the proxy.
+func (t *DevicesTable) AllUserIDs() (userIDs []string, err error) {
+	err = t.db.Select(&userIDs, `SELECT DISTINCT user_id FROM syncv3_sync2_devices`)
+	return
+}
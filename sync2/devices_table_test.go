@@ -22,7 +22,7 @@ func TestMain(m *testing.M) {
 }
 
 func connectToDB(t *testing.T) (*sqlx.DB, func()) {
-	db, err := sqlx.Open("postgres", postgresConnectionString)
+	db, err := sqlutil.Open(postgresConnectionString)
 	if err != nil {
 		t.Fatalf("failed to open SQL db: %s", err)
 	}
@@ -102,7 +102,7 @@ func TestTokenForEachDevice(t *testing.T) {
 
 	// HACK: discard rows inserted by other tests. We don't normally need to do this,
 	// but this is testing a query that scans the entire devices table.
-	db.Exec("TRUNCATE syncv3_sync2_devices, syncv3_sync2_tokens;")
+	db.Exec("DELETE FROM syncv3_sync2_devices; DELETE FROM syncv3_sync2_tokens;")
 
 	tokens := NewTokensTable(db, "my_secret")
 	devices := NewDevicesTable(db)
@@ -185,6 +185,29 @@ func TestTokenForEachDevice(t *testing.T) {
 		assertEqual(t, gotTokens[i].DeviceID, wantTokens[i].DeviceID, "Token.DeviceID mismatch")
 		assertEqual(t, gotTokens[i].AccessToken, wantTokens[i].AccessToken, "Token.AccessToken mismatch")
 	}
+
+	t.Log("Only fetch tokens for devices whose poller leases have expired.")
+	leases := NewPollerLeasesTable(db)
+	for _, pid := range []PollerID{{UserID: alice, DeviceID: aliceDevice}, {UserID: chris, DeviceID: chrisDevice}} {
+		if _, err = leases.Acquire(pid, "instance", -time.Second); err != nil {
+			t.Fatalf("Acquire returned error: %s", err)
+		}
+	}
+	if _, err = leases.Acquire(PollerID{UserID: bob, DeviceID: bobDevice}, "instance", time.Minute); err != nil {
+		t.Fatalf("Acquire returned error: %s", err)
+	}
+	gotTokens, err = tokens.TokenForEachExpiredLease(time.Now())
+	if err != nil {
+		t.Fatalf("Failed TokenForEachExpiredLease: %s", err)
+	}
+	if len(gotTokens) != 1 {
+		t.Fatalf("TokenForEachExpiredLease: got %d tokens, want 1", len(gotTokens))
+	}
+	assertEqual(t, gotTokens[0].AccessToken, expectAlice.AccessToken, "Token.AccessToken mismatch")
+	assertEqual(t, gotTokens[0].Since, sinceValue, "Device.Since mismatch")
+	if err = leases.ReleaseAll("instance"); err != nil {
+		t.Fatalf("ReleaseAll returned error: %s", err)
+	}
 }
 
 func TestDevicesTable_FindOldDevices(t *testing.T) {
@@ -193,7 +216,7 @@ func TestDevicesTable_FindOldDevices(t *testing.T) {
 
 	// HACK: discard rows inserted by other tests. We don't normally need to do this,
 	// but this is testing a query that scans the entire devices table.
-	db.Exec("TRUNCATE syncv3_sync2_devices, syncv3_sync2_tokens;")
+	db.Exec("DELETE FROM syncv3_sync2_devices; DELETE FROM syncv3_sync2_tokens;")
 
 	tokens := NewTokensTable(db, "my_secret")
 	devices := NewDevicesTable(db)
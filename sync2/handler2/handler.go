@@ -14,6 +14,7 @@ import (
 	"github.com/getsentry/sentry-go"
 
 	"github.com/matrix-org/sliding-sync/internal"
+	"github.com/matrix-org/sliding-sync/notifier"
 	"github.com/matrix-org/sliding-sync/pubsub"
 	"github.com/matrix-org/sliding-sync/state"
 	"github.com/matrix-org/sliding-sync/sync2"
@@ -23,6 +24,13 @@ import (
 	"github.com/tidwall/sjson"
 )
 
+// unreadCounts are the notification counts most recently seen for a user in a room.
+type unreadCounts struct {
+	Highlight int
+	Notif     int
+	Threads   map[string]internal.UnreadCounts
+}
+
 // Handler is responsible for starting v2 pollers at startup;
 // processing v2 data (as a sync2.V2DataReceiver) and publishing updates (pubsub.Payload to V2Listeners);
 // and receiving and processing EnsurePolling events.
@@ -34,10 +42,7 @@ type Handler struct {
 	v3Sub   *pubsub.V3Sub
 	// user_id|room_id|event_type => fnv_hash(last_event_bytes)
 	accountDataMap *sync.Map
-	unreadMap      map[string]struct {
-		Highlight int
-		Notif     int
-	}
+	unreadMap      map[string]unreadCounts
 	// room_id -> PollerID, stores which Poller is allowed to update typing notifications
 	typingHandler map[string]sync2.PollerID
 	typingMu      *sync.Mutex
@@ -45,10 +50,15 @@ type Handler struct {
 
 	deviceDataTicker   *sync2.DeviceDataTicker
 	pollerExpiryTicker *time.Ticker
+	leases             *pollerLeases
 	e2eeWorkerPool     *internal.WorkerPool
 
 	numPollers prometheus.Gauge
 	subSystem  string
+
+	notifier Notifier
+	// room_id|user_id => the last event in the timeline most recently accumulated for this user
+	latestEvents map[string]*notifier.Event
 }
 
 func NewHandler(
@@ -56,14 +66,11 @@ func NewHandler(
 	pub pubsub.Notifier, sub pubsub.Listener, enablePrometheus bool, deviceDataUpdateDuration time.Duration,
 ) (*Handler, error) {
 	h := &Handler{
-		pMap:      pMap,
-		v2Store:   v2Store,
-		Store:     store,
-		subSystem: "poller",
-		unreadMap: make(map[string]struct {
-			Highlight int
-			Notif     int
-		}),
+		pMap:             pMap,
+		v2Store:          v2Store,
+		Store:            store,
+		subSystem:        "poller",
+		unreadMap:        make(map[string]unreadCounts),
 		accountDataMap:   &sync.Map{},
 		typingMu:         &sync.Mutex{},
 		typingHandler:    make(map[string]sync2.PollerID),
@@ -100,7 +107,8 @@ func (h *Handler) Listen() {
 }
 
 func (h *Handler) Teardown() {
-	// stop polling and tear down DB conns
+	// hand our pollers over to other instances, then stop polling and tear down DB conns
+	h.leases.releaseAll()
 	h.v3Sub.Teardown()
 	h.v2Pub.Close()
 	h.Store.Teardown()
@@ -113,6 +121,9 @@ func (h *Handler) Teardown() {
 	if h.numPollers != nil {
 		prometheus.Unregister(h.numPollers)
 	}
+	if h.notifier != nil {
+		h.notifier.Close()
+	}
 }
 
 func (h *Handler) StartV2Pollers() {
@@ -122,6 +133,14 @@ func (h *Handler) StartV2Pollers() {
 		sentry.CaptureException(err)
 		return
 	}
+	h.startPollers(tokens)
+	log.Info().Msg("StartV2Pollers finished")
+	h.startPollerExpiryTicker()
+}
+
+// startPollers starts a poller for each of these devices, skipping devices which are leased to
+// another instance.
+func (h *Handler) startPollers(tokens []sync2.TokenForPoller) {
 	// how many concurrent pollers to make at startup.
 	// Too high and this will flood the upstream server with sync requests at startup.
 	// Too low and this will take ages for the v2 pollers to startup.
@@ -148,10 +167,14 @@ func (h *Handler) StartV2Pollers() {
 					UserID:   t.UserID,
 					DeviceID: t.DeviceID,
 				}
-				_, err = h.pMap.EnsurePolling(
+				if !h.leases.acquire(pid) {
+					continue
+				}
+				_, err := h.pMap.EnsurePolling(
 					pid, t.AccessToken, t.Since, true)
 				if err != nil {
 					log.Err(err).Str("user_id", t.UserID).Str("device_id", t.DeviceID).Msg("Failed to start poller")
+					h.leases.release(pid)
 				} else {
 					h.updateMetrics()
 				}
@@ -164,8 +187,6 @@ func (h *Handler) StartV2Pollers() {
 		}()
 	}
 	wg.Wait()
-	log.Info().Msg("StartV2Pollers finished")
-	h.startPollerExpiryTicker()
 }
 
 func (h *Handler) updateMetrics() {
@@ -176,6 +197,7 @@ func (h *Handler) updateMetrics() {
 }
 
 func (h *Handler) OnTerminated(ctx context.Context, pollerID sync2.PollerID) {
+	h.leases.release(pollerID)
 	// Check if this device is handling any typing notifications, of so, remove it
 	h.typingMu.Lock()
 	defer h.typingMu.Unlock()
@@ -187,6 +209,14 @@ func (h *Handler) OnTerminated(ctx context.Context, pollerID sync2.PollerID) {
 	h.updateMetrics()
 }
 
+func (h *Handler) OnUpstreamHealth(ctx context.Context, health sync2.UpstreamHealth) {
+	h.v2Pub.Notify(pubsub.ChanV2, &pubsub.V2UpstreamHealth{
+		ServerName:   health.ServerName,
+		Degraded:     health.Degraded,
+		RetryAfterMS: health.RetryAfter.Milliseconds(),
+	})
+}
+
 func (h *Handler) OnExpiredToken(ctx context.Context, accessTokenHash, userID, deviceID string) {
 	err := h.v2Store.TokensTable.Delete(accessTokenHash)
 	if err != nil {
@@ -200,6 +230,20 @@ func (h *Handler) OnExpiredToken(ctx context.Context, accessTokenHash, userID, d
 	})
 }
 
+// ExpireToken is called when the authenticator rejects an access token which we had stored. The
+// token is expired as if the homeserver had rejected it whilst polling.
+func (h *Handler) ExpireToken(p *pubsub.V3ExpiredToken) {
+	pid := sync2.PollerID{UserID: p.UserID, DeviceID: p.DeviceID}
+	// don't block us from consuming more pubsub messages whilst the poller stops
+	go func() {
+		defer internal.ReportPanicsToSentry()
+		if h.pMap.ExpirePollerWithToken(pid, p.AccessTokenHash) {
+			return // the poller map has called OnExpiredToken
+		}
+		h.OnExpiredToken(context.Background(), p.AccessTokenHash, p.UserID, p.DeviceID)
+	}()
+}
+
 func (h *Handler) addPrometheusMetrics() {
 	h.numPollers = prometheus.NewGauge(prometheus.GaugeOpts{
 		Namespace: "sliding_sync",
@@ -292,6 +336,10 @@ func (h *Handler) Accumulate(ctx context.Context, userID, deviceID, roomID strin
 		return err
 	}
 
+	if len(timeline.Events) > 0 {
+		h.rememberLatestEvent(userID, roomID, timeline.Events[len(timeline.Events)-1])
+	}
+
 	// Consumers should reload state content before processing new timeline events.
 	if accResult.IncludesStateRedaction {
 		h.v2Pub.Notify(pubsub.ChanV2, &pubsub.V2StateRedaction{
@@ -425,6 +473,34 @@ func (h *Handler) OnReceipt(ctx context.Context, userID, roomID, ephEventType st
 	})
 }
 
+func (h *Handler) OnPresence(ctx context.Context, userID string, events []json.RawMessage) {
+	nowMs := time.Now().UnixMilli()
+	for _, ev := range events {
+		presence, ok, err := state.UnpackPresenceFromEvent(ev, nowMs)
+		if err != nil {
+			log.Warn().Err(err).Str("user", userID).Msg("OnPresence: failed to parse presence event")
+			continue
+		}
+		if !ok {
+			continue
+		}
+		// every poller for a user sharing a room with this sender will see the same update,
+		// so only notify when the stored presence actually changes.
+		changed, err := h.Store.PresenceTable.Upsert(presence)
+		if err != nil {
+			log.Err(err).Str("user", presence.UserID).Msg("failed to store presence")
+			internal.GetSentryHubFromContextOrDefault(ctx).CaptureException(err)
+			continue
+		}
+		if !changed {
+			continue
+		}
+		h.v2Pub.Notify(pubsub.ChanV2, &pubsub.V2Presence{
+			Presence: presence,
+		})
+	}
+}
+
 func (h *Handler) AddToDeviceMessages(ctx context.Context, userID, deviceID string, msgs []json.RawMessage) error {
 	_, err := h.Store.ToDeviceTable.InsertMessages(userID, deviceID, msgs)
 	if err != nil {
@@ -439,7 +515,7 @@ func (h *Handler) AddToDeviceMessages(ctx context.Context, userID, deviceID stri
 	return nil
 }
 
-func (h *Handler) UpdateUnreadCounts(ctx context.Context, roomID, userID string, highlightCount, notifCount *int) {
+func (h *Handler) UpdateUnreadCounts(ctx context.Context, roomID, userID string, highlightCount, notifCount *int, threadCounts map[string]internal.UnreadCounts) {
 	// only touch the DB and notify if they have changed. sync v2 will alwyas include the counts
 	// even if they haven't changed :(
 	key := roomID + userID
@@ -452,15 +528,17 @@ func (h *Handler) UpdateUnreadCounts(ctx context.Context, roomID, userID string,
 	if notifCount != nil {
 		nc = *notifCount
 	}
-	if ok && entry.Highlight == hc && entry.Notif == nc {
+	threadsChanged := !ok || !internal.SameThreadUnreadCounts(entry.Threads, threadCounts)
+	if ok && entry.Highlight == hc && entry.Notif == nc && !threadsChanged {
 		return // dupe
 	}
-	h.unreadMap[key] = struct {
-		Highlight int
-		Notif     int
-	}{
+	if h.notifier != nil {
+		h.notifyIfIncreased(ctx, userID, roomID, entry, ok, hc, nc)
+	}
+	h.unreadMap[key] = unreadCounts{
 		Highlight: hc,
 		Notif:     nc,
+		Threads:   threadCounts,
 	}
 
 	err := h.Store.UnreadTable.UpdateUnreadCounters(userID, roomID, highlightCount, notifCount)
@@ -468,11 +546,19 @@ func (h *Handler) UpdateUnreadCounts(ctx context.Context, roomID, userID string,
 		log.Err(err).Str("user", userID).Str("room", roomID).Msg("failed to update unread counters")
 		internal.GetSentryHubFromContextOrDefault(ctx).CaptureException(err)
 	}
+	if threadsChanged {
+		err = h.Store.UnreadTable.UpdateThreadUnreadCounters(userID, roomID, threadCounts)
+		if err != nil {
+			log.Err(err).Str("user", userID).Str("room", roomID).Msg("failed to update thread unread counters")
+			internal.GetSentryHubFromContextOrDefault(ctx).CaptureException(err)
+		}
+	}
 	h.v2Pub.Notify(pubsub.ChanV2, &pubsub.V2UnreadCounts{
-		RoomID:            roomID,
-		UserID:            userID,
-		HighlightCount:    highlightCount,
-		NotificationCount: notifCount,
+		RoomID:             roomID,
+		UserID:             userID,
+		HighlightCount:     highlightCount,
+		NotificationCount:  notifCount,
+		ThreadUnreadCounts: threadCounts,
 	})
 }
 
@@ -523,6 +609,13 @@ func (h *Handler) OnInvite(ctx context.Context, userID, roomID string, inviteSta
 		internal.GetSentryHubFromContextOrDefault(ctx).CaptureException(err)
 		return err
 	}
+	// an accepted knock turns into an invite
+	err = h.Store.KnocksTable.RemoveKnock(userID, roomID)
+	if err != nil {
+		log.Err(err).Str("user", userID).Str("room", roomID).Msg("failed to retire knock")
+		internal.GetSentryHubFromContextOrDefault(ctx).CaptureException(err)
+		return err
+	}
 	h.v2Pub.Notify(pubsub.ChanV2, &pubsub.V2InviteRoom{
 		UserID: userID,
 		RoomID: roomID,
@@ -530,7 +623,23 @@ func (h *Handler) OnInvite(ctx context.Context, userID, roomID string, inviteSta
 	return nil
 }
 
+func (h *Handler) OnKnock(ctx context.Context, userID, roomID string, knockState []json.RawMessage) error {
+	err := h.Store.KnocksTable.InsertKnock(userID, roomID, knockState)
+	if err != nil {
+		log.Err(err).Str("user", userID).Str("room", roomID).Msg("failed to insert knock")
+		internal.GetSentryHubFromContextOrDefault(ctx).CaptureException(err)
+		return err
+	}
+	h.v2Pub.Notify(pubsub.ChanV2, &pubsub.V2KnockRoom{
+		UserID: userID,
+		RoomID: roomID,
+	})
+	return nil
+}
+
 func (h *Handler) OnLeftRoom(ctx context.Context, userID, roomID string, leaveEv json.RawMessage) error {
+	// unread counts aren't sent for left rooms, so nothing will notify with the accumulated event
+	delete(h.latestEvents, roomID+userID)
 	// remove any invites for this user if they are rejecting an invite
 	err := h.Store.InvitesTable.RemoveInvite(userID, roomID)
 	if err != nil {
@@ -538,6 +647,13 @@ func (h *Handler) OnLeftRoom(ctx context.Context, userID, roomID string, leaveEv
 		internal.GetSentryHubFromContextOrDefault(ctx).CaptureException(err)
 		return err
 	}
+	// likewise for knocks which were rejected or rescinded
+	err = h.Store.KnocksTable.RemoveKnock(userID, roomID)
+	if err != nil {
+		log.Err(err).Str("user", userID).Str("room", roomID).Msg("failed to retire knock")
+		internal.GetSentryHubFromContextOrDefault(ctx).CaptureException(err)
+		return err
+	}
 
 	// Remove room from the typing deviceHandler map, this ensures we always
 	// have a device handling typing notifications for a given room.
@@ -565,18 +681,24 @@ func (h *Handler) EnsurePolling(p *pubsub.V3EnsurePolling) {
 		sentry.CaptureException(err)
 		return
 	}
+	pid := sync2.PollerID{
+		UserID:   p.UserID,
+		DeviceID: p.DeviceID,
+	}
+	if !h.leases.acquire(pid) {
+		// another instance is polling this device and will reply instead
+		log.Info().Msg("EnsurePolling: device is polled by another instance")
+		return
+	}
 	// don't block us from consuming more pubsub messages just because someone wants to sync
 	go func() {
 		// blocks until an initial sync is done
-		pid := sync2.PollerID{
-			UserID:   p.UserID,
-			DeviceID: p.DeviceID,
-		}
 		_, err = h.pMap.EnsurePolling(
 			pid, accessToken, since, false,
 		)
 		if err != nil {
 			log.Err(err).Msg("Failed to start poller")
+			h.leases.release(pid)
 		}
 		h.updateMetrics()
 		h.v2Pub.Notify(pubsub.ChanV2, &pubsub.V2InitialSyncComplete{
@@ -51,6 +51,14 @@ func (p *mockPollerMap) ExpirePollers([]sync2.PollerID) int {
 	return 0
 }
 
+func (p *mockPollerMap) ExpirePollerWithToken(sync2.PollerID, string) bool {
+	return false
+}
+
+func (p *mockPollerMap) TerminatePollers([]sync2.PollerID) int {
+	return 0
+}
+
 func (p *mockPollerMap) EnsurePolling(pid sync2.PollerID, accessToken, v2since string, isStartup bool) (bool, error) {
 	p.calls = append(p.calls, pollInfo{
 		pid:         pid,
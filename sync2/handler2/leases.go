@@ -0,0 +1,168 @@
+package handler2
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/getsentry/sentry-go"
+	"github.com/matrix-org/sliding-sync/sync2"
+	"github.com/rs/zerolog/log"
+)
+
+// How long a poller lease lasts without being renewed. Leases are renewed every third of this, so
+// an instance has to miss a couple of renewals before another instance takes over its pollers.
+const pollerLeaseTTL = time.Minute
+
+// pollerLeases tracks the leases this instance holds on devices, see sync2.PollerLeasesTable.
+// A nil *pollerLeases means leases are disabled and every poller may be started.
+type pollerLeases struct {
+	table      *sync2.PollerLeasesTable
+	instanceID string
+	stop       chan struct{}
+	released   atomic.Bool
+
+	mu   *sync.Mutex
+	held map[sync2.PollerID]struct{}
+}
+
+// acquire the lease for this device. Returns true if this instance may poll it.
+func (l *pollerLeases) acquire(pid sync2.PollerID) bool {
+	if l == nil {
+		return true
+	}
+	if l.released.Load() {
+		return false
+	}
+	ok, err := l.table.Acquire(pid, l.instanceID, pollerLeaseTTL)
+	if err != nil {
+		log.Err(err).Str("user", pid.UserID).Str("device", pid.DeviceID).Msg("failed to acquire poller lease")
+		sentry.CaptureException(err)
+		return false
+	}
+	if ok {
+		l.mu.Lock()
+		l.held[pid] = struct{}{}
+		l.mu.Unlock()
+	}
+	return ok
+}
+
+func (l *pollerLeases) release(pid sync2.PollerID) {
+	if l == nil || l.released.Load() {
+		return
+	}
+	l.mu.Lock()
+	delete(l.held, pid)
+	l.mu.Unlock()
+	if err := l.table.Release(pid, l.instanceID); err != nil {
+		log.Err(err).Str("user", pid.UserID).Str("device", pid.DeviceID).Msg("failed to release poller lease")
+		sentry.CaptureException(err)
+	}
+}
+
+// renew every lease we hold, returning the devices whose leases we have lost.
+func (l *pollerLeases) renew() (lost []sync2.PollerID, err error) {
+	renewed, err := l.table.Renew(l.instanceID, pollerLeaseTTL)
+	if err != nil {
+		return nil, err
+	}
+	stillHeld := make(map[sync2.PollerID]struct{}, len(renewed))
+	for _, pid := range renewed {
+		stillHeld[pid] = struct{}{}
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for pid := range l.held {
+		if _, ok := stillHeld[pid]; !ok {
+			lost = append(lost, pid)
+			delete(l.held, pid)
+		}
+	}
+	return lost, nil
+}
+
+// releaseAll gives up every lease, so other instances can take over straight away.
+func (l *pollerLeases) releaseAll() {
+	if l == nil || l.released.Swap(true) {
+		return
+	}
+	close(l.stop)
+	if err := l.table.ReleaseAll(l.instanceID); err != nil {
+		log.Err(err).Str("instance", l.instanceID).Msg("failed to release poller leases")
+		sentry.CaptureException(err)
+	}
+}
+
+// EnablePollerLeases makes this instance take a lease on each device before polling it, so that
+// several instances can share one database without polling the same device twice. The instance ID
+// must be unique to this instance.
+func (h *Handler) EnablePollerLeases(instanceID string) {
+	h.leases = &pollerLeases{
+		table:      h.v2Store.PollerLeasesTable,
+		instanceID: instanceID,
+		stop:       make(chan struct{}),
+		mu:         &sync.Mutex{},
+		held:       make(map[sync2.PollerID]struct{}),
+	}
+	go h.maintainPollerLeases()
+}
+
+// maintainPollerLeases runs until Teardown. It renews our leases, stops pollers whose leases we
+// have lost, and takes over the pollers of instances which have gone away.
+func (h *Handler) maintainPollerLeases() {
+	ticker := time.NewTicker(pollerLeaseTTL / 3)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-h.leases.stop:
+			return
+		case <-ticker.C:
+		}
+		lost, err := h.leases.renew()
+		if err != nil {
+			log.Err(err).Msg("failed to renew poller leases")
+			sentry.CaptureException(err)
+			continue
+		}
+		if len(lost) > 0 {
+			log.Warn().Int("num_lost", len(lost)).Msg("lost poller leases to another instance, stopping pollers")
+			h.pMap.TerminatePollers(lost)
+		}
+		h.adoptExpiredPollers()
+	}
+}
+
+// adoptExpiredPollers starts pollers for devices whose leases have expired.
+func (h *Handler) adoptExpiredPollers() {
+	now := time.Now()
+	expired, err := h.leases.table.Expired(now)
+	if err != nil {
+		log.Err(err).Msg("failed to select expired poller leases")
+		sentry.CaptureException(err)
+		return
+	}
+	if len(expired) == 0 {
+		return
+	}
+	adopt, err := h.v2Store.TokensTable.TokenForEachExpiredLease(now)
+	if err != nil {
+		log.Err(err).Msg("failed to query tokens for expired poller leases")
+		sentry.CaptureException(err)
+		return
+	}
+	hasToken := make(map[sync2.PollerID]struct{}, len(adopt))
+	for _, t := range adopt {
+		hasToken[sync2.PollerID{UserID: t.UserID, DeviceID: t.DeviceID}] = struct{}{}
+	}
+	for _, pid := range expired {
+		if _, ok := hasToken[pid]; !ok {
+			// the device has gone, so remove its lease
+			if h.leases.acquire(pid) {
+				h.leases.release(pid)
+			}
+		}
+	}
+	log.Info().Int("num_devices", len(adopt)).Msg("taking over pollers with expired leases")
+	h.startPollers(adopt)
+}
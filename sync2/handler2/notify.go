@@ -0,0 +1,78 @@
+package handler2
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/matrix-org/sliding-sync/internal"
+	"github.com/matrix-org/sliding-sync/notifier"
+	"github.com/rs/zerolog/log"
+	"github.com/tidwall/gjson"
+)
+
+// Notifier is told when a user's highlight or notification count in a room goes up.
+type Notifier interface {
+	Notify(n notifier.Notification)
+	Close()
+}
+
+// EnableNotifier makes the handler call the notifier when unread counts go up. Counts which have
+// never been seen before, such as those on a user's first sync, don't count as going up.
+func (h *Handler) EnableNotifier(n Notifier) {
+	h.notifier = n
+	h.latestEvents = make(map[string]*notifier.Event)
+}
+
+// rememberLatestEvent stores the last event in this timeline, so it can be included in any
+// notification sent when the poller updates the unread counts for this room straight afterwards.
+func (h *Handler) rememberLatestEvent(userID, roomID string, timeline []byte) {
+	if h.notifier == nil {
+		return
+	}
+	parsed := gjson.ParseBytes(timeline)
+	h.latestEvents[roomID+userID] = &notifier.Event{
+		EventID: parsed.Get("event_id").Str,
+		Type:    parsed.Get("type").Str,
+		Sender:  parsed.Get("sender").Str,
+	}
+}
+
+// notifyIfIncreased calls the notifier if either count has gone up since `prev`. If !hasPrev,
+// the previous counts are loaded from the database, before they are overwritten with the new ones.
+func (h *Handler) notifyIfIncreased(ctx context.Context, userID, roomID string, prev unreadCounts, hasPrev bool, highlightCount, notifCount int) {
+	latestEvent := h.latestEvents[roomID+userID]
+	delete(h.latestEvents, roomID+userID)
+	if !hasPrev {
+		var err error
+		prev.Highlight, prev.Notif, err = h.Store.UnreadTable.SelectUnreadCounters(userID, roomID)
+		if errors.Is(err, sql.ErrNoRows) {
+			return
+		}
+		if err != nil {
+			log.Err(err).Str("user", userID).Str("room", roomID).Msg("failed to select unread counters for notifier")
+			internal.GetSentryHubFromContextOrDefault(ctx).CaptureException(err)
+			return
+		}
+	}
+	if highlightCount <= prev.Highlight && notifCount <= prev.Notif {
+		return
+	}
+	metadata := internal.NewRoomMetadata(roomID)
+	if err := h.Store.ResetMetadataState(metadata); err != nil {
+		log.Err(err).Str("user", userID).Str("room", roomID).Msg("failed to load room metadata for notifier")
+		internal.GetSentryHubFromContextOrDefault(ctx).CaptureException(err)
+	}
+	metadata.RemoveHero(userID)
+	roomName, _ := internal.CalculateRoomName(metadata, 5)
+	h.notifier.Notify(notifier.Notification{
+		UserID:            userID,
+		RoomID:            roomID,
+		RoomName:          roomName,
+		HighlightCount:    highlightCount,
+		NotificationCount: notifCount,
+		Event:             latestEvent,
+		TS:                time.Now().UnixMilli(),
+	})
+}
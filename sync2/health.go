@@ -0,0 +1,275 @@
+package sync2
+
+import (
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/rs/zerolog/log"
+)
+
+// Upstream health. When a homeserver goes down, every poller talking to it starts failing at once.
+// Rather than each poller retrying on its own schedule (in lockstep with every other poller),
+// failed /sync requests are reported to a HealthTracker shared by all pollers for that homeserver.
+// Once enough requests in a row have failed, the circuit breaker opens: pollers and new
+// EnsurePolling calls wait until it has been open for a while, then a single poller is allowed
+// to probe the homeserver. If the probe succeeds the breaker closes and everyone carries on,
+// else it opens again for twice as long.
+
+// alias rand.Float64 so tests can make jitter deterministic
+var randFloat = rand.Float64
+
+type breakerState int
+
+const (
+	breakerClosed breakerState = iota
+	// requests are paused
+	breakerOpen
+	// a single probe request is allowed through
+	breakerHalfOpen
+)
+
+// UpstreamHealth is a snapshot of the upstream homeserver's health.
+type UpstreamHealth struct {
+	// the homeserver this is about, as keyed in Upstreams
+	ServerName string
+	// true if the circuit breaker is open, so pollers are paused
+	Degraded bool
+	// how long until the breaker next lets a request through
+	RetryAfter time.Duration
+}
+
+// healthMetrics are shared by the HealthTrackers for each homeserver, labelled by server name.
+type healthMetrics struct {
+	degraded *prometheus.GaugeVec
+	failures *prometheus.CounterVec
+	opened   *prometheus.CounterVec
+}
+
+func newHealthMetrics() *healthMetrics {
+	m := &healthMetrics{
+		degraded: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: "sliding_sync",
+			Subsystem: "poller",
+			Name:      "upstream_degraded",
+			Help:      "1 if the circuit breaker for the upstream homeserver is open, else 0.",
+		}, []string{"homeserver"}),
+		failures: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "sliding_sync",
+			Subsystem: "poller",
+			Name:      "upstream_failures",
+			Help:      "Total number of sync v2 requests which failed due to the upstream homeserver.",
+		}, []string{"homeserver"}),
+		opened: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "sliding_sync",
+			Subsystem: "poller",
+			Name:      "upstream_breaker_opened",
+			Help:      "Total number of times the circuit breaker for the upstream homeserver opened.",
+		}, []string{"homeserver"}),
+	}
+	prometheus.MustRegister(m.degraded, m.failures, m.opened)
+	return m
+}
+
+func (m *healthMetrics) unregister() {
+	prometheus.Unregister(m.degraded)
+	prometheus.Unregister(m.failures)
+	prometheus.Unregister(m.opened)
+}
+
+// HealthTracker tracks whether /sync requests to an upstream homeserver are succeeding.
+// It is safe for concurrent use.
+type HealthTracker struct {
+	// The number of consecutive failed requests, across all pollers, which opens the breaker.
+	FailureThreshold int
+	// How long the breaker stays open the first time it opens. This doubles every time the
+	// probe fails, up to MaxOpenDuration.
+	OpenDuration    time.Duration
+	MaxOpenDuration time.Duration
+
+	serverName          string
+	mu                  sync.Mutex
+	state               breakerState
+	consecutiveFailures int
+	openedAt            time.Time
+	openFor             time.Duration
+	probeStarted        time.Time
+	onChange            func(health UpstreamHealth)
+
+	degradedGauge    prometheus.Gauge
+	failuresCounter  prometheus.Counter
+	breakerOpenCount prometheus.Counter
+
+	// for tests
+	now func() time.Time
+}
+
+// newHealthTracker makes a HealthTracker for the homeserver with this server name. metrics may be nil.
+func newHealthTracker(serverName string, metrics *healthMetrics, onChange func(health UpstreamHealth)) *HealthTracker {
+	t := &HealthTracker{
+		FailureThreshold: 20,
+		OpenDuration:     10 * time.Second,
+		MaxOpenDuration:  5 * time.Minute,
+		serverName:       serverName,
+		onChange:         onChange,
+		now:              time.Now,
+	}
+	if metrics != nil {
+		t.degradedGauge = metrics.degraded.WithLabelValues(serverName)
+		t.failuresCounter = metrics.failures.WithLabelValues(serverName)
+		t.breakerOpenCount = metrics.opened.WithLabelValues(serverName)
+	}
+	return t
+}
+
+// Health returns the current health of the upstream homeserver.
+func (t *HealthTracker) Health() UpstreamHealth {
+	if t == nil {
+		return UpstreamHealth{}
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.health()
+}
+
+func (t *HealthTracker) health() UpstreamHealth {
+	if t.state == breakerClosed {
+		return UpstreamHealth{ServerName: t.serverName}
+	}
+	retryAfter := t.openedAt.Add(t.openFor).Sub(t.now())
+	if retryAfter < 0 {
+		retryAfter = 0
+	}
+	return UpstreamHealth{ServerName: t.serverName, Degraded: true, RetryAfter: retryAfter}
+}
+
+// RecordSuccess is called when the upstream homeserver responds to a request, even if the
+// response was an error which isn't the homeserver's fault e.g a 401.
+func (t *HealthTracker) RecordSuccess() {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	t.consecutiveFailures = 0
+	if t.state == breakerClosed {
+		t.mu.Unlock()
+		return
+	}
+	t.state = breakerClosed
+	t.openFor = 0
+	log.Info().Str("homeserver", t.serverName).Msg("HealthTracker: upstream homeserver has recovered, closing circuit breaker")
+	t.changed()
+}
+
+// RecordFailure is called when a request fails due to the upstream homeserver.
+func (t *HealthTracker) RecordFailure() {
+	if t == nil {
+		return
+	}
+	if t.failuresCounter != nil {
+		t.failuresCounter.Inc()
+	}
+	t.mu.Lock()
+	t.consecutiveFailures++
+	switch t.state {
+	case breakerClosed:
+		if t.consecutiveFailures < t.FailureThreshold {
+			t.mu.Unlock()
+			return
+		}
+		t.openFor = t.OpenDuration
+	case breakerOpen:
+		// requests which were in flight when the breaker opened
+		t.mu.Unlock()
+		return
+	case breakerHalfOpen:
+		// the probe failed
+		t.openFor *= 2
+		if t.openFor > t.MaxOpenDuration {
+			t.openFor = t.MaxOpenDuration
+		}
+	}
+	t.state = breakerOpen
+	t.openedAt = t.now()
+	if t.breakerOpenCount != nil {
+		t.breakerOpenCount.Inc()
+	}
+	log.Warn().Str("homeserver", t.serverName).Int("consecutive_failures", t.consecutiveFailures).Str("duration", t.openFor.String()).Msg(
+		"HealthTracker: upstream homeserver is unhealthy, opening circuit breaker",
+	)
+	t.changed()
+}
+
+// changed notifies listeners of the new health. Must be called with mu held, and unlocks it.
+func (t *HealthTracker) changed() {
+	health := t.health()
+	onChange := t.onChange
+	t.mu.Unlock()
+	if t.degradedGauge != nil {
+		if health.Degraded {
+			t.degradedGauge.Set(1)
+		} else {
+			t.degradedGauge.Set(0)
+		}
+	}
+	if onChange != nil {
+		onChange(health)
+	}
+}
+
+// Wait returns how long to wait before making a request. Returns 0 if the request can be made now.
+// Once the breaker has been open for long enough, callers which don't want to probe can carry on,
+// whereas only one caller at a time is allowed to probe. The result of the probe request must be
+// reported via RecordSuccess or RecordFailure.
+func (t *HealthTracker) Wait(probe bool) time.Duration {
+	if t == nil {
+		return 0
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.state == breakerClosed {
+		return 0
+	}
+	now := t.now()
+	reopenAt := t.openedAt.Add(t.openFor)
+	if now.Before(reopenAt) {
+		return reopenAt.Sub(now)
+	}
+	if !probe {
+		return 0
+	}
+	// Only one probe at a time. If the probe hasn't reported back after openFor, assume it
+	// went away (e.g the poller was terminated) and let someone else probe.
+	if t.state == breakerHalfOpen && now.Sub(t.probeStarted) < t.openFor {
+		return jitter(t.openFor)
+	}
+	t.state = breakerHalfOpen
+	t.probeStarted = now
+	return 0
+}
+
+// upstreamBackoff returns how long a poller should wait after failCount consecutive failed
+// requests to the upstream homeserver: 3s, 6s, 12s, ... up to 1 minute, with jitter.
+// We don't back off further than this because the response to a slow /sync may only be
+// cached by the homeserver for a short while, and waiting too long can force it to redo the work.
+func upstreamBackoff(failCount int) time.Duration {
+	backoff := 3 * time.Second
+	for i := 1; i < failCount && backoff < time.Minute; i++ {
+		backoff *= 2
+	}
+	if backoff > time.Minute {
+		backoff = time.Minute
+	}
+	return jitter(backoff)
+}
+
+// jitter returns a random duration between d/2 and d, so pollers don't retry in lockstep.
+func jitter(d time.Duration) time.Duration {
+	return d/2 + time.Duration(randFloat()*float64(d/2))
+}
+
+// isUpstreamFailure returns true if a failed /sync request was the upstream homeserver's fault.
+func isUpstreamFailure(statusCode int) bool {
+	return statusCode == 0 || statusCode == 429 || statusCode >= 500
+}
@@ -0,0 +1,81 @@
+package sync2
+
+import (
+	"math/rand"
+	"testing"
+	"time"
+)
+
+func TestHealthTracker(t *testing.T) {
+	now := time.Now()
+	var changes []UpstreamHealth
+	ht := newHealthTracker("example.org", nil, func(health UpstreamHealth) {
+		changes = append(changes, health)
+	})
+	ht.FailureThreshold = 3
+	ht.OpenDuration = 10 * time.Second
+	ht.MaxOpenDuration = 15 * time.Second
+	ht.now = func() time.Time { return now }
+	randFloat = func() float64 { return 1 }
+	defer func() { randFloat = rand.Float64 }()
+
+	assertWait := func(probe bool, want time.Duration) {
+		t.Helper()
+		if got := ht.Wait(probe); got != want {
+			t.Fatalf("Wait(%v): got %v want %v", probe, got, want)
+		}
+	}
+
+	// a success resets the count of consecutive failures
+	ht.RecordFailure()
+	ht.RecordFailure()
+	ht.RecordSuccess()
+	ht.RecordFailure()
+	ht.RecordFailure()
+	assertWait(true, 0)
+	if len(changes) != 0 {
+		t.Fatalf("breaker opened too early: %+v", changes)
+	}
+
+	ht.RecordFailure()
+	if len(changes) != 1 || changes[0] != (UpstreamHealth{ServerName: "example.org", Degraded: true, RetryAfter: 10 * time.Second}) {
+		t.Fatalf("breaker did not open: %+v", changes)
+	}
+	assertWait(true, 10*time.Second)
+	assertWait(false, 10*time.Second)
+
+	// once open for long enough, one caller can probe whilst others wait
+	now = now.Add(10 * time.Second)
+	assertWait(false, 0)
+	assertWait(true, 0)
+	assertWait(true, 10*time.Second)
+
+	// the probe failed, so open for longer, up to the max
+	ht.RecordFailure()
+	if !ht.Health().Degraded {
+		t.Fatalf("breaker closed after the probe failed")
+	}
+	assertWait(true, 15*time.Second)
+	now = now.Add(15 * time.Second)
+	assertWait(true, 0)
+
+	// the probe succeeded
+	ht.RecordSuccess()
+	if len(changes) != 3 || changes[2].Degraded {
+		t.Fatalf("breaker did not close: %+v", changes)
+	}
+	assertWait(true, 0)
+}
+
+func TestUpstreamBackoff(t *testing.T) {
+	randFloat = func() float64 { return 0 }
+	defer func() { randFloat = rand.Float64 }()
+	for failCount, want := range []time.Duration{1500 * time.Millisecond, 1500 * time.Millisecond, 3 * time.Second, 6 * time.Second, 12 * time.Second, 24 * time.Second, 30 * time.Second, 30 * time.Second} {
+		if failCount == 0 {
+			continue
+		}
+		if got := upstreamBackoff(failCount); got != want {
+			t.Errorf("upstreamBackoff(%d): got %v want %v", failCount, got, want)
+		}
+	}
+}
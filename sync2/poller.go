@@ -6,6 +6,7 @@ import (
 	"errors"
 	"fmt"
 	"runtime/debug"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -25,6 +26,16 @@ type PollerID struct {
 	DeviceID string
 }
 
+// PollerInfo is a snapshot of a running poller, used by the admin API.
+type PollerInfo struct {
+	UserID   string `json:"user_id"`
+	DeviceID string `json:"device_id"`
+	// The since token which will be used for the next sync v2 request.
+	Since string `json:"since"`
+	// When the last sync v2 response was processed. Zero if no response has been processed yet.
+	LastPoll time.Time `json:"last_poll"`
+}
+
 // alias time.Sleep/time.Since so tests can monkey patch it out
 var timeSleep = time.Sleep
 var timeSince = time.Since
@@ -47,17 +58,23 @@ type V2DataReceiver interface {
 	SetTyping(ctx context.Context, pollerID PollerID, roomID string, ephEvent json.RawMessage)
 	// Sent when there is a new receipt
 	OnReceipt(ctx context.Context, userID, roomID, ephEventType string, ephEvent json.RawMessage)
+	// Sent when there are presence events in the `presence` section of the v2 response.
+	OnPresence(ctx context.Context, userID string, events []json.RawMessage)
 	// AddToDeviceMessages adds this chunk of to_device messages. Preserve the ordering.
 	// Return an error to stop the since token advancing.
 	AddToDeviceMessages(ctx context.Context, userID, deviceID string, msgs []json.RawMessage) error
-	// UpdateUnreadCounts sets the highlight_count and notification_count for this user in this room.
-	UpdateUnreadCounts(ctx context.Context, roomID, userID string, highlightCount, notifCount *int)
+	// UpdateUnreadCounts sets the highlight_count and notification_count for this user in this room,
+	// along with the counts for each thread. threadCounts replaces any existing thread counts.
+	UpdateUnreadCounts(ctx context.Context, roomID, userID string, highlightCount, notifCount *int, threadCounts map[string]internal.UnreadCounts)
 	// Set the latest account data for this user.
 	// Return an error to stop the since token advancing.
 	OnAccountData(ctx context.Context, userID, roomID string, events []json.RawMessage) error // ping update with types? Can you race when re-querying?
 	// Sent when there is a room in the `invite` section of the v2 response.
 	// Return an error to stop the since token advancing.
 	OnInvite(ctx context.Context, userID, roomID string, inviteState []json.RawMessage) error // invitestate in db
+	// Sent when there is a room in the `knock` section of the v2 response.
+	// Return an error to stop the since token advancing.
+	OnKnock(ctx context.Context, userID, roomID string, knockState []json.RawMessage) error
 	// Sent when there is a room in the `leave` section of the v2 response.
 	// Return an error to stop the since token advancing.
 	OnLeftRoom(ctx context.Context, userID, roomID string, leaveEvent json.RawMessage) error
@@ -67,6 +84,8 @@ type V2DataReceiver interface {
 	OnTerminated(ctx context.Context, pollerID PollerID)
 	// Sent when the token gets a 401 response
 	OnExpiredToken(ctx context.Context, accessTokenHash, userID, deviceID string)
+	// Sent when the upstream homeserver becomes unhealthy, or recovers.
+	OnUpstreamHealth(ctx context.Context, health UpstreamHealth)
 }
 
 type IPollerMap interface {
@@ -77,11 +96,17 @@ type IPollerMap interface {
 	// ExpirePollers requests that the given pollers are terminated as if their access
 	// tokens had expired. Returns the number of pollers successfully terminated.
 	ExpirePollers(ids []PollerID) int
+	// ExpirePollerWithToken is like ExpirePollers for one device, but only if its poller is
+	// using this access token. Returns true if the poller was terminated.
+	ExpirePollerWithToken(id PollerID, accessTokenHash string) bool
+	// TerminatePollers stops the given pollers without expiring their access tokens, so they
+	// can be started again later. Returns the number of pollers terminated.
+	TerminatePollers(ids []PollerID) int
 }
 
 // PollerMap is a map of device ID to Poller
 type PollerMap struct {
-	v2Client                    Client
+	upstreams                   *Upstreams
 	callbacks                   V2DataReceiver
 	pollerMu                    *sync.Mutex
 	Pollers                     map[PollerID]*poller
@@ -92,6 +117,9 @@ type PollerMap struct {
 	gappyStateSizeVec           *prometheus.HistogramVec
 	numOutstandingSyncReqsGauge prometheus.Gauge
 	totalNumPollsCounter        prometheus.Counter
+	healthMetrics               *healthMetrics
+	// server name => health of that homeserver. Read-only once pollers are running.
+	healths map[string]*HealthTracker
 }
 
 // NewPollerMap makes a new PollerMap. Guarantees that the V2DataReceiver will be called on the same
@@ -120,12 +148,12 @@ type PollerMap struct {
 // NOT to-device messages,or since tokens.
 func NewPollerMap(v2Client Client, enablePrometheus bool) *PollerMap {
 	pm := &PollerMap{
-		v2Client: v2Client,
 		pollerMu: &sync.Mutex{},
 		Pollers:  make(map[PollerID]*poller),
 		executor: make(chan func(), 0),
 	}
 	if enablePrometheus {
+		pm.healthMetrics = newHealthMetrics()
 		pm.processHistogramVec = prometheus.NewHistogramVec(prometheus.HistogramOpts{
 			Namespace: "sliding_sync",
 			Subsystem: "poller",
@@ -165,6 +193,7 @@ func NewPollerMap(v2Client Client, enablePrometheus bool) *PollerMap {
 		})
 		prometheus.MustRegister(pm.numOutstandingSyncReqsGauge)
 	}
+	pm.SetUpstreams(NewUpstreams(v2Client))
 	return pm
 }
 
@@ -172,6 +201,20 @@ func (h *PollerMap) SetCallbacks(callbacks V2DataReceiver) {
 	h.callbacks = callbacks
 }
 
+// SetUpstreams sets which homeserver each device is polled from. Must be called before any
+// pollers are started.
+func (h *PollerMap) SetUpstreams(upstreams *Upstreams) {
+	h.upstreams = upstreams
+	h.healths = make(map[string]*HealthTracker)
+	for serverName := range upstreams.Clients() {
+		h.healths[serverName] = newHealthTracker(serverName, h.healthMetrics, func(health UpstreamHealth) {
+			if h.callbacks != nil {
+				h.callbacks.OnUpstreamHealth(context.Background(), health)
+			}
+		})
+	}
+}
+
 // Terminate all pollers. Useful in tests.
 func (h *PollerMap) Terminate() {
 	h.pollerMu.Lock()
@@ -194,6 +237,9 @@ func (h *PollerMap) Terminate() {
 	if h.numOutstandingSyncReqsGauge != nil {
 		prometheus.Unregister(h.numOutstandingSyncReqsGauge)
 	}
+	if h.healthMetrics != nil {
+		h.healthMetrics.unregister()
+	}
 	close(h.executor)
 }
 
@@ -223,8 +269,31 @@ func (h *PollerMap) DeviceIDs(userID string) []string {
 }
 
 func (h *PollerMap) ExpirePollers(pids []PollerID) int {
+	pollers := h.terminatePollers(pids)
+	for _, p := range pollers {
+		// Ensure that we won't recreate this poller on startup. If it reappears later,
+		// we'll make another EnsurePolling call which will recreate the poller.
+		h.callbacks.OnExpiredToken(context.Background(), hashToken(p.accessToken), p.userID, p.deviceID)
+	}
+	return len(pollers)
+}
+
+func (h *PollerMap) ExpirePollerWithToken(pid PollerID, accessTokenHash string) bool {
+	h.pollerMu.Lock()
+	p, ok := h.Pollers[pid]
+	h.pollerMu.Unlock()
+	if !ok || hashToken(p.accessToken) != accessTokenHash {
+		return false
+	}
+	return h.ExpirePollers([]PollerID{pid}) > 0
+}
+
+func (h *PollerMap) TerminatePollers(pids []PollerID) int {
+	return len(h.terminatePollers(pids))
+}
+
+func (h *PollerMap) terminatePollers(pids []PollerID) []*poller {
 	h.pollerMu.Lock()
-	numTerminated := 0
 	var pollersToTerminate []*poller
 	for _, pid := range pids {
 		p, ok := h.Pollers[pid]
@@ -237,13 +306,39 @@ func (h *PollerMap) ExpirePollers(pids []PollerID) int {
 	// now terminate the pollers.
 	for _, p := range pollersToTerminate {
 		p.Terminate()
-		// Ensure that we won't recreate this poller on startup. If it reappears later,
-		// we'll make another EnsurePolling call which will recreate the poller.
-		h.callbacks.OnExpiredToken(context.Background(), hashToken(p.accessToken), p.userID, p.deviceID)
-		numTerminated++
 	}
+	return pollersToTerminate
+}
+
+// UpstreamHealth returns the health of each upstream homeserver, as seen by this instance's pollers.
+func (h *PollerMap) UpstreamHealth() []UpstreamHealth {
+	healths := make([]UpstreamHealth, 0, len(h.healths))
+	for _, health := range h.healths {
+		healths = append(healths, health.Health())
+	}
+	slices.SortFunc(healths, func(a, b UpstreamHealth) int {
+		return strings.Compare(a.ServerName, b.ServerName)
+	})
+	return healths
+}
 
-	return numTerminated
+// PollerInfos returns a snapshot of every running poller, sorted by user then device.
+func (h *PollerMap) PollerInfos() []PollerInfo {
+	h.pollerMu.Lock()
+	infos := make([]PollerInfo, 0, len(h.Pollers))
+	for _, p := range h.Pollers {
+		if !p.terminated.Load() {
+			infos = append(infos, p.Info())
+		}
+	}
+	h.pollerMu.Unlock()
+	slices.SortFunc(infos, func(a, b PollerInfo) int {
+		if a.UserID != b.UserID {
+			return strings.Compare(a.UserID, b.UserID)
+		}
+		return strings.Compare(a.DeviceID, b.DeviceID)
+	})
+	return infos
 }
 
 // EnsurePolling makes sure there is a poller for this device, making one if need be.
@@ -271,6 +366,15 @@ func (h *PollerMap) EnsurePolling(pid PollerID, accessToken, v2since string, isS
 		poller.WaitUntilInitialSync()
 		return false, nil
 	}
+	// don't start new pollers whilst the upstream homeserver is unhealthy: they would only add to
+	// the load on it. Wait until the circuit breaker lets requests through again.
+	serverName := h.upstreams.ServerFor(pid.UserID)
+	if wait := h.healths[serverName].Wait(false); wait > 0 {
+		h.pollerMu.Unlock()
+		log.Info().Str("user", pid.UserID).Str("duration", wait.String()).Msg("PollerMap.EnsurePolling: upstream is unhealthy, waiting")
+		timeSleep(wait)
+		return h.EnsurePolling(pid, accessToken, v2since, isStartup)
+	}
 	// check if we need to wait at all: we don't need to if this user is already syncing on a different device
 	// This is O(n) so we may want to map this if we get a lot of users...
 	needToWait := true
@@ -288,12 +392,13 @@ func (h *PollerMap) EnsurePolling(pid PollerID, accessToken, v2since string, isS
 
 	// replace the poller. If we don't need to wait, then we just want to nab to-device events initially.
 	// We don't do that on startup though as we cannot be sure that other pollers will not be using expired tokens.
-	poller = newPoller(pid, accessToken, h.v2Client, h, !needToWait && !isStartup)
+	poller = newPoller(pid, accessToken, h.upstreams.ForUser(pid.UserID), h, !needToWait && !isStartup)
 	poller.processHistogramVec = h.processHistogramVec
 	poller.timelineSizeVec = h.timelineSizeHistogramVec
 	poller.gappyStateSizeVec = h.gappyStateSizeVec
 	poller.numOutstandingSyncReqs = h.numOutstandingSyncReqsGauge
 	poller.totalNumPolls = h.totalNumPollsCounter
+	poller.health = h.healths[serverName]
 	go poller.Poll(v2since)
 	h.Pollers[pid] = poller
 
@@ -358,6 +463,17 @@ func (h *PollerMap) OnInvite(ctx context.Context, userID, roomID string, inviteS
 	return
 }
 
+func (h *PollerMap) OnKnock(ctx context.Context, userID, roomID string, knockState []json.RawMessage) (err error) {
+	var wg sync.WaitGroup
+	wg.Add(1)
+	h.executor <- func() {
+		err = h.callbacks.OnKnock(ctx, userID, roomID, knockState)
+		wg.Done()
+	}
+	wg.Wait()
+	return
+}
+
 func (h *PollerMap) OnLeftRoom(ctx context.Context, userID, roomID string, leaveEvent json.RawMessage) (err error) {
 	var wg sync.WaitGroup
 	wg.Add(1)
@@ -383,11 +499,15 @@ func (h *PollerMap) OnExpiredToken(ctx context.Context, accessTokenHash, userID,
 	h.callbacks.OnExpiredToken(ctx, accessTokenHash, userID, deviceID)
 }
 
-func (h *PollerMap) UpdateUnreadCounts(ctx context.Context, roomID, userID string, highlightCount, notifCount *int) {
+func (h *PollerMap) OnUpstreamHealth(ctx context.Context, health UpstreamHealth) {
+	h.callbacks.OnUpstreamHealth(ctx, health)
+}
+
+func (h *PollerMap) UpdateUnreadCounts(ctx context.Context, roomID, userID string, highlightCount, notifCount *int, threadCounts map[string]internal.UnreadCounts) {
 	var wg sync.WaitGroup
 	wg.Add(1)
 	h.executor <- func() {
-		h.callbacks.UpdateUnreadCounts(ctx, roomID, userID, highlightCount, notifCount)
+		h.callbacks.UpdateUnreadCounts(ctx, roomID, userID, highlightCount, notifCount, threadCounts)
 		wg.Done()
 	}
 	wg.Wait()
@@ -414,6 +534,16 @@ func (h *PollerMap) OnReceipt(ctx context.Context, userID, roomID, ephEventType
 	wg.Wait()
 }
 
+func (h *PollerMap) OnPresence(ctx context.Context, userID string, events []json.RawMessage) {
+	var wg sync.WaitGroup
+	wg.Add(1)
+	h.executor <- func() {
+		h.callbacks.OnPresence(ctx, userID, events)
+		wg.Done()
+	}
+	wg.Wait()
+}
+
 func (h *PollerMap) OnE2EEData(ctx context.Context, userID, deviceID string, otkCounts map[string]int, fallbackKeyTypes []string, deviceListChanges map[string]int) error {
 	// This is device-scoped data and will never race with another poller. Therefore we
 	// do not need to queue this up in the executor. However: the poller does need to
@@ -440,12 +570,19 @@ type poller struct {
 	terminated *atomic.Bool
 	wg         *sync.WaitGroup
 
+	// the latest since token and when it was returned, for the admin API. Guarded by statusMu as
+	// these are read outside of the poll loop.
+	statusMu *sync.Mutex
+	since    string
+	lastPoll time.Time
+
 	// stats about poll response data, for logging purposes
 	lastLogged              time.Time
 	totalStateCalls         int
 	totalTimelineCalls      int
 	totalReceipts           int
 	totalTyping             int
+	totalPresence           int
 	totalInvites            int
 	totalDeviceEvents       int
 	totalAccountData        int
@@ -458,6 +595,8 @@ type poller struct {
 	gappyStateSizeVec      *prometheus.HistogramVec
 	numOutstandingSyncReqs prometheus.Gauge
 	totalNumPolls          prometheus.Counter
+	// shared by all pollers for the same homeserver. May be nil.
+	health *HealthTracker
 }
 
 func newPoller(pid PollerID, accessToken string, client Client, receiver V2DataReceiver, initialToDeviceOnly bool) *poller {
@@ -471,6 +610,7 @@ func newPoller(pid PollerID, accessToken string, client Client, receiver V2DataR
 		receiver:            receiver,
 		terminated:          &atomic.Bool{},
 		wg:                  &wg,
+		statusMu:            &sync.Mutex{},
 		initialToDeviceOnly: initialToDeviceOnly,
 	}
 }
@@ -484,11 +624,33 @@ func (p *poller) Terminate() {
 	p.terminated.CompareAndSwap(false, true)
 }
 
+// Info returns a snapshot of this poller.
+func (p *poller) Info() PollerInfo {
+	p.statusMu.Lock()
+	defer p.statusMu.Unlock()
+	return PollerInfo{
+		UserID:   p.userID,
+		DeviceID: p.deviceID,
+		Since:    p.since,
+		LastPoll: p.lastPoll,
+	}
+}
+
+func (p *poller) setSince(since string, lastPoll time.Time) {
+	p.statusMu.Lock()
+	defer p.statusMu.Unlock()
+	p.since = since
+	p.lastPoll = lastPoll
+}
+
 type pollLoopState struct {
 	firstTime       bool
 	failCount       int
 	since           string
 	lastStoredSince time.Time // The time we last stored the since token in the database
+
+	// the number of consecutive requests which failed due to the upstream homeserver
+	upstreamFailCount int
 }
 
 // Poll will block forever, repeatedly calling v2 sync. Do this in a goroutine.
@@ -506,6 +668,7 @@ func (p *poller) Poll(since string) {
 	ctx := sentry.SetHubOnContext(context.Background(), hub)
 
 	log.Info().Str("since", since).Msg("Poller: v2 poll loop started")
+	p.setSince(since, time.Time{})
 	defer func() {
 		panicErr := recover()
 		if panicErr != nil {
@@ -549,21 +712,31 @@ func (p *poller) poll(ctx context.Context, s *pollLoopState) error {
 		p.totalNumPolls.Inc()
 	}
 	if s.failCount > 0 {
-		if s.failCount > 1000 {
-			// 3s * 1000 = 3000s = 50 minutes
+		// don't blame the access token if the homeserver is down
+		if s.failCount > 1000 && !p.health.Health().Degraded {
 			errMsg := "poller: access token has failed >1000 times to /sync, terminating loop"
 			log.Warn().Msg(errMsg)
 			p.receiver.OnExpiredToken(ctx, hashToken(p.accessToken), p.userID, p.deviceID)
 			p.Terminate()
 			return fmt.Errorf(errMsg)
 		}
-		// don't backoff when doing v2 syncs because the response is only in the cache for a short
+		// don't backoff much when doing v2 syncs because the response is only in the cache for a short
 		// period of time (on massive accounts on matrix.org) such that if you wait 2,4,8min between
 		// requests it might force the server to do the work all over again :(
 		waitTime := 3 * time.Second
+		if s.upstreamFailCount > 0 {
+			waitTime = upstreamBackoff(s.upstreamFailCount)
+		}
 		log.Warn().Str("duration", waitTime.String()).Int("fail-count", s.failCount).Msg("Poller: waiting before next poll")
 		timeSleep(waitTime)
 	}
+	// wait for the circuit breaker, if the upstream homeserver is unhealthy
+	for wait := p.health.Wait(true); wait > 0; wait = p.health.Wait(true) {
+		if p.terminated.Load() {
+			return fmt.Errorf("poller terminated")
+		}
+		timeSleep(wait)
+	}
 	if p.terminated.Load() {
 		return fmt.Errorf("poller terminated")
 	}
@@ -581,6 +754,13 @@ func (p *poller) poll(ctx context.Context, s *pollLoopState) error {
 	if p.terminated.Load() {
 		return fmt.Errorf("poller terminated")
 	}
+	if err != nil && isUpstreamFailure(statusCode) {
+		p.health.RecordFailure()
+		s.upstreamFailCount += 1
+	} else {
+		p.health.RecordSuccess()
+		s.upstreamFailCount = 0
+	}
 	if err != nil {
 		// check if temporary
 		isFatal := statusCode == 401 || statusCode == 403
@@ -623,6 +803,7 @@ func (p *poller) poll(ctx context.Context, s *pollLoopState) error {
 		s.failCount += 1
 		return nil
 	}
+	p.parsePresence(ctx, resp)
 	// process to-device messages as the LAST retryable data so we don't double-process
 	// to-device msgs on retrys. In other words, if parseToDeviceMessages returns no error
 	// then we for sure are going to increment the since token, so cannot see duplicates.
@@ -640,6 +821,7 @@ func (p *poller) poll(ctx context.Context, s *pollLoopState) error {
 	wasFirst := s.firstTime
 
 	s.since = resp.NextBatch
+	p.setSince(s.since, time.Now())
 	// Persist the since token if it either was more than one minute ago since we
 	// last stored it OR the response contains to-device messages
 	if timeSince(s.lastStoredSince) > time.Minute || len(resp.ToDevice.Events) > 0 {
@@ -779,6 +961,16 @@ func (p *poller) parseGlobalAccountData(ctx context.Context, res *SyncResponse)
 	return p.receiver.OnAccountData(ctx, p.userID, AccountDataGlobalRoom, res.AccountData.Events)
 }
 
+func (p *poller) parsePresence(ctx context.Context, res *SyncResponse) {
+	ctx, task := internal.StartTask(ctx, "parsePresence")
+	defer task.End()
+	if len(res.Presence.Events) == 0 {
+		return
+	}
+	p.totalPresence += len(res.Presence.Events)
+	p.receiver.OnPresence(ctx, p.userID, res.Presence.Events)
+}
+
 func (p *poller) parseRoomsResponse(ctx context.Context, res *SyncResponse) error {
 	ctx, task := internal.StartTask(ctx, "parseRoomsResponse")
 	defer task.End()
@@ -880,8 +1072,13 @@ func (p *poller) parseRoomsResponse(ctx context.Context, res *SyncResponse) erro
 		// process unread counts AFTER events so global caches have been updated by the time this metadata is added.
 		// Previously we did this BEFORE events so we atomically showed the event and the unread count in one go, but
 		// this could cause clients to de-sync: see TestUnreadCountMisordering integration test.
+		// Threads with no unread notifications are omitted, so the thread counts are only meaningful
+		// alongside the room counts.
 		if roomData.UnreadNotifications.HighlightCount != nil || roomData.UnreadNotifications.NotificationCount != nil {
-			p.receiver.UpdateUnreadCounts(ctx, roomID, p.userID, roomData.UnreadNotifications.HighlightCount, roomData.UnreadNotifications.NotificationCount)
+			p.receiver.UpdateUnreadCounts(
+				ctx, roomID, p.userID, roomData.UnreadNotifications.HighlightCount, roomData.UnreadNotifications.NotificationCount,
+				roomData.ThreadUnreadCounts(),
+			)
 		}
 	}
 	for roomID, roomData := range res.Rooms.Leave {
@@ -917,6 +1114,12 @@ func (p *poller) parseRoomsResponse(ctx context.Context, res *SyncResponse) erro
 			lastErrs = append(lastErrs, fmt.Errorf("OnInvite[%s]: %w", roomID, err))
 		}
 	}
+	for roomID, roomData := range res.Rooms.Knock {
+		err := p.receiver.OnKnock(ctx, p.userID, roomID, roomData.KnockState.Events)
+		if err != nil {
+			lastErrs = append(lastErrs, fmt.Errorf("OnKnock[%s]: %w", roomID, err))
+		}
+	}
 
 	p.totalReceipts += receiptCalls
 	p.totalStateCalls += stateCalls
@@ -966,7 +1169,7 @@ func (p *poller) maybeLogStats(force bool) {
 		"device [events,changed,left,account]", []int{
 			p.totalDeviceEvents, p.totalChangedDeviceLists, p.totalLeftDeviceLists, p.totalAccountData,
 		},
-	).Msg("Poller: accumulated data")
+	).Int("presence", p.totalPresence).Msg("Poller: accumulated data")
 
 	p.totalAccountData = 0
 	p.totalChangedDeviceLists = 0
@@ -977,6 +1180,7 @@ func (p *poller) maybeLogStats(force bool) {
 	p.totalStateCalls = 0
 	p.totalTimelineCalls = 0
 	p.totalTyping = 0
+	p.totalPresence = 0
 }
 
 func (p *poller) trackTimelineSize(size int, limited bool) {
@@ -0,0 +1,78 @@
+package sync2
+
+import (
+	"database/sql"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// PollerLeasesTable records which proxy instance owns the poller for each device. When several
+// instances share a database, an instance must hold the lease for a device before polling it, so
+// a device is never polled twice. Leases expire if they are not renewed, which lets another
+// instance take over the pollers of an instance which has died.
+type PollerLeasesTable struct {
+	db *sqlx.DB
+}
+
+func NewPollerLeasesTable(db *sqlx.DB) *PollerLeasesTable {
+	// make sure tables are made
+	db.MustExec(`
+	CREATE TABLE IF NOT EXISTS syncv3_poller_leases (
+		user_id TEXT NOT NULL,
+		device_id TEXT NOT NULL,
+		instance_id TEXT NOT NULL,
+		expires_ts BIGINT NOT NULL,
+		UNIQUE(user_id, device_id)
+	);
+	CREATE INDEX IF NOT EXISTS syncv3_poller_leases_expires_idx ON syncv3_poller_leases(expires_ts);
+	`)
+	return &PollerLeasesTable{db}
+}
+
+// Acquire the lease on this device for this instance. Succeeds if nobody holds the lease, the
+// lease has expired, or this instance already holds it, in which case it is extended.
+func (t *PollerLeasesTable) Acquire(pid PollerID, instanceID string, ttl time.Duration) (bool, error) {
+	now := time.Now()
+	var holder string
+	err := t.db.QueryRow(`
+	INSERT INTO syncv3_poller_leases(user_id, device_id, instance_id, expires_ts) VALUES($1, $2, $3, $4)
+	ON CONFLICT (user_id, device_id) DO UPDATE SET instance_id = EXCLUDED.instance_id, expires_ts = EXCLUDED.expires_ts
+	WHERE syncv3_poller_leases.instance_id = EXCLUDED.instance_id OR syncv3_poller_leases.expires_ts < $5
+	RETURNING instance_id`,
+		pid.UserID, pid.DeviceID, instanceID, now.Add(ttl).UnixMilli(), now.UnixMilli(),
+	).Scan(&holder)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// Renew every lease held by this instance. Returns the devices this instance still holds leases
+// for: a lease can be lost if it expired and was acquired by another instance.
+func (t *PollerLeasesTable) Renew(instanceID string, ttl time.Duration) (pids []PollerID, err error) {
+	err = t.db.Select(&pids, `UPDATE syncv3_poller_leases SET expires_ts=$1 WHERE instance_id=$2
+	RETURNING user_id AS userid, device_id AS deviceid`, time.Now().Add(ttl).UnixMilli(), instanceID)
+	return
+}
+
+// Expired returns the devices whose leases expired before this time without being released, which
+// means the instance polling them has gone away.
+func (t *PollerLeasesTable) Expired(expiredBefore time.Time) (pids []PollerID, err error) {
+	err = t.db.Select(&pids, `SELECT user_id AS userid, device_id AS deviceid FROM syncv3_poller_leases
+	WHERE expires_ts < $1`, expiredBefore.UnixMilli())
+	return
+}
+
+// Release the lease on this device, if this instance holds it.
+func (t *PollerLeasesTable) Release(pid PollerID, instanceID string) error {
+	_, err := t.db.Exec(`DELETE FROM syncv3_poller_leases WHERE user_id=$1 AND device_id=$2 AND instance_id=$3`,
+		pid.UserID, pid.DeviceID, instanceID)
+	return err
+}
+
+// ReleaseAll releases every lease held by this instance.
+func (t *PollerLeasesTable) ReleaseAll(instanceID string) error {
+	_, err := t.db.Exec(`DELETE FROM syncv3_poller_leases WHERE instance_id=$1`, instanceID)
+	return err
+}
@@ -0,0 +1,72 @@
+package sync2
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestPollerLeasesTable(t *testing.T) {
+	db, close := connectToDB(t)
+	defer close()
+	table := NewPollerLeasesTable(db)
+	alice := PollerID{UserID: "@TestPollerLeasesTable_alice:localhost", DeviceID: "A"}
+	bob := PollerID{UserID: "@TestPollerLeasesTable_bob:localhost", DeviceID: "B"}
+	mustAcquire := func(pid PollerID, instanceID string, ttl time.Duration, want bool) {
+		t.Helper()
+		got, err := table.Acquire(pid, instanceID, ttl)
+		if err != nil {
+			t.Fatalf("Acquire: %s", err)
+		}
+		if got != want {
+			t.Fatalf("Acquire(%v, %s): got %v want %v", pid, instanceID, got, want)
+		}
+	}
+
+	mustAcquire(alice, "one", time.Minute, true)
+	// the holder can re-acquire, nobody else can
+	mustAcquire(alice, "one", time.Minute, true)
+	mustAcquire(alice, "two", time.Minute, false)
+
+	// expired leases can be taken over
+	mustAcquire(bob, "one", -time.Second, true)
+	expired, err := table.Expired(time.Now())
+	if err != nil {
+		t.Fatalf("Expired: %s", err)
+	}
+	if !containsPollerID(expired, bob) || containsPollerID(expired, alice) {
+		t.Fatalf("Expired: got %v want bob but not alice", expired)
+	}
+	mustAcquire(bob, "two", time.Minute, true)
+
+	renewed, err := table.Renew("one", time.Minute)
+	if err != nil {
+		t.Fatalf("Renew: %s", err)
+	}
+	if !reflect.DeepEqual(renewed, []PollerID{alice}) {
+		t.Fatalf("Renew: got %v want only alice as bob was taken over", renewed)
+	}
+
+	// only the holder can release
+	if err = table.Release(bob, "one"); err != nil {
+		t.Fatalf("Release: %s", err)
+	}
+	mustAcquire(bob, "one", time.Minute, false)
+	if err = table.ReleaseAll("two"); err != nil {
+		t.Fatalf("ReleaseAll: %s", err)
+	}
+	mustAcquire(bob, "one", time.Minute, true)
+	if err = table.ReleaseAll("one"); err != nil {
+		t.Fatalf("ReleaseAll: %s", err)
+	}
+	mustAcquire(alice, "two", time.Minute, true)
+}
+
+func containsPollerID(pids []PollerID, pid PollerID) bool {
+	for _, p := range pids {
+		if p == pid {
+			return true
+		}
+	}
+	return false
+}
@@ -4,6 +4,7 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"math/rand"
 	"net/http"
 	"strconv"
 	"sync"
@@ -37,6 +38,7 @@ func setTimeSleepDelay(val time.Duration, fn ...func(d time.Duration)) {
 	timeSleepMu.Lock()
 	defer timeSleepMu.Unlock()
 	timeSleepValue = val
+	timeSleepCheck = nil
 	if len(fn) > 0 {
 		timeSleepCheck = fn[0]
 	}
@@ -75,11 +77,7 @@ func TestPollerMapEnsurePolling(t *testing.T) {
 	}
 	initialResponse := &SyncResponse{
 		NextBatch: nextSince,
-		Rooms: struct {
-			Join   map[string]SyncV2JoinResponse   `json:"join"`
-			Invite map[string]SyncV2InviteResponse `json:"invite"`
-			Leave  map[string]SyncV2LeaveResponse  `json:"leave"`
-		}{
+		Rooms: SyncRoomsResponse{
 			Join: map[string]SyncV2JoinResponse{
 				roomID: {
 					State: EventsResponse{
@@ -158,11 +156,7 @@ func TestPollerMapEnsurePollingIdempotent(t *testing.T) {
 	}
 	initialResponse := &SyncResponse{
 		NextBatch: nextSince,
-		Rooms: struct {
-			Join   map[string]SyncV2JoinResponse   `json:"join"`
-			Invite map[string]SyncV2InviteResponse `json:"invite"`
-			Leave  map[string]SyncV2LeaveResponse  `json:"leave"`
-		}{
+		Rooms: SyncRoomsResponse{
 			Join: map[string]SyncV2JoinResponse{
 				roomID: {
 					State: EventsResponse{
@@ -353,11 +347,7 @@ func TestPollerPollFromNothing(t *testing.T) {
 			joinResp.State.Events = roomState
 			return &SyncResponse{
 				NextBatch: nextSince,
-				Rooms: struct {
-					Join   map[string]SyncV2JoinResponse   `json:"join"`
-					Invite map[string]SyncV2InviteResponse `json:"invite"`
-					Leave  map[string]SyncV2LeaveResponse  `json:"leave"`
-				}{
+				Rooms: SyncRoomsResponse{
 					Join: map[string]SyncV2JoinResponse{
 						roomID: joinResp,
 					},
@@ -444,11 +434,7 @@ func TestPollerPollFromExisting(t *testing.T) {
 			// ToDevice messages in the response)
 			ToDevice:  EventsResponse{Events: toDeviceResponses[sinceInt]},
 			NextBatch: fmt.Sprintf("%d", sinceInt+1),
-			Rooms: struct {
-				Join   map[string]SyncV2JoinResponse   `json:"join"`
-				Invite map[string]SyncV2InviteResponse `json:"invite"`
-				Leave  map[string]SyncV2LeaveResponse  `json:"leave"`
-			}{
+			Rooms: SyncRoomsResponse{
 				Join: map[string]SyncV2JoinResponse{
 					roomID: joinResp,
 				},
@@ -632,7 +618,8 @@ func TestPollerGivesUpEventually(t *testing.T) {
 	}
 }
 
-// Tests that the poller backs off in 2,4,8,etc second increments to a variety of errors
+// Tests that the poller backs off in 3,6,12,etc second increments to errors from the upstream
+// homeserver, and waits 3s after any other error.
 func TestPollerBackoff(t *testing.T) {
 	deviceID := "FOOBAR"
 	hasPolledSuccessfully := make(chan struct{})
@@ -649,19 +636,27 @@ func TestPollerBackoff(t *testing.T) {
 		{
 			code:    500,
 			err:     fmt.Errorf("internal server error"),
-			backoff: 3 * time.Second,
+			backoff: 6 * time.Second,
 		},
 		{
 			code:    502,
 			err:     fmt.Errorf("bad gateway error"),
-			backoff: 3 * time.Second,
+			backoff: 12 * time.Second,
 		},
 		{
 			code:    404,
 			err:     fmt.Errorf("not found"),
 			backoff: 3 * time.Second,
 		},
+		{
+			code:    429,
+			err:     fmt.Errorf("too many requests"),
+			backoff: 3 * time.Second,
+		},
 	}
+	// no jitter
+	randFloat = func() float64 { return 1 }
+	defer func() { randFloat = rand.Float64 }()
 	errorResponsesIndex := 0
 	var wantBackoffDuration time.Duration
 	accumulator, client := newMocks(func(authHeader, since string) (*SyncResponse, int, error) {
@@ -1272,6 +1267,9 @@ func (c *mockClient) DoSyncV2(ctx context.Context, authHeader, since string, isF
 func (c *mockClient) WhoAmI(ctx context.Context, authHeader string) (string, string, error) {
 	return "@alice:localhost", "device_123", nil
 }
+func (c *mockClient) Messages(ctx context.Context, authHeader, roomID, from string, limit int) (*MessagesResponse, int, error) {
+	return &MessagesResponse{Start: from}, 200, nil
+}
 
 type mockDataReceiver struct {
 	*overrideDataReceiver
@@ -1315,14 +1313,17 @@ type overrideDataReceiver struct {
 	setTyping           func(ctx context.Context, pollerID PollerID, roomID string, ephEvent json.RawMessage)
 	updateDeviceSince   func(ctx context.Context, userID, deviceID, since string)
 	addToDeviceMessages func(ctx context.Context, userID, deviceID string, msgs []json.RawMessage) error
-	updateUnreadCounts  func(ctx context.Context, roomID, userID string, highlightCount, notifCount *int)
+	updateUnreadCounts  func(ctx context.Context, roomID, userID string, highlightCount, notifCount *int, threadCounts map[string]internal.UnreadCounts)
 	onAccountData       func(ctx context.Context, userID, roomID string, events []json.RawMessage) error
 	onReceipt           func(ctx context.Context, userID, roomID, ephEventType string, ephEvent json.RawMessage)
+	onPresence          func(ctx context.Context, userID string, events []json.RawMessage)
 	onInvite            func(ctx context.Context, userID, roomID string, inviteState []json.RawMessage) error
+	onKnock             func(ctx context.Context, userID, roomID string, knockState []json.RawMessage) error
 	onLeftRoom          func(ctx context.Context, userID, roomID string, leaveEvent json.RawMessage) error
 	onE2EEData          func(ctx context.Context, userID, deviceID string, otkCounts map[string]int, fallbackKeyTypes []string, deviceListChanges map[string]int) error
 	onTerminated        func(ctx context.Context, pollerID PollerID)
 	onExpiredToken      func(ctx context.Context, accessTokenHash, userID, deviceID string)
+	onUpstreamHealth    func(ctx context.Context, health UpstreamHealth)
 }
 
 func (s *overrideDataReceiver) Accumulate(ctx context.Context, userID, deviceID, roomID string, timeline TimelineResponse) error {
@@ -1355,11 +1356,11 @@ func (s *overrideDataReceiver) AddToDeviceMessages(ctx context.Context, userID,
 	}
 	return s.addToDeviceMessages(ctx, userID, deviceID, msgs)
 }
-func (s *overrideDataReceiver) UpdateUnreadCounts(ctx context.Context, roomID, userID string, highlightCount, notifCount *int) {
+func (s *overrideDataReceiver) UpdateUnreadCounts(ctx context.Context, roomID, userID string, highlightCount, notifCount *int, threadCounts map[string]internal.UnreadCounts) {
 	if s.updateUnreadCounts == nil {
 		return
 	}
-	s.updateUnreadCounts(ctx, roomID, userID, highlightCount, notifCount)
+	s.updateUnreadCounts(ctx, roomID, userID, highlightCount, notifCount, threadCounts)
 }
 func (s *overrideDataReceiver) OnAccountData(ctx context.Context, userID, roomID string, events []json.RawMessage) error {
 	if s.onAccountData == nil {
@@ -1373,12 +1374,24 @@ func (s *overrideDataReceiver) OnReceipt(ctx context.Context, userID, roomID, ep
 	}
 	s.onReceipt(ctx, userID, roomID, ephEventType, ephEvent)
 }
+func (s *overrideDataReceiver) OnPresence(ctx context.Context, userID string, events []json.RawMessage) {
+	if s.onPresence == nil {
+		return
+	}
+	s.onPresence(ctx, userID, events)
+}
 func (s *overrideDataReceiver) OnInvite(ctx context.Context, userID, roomID string, inviteState []json.RawMessage) error {
 	if s.onInvite == nil {
 		return nil
 	}
 	return s.onInvite(ctx, userID, roomID, inviteState)
 }
+func (s *overrideDataReceiver) OnKnock(ctx context.Context, userID, roomID string, knockState []json.RawMessage) error {
+	if s.onKnock == nil {
+		return nil
+	}
+	return s.onKnock(ctx, userID, roomID, knockState)
+}
 func (s *overrideDataReceiver) OnLeftRoom(ctx context.Context, userID, roomID string, leaveEvent json.RawMessage) error {
 	if s.onLeftRoom == nil {
 		return nil
@@ -1403,6 +1416,12 @@ func (s *overrideDataReceiver) OnExpiredToken(ctx context.Context, accessTokenHa
 	}
 	s.onExpiredToken(ctx, accessTokenHash, userID, deviceID)
 }
+func (s *overrideDataReceiver) OnUpstreamHealth(ctx context.Context, health UpstreamHealth) {
+	if s.onUpstreamHealth == nil {
+		return
+	}
+	s.onUpstreamHealth(ctx, health)
+}
 
 func newMocks(doSyncV2 func(authHeader, since string) (*SyncResponse, int, error)) (*mockDataReceiver, *mockClient) {
 	client := &mockClient{
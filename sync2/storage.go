@@ -3,17 +3,19 @@ package sync2
 import (
 	"github.com/getsentry/sentry-go"
 	"github.com/jmoiron/sqlx"
+	"github.com/matrix-org/sliding-sync/sqlutil"
 	"github.com/rs/zerolog/log"
 )
 
 type Storage struct {
-	DevicesTable *DevicesTable
-	TokensTable  *TokensTable
-	DB           *sqlx.DB
+	DevicesTable      *DevicesTable
+	TokensTable       *TokensTable
+	PollerLeasesTable *PollerLeasesTable
+	DB                *sqlx.DB
 }
 
 func NewStore(postgresURI, secret string) *Storage {
-	db, err := sqlx.Open("postgres", postgresURI)
+	db, err := sqlutil.Open(postgresURI)
 	if err != nil {
 		sentry.CaptureException(err)
 		// TODO: if we panic(), will sentry have a chance to flush the event?
@@ -24,9 +26,10 @@ func NewStore(postgresURI, secret string) *Storage {
 
 func NewStoreWithDB(db *sqlx.DB, secret string) *Storage {
 	return &Storage{
-		DevicesTable: NewDevicesTable(db),
-		TokensTable:  NewTokensTable(db, secret),
-		DB:           db,
+		DevicesTable:      NewDevicesTable(db),
+		TokensTable:       NewTokensTable(db, secret),
+		PollerLeasesTable: NewPollerLeasesTable(db),
+		DB:                db,
 	}
 }
 
@@ -8,6 +8,7 @@ import (
 	"encoding/hex"
 	"fmt"
 	"github.com/jmoiron/sqlx"
+	"github.com/matrix-org/sliding-sync/sqlutil"
 	"github.com/rs/zerolog/log"
 	"io"
 	"strings"
@@ -21,6 +22,14 @@ type Token struct {
 	UserID               string    `db:"user_id"`
 	DeviceID             string    `db:"device_id"`
 	LastSeen             time.Time `db:"last_seen"`
+	// When the token must be checked with the authenticator again, in milliseconds since the
+	// epoch. 0 means the token is trusted until the homeserver rejects it.
+	ExpiresTS int64 `db:"expires_ts"`
+}
+
+// Expired returns true if the token must be checked with the authenticator again.
+func (t *Token) Expired(now time.Time) bool {
+	return t.ExpiresTS > 0 && now.UnixMilli() >= t.ExpiresTS
 }
 
 // TokensTable remembers sync v2 tokens
@@ -43,8 +52,16 @@ func NewTokensTable(db *sqlx.DB, secret string) *TokensTable {
 		-- TODO: FK constraints to devices table?
 		user_id TEXT NOT NULL,
 		device_id TEXT NOT NULL,
-		last_seen TIMESTAMP WITH TIME ZONE NOT NULL
-	);`)
+		last_seen ` + sqlutil.DialectOf(db).Timestamp() + ` NOT NULL,
+		expires_ts BIGINT NOT NULL DEFAULT 0
+	);
+	-- tokens which the authenticator has rejected, so we don't have to ask again until expires_ts
+	CREATE TABLE IF NOT EXISTS syncv3_sync2_rejected_tokens (
+		token_hash TEXT NOT NULL PRIMARY KEY, -- SHA256(access token)
+		expires_ts BIGINT NOT NULL
+	);
+	CREATE INDEX IF NOT EXISTS syncv3_sync2_rejected_tokens_expires_idx ON syncv3_sync2_rejected_tokens(expires_ts);
+	CREATE INDEX IF NOT EXISTS syncv3_sync2_tokens_device_idx ON syncv3_sync2_tokens(user_id, device_id);`)
 
 	// derive the key from the secret
 	hash := sha256.New()
@@ -120,7 +137,7 @@ func (t *TokensTable) Token(plaintextToken string) (*Token, error) {
 	var token Token
 	err := t.db.Get(
 		&token,
-		`SELECT token_encrypted, user_id, device_id, last_seen FROM syncv3_sync2_tokens WHERE token_hash=$1`,
+		`SELECT token_encrypted, user_id, device_id, last_seen, expires_ts FROM syncv3_sync2_tokens WHERE token_hash=$1`,
 		tokenHash,
 	)
 	if err != nil {
@@ -147,16 +164,37 @@ func (t *TokensTable) TokenForEachDevice(txn *sqlx.Tx) (tokens []TokenForPoller,
 	} else {
 		db = t.db
 	}
+	return t.selectTokenForEachDevice(db, "")
+}
 
+// TokenForEachExpiredLease loads the most recently used token for each device whose poller lease
+// expired before this time, see PollerLeasesTable.
+func (t *TokensTable) TokenForEachExpiredLease(expiredBefore time.Time) (tokens []TokenForPoller, err error) {
+	return t.selectTokenForEachDevice(
+		t.db, "JOIN syncv3_poller_leases USING (user_id, device_id) WHERE syncv3_poller_leases.expires_ts < $1", expiredBefore.UnixMilli(),
+	)
+}
+
+// selectTokenForEachDevice loads the most recently used token for each device, restricted by a
+// clause which is added after the join on the devices table.
+func (t *TokensTable) selectTokenForEachDevice(db sqlx.Queryer, clause string, args ...interface{}) (tokens []TokenForPoller, err error) {
 	// Fetches the most recently seen token for each device, see e.g.
 	// https://www.postgresql.org/docs/11/sql-select.html#SQL-DISTINCT
-	err = sqlx.Select(
-		db,
-		&tokens,
-		`SELECT DISTINCT ON (user_id, device_id) token_encrypted, user_id, device_id, last_seen, since
-		FROM syncv3_sync2_tokens JOIN syncv3_sync2_devices USING (user_id, device_id)
+	query := `SELECT DISTINCT ON (user_id, device_id) token_encrypted, user_id, device_id, last_seen, since
+		FROM syncv3_sync2_tokens JOIN syncv3_sync2_devices USING (user_id, device_id) ` + clause + `
 		ORDER BY user_id, device_id, last_seen DESC
-	`)
+	`
+	if sqlutil.IsSQLite(t.db) {
+		// SQLite has no DISTINCT ON, so rank each device's tokens instead
+		query = `SELECT token_encrypted, user_id, device_id, last_seen, since FROM (
+			SELECT token_encrypted, user_id, device_id, last_seen, since,
+				ROW_NUMBER() OVER (PARTITION BY user_id, device_id ORDER BY last_seen DESC) AS row_num
+			FROM syncv3_sync2_tokens JOIN syncv3_sync2_devices USING (user_id, device_id) ` + clause + `
+		) WHERE row_num = 1
+		ORDER BY user_id, device_id
+	`
+	}
+	err = sqlx.Select(db, &tokens, query, args...)
 	if err != nil {
 		return
 	}
@@ -199,6 +237,45 @@ func (t *TokensTable) Insert(txn *sqlx.Tx, plaintextToken, userID, deviceID stri
 	}, nil
 }
 
+// SetExpiry sets when this token must be checked with the authenticator again. The zero time
+// means the token is trusted until the homeserver rejects it.
+func (t *TokensTable) SetExpiry(txn *sqlx.Tx, token *Token, expiresAt time.Time) error {
+	var expiresTS int64
+	if !expiresAt.IsZero() {
+		expiresTS = expiresAt.UnixMilli()
+	}
+	_, err := txn.Exec(`UPDATE syncv3_sync2_tokens SET expires_ts = $1 WHERE token_hash = $2`, expiresTS, token.AccessTokenHash)
+	if err != nil {
+		return err
+	}
+	token.ExpiresTS = expiresTS
+	return nil
+}
+
+// Reject remembers that the authenticator rejected this token, until the given time.
+// Rejections which have expired are deleted at the same time.
+func (t *TokensTable) Reject(plaintextToken string, until time.Time) error {
+	return sqlutil.WithTransaction(t.db, func(txn *sqlx.Tx) error {
+		_, err := txn.Exec(`DELETE FROM syncv3_sync2_rejected_tokens WHERE expires_ts <= $1`, time.Now().UnixMilli())
+		if err != nil {
+			return err
+		}
+		_, err = txn.Exec(`INSERT INTO syncv3_sync2_rejected_tokens(token_hash, expires_ts) VALUES ($1, $2)
+		ON CONFLICT (token_hash) DO UPDATE SET expires_ts = excluded.expires_ts`, hashToken(plaintextToken), until.UnixMilli())
+		return err
+	})
+}
+
+// Rejected returns true if the authenticator rejected this token, and that hasn't expired yet.
+func (t *TokensTable) Rejected(plaintextToken string, now time.Time) (bool, error) {
+	var count int
+	err := t.db.QueryRow(
+		`SELECT COUNT(*) FROM syncv3_sync2_rejected_tokens WHERE token_hash = $1 AND expires_ts > $2`,
+		hashToken(plaintextToken), now.UnixMilli(),
+	).Scan(&count)
+	return count > 0, err
+}
+
 // MaybeUpdateLastSeen actions a request to update a Token struct with its last_seen value
 // in the DB. To avoid spamming the DB with a write every time a sync3 request arrives,
 // we only update the last seen timestamp or the if it is at least 24 hours old.
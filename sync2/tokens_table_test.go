@@ -128,7 +128,80 @@ func TestDeletingTokens(t *testing.T) {
 	t.Log("We should no longer be able to fetch this token.")
 	token, err = tokens.Token(accessToken)
 	if token != nil || err == nil {
-		t.Fatalf("Fetching token after deletion did not fail: got %s, %s", token, err)
+		t.Fatalf("Fetching token after deletion did not fail: got %v, %s", token, err)
+	}
+}
+
+func TestTokenExpiry(t *testing.T) {
+	db, close := connectToDB(t)
+	defer close()
+	tokens := NewTokensTable(db, "my_secret")
+	accessToken := "TestTokenExpiry"
+	now := time.Now()
+
+	err := sqlutil.WithTransaction(db, func(txn *sqlx.Tx) error {
+		token, err := tokens.Insert(txn, accessToken, "@alice:localhost", "device", now)
+		if err != nil {
+			return err
+		}
+		return tokens.SetExpiry(txn, token, now.Add(time.Hour))
+	})
+	if err != nil {
+		t.Fatalf("Failed to insert token with expiry: %s", err)
+	}
+	token, err := tokens.Token(accessToken)
+	if err != nil {
+		t.Fatalf("Failed to fetch token: %s", err)
+	}
+	if token.Expired(now) {
+		t.Errorf("Token expired before its expiry time")
+	}
+	if !token.Expired(now.Add(time.Hour)) {
+		t.Errorf("Token did not expire at its expiry time")
+	}
+	if (&Token{}).Expired(now.Add(24 * time.Hour)) {
+		t.Errorf("Token without an expiry time expired")
+	}
+}
+
+func TestRejectedTokens(t *testing.T) {
+	db, close := connectToDB(t)
+	defer close()
+	tokens := NewTokensTable(db, "my_secret")
+	now := time.Now()
+
+	if err := tokens.Reject("rejected_old", now.Add(-time.Minute)); err != nil {
+		t.Fatalf("Reject: %s", err)
+	}
+	if err := tokens.Reject("rejected", now.Add(time.Minute)); err != nil {
+		t.Fatalf("Reject: %s", err)
+	}
+	testCases := []struct {
+		token        string
+		at           time.Time
+		wantRejected bool
+	}{
+		{token: "rejected", at: now, wantRejected: true},
+		{token: "rejected", at: now.Add(time.Minute), wantRejected: false},
+		{token: "rejected_old", at: now, wantRejected: false},
+		{token: "never_seen", at: now, wantRejected: false},
+	}
+	for _, tc := range testCases {
+		rejected, err := tokens.Rejected(tc.token, tc.at)
+		if err != nil {
+			t.Fatalf("Rejected: %s", err)
+		}
+		if rejected != tc.wantRejected {
+			t.Errorf("Rejected(%s, %v): got %v want %v", tc.token, tc.at, rejected, tc.wantRejected)
+		}
+	}
+
+	// rejecting again extends the rejection
+	if err := tokens.Reject("rejected", now.Add(time.Hour)); err != nil {
+		t.Fatalf("Reject: %s", err)
+	}
+	if rejected, _ := tokens.Rejected("rejected", now.Add(time.Minute)); !rejected {
+		t.Errorf("Rejected: rejecting again did not extend the rejection")
 	}
 }
 
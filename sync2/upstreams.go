@@ -0,0 +1,115 @@
+package sync2
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Upstreams picks which homeserver to talk to, so that one proxy can serve several homeservers.
+// Users are always sent to the homeserver for the server name in their user ID. Requests with an
+// unknown access token are sent to the homeserver mapped to the Host they were made to. Anything
+// else goes to the default homeserver. Only requests are routed: every homeserver shares the same
+// storage, and tokens, devices and rooms are not keyed by homeserver.
+type Upstreams struct {
+	defaultClient Client
+	// server name => client
+	clients map[string]Client
+	// request host => server name
+	hosts map[string]string
+}
+
+// NewUpstreams returns Upstreams which sends everything to this client.
+func NewUpstreams(defaultClient Client) *Upstreams {
+	return &Upstreams{
+		defaultClient: defaultClient,
+		clients:       make(map[string]Client),
+		hosts:         make(map[string]string),
+	}
+}
+
+// AddHomeserver sends users on this server name to this client.
+func (u *Upstreams) AddHomeserver(serverName string, client Client) {
+	u.clients[serverName] = client
+}
+
+// AddHost sends requests made to this host to the homeserver for this server name.
+func (u *Upstreams) AddHost(host, serverName string) error {
+	if _, ok := u.clients[serverName]; !ok {
+		return fmt.Errorf("host %s maps to unknown homeserver %s", host, serverName)
+	}
+	u.hosts[strings.ToLower(host)] = serverName
+	return nil
+}
+
+// Clients returns every client, keyed by server name. The default client has the key "".
+func (u *Upstreams) Clients() map[string]Client {
+	clients := make(map[string]Client, len(u.clients)+1)
+	for serverName, client := range u.clients {
+		clients[serverName] = client
+	}
+	clients[""] = u.defaultClient
+	return clients
+}
+
+// ServerFor returns the server name of the homeserver which serves this user, or "" if the user
+// is served by the default homeserver.
+func (u *Upstreams) ServerFor(userID string) string {
+	serverName := ServerNameFromUserID(userID)
+	if _, ok := u.clients[serverName]; ok {
+		return serverName
+	}
+	return ""
+}
+
+// ForUser returns the client for the homeserver which serves this user.
+func (u *Upstreams) ForUser(userID string) Client {
+	return u.forServer(u.ServerFor(userID))
+}
+
+// ForHost returns the server name and client for requests made to this host. The server name is
+// "" if the host isn't mapped to a homeserver, in which case the default client is returned.
+func (u *Upstreams) ForHost(host string) (serverName string, client Client) {
+	// ignore the port
+	if i := strings.LastIndex(host, ":"); i != -1 && !strings.HasSuffix(host, "]") {
+		host = host[:i]
+	}
+	serverName = u.hosts[strings.ToLower(host)]
+	return serverName, u.forServer(serverName)
+}
+
+func (u *Upstreams) forServer(serverName string) Client {
+	if client, ok := u.clients[serverName]; ok {
+		return client
+	}
+	return u.defaultClient
+}
+
+// ServerNameFromUserID returns the server name part of a Matrix user ID e.g "example.org:8448"
+// for "@alice:example.org:8448".
+func ServerNameFromUserID(userID string) string {
+	_, serverName, _ := strings.Cut(userID, ":")
+	return serverName
+}
+
+// ParseMapping parses a comma separated list of key=value e.g
+// "example.org=https://matrix.example.org,example.com=http://localhost:8008".
+func ParseMapping(s string) (map[string]string, error) {
+	mapping := make(map[string]string)
+	for _, item := range strings.Split(s, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		key, value, ok := strings.Cut(item, "=")
+		key = strings.TrimSpace(key)
+		value = strings.TrimSpace(value)
+		if !ok || key == "" || value == "" {
+			return nil, fmt.Errorf("%q: must be key=value", item)
+		}
+		if _, exists := mapping[key]; exists {
+			return nil, fmt.Errorf("%q: %s is listed more than once", item, key)
+		}
+		mapping[key] = value
+	}
+	return mapping, nil
+}
@@ -0,0 +1,85 @@
+package sync2
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestUpstreams(t *testing.T) {
+	defaultClient := &HTTPClient{DestinationServer: "https://default"}
+	orgClient := &HTTPClient{DestinationServer: "https://matrix.example.org"}
+	comClient := &HTTPClient{DestinationServer: "https://matrix.example.com"}
+	u := NewUpstreams(defaultClient)
+	u.AddHomeserver("example.org", orgClient)
+	u.AddHomeserver("example.com:8448", comClient)
+	if err := u.AddHost("Sync.Example.org", "example.org"); err != nil {
+		t.Fatalf("AddHost: %s", err)
+	}
+	if err := u.AddHost("sync.example.net", "example.net"); err == nil {
+		t.Fatalf("AddHost: expected an error for an unknown homeserver")
+	}
+
+	userCases := []struct {
+		userID     string
+		wantServer string
+		wantClient Client
+	}{
+		{userID: "@alice:example.org", wantServer: "example.org", wantClient: orgClient},
+		{userID: "@bob:example.com:8448", wantServer: "example.com:8448", wantClient: comClient},
+		// the port is part of the server name
+		{userID: "@bob:example.com", wantServer: "", wantClient: defaultClient},
+		{userID: "@charlie:localhost", wantServer: "", wantClient: defaultClient},
+	}
+	for _, tc := range userCases {
+		if got := u.ServerFor(tc.userID); got != tc.wantServer {
+			t.Errorf("ServerFor(%s): got %q want %q", tc.userID, got, tc.wantServer)
+		}
+		if got := u.ForUser(tc.userID); got != tc.wantClient {
+			t.Errorf("ForUser(%s): got %v want %v", tc.userID, got, tc.wantClient)
+		}
+	}
+
+	hostCases := []struct {
+		host       string
+		wantServer string
+		wantClient Client
+	}{
+		{host: "sync.example.org", wantServer: "example.org", wantClient: orgClient},
+		{host: "SYNC.EXAMPLE.ORG:443", wantServer: "example.org", wantClient: orgClient},
+		{host: "sync.example.com", wantServer: "", wantClient: defaultClient},
+		{host: "[::1]", wantServer: "", wantClient: defaultClient},
+		{host: "", wantServer: "", wantClient: defaultClient},
+	}
+	for _, tc := range hostCases {
+		gotServer, gotClient := u.ForHost(tc.host)
+		if gotServer != tc.wantServer || gotClient != tc.wantClient {
+			t.Errorf("ForHost(%s): got (%q, %v) want (%q, %v)", tc.host, gotServer, gotClient, tc.wantServer, tc.wantClient)
+		}
+	}
+
+	if got := len(u.Clients()); got != 3 {
+		t.Errorf("Clients: got %d clients want 3", got)
+	}
+}
+
+func TestParseMapping(t *testing.T) {
+	got, err := ParseMapping("example.org=https://matrix.example.org, example.com:8448 = http://localhost:8008,")
+	if err != nil {
+		t.Fatalf("ParseMapping returned error: %s", err)
+	}
+	want := map[string]string{
+		"example.org":      "https://matrix.example.org",
+		"example.com:8448": "http://localhost:8008",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("ParseMapping: got %v want %v", got, want)
+	}
+	if got, err := ParseMapping(""); err != nil || len(got) != 0 {
+		t.Fatalf("ParseMapping(\"\"): got (%v, %v) want an empty mapping", got, err)
+	}
+	for _, invalid := range []string{"example.org", "=https://x", "example.org=", "a=b,a=c"} {
+		if _, err := ParseMapping(invalid); err == nil {
+			t.Errorf("ParseMapping(%q): expected an error", invalid)
+		}
+	}
+}
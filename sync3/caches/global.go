@@ -272,6 +272,10 @@ func (c *GlobalCache) OnReceipt(ctx context.Context, receipt internal.Receipt) {
 	// nothing to do but we need it because the Dispatcher demands it.
 }
 
+func (c *GlobalCache) OnPresence(ctx context.Context, presence internal.Presence, sharedRoomIDs []string) {
+	// nothing to do but we need it because the Dispatcher demands it.
+}
+
 func (c *GlobalCache) OnNewEvent(
 	ctx context.Context, ed *EventData,
 ) {
@@ -295,6 +299,22 @@ func (c *GlobalCache) OnNewEvent(
 		if ed.StateKey != nil && *ed.StateKey == "" {
 			metadata.Encrypted = true
 		}
+	case "m.room.topic":
+		if ed.StateKey != nil && *ed.StateKey == "" {
+			metadata.Topic = ed.Content.Get("topic").Str
+		}
+	case "m.room.join_rules":
+		if ed.StateKey != nil && *ed.StateKey == "" {
+			metadata.JoinRule = ed.Content.Get("join_rule").Str
+		}
+	case "m.room.history_visibility":
+		if ed.StateKey != nil && *ed.StateKey == "" {
+			metadata.HistoryVisibility = ed.Content.Get("history_visibility").Str
+		}
+	case "m.room.guest_access":
+		if ed.StateKey != nil && *ed.StateKey == "" {
+			metadata.GuestAccess = ed.Content.Get("guest_access").Str
+		}
 	case "m.room.tombstone":
 		if ed.StateKey != nil && *ed.StateKey == "" {
 			newRoomID := ed.Content.Get("replacement_room").Str
@@ -38,6 +38,16 @@ func (u *InviteUpdate) Type() string {
 	return fmt.Sprintf("InviteUpdate[%s]", u.RoomID())
 }
 
+// KnockUpdate corresponds to a key-value pair from a v2 sync's `knock` section.
+type KnockUpdate struct {
+	RoomUpdate
+	KnockData InviteData
+}
+
+func (u *KnockUpdate) Type() string {
+	return fmt.Sprintf("KnockUpdate[%s]", u.RoomID())
+}
+
 // TypingEdu corresponds to a typing EDU in the `ephemeral` section of a joined room's v2 sync resposne.
 type TypingUpdate struct {
 	RoomUpdate
@@ -70,6 +80,18 @@ func (u *UnreadCountUpdate) Type() string {
 	return fmt.Sprintf("UnreadCountUpdate[%s]", u.RoomID())
 }
 
+// SpaceUpdate is sent when a child is added to or removed from a space which the user is joined to.
+// It is sent after any update for the child room, so the child's UserRoomData.Spaces is up to date.
+type SpaceUpdate struct {
+	ParentRoomID string `json:"parent_room_id"`
+	ChildRoomID  string `json:"child_room_id"`
+	IsDeleted    bool   `json:"deleted,omitempty"`
+}
+
+func (u *SpaceUpdate) Type() string {
+	return fmt.Sprintf("SpaceUpdate[%s] child=%s deleted=%v", u.ParentRoomID, u.ChildRoomID, u.IsDeleted)
+}
+
 // AccountDataUpdate represents the (global) `account_data` section of a v2 sync response.
 type AccountDataUpdate struct {
 	AccountData []state.AccountData
@@ -89,6 +111,18 @@ func (u *RoomAccountDataUpdate) Type() string {
 	return fmt.Sprintf("RoomAccountDataUpdate[%s] len=%v", u.RoomID(), len(u.AccountData))
 }
 
+// PresenceUpdate represents a change in the presence of a user who shares at least one
+// joined room with the receiving user.
+type PresenceUpdate struct {
+	Presence internal.Presence
+	// The joined rooms shared between the receiving user and Presence.UserID.
+	SharedRoomIDs []string
+}
+
+func (u *PresenceUpdate) Type() string {
+	return fmt.Sprintf("PresenceUpdate[%s]", u.Presence.UserID)
+}
+
 type DeviceDataUpdate struct {
 	// no data; just wakes up the connection
 	// data comes via sidechannels e.g the database
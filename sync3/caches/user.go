@@ -42,10 +42,17 @@ type JoinChecker interface {
 type UserRoomData struct {
 	IsDM              bool
 	IsInvite          bool
+	IsKnock           bool
 	HasLeft           bool
 	NotificationCount int
 	HighlightCount    int
-	Invite            *InviteData
+	// thread root -> counts, for threads with unread notifications. Replaced wholesale, never
+	// modified in place, so copies of UserRoomData can share it.
+	ThreadUnreadCounts map[string]internal.UnreadCounts
+	Invite             *InviteData
+	// Knock is the knock_state for a room the user has knocked on. It has the same shape as
+	// invite_state, so is parsed the same way.
+	Knock *InviteData
 
 	// TODO: should CanonicalisedName really be in RoomConMetadata? It's only set in SetRoom AFAICS
 	CanonicalisedName string // stripped leading symbols like #, all in lower case
@@ -66,6 +73,9 @@ type UserRoomData struct {
 	Tags map[string]float64
 	// JoinTiming tracks our latest join to the room, excluding profile changes.
 	JoinTiming internal.EventMetadata
+	// MarkedUnread is true if the user has flagged this room as unread via m.marked_unread.
+	// See https://github.com/matrix-org/matrix-spec-proposals/pull/2867
+	MarkedUnread bool
 }
 
 func NewUserRoomData() UserRoomData {
@@ -85,19 +95,57 @@ type InviteData struct {
 	NameEvent            string // the content of m.room.name, NOT the calculated name
 	AvatarEvent          string // the content of m.room.avatar, NOT the calculated avatar
 	CanonicalAlias       string
+	Topic                string
+	JoinRule             string
+	HistoryVisibility    string
+	GuestAccess          string
 	LastMessageTimestamp uint64
 	Encrypted            bool
 	IsDM                 bool
 	RoomType             string
+	isKnock              bool
 }
 
 func NewInviteData(ctx context.Context, userID, roomID string, inviteState []json.RawMessage) *InviteData {
+	id := parseStrippedState(userID, roomID, inviteState)
+	if id.InviteEvent == nil {
+		const errMsg = "cannot make invite, missing invite event for user"
+		log.Error().Str("invitee", userID).Str("room", roomID).Int("num_invite_state", len(inviteState)).Msg(errMsg)
+		hub := internal.GetSentryHubFromContextOrDefault(ctx)
+		hub.WithScope(func(scope *sentry.Scope) {
+			scope.SetContext(internal.SentryCtxKey, map[string]interface{}{
+				"invitee":          userID,
+				"room":             roomID,
+				"num_invite_state": len(inviteState),
+			})
+			hub.CaptureException(fmt.Errorf(errMsg))
+		})
+		return nil
+	}
+	return id
+}
+
+// NewKnockData parses the knock_state for a room the user has knocked on. The user's knock
+// m.room.member event takes the place of the invite event.
+func NewKnockData(ctx context.Context, userID, roomID string, knockState []json.RawMessage) *InviteData {
+	kd := parseStrippedState(userID, roomID, knockState)
+	if kd.InviteEvent == nil {
+		const errMsg = "cannot make knock, missing knock event for user"
+		log.Error().Str("user", userID).Str("room", roomID).Int("num_knock_state", len(knockState)).Msg(errMsg)
+		internal.GetSentryHubFromContextOrDefault(ctx).CaptureException(fmt.Errorf(errMsg))
+		return nil
+	}
+	kd.isKnock = true
+	return kd
+}
+
+func parseStrippedState(userID, roomID string, strippedState []json.RawMessage) *InviteData {
 	// work out metadata for this invite. There's an origin_server_ts on the invite m.room.member event
 	id := InviteData{
 		roomID:      roomID,
-		InviteState: inviteState,
+		InviteState: strippedState,
 	}
-	for _, ev := range inviteState {
+	for _, ev := range strippedState {
 		j := gjson.ParseBytes(ev)
 
 		switch j.Get("type").Str {
@@ -130,26 +178,20 @@ func NewInviteData(ctx context.Context, userID, roomID string, inviteState []jso
 			id.AvatarEvent = j.Get("content.url").Str
 		case "m.room.canonical_alias":
 			id.CanonicalAlias = j.Get("content.alias").Str
+		case "m.room.topic":
+			id.Topic = j.Get("content.topic").Str
+		case "m.room.join_rules":
+			id.JoinRule = j.Get("content.join_rule").Str
+		case "m.room.history_visibility":
+			id.HistoryVisibility = j.Get("content.history_visibility").Str
+		case "m.room.guest_access":
+			id.GuestAccess = j.Get("content.guest_access").Str
 		case "m.room.encryption":
 			id.Encrypted = true
 		case "m.room.create":
 			id.RoomType = j.Get("content.type").Str
 		}
 	}
-	if id.InviteEvent == nil {
-		const errMsg = "cannot make invite, missing invite event for user"
-		log.Error().Str("invitee", userID).Str("room", roomID).Int("num_invite_state", len(inviteState)).Msg(errMsg)
-		hub := internal.GetSentryHubFromContextOrDefault(ctx)
-		hub.WithScope(func(scope *sentry.Scope) {
-			scope.SetContext(internal.SentryCtxKey, map[string]interface{}{
-				"invitee":          userID,
-				"room":             roomID,
-				"num_invite_state": len(inviteState),
-			})
-			hub.CaptureException(fmt.Errorf(errMsg))
-		})
-		return nil
-	}
 	return &id
 }
 
@@ -163,7 +205,13 @@ func (i *InviteData) RoomMetadata() *internal.RoomMetadata {
 	metadata.NameEvent = i.NameEvent
 	metadata.AvatarEvent = i.AvatarEvent
 	metadata.CanonicalAlias = i.CanonicalAlias
-	metadata.InviteCount = 1
+	metadata.Topic = i.Topic
+	metadata.JoinRule = i.JoinRule
+	metadata.HistoryVisibility = i.HistoryVisibility
+	metadata.GuestAccess = i.GuestAccess
+	if !i.isKnock {
+		metadata.InviteCount = 1
+	}
 	metadata.JoinCount = 1
 	metadata.LastMessageTimestamp = i.LastMessageTimestamp
 	metadata.Encrypted = i.Encrypted
@@ -182,7 +230,7 @@ type UserCacheListener interface {
 
 // Subset of store functions used by the user cache
 type UserCacheStore interface {
-	LatestEventsInRooms(userID string, roomIDs []string, to int64, limit int) (map[string]*state.LatestEvents, error)
+	LatestEventsInRooms(userID string, roomIDs []string, to int64, limit int, filter *internal.TimelineFilter) (map[string]*state.LatestEvents, error)
 	GetClosestPrevBatch(roomID string, eventNID int64) (prevBatch string)
 }
 
@@ -320,17 +368,17 @@ func (c *UserCache) OnRegistered(ctx context.Context) error {
 
 // LazyLoadTimelines loads the most recent timeline events (up to `maxTimelineEvents`)
 // for each of the given rooms from the database (plus other timeline-related data).
-// Only events with NID <= loadPos are returned.
+// Only events with NID <= loadPos which pass the filter are returned.
 // Events from senders ignored by this user are dropped.
 // Returns nil on error.
-func (c *UserCache) LazyLoadTimelines(ctx context.Context, loadPos int64, roomIDs []string, maxTimelineEvents int) map[string]state.LatestEvents {
+func (c *UserCache) LazyLoadTimelines(ctx context.Context, loadPos int64, roomIDs []string, maxTimelineEvents int, filter *internal.TimelineFilter) map[string]state.LatestEvents {
 	_, span := internal.StartSpan(ctx, "LazyLoadTimelines")
 	defer span.End()
 	if c.LazyLoadTimelinesOverride != nil {
 		return c.LazyLoadTimelinesOverride(loadPos, roomIDs, maxTimelineEvents)
 	}
 	result := make(map[string]state.LatestEvents)
-	roomIDToLatestEvents, err := c.store.LatestEventsInRooms(c.UserID, roomIDs, loadPos, maxTimelineEvents)
+	roomIDToLatestEvents, err := c.store.LatestEventsInRooms(c.UserID, roomIDs, loadPos, maxTimelineEvents, filter)
 	if err != nil {
 		log.Err(err).Strs("rooms", roomIDs).Msg("failed to get LatestEventsInRooms")
 		internal.GetSentryHubFromContextOrDefault(ctx).CaptureException(err)
@@ -415,6 +463,19 @@ func (c *UserCache) newRoomUpdate(ctx context.Context, roomID string) RoomUpdate
 	}
 }
 
+func (c *UserCache) Knocks() map[string]UserRoomData {
+	c.roomToDataMu.Lock()
+	defer c.roomToDataMu.Unlock()
+	knocks := make(map[string]UserRoomData)
+	for roomID, urd := range c.roomToData {
+		if !urd.IsKnock || urd.Knock == nil {
+			continue
+		}
+		knocks[roomID] = urd
+	}
+	return knocks
+}
+
 func (c *UserCache) Invites() map[string]UserRoomData {
 	c.roomToDataMu.Lock()
 	defer c.roomToDataMu.Unlock()
@@ -520,6 +581,13 @@ func (c *UserCache) OnReceipt(ctx context.Context, receipt internal.Receipt) {
 	})
 }
 
+func (c *UserCache) OnPresence(ctx context.Context, presence internal.Presence, sharedRoomIDs []string) {
+	c.emitOnUpdate(ctx, &PresenceUpdate{
+		Presence:      presence,
+		SharedRoomIDs: sharedRoomIDs,
+	})
+}
+
 func (c *UserCache) emitOnRoomUpdate(ctx context.Context, update RoomUpdate) {
 	c.listenersMu.RLock()
 	var listeners []UserCacheListener
@@ -544,7 +612,7 @@ func (c *UserCache) emitOnUpdate(ctx context.Context, update Update) {
 	}
 }
 
-func (c *UserCache) OnUnreadCounts(ctx context.Context, roomID string, highlightCount, notifCount *int) {
+func (c *UserCache) OnUnreadCounts(ctx context.Context, roomID string, highlightCount, notifCount *int, threadCounts map[string]internal.UnreadCounts) {
 	data := c.LoadRoomData(roomID)
 	hasCountDecreased := false
 	if highlightCount != nil {
@@ -557,6 +625,14 @@ func (c *UserCache) OnUnreadCounts(ctx context.Context, roomID string, highlight
 		}
 		data.NotificationCount = *notifCount
 	}
+	for threadID, prev := range data.ThreadUnreadCounts {
+		if hasCountDecreased {
+			break
+		}
+		next := threadCounts[threadID]
+		hasCountDecreased = next.HighlightCount < prev.HighlightCount || next.NotificationCount < prev.NotificationCount
+	}
+	data.ThreadUnreadCounts = threadCounts
 	c.roomToDataMu.Lock()
 	c.roomToData[roomID] = data
 	c.roomToDataMu.Unlock()
@@ -589,11 +665,22 @@ func (c *UserCache) OnSpaceUpdate(ctx context.Context, parentRoomID, childRoomID
 		}
 		c.emitOnRoomUpdate(ctx, roomUpdate)
 	}
+
+	// children injected by OnRegistered aren't news, and don't have any content
+	if eventData.NID == 0 {
+		return
+	}
+	c.emitOnUpdate(ctx, &SpaceUpdate{
+		ParentRoomID: parentRoomID,
+		ChildRoomID:  childRoomID,
+		IsDeleted:    isDeleted,
+	})
 }
 
 func (c *UserCache) OnNewEvent(ctx context.Context, eventData *EventData) {
 	// add this to our tracked timelines if we have one
 	urd := c.LoadRoomData(eventData.RoomID)
+	wasJoined := urd.JoinTiming.NID > 0 && !urd.HasLeft && !urd.IsInvite && !urd.IsKnock
 	// reset the IsInvite field when the user actually joins/rejects the invite
 	if urd.IsInvite && eventData.EventType == "m.room.member" && eventData.StateKey != nil && *eventData.StateKey == c.UserID {
 		urd.IsInvite = eventData.Content.Get("membership").Str == "invite"
@@ -601,6 +688,25 @@ func (c *UserCache) OnNewEvent(ctx context.Context, eventData *EventData) {
 			urd.HighlightCount = 0
 		}
 	}
+	// likewise for knocks, when the user is let in or gives up
+	if urd.IsKnock && eventData.EventType == "m.room.member" && eventData.StateKey != nil && *eventData.StateKey == c.UserID {
+		urd.IsKnock = eventData.Content.Get("membership").Str == "knock"
+	}
+	// track our latest join to the room, so clients can sort rooms by when they were joined
+	if eventData.EventType == "m.room.member" && eventData.StateKey != nil && *eventData.StateKey == c.UserID &&
+		eventData.NID > 0 && eventData.Content.Get("membership").Str == "join" {
+		// profile changes are also joins, so only update the timing if we weren't already joined.
+		// The previous membership is the best way to tell, if the homeserver gave it to us.
+		if prevMembership := gjson.GetBytes(eventData.Event, "unsigned.prev_content.membership"); prevMembership.Exists() {
+			wasJoined = prevMembership.Str == "join"
+		}
+		if !wasJoined {
+			urd.JoinTiming = internal.EventMetadata{
+				NID:       eventData.NID,
+				Timestamp: eventData.Timestamp,
+			}
+		}
+	}
 	if eventData.EventType == "m.space.child" && eventData.StateKey != nil {
 		// the children for a space we are a part of have changed. Find the room that was affected and update our cache value.
 		childRoomID := *eventData.StateKey
@@ -627,6 +733,8 @@ func (c *UserCache) OnInvite(ctx context.Context, roomID string, inviteStateEven
 
 	urd := c.LoadRoomData(roomID)
 	urd.IsInvite = true
+	urd.IsKnock = false
+	urd.Knock = nil
 	urd.HasLeft = false
 	urd.HighlightCount = InvitesAreHighlightsValue
 	urd.IsDM = inviteData.IsDM
@@ -648,12 +756,41 @@ func (c *UserCache) OnInvite(ctx context.Context, roomID string, inviteStateEven
 	c.emitOnRoomUpdate(ctx, up)
 }
 
+func (c *UserCache) OnKnock(ctx context.Context, roomID string, knockStateEvents []json.RawMessage) {
+	knockData := NewKnockData(ctx, c.UserID, roomID, knockStateEvents)
+	if knockData == nil {
+		return // malformed knock
+	}
+
+	urd := c.LoadRoomData(roomID)
+	urd.IsKnock = true
+	urd.HasLeft = false
+	urd.Knock = knockData
+	c.roomToDataMu.Lock()
+	c.roomToData[roomID] = urd
+	c.roomToDataMu.Unlock()
+
+	up := &KnockUpdate{
+		RoomUpdate: &roomUpdateCache{
+			roomID: roomID,
+			// as with invites, only the knock_state may be shown
+			globalRoomData: knockData.RoomMetadata(),
+			userRoomData:   &urd,
+		},
+		KnockData: *knockData,
+	}
+	c.emitOnRoomUpdate(ctx, up)
+}
+
 func (c *UserCache) OnLeftRoom(ctx context.Context, roomID string, leaveEvent json.RawMessage) {
 	urd := c.LoadRoomData(roomID)
 	wasInvite := urd.IsInvite
+	wasKnock := urd.IsKnock
 	urd.IsInvite = false
+	urd.IsKnock = false
 	urd.HasLeft = true
 	urd.Invite = nil
+	urd.Knock = nil
 	urd.HighlightCount = 0
 	c.roomToDataMu.Lock()
 	c.roomToData[roomID] = urd
@@ -687,9 +824,9 @@ func (c *UserCache) OnLeftRoom(ctx context.Context, roomID string, leaveEvent js
 			Content:   ev.Get("content"),
 			Timestamp: ev.Get("origin_server_ts").Uint(),
 			Sender:    sender,
-			// if this is an invite rejection/a kick we need to make sure we tell the client, and not
+			// if this is an invite or knock rejection/a kick we need to make sure we tell the client, and not
 			// skip it because of the lack of a NID (this event may not be in the events table)
-			AlwaysProcess: wasInvite || isKick,
+			AlwaysProcess: wasInvite || wasKnock || isKick,
 		},
 	}
 	c.emitOnRoomUpdate(ctx, up)
@@ -699,6 +836,8 @@ func (c *UserCache) OnAccountData(ctx context.Context, datas []state.AccountData
 	roomUpdates := make(map[string][]state.AccountData)
 	// room_id -> tag_id -> order
 	tagUpdates := make(map[string]map[string]float64)
+	// room_id -> marked unread
+	markedUnreadUpdates := make(map[string]bool)
 	for _, d := range datas {
 		up := roomUpdates[d.RoomID]
 		up = append(up, d)
@@ -738,6 +877,11 @@ func (c *UserCache) OnAccountData(ctx context.Context, datas []state.AccountData
 				tagUpdates[d.RoomID][k.Str] = v.Get("order").Float()
 				return true
 			})
+		case "m.marked_unread", "com.famedly.marked_unread":
+			if d.RoomID == state.AccountDataGlobalRoom {
+				continue
+			}
+			markedUnreadUpdates[d.RoomID] = gjson.GetBytes(d.Data, "content.unread").Bool()
 		case "m.ignored_user_list":
 			if d.RoomID != state.AccountDataGlobalRoom {
 				continue
@@ -769,6 +913,18 @@ func (c *UserCache) OnAccountData(ctx context.Context, datas []state.AccountData
 		}
 		c.roomToDataMu.Unlock()
 	}
+	if len(markedUnreadUpdates) > 0 {
+		c.roomToDataMu.Lock()
+		for roomID, markedUnread := range markedUnreadUpdates {
+			urd, ok := c.roomToData[roomID]
+			if !ok {
+				urd = NewUserRoomData()
+			}
+			urd.MarkedUnread = markedUnread
+			c.roomToData[roomID] = urd
+		}
+		c.roomToDataMu.Unlock()
+	}
 	// bucket account data updates per-room and globally then invoke listeners
 	for roomID, updates := range roomUpdates {
 		if roomID == state.AccountDataGlobalRoom {
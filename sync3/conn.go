@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"runtime/debug"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/matrix-org/sliding-sync/internal"
@@ -37,6 +38,30 @@ type ConnHandler interface {
 	Destroy()
 	Alive() bool
 	SetCancelCallback(cancel context.CancelFunc)
+	// Info returns a snapshot of the connection. It may be called concurrently with
+	// OnIncomingRequest. The handler does not need to set the ConnID or LastActivity fields.
+	Info() ConnInfo
+}
+
+// Checkpointer is an optional interface for ConnHandlers which persist their state so that the
+// connection can be resumed after the proxy restarts. Checkpoint is called with the connection
+// lock held every time a new response is buffered, and pos is the position of that response.
+type Checkpointer interface {
+	Checkpoint(cid ConnID, pos int64)
+}
+
+// ConnInfo is a snapshot of a connection, used by the admin API.
+type ConnInfo struct {
+	UserID   string `json:"user_id"`
+	DeviceID string `json:"device_id"`
+	CID      string `json:"conn_id"`
+	// list key -> the ranges the client is tracking
+	Lists                map[string]SliceRanges `json:"lists"`
+	NumRoomSubscriptions int                    `json:"num_room_subscriptions"`
+	// The number of updates waiting to be sent to the client.
+	BufferDepth int `json:"buffer_depth"`
+	// When the client last made a request on this connection.
+	LastActivity time.Time `json:"last_activity"`
 }
 
 // Conn is an abstraction of a long-poll connection. It automatically handles the position values
@@ -64,6 +89,9 @@ type Conn struct {
 	mu                         *sync.Mutex
 	cancelOutstandingRequest   func()
 	cancelOutstandingRequestMu *sync.Mutex
+
+	// unix millis of the last incoming request, read by the admin API
+	lastActivity atomic.Int64
 }
 
 func NewConn(connID ConnID, h ConnHandler) *Conn {
@@ -75,10 +103,33 @@ func NewConn(connID ConnID, h ConnHandler) *Conn {
 	}
 }
 
+// Resume prepares a new connection to continue from a position issued before a restart. The
+// client has already seen the response at pos, so it is treated as the ACKing response and the
+// next request with ?pos=pos is processed as a non-initial request. Must be called before the
+// connection is handed to any requests.
+func (c *Conn) Resume(pos int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.lastPos = pos
+	c.serverResponses = []Response{{Pos: fmt.Sprintf("%d", pos)}}
+}
+
 func (c *Conn) Alive() bool {
 	return c.handler.Alive()
 }
 
+// Info returns a snapshot of this connection.
+func (c *Conn) Info() ConnInfo {
+	info := c.handler.Info()
+	info.UserID = c.UserID
+	info.DeviceID = c.DeviceID
+	info.CID = c.CID
+	if ts := c.lastActivity.Load(); ts > 0 {
+		info.LastActivity = time.UnixMilli(ts)
+	}
+	return info
+}
+
 func (c *Conn) OnUpdate(ctx context.Context, update caches.Update) {
 	c.handler.OnUpdate(ctx, update)
 }
@@ -136,6 +187,7 @@ func (c *Conn) isOutstanding(pos int64) bool {
 // client. It will NOT be reported to Sentry---this should happen as close as possible
 // to the creation of the error (or else Sentry cannot provide a meaningful traceback.)
 func (c *Conn) OnIncomingRequest(ctx context.Context, req *Request, start time.Time) (resp *Response, herr *internal.HandlerError) {
+	c.lastActivity.Store(start.UnixMilli())
 	ctx, span := internal.StartSpan(ctx, "OnIncomingRequest.AcquireMutex")
 	c.cancelOutstandingRequestMu.Lock()
 	if c.cancelOutstandingRequest != nil {
@@ -242,6 +294,9 @@ func (c *Conn) OnIncomingRequest(ctx context.Context, req *Request, start time.T
 	// buffer it
 	c.serverResponses = append(c.serverResponses, *resp)
 	c.lastPos = resp.PosInt()
+	if cp, ok := c.handler.(Checkpointer); ok {
+		cp.Checkpoint(c.ConnID, c.lastPos)
+	}
 	if nextUnACKedResponse == nil {
 		nextUnACKedResponse = resp
 	}
@@ -27,6 +27,7 @@ func (c *connHandlerMock) Alive() bool                                        {
 func (c *connHandlerMock) OnUpdate(ctx context.Context, update caches.Update) {}
 func (c *connHandlerMock) PublishEventsUpTo(roomID string, nid int64)         {}
 func (c *connHandlerMock) SetCancelCallback(cancel context.CancelFunc)        {}
+func (c *connHandlerMock) Info() ConnInfo                                     { return ConnInfo{} }
 
 // Test that Conn can send and receive requests based on positions
 func TestConn(t *testing.T) {
@@ -73,6 +74,50 @@ func TestConn(t *testing.T) {
 	}
 }
 
+type checkpointingConnHandlerMock struct {
+	connHandlerMock
+	positions []int64
+}
+
+func (c *checkpointingConnHandlerMock) Checkpoint(cid ConnID, pos int64) {
+	c.positions = append(c.positions, pos)
+}
+
+// Test that a resumed Conn accepts the position it was resumed from and carries on from there,
+// checkpointing every new position.
+func TestConnResume(t *testing.T) {
+	ctx := context.Background()
+	var gotInitial []bool
+	h := &checkpointingConnHandlerMock{
+		connHandlerMock: connHandlerMock{func(ctx context.Context, cid ConnID, req *Request, isInitial bool) (*Response, error) {
+			gotInitial = append(gotInitial, isInitial)
+			return &Response{}, nil
+		}},
+	}
+	c := NewConn(ConnID{DeviceID: "d"}, h)
+	c.Resume(41)
+
+	// unknown positions are still rejected
+	_, err := c.OnIncomingRequest(ctx, &Request{pos: 40}, time.Now())
+	if err == nil {
+		t.Fatalf("expected error for pos before the resumed pos, got none")
+	}
+
+	resp, err := c.OnIncomingRequest(ctx, &Request{pos: 41}, time.Now())
+	assertNoError(t, err)
+	assertPos(t, resp.Pos, 42)
+	resp, err = c.OnIncomingRequest(ctx, &Request{pos: 42}, time.Now())
+	assertNoError(t, err)
+	assertPos(t, resp.Pos, 43)
+
+	if len(gotInitial) != 2 || gotInitial[0] || gotInitial[1] {
+		t.Errorf("resumed requests should not be initial, got %v", gotInitial)
+	}
+	if len(h.positions) != 2 || h.positions[0] != 42 || h.positions[1] != 43 {
+		t.Errorf("got checkpoints at %v want [42 43]", h.positions)
+	}
+}
+
 // Test that Conn is blocking and linearises requests to OnIncomingRequest
 // It does this by triggering 2 OnIncomingRequest calls one after the other with a 1ms delay
 // The first request will "process" for 10ms whereas the 2nd request will process immediately.
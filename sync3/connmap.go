@@ -2,6 +2,7 @@ package sync3
 
 import (
 	"context"
+	"strings"
 	"sync"
 	"time"
 
@@ -108,6 +109,35 @@ func (m *ConnMap) Conns(userID, deviceID string) []*Conn {
 	return conns
 }
 
+// ConnInfos returns a snapshot of every connection for this user, or of all connections if
+// userID is empty. Connections are sorted by user, device then conn ID.
+func (m *ConnMap) ConnInfos(userID string) []ConnInfo {
+	m.mu.Lock()
+	var conns []*Conn
+	if userID != "" {
+		conns = append(conns, m.userIDToConn[userID]...)
+	} else {
+		for _, conn := range m.connIDToConn {
+			conns = append(conns, conn)
+		}
+	}
+	m.mu.Unlock()
+	infos := make([]ConnInfo, 0, len(conns))
+	for _, conn := range conns {
+		infos = append(infos, conn.Info())
+	}
+	slices.SortFunc(infos, func(a, b ConnInfo) int {
+		if a.UserID != b.UserID {
+			return strings.Compare(a.UserID, b.UserID)
+		}
+		if a.DeviceID != b.DeviceID {
+			return strings.Compare(a.DeviceID, b.DeviceID)
+		}
+		return strings.Compare(a.CID, b.CID)
+	})
+	return infos
+}
+
 // Conn returns a connection with this ConnID. Returns nil if no connection exists.
 func (m *ConnMap) Conn(cid ConnID) *Conn {
 	m.mu.Lock()
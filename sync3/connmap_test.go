@@ -198,6 +198,39 @@ func TestConnMap_TTLExpiryStaggeredDevices(t *testing.T) {
 	}
 }
 
+func TestConnMap_ConnInfos(t *testing.T) {
+	cm := NewConnMap(false, time.Minute)
+	cids := []ConnID{
+		{UserID: bob, DeviceID: "A", CID: "room-list"},
+		{UserID: alice, DeviceID: "B", CID: "room-list"},
+		{UserID: alice, DeviceID: "A", CID: "room-list"},
+		{UserID: alice, DeviceID: "A", CID: "encryption"},
+	}
+	for _, cid := range cids {
+		_, cancel := context.WithCancel(context.Background())
+		cm.CreateConn(cid, cancel, func() ConnHandler {
+			return &mockConnHandler{}
+		})
+	}
+	cm.Conn(cids[0]).lastActivity.Store(1000)
+
+	infos := cm.ConnInfos("")
+	var gotIDs []ConnID
+	for _, info := range infos {
+		gotIDs = append(gotIDs, ConnID{UserID: info.UserID, DeviceID: info.DeviceID, CID: info.CID})
+		mustEqual(t, info.BufferDepth, 1, "BufferDepth was not taken from the handler")
+	}
+	wantIDs := []ConnID{cids[3], cids[2], cids[1], cids[0]}
+	if !reflect.DeepEqual(gotIDs, wantIDs) {
+		t.Fatalf("ConnInfos: got %v want %v", gotIDs, wantIDs)
+	}
+	mustEqual(t, infos[3].LastActivity.UnixMilli(), int64(1000), "LastActivity mismatch")
+	mustEqual(t, infos[0].LastActivity.IsZero(), true, "LastActivity set without a request")
+
+	mustEqual(t, len(cm.ConnInfos(bob)), 1, "ConnInfos for bob")
+	mustEqual(t, len(cm.ConnInfos("@unknown:localhost")), 0, "ConnInfos for unknown user")
+}
+
 func assertDestroyedConns(t *testing.T, cidToConn map[ConnID]*Conn, isDestroyedFn func(cid ConnID) bool) {
 	t.Helper()
 	for cid, conn := range cidToConn {
@@ -228,3 +261,6 @@ func (c *mockConnHandler) Alive() bool {
 func (c *mockConnHandler) SetCancelCallback(cancel context.CancelFunc) {
 	c.cancel = cancel
 }
+func (c *mockConnHandler) Info() ConnInfo {
+	return ConnInfo{BufferDepth: 1}
+}
@@ -18,6 +18,8 @@ type Receiver interface {
 	OnNewEvent(ctx context.Context, event *caches.EventData)
 	OnReceipt(ctx context.Context, receipt internal.Receipt)
 	OnEphemeralEvent(ctx context.Context, roomID string, ephEvent json.RawMessage)
+	// OnPresence is called with the rooms the receiver shares with the user whose presence changed.
+	OnPresence(ctx context.Context, presence internal.Presence, sharedRoomIDs []string)
 	// OnRegistered is called after a successful call to Dispatcher.Register
 	OnRegistered(ctx context.Context) error
 }
@@ -260,6 +262,40 @@ func (d *Dispatcher) OnReceipt(ctx context.Context, receipt internal.Receipt) {
 	}
 }
 
+// OnPresence notifies every registered user who shares at least one joined room with the
+// user whose presence has changed. Users who share no rooms are never told about it.
+func (d *Dispatcher) OnPresence(ctx context.Context, presence internal.Presence) {
+	userToSharedRooms := make(map[string][]string)
+	for _, roomID := range d.jrt.JoinedRoomsForUser(presence.UserID) {
+		userIDs, _ := d.jrt.JoinedUsersForRoom(roomID, func(userID string) bool {
+			if userID == DispatcherAllUsers {
+				return false // safety guard to prevent dupe global callbacks
+			}
+			return d.ReceiverForUser(userID) != nil
+		})
+		for _, userID := range userIDs {
+			userToSharedRooms[userID] = append(userToSharedRooms[userID], roomID)
+		}
+	}
+
+	d.userToReceiverMu.RLock()
+	defer d.userToReceiverMu.RUnlock()
+
+	// global listeners (invoke before per-user listeners so caches can update)
+	listener := d.userToReceiver[DispatcherAllUsers]
+	if listener != nil {
+		listener.OnPresence(ctx, presence, nil)
+	}
+
+	for userID, sharedRoomIDs := range userToSharedRooms {
+		l := d.userToReceiver[userID]
+		if l == nil {
+			continue
+		}
+		l.OnPresence(ctx, presence, sharedRoomIDs)
+	}
+}
+
 func (d *Dispatcher) notifyListeners(ctx context.Context, ed *caches.EventData, userIDs []string, targetUser string, shouldForceInitial bool, membership string) {
 	internal.Logf(ctx, "dispatcher", "%s: notify %d users (nid=%d,join_count=%d)", ed.RoomID, len(userIDs), ed.NID, ed.JoinCount)
 	// invoke listeners
@@ -13,12 +13,26 @@ import (
 // Client created request params
 type AccountDataRequest struct {
 	Core
+	// Only send account data of these types. Applies to both global and room account data.
+	internal.TypeFilter
 }
 
 func (r *AccountDataRequest) Name() string {
 	return "AccountDataRequest"
 }
 
+func (r *AccountDataRequest) ApplyDelta(gnext GenericRequest) {
+	r.Core.ApplyDelta(gnext)
+	next := gnext.(*AccountDataRequest)
+	// nil means they didn't specify this field, so leave it unchanged.
+	if next.Types != nil {
+		r.Types = next.Types
+	}
+	if next.NotTypes != nil {
+		r.NotTypes = next.NotTypes
+	}
+}
+
 // Server response
 type AccountDataResponse struct {
 	Global []json.RawMessage            `json:"global,omitempty"`
@@ -42,15 +56,31 @@ func accountEventsAsJSON(events []state.AccountData) []json.RawMessage {
 	return j
 }
 
+// filterAccountData returns the account data which passes the request's type filter.
+func (r *AccountDataRequest) filterAccountData(events []state.AccountData) []state.AccountData {
+	if !r.TypeFilter.Filters() {
+		return events
+	}
+	filtered := make([]state.AccountData, 0, len(events))
+	for _, ad := range events {
+		if r.TypeFilter.Include(ad.Type) {
+			filtered = append(filtered, ad)
+		}
+	}
+	return filtered
+}
+
 func (r *AccountDataRequest) AppendLive(ctx context.Context, res *Response, extCtx Context, up caches.Update) {
 	var globalMsgs []json.RawMessage
 	roomToMsgs := map[string][]json.RawMessage{}
 	switch update := up.(type) {
 	case *caches.AccountDataUpdate:
-		globalMsgs = accountEventsAsJSON(update.AccountData)
+		globalMsgs = accountEventsAsJSON(r.filterAccountData(update.AccountData))
 	case *caches.RoomAccountDataUpdate:
 		if r.RoomInScope(update.RoomID(), extCtx) {
-			roomToMsgs[update.RoomID()] = accountEventsAsJSON(update.AccountData)
+			if roomAccountData := r.filterAccountData(update.AccountData); len(roomAccountData) > 0 {
+				roomToMsgs[update.RoomID()] = accountEventsAsJSON(roomAccountData)
+			}
 		}
 	case caches.RoomUpdate:
 		if !r.RoomInScope(update.RoomID(), extCtx) {
@@ -65,7 +95,7 @@ func (r *AccountDataRequest) AppendLive(ctx context.Context, res *Response, extC
 				// for the same room, we could send dupe room account data if we didn't do this check.
 				return
 			}
-			roomAccountData, err := extCtx.Store.AccountDatas(extCtx.UserID, update.RoomID())
+			roomAccountData, err := extCtx.Store.AccountDatas(extCtx.UserID, &r.TypeFilter, update.RoomID())
 			if err != nil {
 				log.Err(err).Str("user", extCtx.UserID).Str("room", update.RoomID()).Msg("failed to fetch room account data")
 				internal.GetSentryHubFromContextOrDefault(ctx).CaptureException(err)
@@ -108,7 +138,7 @@ func (r *AccountDataRequest) ProcessInitial(ctx context.Context, res *Response,
 	// room account data needs to be sent every time the user scrolls the list to get new room IDs
 	// TODO: remember which rooms the client has been told about
 	if len(roomIDs) > 0 {
-		roomsAccountData, err := extCtx.Store.AccountDatas(extCtx.UserID, roomIDs...)
+		roomsAccountData, err := extCtx.Store.AccountDatas(extCtx.UserID, &r.TypeFilter, roomIDs...)
 		if err != nil {
 			log.Err(err).Str("user", extCtx.UserID).Strs("rooms", roomIDs).Msg("failed to fetch room account data")
 			internal.GetSentryHubFromContextOrDefault(ctx).CaptureException(err)
@@ -122,7 +152,7 @@ func (r *AccountDataRequest) ProcessInitial(ctx context.Context, res *Response,
 	}
 	// global account data is only sent on the first connection, then we live stream
 	if extCtx.IsInitial {
-		globalAccountData, err := extCtx.Store.AccountDatas(extCtx.UserID)
+		globalAccountData, err := extCtx.Store.AccountDatas(extCtx.UserID, &r.TypeFilter)
 		if err != nil {
 			log.Err(err).Str("user", extCtx.UserID).Msg("failed to fetch global account data")
 			internal.GetSentryHubFromContextOrDefault(ctx).CaptureException(err)
@@ -112,3 +112,45 @@ func TestLiveAccountDataAggregation(t *testing.T) {
 		t.Fatalf("got  %+v\nwant %+v", res.AccountData.Global, wantGlobalAccountData)
 	}
 }
+
+func TestLiveAccountDataTypeFilter(t *testing.T) {
+	boolTrue := true
+	ext := &AccountDataRequest{
+		Core: Core{
+			Enabled: &boolTrue,
+			Rooms:   []string{"*"},
+		},
+	}
+	// the filter is sticky, and can be updated by later requests
+	ext.ApplyDelta(&AccountDataRequest{
+		TypeFilter: internal.TypeFilter{NotTypes: []string{"m.secret_storage.*"}},
+	})
+	ext.ApplyDelta(&AccountDataRequest{})
+	var res Response
+	var extCtx = Context{
+		AllSubscribedRooms: []string{roomA},
+	}
+	direct := state.AccountData{Type: "m.direct", Data: []byte(`{"type":"m.direct"}`)}
+	secret := state.AccountData{Type: "m.secret_storage.key.abc", Data: []byte(`{"type":"m.secret_storage.key.abc"}`)}
+	ext.AppendLive(ctx, &res, extCtx, &caches.AccountDataUpdate{
+		AccountData: []state.AccountData{direct, secret},
+	})
+	// room updates which are entirely filtered out don't create an entry for the room
+	ext.AppendLive(ctx, &res, extCtx, &caches.RoomAccountDataUpdate{
+		RoomUpdate: &dummyRoomUpdate{
+			roomID:         roomA,
+			globalMetadata: &internal.RoomMetadata{RoomID: roomA},
+		},
+		AccountData: []state.AccountData{secret},
+	})
+	if res.AccountData == nil {
+		t.Fatalf("Didn't get account data: %v", res)
+	}
+	wantGlobalAccountData := []json.RawMessage{direct.Data}
+	if !reflect.DeepEqual(res.AccountData.Global, wantGlobalAccountData) {
+		t.Fatalf("got  %+v\nwant %+v", res.AccountData.Global, wantGlobalAccountData)
+	}
+	if len(res.AccountData.Rooms) != 0 {
+		t.Fatalf("got room account data %+v, want none", res.AccountData.Rooms)
+	}
+}
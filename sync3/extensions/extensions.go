@@ -158,11 +158,14 @@ type Request struct {
 	AccountData *AccountDataRequest `json:"account_data"`
 	Typing      *TypingRequest      `json:"typing"`
 	Receipts    *ReceiptsRequest    `json:"receipts"`
+	Presence    *PresenceRequest    `json:"presence"`
+	Threads     *ThreadsRequest     `json:"threads"`
+	Spaces      *SpacesRequest      `json:"spaces"`
 }
 
 func (r *Request) fields() []GenericRequest {
 	return []GenericRequest{
-		r.ToDevice, r.E2EE, r.AccountData, r.Typing, r.Receipts,
+		r.ToDevice, r.E2EE, r.AccountData, r.Typing, r.Receipts, r.Presence, r.Threads, r.Spaces,
 	}
 }
 
@@ -173,6 +176,9 @@ func (r *Request) setFields(fields []GenericRequest) {
 	r.AccountData = fields[2].(*AccountDataRequest)
 	r.Typing = fields[3].(*TypingRequest)
 	r.Receipts = fields[4].(*ReceiptsRequest)
+	r.Presence = fields[5].(*PresenceRequest)
+	r.Threads = fields[6].(*ThreadsRequest)
+	r.Spaces = fields[7].(*SpacesRequest)
 }
 
 func (r Request) EnabledExtensions() (exts []GenericRequest) {
@@ -235,6 +241,15 @@ func (r *Request) InterpretAsInitial() {
 	if r.Receipts != nil {
 		r.Receipts.InterpretAsInitial()
 	}
+	if r.Presence != nil {
+		r.Presence.InterpretAsInitial()
+	}
+	if r.Threads != nil {
+		r.Threads.InterpretAsInitial()
+	}
+	if r.Spaces != nil {
+		r.Spaces.InterpretAsInitial()
+	}
 }
 
 // Response represents the top-level `extensions` key in the JSON response.
@@ -246,11 +261,14 @@ type Response struct {
 	AccountData *AccountDataResponse `json:"account_data,omitempty"`
 	Typing      *TypingResponse      `json:"typing,omitempty"`
 	Receipts    *ReceiptsResponse    `json:"receipts,omitempty"`
+	Presence    *PresenceResponse    `json:"presence,omitempty"`
+	Threads     *ThreadsResponse     `json:"threads,omitempty"`
+	Spaces      *SpacesResponse      `json:"spaces,omitempty"`
 }
 
 func (r Response) fields() []GenericResponse {
 	return []GenericResponse{
-		r.ToDevice, r.E2EE, r.AccountData, r.Typing, r.Receipts,
+		r.ToDevice, r.E2EE, r.AccountData, r.Typing, r.Receipts, r.Presence, r.Threads, r.Spaces,
 	}
 }
 
@@ -294,6 +312,9 @@ type Context struct {
 	AllLists []string
 	// AllSubscribedRooms is the slice of room IDs provided to the Room Subscription API.
 	AllSubscribedRooms []string
+	// JoinedSpaces is the room IDs of the spaces the user is joined to. Only set when the spaces
+	// extension is enabled.
+	JoinedSpaces []string
 }
 
 type HandlerInterface interface {
@@ -137,6 +137,7 @@ func TestExtension_ApplyDelta(t *testing.T) {
 					Core: Core{
 						Enabled: &boolFalse,
 					},
+					Scope: ReceiptScopeOwn,
 				},
 				Typing: &TypingRequest{
 					Core: Core{
@@ -193,6 +194,7 @@ func TestExtension_ApplyDelta(t *testing.T) {
 					Core: Core{
 						Enabled: &boolTrue,
 					},
+					Scope: ReceiptScopeOwn,
 				},
 				Typing: &TypingRequest{
 					Core: Core{
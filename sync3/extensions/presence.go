@@ -0,0 +1,114 @@
+package extensions
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"github.com/matrix-org/sliding-sync/internal"
+	"github.com/matrix-org/sliding-sync/state"
+	"github.com/matrix-org/sliding-sync/sync3/caches"
+	"github.com/rs/zerolog/log"
+)
+
+// Client created request params
+type PresenceRequest struct {
+	Core
+}
+
+func (r *PresenceRequest) Name() string {
+	return "PresenceRequest"
+}
+
+// Server response
+type PresenceResponse struct {
+	// m.presence events, at most one per user
+	Events []json.RawMessage `json:"events,omitempty"`
+	// user_id -> index in Events, so newer presence for the same user replaces older presence
+	userIDToIndex map[string]int
+}
+
+func (r *PresenceResponse) HasData(isInitial bool) bool {
+	if isInitial {
+		return true
+	}
+	return len(r.Events) > 0
+}
+
+func (r *PresenceResponse) add(userID string, ev json.RawMessage) {
+	if i, exists := r.userIDToIndex[userID]; exists {
+		r.Events[i] = ev
+		return
+	}
+	r.userIDToIndex[userID] = len(r.Events)
+	r.Events = append(r.Events, ev)
+}
+
+func newPresenceResponse() *PresenceResponse {
+	return &PresenceResponse{
+		userIDToIndex: make(map[string]int),
+	}
+}
+
+func (r *PresenceRequest) AppendLive(ctx context.Context, res *Response, extCtx Context, up caches.Update) {
+	update, ok := up.(*caches.PresenceUpdate)
+	if !ok {
+		return
+	}
+	// only tell the client about users in rooms it can currently see
+	visible := false
+	for _, roomID := range update.SharedRoomIDs {
+		if r.RoomInScope(roomID, extCtx) {
+			visible = true
+			break
+		}
+	}
+	if !visible {
+		return
+	}
+	ev, err := state.PackPresenceIntoEvent(update.Presence, time.Now().UnixMilli())
+	if err != nil {
+		log.Err(err).Str("user", extCtx.UserID).Str("presence_user", update.Presence.UserID).Msg("failed to pack presence into event")
+		internal.GetSentryHubFromContextOrDefault(ctx).CaptureException(err)
+		return
+	}
+	if res.Presence == nil {
+		res.Presence = newPresenceResponse()
+	}
+	res.Presence.add(update.Presence.UserID, ev)
+}
+
+func (r *PresenceRequest) ProcessInitial(ctx context.Context, res *Response, extCtx Context) {
+	// presence needs to be sent every time the user scrolls the list to get new room IDs
+	// TODO: remember which users the client has been told about
+	roomIDs := make([]string, 0, len(extCtx.RoomIDToTimeline))
+	for roomID := range extCtx.RoomIDToTimeline {
+		if r.RoomInScope(roomID, extCtx) {
+			roomIDs = append(roomIDs, roomID)
+		}
+	}
+	if len(roomIDs) == 0 {
+		return
+	}
+	presences, err := extCtx.Store.PresenceForJoinedMembers(roomIDs)
+	if err != nil {
+		log.Err(err).Str("user", extCtx.UserID).Strs("rooms", roomIDs).Msg("failed to fetch presence")
+		internal.GetSentryHubFromContextOrDefault(ctx).CaptureException(err)
+		return
+	}
+	if len(presences) == 0 {
+		return // don't add a presence extension, no data!
+	}
+	nowMs := time.Now().UnixMilli()
+	extRes := newPresenceResponse()
+	for _, p := range presences {
+		ev, err := state.PackPresenceIntoEvent(p, nowMs)
+		if err != nil {
+			log.Err(err).Str("user", extCtx.UserID).Str("presence_user", p.UserID).Msg("failed to pack presence into event")
+			internal.GetSentryHubFromContextOrDefault(ctx).CaptureException(err)
+			continue
+		}
+		extRes.add(p.UserID, ev)
+	}
+	res.Presence = extRes
+}
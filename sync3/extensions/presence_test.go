@@ -0,0 +1,71 @@
+package extensions
+
+import (
+	"testing"
+
+	"github.com/matrix-org/sliding-sync/internal"
+	"github.com/matrix-org/sliding-sync/sync3/caches"
+	"github.com/tidwall/gjson"
+)
+
+// Test that live presence is aggregated per user and only sent for users in visible rooms
+func TestLivePresence(t *testing.T) {
+	ext := &PresenceRequest{
+		Core: Core{
+			Enabled: &boolTrue,
+			Lists:   []string{"*"},
+			Rooms:   []string{"*"},
+		},
+	}
+	var res Response
+	extCtx := Context{
+		AllSubscribedRooms: []string{roomA},
+		AllLists:           []string{"a"},
+		RoomIDsToLists: map[string][]string{
+			roomB: {"a"},
+		},
+	}
+	alice := "@alice:localhost"
+	bob := "@bob:localhost"
+	charlie := "@charlie:localhost"
+
+	// charlie shares no visible rooms with us, so should be ignored
+	ext.AppendLive(ctx, &res, extCtx, &caches.PresenceUpdate{
+		Presence:      internal.Presence{UserID: charlie, Presence: "online"},
+		SharedRoomIDs: []string{roomC},
+	})
+	if res.Presence != nil {
+		t.Fatalf("got presence for a user in a room which isn't visible: %v", res.Presence.Events)
+	}
+
+	// alice is in a room subscription, bob is in a list
+	ext.AppendLive(ctx, &res, extCtx, &caches.PresenceUpdate{
+		Presence:      internal.Presence{UserID: alice, Presence: "online"},
+		SharedRoomIDs: []string{roomC, roomA},
+	})
+	ext.AppendLive(ctx, &res, extCtx, &caches.PresenceUpdate{
+		Presence:      internal.Presence{UserID: bob, Presence: "online"},
+		SharedRoomIDs: []string{roomB},
+	})
+	// alice changes presence again, which should replace her earlier presence
+	ext.AppendLive(ctx, &res, extCtx, &caches.PresenceUpdate{
+		Presence:      internal.Presence{UserID: alice, Presence: "unavailable"},
+		SharedRoomIDs: []string{roomA},
+	})
+	if res.Presence == nil {
+		t.Fatalf("presence response is empty")
+	}
+	want := map[string]string{
+		alice: "unavailable",
+		bob:   "online",
+	}
+	if len(res.Presence.Events) != len(want) {
+		t.Fatalf("got %d presence events, want %d", len(res.Presence.Events), len(want))
+	}
+	for _, ev := range res.Presence.Events {
+		sender := gjson.GetBytes(ev, "sender").Str
+		if got := gjson.GetBytes(ev, "content.presence").Str; got != want[sender] {
+			t.Errorf("got presence %q for %s, want %q", got, sender, want[sender])
+		}
+	}
+}
@@ -8,17 +8,100 @@ import (
 	"github.com/matrix-org/sliding-sync/state"
 	"github.com/matrix-org/sliding-sync/sync3/caches"
 	"github.com/rs/zerolog/log"
+	"golang.org/x/exp/slices"
 )
 
+// Values for ReceiptsRequest.Scope. In every scope, only rooms which are in scope for the
+// extension are considered.
+const (
+	// Send receipts for the events in initial timelines, the user's own receipts and every
+	// live receipt. This is the default.
+	ReceiptScopeAll = "all"
+	// Only send receipts for events which have been sent to the client in a timeline on this
+	// connection, along with the user's own receipts. Useful in large rooms, where receipts
+	// for events the client can't see would otherwise flood it.
+	ReceiptScopeTimeline = "timeline"
+	// Only send the user's own receipts.
+	ReceiptScopeOwn = "own"
+)
+
+// The number of timeline event IDs remembered per room for ReceiptScopeTimeline. Receipts for
+// events older than this are dropped.
+const maxReceiptTimelineEvents = 100
+
 // Client created request params
 type ReceiptsRequest struct {
 	Core
+	// One of the ReceiptScope constants. Omitted means ReceiptScopeAll.
+	Scope string `json:"scope,omitempty"`
+
+	// room ID -> IDs of the events sent to the client in timelines, oldest first. Only tracked
+	// for ReceiptScopeTimeline.
+	timelineEventIDs map[string][]string
 }
 
 func (r *ReceiptsRequest) Name() string {
 	return "ReceiptsRequest"
 }
 
+func (r *ReceiptsRequest) ApplyDelta(gnext GenericRequest) {
+	r.Core.ApplyDelta(gnext)
+	next := gnext.(*ReceiptsRequest)
+	// empty means they didn't specify this field, so leave it unchanged.
+	if next.Scope != "" {
+		r.Scope = next.Scope
+	}
+}
+
+// ValidScope returns true if the scope is empty or one of the ReceiptScope constants.
+func (r *ReceiptsRequest) ValidScope() bool {
+	switch r.Scope {
+	case "", ReceiptScopeAll, ReceiptScopeTimeline, ReceiptScopeOwn:
+		return true
+	}
+	return false
+}
+
+// trackTimelines remembers the event IDs in these timelines so receipts for them can be sent later.
+func (r *ReceiptsRequest) trackTimelines(extCtx Context) {
+	if r.Scope != ReceiptScopeTimeline {
+		return
+	}
+	if r.timelineEventIDs == nil {
+		r.timelineEventIDs = make(map[string][]string)
+	}
+	for roomID, eventIDs := range extCtx.RoomIDToTimeline {
+		if !r.RoomInScope(roomID, extCtx) {
+			continue
+		}
+		// the same response is seen once per live update, so skip events we already know about
+		tracked := r.timelineEventIDs[roomID]
+		for _, eventID := range eventIDs {
+			if !slices.Contains(tracked, eventID) {
+				tracked = append(tracked, eventID)
+			}
+		}
+		if len(tracked) > maxReceiptTimelineEvents {
+			tracked = tracked[len(tracked)-maxReceiptTimelineEvents:]
+		}
+		r.timelineEventIDs[roomID] = tracked
+	}
+}
+
+// includeReceipt returns true if this receipt should be sent to the client, according to the scope.
+func (r *ReceiptsRequest) includeReceipt(receipt internal.Receipt, userID string) bool {
+	if receipt.UserID == userID {
+		return true
+	}
+	switch r.Scope {
+	case ReceiptScopeOwn:
+		return false
+	case ReceiptScopeTimeline:
+		return slices.Contains(r.timelineEventIDs[receipt.RoomID], receipt.EventID)
+	}
+	return true
+}
+
 // Server response
 type ReceiptsResponse struct {
 	// room_id -> m.receipt ephemeral event
@@ -33,9 +116,11 @@ func (r *ReceiptsResponse) HasData(isInitial bool) bool {
 }
 
 func (r *ReceiptsRequest) AppendLive(ctx context.Context, res *Response, extCtx Context, up caches.Update) {
+	// the client is sent this update's timeline events alongside any receipts for them
+	r.trackTimelines(extCtx)
 	switch update := up.(type) {
 	case *caches.ReceiptUpdate:
-		if !r.RoomInScope(update.RoomID(), extCtx) {
+		if !r.RoomInScope(update.RoomID(), extCtx) || !r.includeReceipt(update.Receipt, extCtx.UserID) {
 			break
 		}
 
@@ -85,6 +170,7 @@ func (r *ReceiptsRequest) AppendLive(ctx context.Context, res *Response, extCtx
 }
 
 func (r *ReceiptsRequest) ProcessInitial(ctx context.Context, res *Response, extCtx Context) {
+	r.trackTimelines(extCtx)
 	// grab receipts for all timelines for all the rooms we're going to return
 	rooms := make(map[string]json.RawMessage)
 	interestedRoomIDs := make([]string, 0, len(extCtx.RoomIDToTimeline))
@@ -93,6 +179,10 @@ func (r *ReceiptsRequest) ProcessInitial(ctx context.Context, res *Response, ext
 		if !r.RoomInScope(roomID, extCtx) {
 			continue
 		}
+		interestedRoomIDs = append(interestedRoomIDs, roomID)
+		if r.Scope == ReceiptScopeOwn {
+			continue
+		}
 		receipts, err := extCtx.Store.ReceiptTable.SelectReceiptsForEvents(roomID, timeline)
 		if err != nil {
 			log.Err(err).Str("user", extCtx.UserID).Str("room", roomID).Msg("failed to SelectReceiptsForEvents")
@@ -100,7 +190,6 @@ func (r *ReceiptsRequest) ProcessInitial(ctx context.Context, res *Response, ext
 			continue
 		}
 		otherReceipts[roomID] = receipts
-		interestedRoomIDs = append(interestedRoomIDs, roomID)
 	}
 	// single shot query to pull out our own receipts for these rooms to always include our own receipts
 	ownReceipts, err := extCtx.Store.ReceiptTable.SelectReceiptsForUser(interestedRoomIDs, extCtx.UserID)
@@ -78,3 +78,83 @@ func TestLiveReceiptsAggregation(t *testing.T) {
 		t.Fatalf("got  %+v\nwant %+v", res.Receipts.Rooms, want)
 	}
 }
+
+// Test that live receipts are only sent if they are within the requested scope.
+func TestLiveReceiptsScope(t *testing.T) {
+	boolTrue := true
+	me := "@me:here"
+	receipt := func(userID, eventID string) *caches.ReceiptUpdate {
+		return &caches.ReceiptUpdate{
+			Receipt: internal.Receipt{
+				RoomID:  roomA,
+				EventID: eventID,
+				UserID:  userID,
+				TS:      12345,
+			},
+			RoomUpdate: &dummyRoomUpdate{
+				roomID: roomA,
+			},
+		}
+	}
+	ownReceipt := receipt(me, "$old")
+	seenReceipt := receipt("@someone:here", "$seen")
+	unseenReceipt := receipt("@someone:here", "$unseen")
+	testCases := []struct {
+		scope string
+		want  []internal.Receipt
+	}{
+		{
+			scope: "",
+			want:  []internal.Receipt{ownReceipt.Receipt, seenReceipt.Receipt, unseenReceipt.Receipt},
+		},
+		{
+			scope: ReceiptScopeAll,
+			want:  []internal.Receipt{ownReceipt.Receipt, seenReceipt.Receipt, unseenReceipt.Receipt},
+		},
+		{
+			scope: ReceiptScopeTimeline,
+			want:  []internal.Receipt{ownReceipt.Receipt, seenReceipt.Receipt},
+		},
+		{
+			scope: ReceiptScopeOwn,
+			want:  []internal.Receipt{ownReceipt.Receipt},
+		},
+	}
+	for _, tc := range testCases {
+		ext := &ReceiptsRequest{
+			Core: Core{
+				Enabled: &boolTrue,
+				Lists:   []string{"*"},
+				Rooms:   []string{"*"},
+			},
+			Scope: tc.scope,
+		}
+		if !ext.ValidScope() {
+			t.Fatalf("scope %q: ValidScope returned false", tc.scope)
+		}
+		// the client was sent $seen in an earlier response
+		ext.trackTimelines(Context{
+			AllSubscribedRooms: []string{roomA},
+			RoomIDToTimeline:   map[string][]string{roomA: {"$seen"}},
+		})
+		var res Response
+		extCtx := Context{
+			UserID:             me,
+			AllSubscribedRooms: []string{roomA},
+		}
+		ext.AppendLive(ctx, &res, extCtx, ownReceipt)
+		ext.AppendLive(ctx, &res, extCtx, seenReceipt)
+		ext.AppendLive(ctx, &res, extCtx, unseenReceipt)
+		if res.Receipts == nil {
+			t.Fatalf("scope %q: receipts response is empty", tc.scope)
+		}
+		want, err := state.PackReceiptsIntoEDU(tc.want)
+		assertNoError(t, err)
+		if !reflect.DeepEqual(res.Receipts.Rooms[roomA], want) {
+			t.Errorf("scope %q: got %s want %s", tc.scope, res.Receipts.Rooms[roomA], want)
+		}
+	}
+	if (&ReceiptsRequest{Scope: "everything"}).ValidScope() {
+		t.Errorf("ValidScope returned true for an unknown scope")
+	}
+}
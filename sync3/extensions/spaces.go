@@ -0,0 +1,192 @@
+package extensions
+
+import (
+	"context"
+	"sort"
+
+	"github.com/matrix-org/sliding-sync/internal"
+	"github.com/matrix-org/sliding-sync/state"
+	"github.com/matrix-org/sliding-sync/sync3/caches"
+	"github.com/rs/zerolog/log"
+)
+
+// Client created request params. The lists and rooms fields are ignored, as the space graph isn't
+// tied to which rooms the client can see.
+type SpacesRequest struct {
+	Core
+	// true once the whole graph has been sent, after which the client is only told about changes
+	sentGraph bool
+}
+
+func (r *SpacesRequest) Name() string {
+	return "SpacesRequest"
+}
+
+func (r *SpacesRequest) ApplyDelta(gnext GenericRequest) {
+	r.Core.ApplyDelta(gnext)
+	if !ExtensionEnabled(r) {
+		// the client isn't told about changes whilst this is disabled, so it needs the whole graph
+		// again if it is re-enabled
+		r.sentGraph = false
+	}
+}
+
+// Server response
+type SpacesResponse struct {
+	// space room ID -> the space's place in the space graph. On an initial sync, or when the
+	// extension is first enabled, this has every space the user is joined to. After that, it has
+	// the spaces which have changed, which replace what the client had for them.
+	Spaces map[string]*Space `json:"spaces,omitempty"`
+	// Spaces the user has left, which the client should forget about.
+	Left []string `json:"left,omitempty"`
+}
+
+// Space is what a space says about itself in its m.space.child and m.space.parent events.
+type Space struct {
+	// Children in the order the spec says to show them.
+	Children []SpaceChild `json:"children"`
+	// Room IDs of the spaces which this space says it is in.
+	Parents []string `json:"parents"`
+}
+
+type SpaceChild struct {
+	RoomID    string `json:"room_id"`
+	Order     string `json:"order,omitempty"`
+	Suggested bool   `json:"suggested,omitempty"`
+}
+
+func (r *SpacesResponse) HasData(isInitial bool) bool {
+	if isInitial {
+		return true
+	}
+	return len(r.Spaces) > 0 || len(r.Left) > 0
+}
+
+// setSpaces replaces these spaces with what is in the relations, which must include every
+// relation for them.
+func (r *SpacesResponse) setSpaces(spaceRoomIDs []string, relations []state.SpaceRelation) {
+	if r.Spaces == nil {
+		r.Spaces = make(map[string]*Space)
+	}
+	for _, spaceRoomID := range spaceRoomIDs {
+		r.Spaces[spaceRoomID] = &Space{
+			Children: []SpaceChild{},
+			Parents:  []string{},
+		}
+		r.removeLeft(spaceRoomID)
+	}
+	for _, rel := range relations {
+		switch rel.Relation {
+		case state.RelationMSpaceChild:
+			if space := r.Spaces[rel.Parent]; space != nil {
+				space.Children = append(space.Children, SpaceChild{
+					RoomID:    rel.Child,
+					Order:     rel.Ordering,
+					Suggested: rel.IsSuggested,
+				})
+			}
+		case state.RelationMSpaceParent:
+			if space := r.Spaces[rel.Child]; space != nil {
+				space.Parents = append(space.Parents, rel.Parent)
+			}
+		}
+	}
+	for _, spaceRoomID := range spaceRoomIDs {
+		space := r.Spaces[spaceRoomID]
+		sortSpaceChildren(space.Children)
+		sort.Strings(space.Parents)
+	}
+}
+
+func (r *SpacesResponse) setLeft(spaceRoomID string) {
+	delete(r.Spaces, spaceRoomID)
+	r.removeLeft(spaceRoomID)
+	r.Left = append(r.Left, spaceRoomID)
+}
+
+func (r *SpacesResponse) removeLeft(spaceRoomID string) {
+	for i, roomID := range r.Left {
+		if roomID == spaceRoomID {
+			r.Left = append(r.Left[:i], r.Left[i+1:]...)
+			return
+		}
+	}
+}
+
+// sortSpaceChildren sorts children with an order before those without, then by order, then by
+// room ID. The spec also breaks ties by when the m.space.child event was sent, but we don't
+// store that.
+func sortSpaceChildren(children []SpaceChild) {
+	sort.Slice(children, func(i, j int) bool {
+		a, b := children[i], children[j]
+		if (a.Order == "") != (b.Order == "") {
+			return a.Order != ""
+		}
+		if a.Order != b.Order {
+			return a.Order < b.Order
+		}
+		return a.RoomID < b.RoomID
+	})
+}
+
+func (r *SpacesRequest) AppendLive(ctx context.Context, res *Response, extCtx Context, up caches.Update) {
+	switch update := up.(type) {
+	case *caches.SpaceUpdate:
+		// only spaces the user is joined to send space updates to their user cache
+		r.refresh(ctx, res, extCtx, update.ParentRoomID)
+	case *caches.RoomEventUpdate:
+		if update.EventData == nil || update.EventData.StateKey == nil || !update.GlobalRoomMetadata().IsSpace() {
+			return
+		}
+		switch update.EventData.EventType {
+		case "m.space.parent":
+			r.refresh(ctx, res, extCtx, update.RoomID())
+		case "m.room.member":
+			if *update.EventData.StateKey != extCtx.UserID {
+				return
+			}
+			switch update.EventData.Content.Get("membership").Str {
+			case "join":
+				r.refresh(ctx, res, extCtx, update.RoomID())
+			case "leave", "ban":
+				if res.Spaces == nil {
+					res.Spaces = &SpacesResponse{}
+				}
+				res.Spaces.setLeft(update.RoomID())
+			}
+		}
+	}
+}
+
+// refresh loads the space from the database and puts it in the response.
+func (r *SpacesRequest) refresh(ctx context.Context, res *Response, extCtx Context, spaceRoomID string) {
+	spaceRoomIDs := []string{spaceRoomID}
+	relations, err := extCtx.Store.SpaceGraph(spaceRoomIDs)
+	if err != nil {
+		log.Err(err).Str("user", extCtx.UserID).Str("space", spaceRoomID).Msg("failed to fetch space graph")
+		internal.GetSentryHubFromContextOrDefault(ctx).CaptureException(err)
+		return
+	}
+	if res.Spaces == nil {
+		res.Spaces = &SpacesResponse{}
+	}
+	res.Spaces.setSpaces(spaceRoomIDs, relations)
+}
+
+func (r *SpacesRequest) ProcessInitial(ctx context.Context, res *Response, extCtx Context) {
+	// the whole graph is only sent on initial syncs or when the extension is enabled, after that
+	// the client is told about changes
+	if r.sentGraph && !extCtx.IsInitial {
+		return
+	}
+	relations, err := extCtx.Store.SpaceGraph(extCtx.JoinedSpaces)
+	if err != nil {
+		log.Err(err).Str("user", extCtx.UserID).Strs("spaces", extCtx.JoinedSpaces).Msg("failed to fetch space graph")
+		internal.GetSentryHubFromContextOrDefault(ctx).CaptureException(err)
+		return
+	}
+	extRes := &SpacesResponse{}
+	extRes.setSpaces(extCtx.JoinedSpaces, relations)
+	res.Spaces = extRes
+	r.sentGraph = true
+}
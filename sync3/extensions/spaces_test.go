@@ -0,0 +1,90 @@
+package extensions
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/matrix-org/sliding-sync/internal"
+	"github.com/matrix-org/sliding-sync/state"
+	"github.com/matrix-org/sliding-sync/sync3/caches"
+	"github.com/tidwall/gjson"
+)
+
+func TestSpacesResponseSetSpaces(t *testing.T) {
+	var res SpacesResponse
+	res.setLeft("!empty")
+	res.setSpaces([]string{"!space", "!empty"}, []state.SpaceRelation{
+		{Parent: "!space", Child: "!unordered", Relation: state.RelationMSpaceChild},
+		{Parent: "!space", Child: "!second", Relation: state.RelationMSpaceChild, Ordering: "b"},
+		{Parent: "!space", Child: "!first", Relation: state.RelationMSpaceChild, Ordering: "a", IsSuggested: true},
+		{Parent: "!space", Child: "!also-unordered", Relation: state.RelationMSpaceChild},
+		{Parent: "!top", Child: "!space", Relation: state.RelationMSpaceParent},
+		// a child of a space we didn't ask for is ignored
+		{Parent: "!other", Child: "!space", Relation: state.RelationMSpaceChild},
+	})
+	want := map[string]*Space{
+		"!space": {
+			Children: []SpaceChild{
+				{RoomID: "!first", Order: "a", Suggested: true},
+				{RoomID: "!second", Order: "b"},
+				{RoomID: "!also-unordered"},
+				{RoomID: "!unordered"},
+			},
+			Parents: []string{"!top"},
+		},
+		"!empty": {
+			Children: []SpaceChild{},
+			Parents:  []string{},
+		},
+	}
+	if !reflect.DeepEqual(res.Spaces, want) {
+		t.Errorf("got %+v want %+v", res.Spaces, want)
+	}
+	// rejoining a space undoes leaving it
+	if len(res.Left) != 0 {
+		t.Errorf("got left spaces %v want none", res.Left)
+	}
+}
+
+func TestLiveSpacesLeave(t *testing.T) {
+	boolTrue := true
+	ext := &SpacesRequest{
+		Core: Core{
+			Enabled: &boolTrue,
+		},
+	}
+	alice := "@alice:localhost"
+	spaceType := "m.space"
+	memberUpdate := func(roomID, userID, membership string, isSpace bool) *caches.RoomEventUpdate {
+		metadata := &internal.RoomMetadata{RoomID: roomID}
+		if isSpace {
+			metadata.RoomType = &spaceType
+		}
+		return &caches.RoomEventUpdate{
+			RoomUpdate: &dummyRoomUpdate{roomID: roomID, globalMetadata: metadata},
+			EventData: &caches.EventData{
+				RoomID:    roomID,
+				EventType: "m.room.member",
+				StateKey:  &userID,
+				Content:   gjson.Parse(`{"membership":"` + membership + `"}`),
+			},
+		}
+	}
+	var res Response
+	extCtx := Context{UserID: alice}
+	// someone else leaving, or us leaving a room which isn't a space, isn't interesting
+	ext.AppendLive(ctx, &res, extCtx, memberUpdate(roomA, "@bob:localhost", "leave", true))
+	ext.AppendLive(ctx, &res, extCtx, memberUpdate(roomB, alice, "leave", false))
+	if res.Spaces != nil {
+		t.Fatalf("got spaces response for irrelevant leaves: %+v", res.Spaces)
+	}
+	ext.AppendLive(ctx, &res, extCtx, memberUpdate(roomA, alice, "leave", true))
+	ext.AppendLive(ctx, &res, extCtx, memberUpdate(roomC, alice, "ban", true))
+	ext.AppendLive(ctx, &res, extCtx, memberUpdate(roomA, alice, "leave", true))
+	if res.Spaces == nil || !res.Spaces.HasData(false) {
+		t.Fatalf("spaces response is empty")
+	}
+	if want := []string{roomC, roomA}; !reflect.DeepEqual(res.Spaces.Left, want) {
+		t.Errorf("got left spaces %v want %v", res.Spaces.Left, want)
+	}
+}
@@ -0,0 +1,61 @@
+package extensions
+
+import (
+	"context"
+
+	"github.com/matrix-org/sliding-sync/sync3/caches"
+)
+
+// Client created request params
+type ThreadsRequest struct {
+	Core
+}
+
+func (r *ThreadsRequest) Name() string {
+	return "ThreadsRequest"
+}
+
+// Server response
+type ThreadsResponse struct {
+	// room_id -> thread root event IDs which have new events, in the order they were first seen
+	Rooms map[string][]string `json:"rooms,omitempty"`
+}
+
+func (r *ThreadsResponse) HasData(isInitial bool) bool {
+	return len(r.Rooms) > 0
+}
+
+func (r *ThreadsResponse) add(roomID, threadRootID string) {
+	for _, id := range r.Rooms[roomID] {
+		if id == threadRootID {
+			return
+		}
+	}
+	r.Rooms[roomID] = append(r.Rooms[roomID], threadRootID)
+}
+
+func (r *ThreadsRequest) AppendLive(ctx context.Context, res *Response, extCtx Context, up caches.Update) {
+	update, ok := up.(*caches.RoomEventUpdate)
+	if !ok || update.EventData == nil {
+		return
+	}
+	relatesTo := update.EventData.Content.Get(`m\.relates_to`)
+	if relatesTo.Get("rel_type").Str != "m.thread" {
+		return
+	}
+	threadRootID := relatesTo.Get("event_id").Str
+	if threadRootID == "" || !r.RoomInScope(update.RoomID(), extCtx) {
+		return
+	}
+	if res.Threads == nil {
+		res.Threads = &ThreadsResponse{
+			Rooms: make(map[string][]string),
+		}
+	}
+	res.Threads.add(update.RoomID(), threadRootID)
+}
+
+func (r *ThreadsRequest) ProcessInitial(ctx context.Context, res *Response, extCtx Context) {
+	// Only new thread activity is reported. The unread counts for existing threads are already
+	// on each room via unread_thread_notifications.
+}
@@ -0,0 +1,55 @@
+package extensions
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/matrix-org/sliding-sync/sync3/caches"
+	"github.com/tidwall/gjson"
+)
+
+func TestLiveThreadsAggregation(t *testing.T) {
+	boolTrue := true
+	ext := &ThreadsRequest{
+		Core: Core{
+			Enabled: &boolTrue,
+			Lists:   []string{"*"},
+			Rooms:   []string{roomA, roomB},
+		},
+	}
+	var res Response
+	extCtx := Context{
+		AllSubscribedRooms: []string{roomA, roomB, roomC},
+	}
+	eventUpdate := func(roomID, content string) *caches.RoomEventUpdate {
+		return &caches.RoomEventUpdate{
+			RoomUpdate: &dummyRoomUpdate{roomID: roomID},
+			EventData: &caches.EventData{
+				RoomID:    roomID,
+				EventType: "m.room.message",
+				Content:   gjson.Parse(content),
+			},
+		}
+	}
+	ext.AppendLive(ctx, &res, extCtx, eventUpdate(roomA, `{"body":"not in a thread"}`))
+	if res.Threads != nil {
+		t.Fatalf("threads response created for a non-thread event: %+v", res.Threads)
+	}
+	ext.AppendLive(ctx, &res, extCtx, eventUpdate(roomA, `{"m.relates_to":{"rel_type":"m.thread","event_id":"$root1"}}`))
+	ext.AppendLive(ctx, &res, extCtx, eventUpdate(roomB, `{"m.relates_to":{"rel_type":"m.thread","event_id":"$root2"}}`))
+	ext.AppendLive(ctx, &res, extCtx, eventUpdate(roomA, `{"m.relates_to":{"rel_type":"m.annotation","event_id":"$root3"}}`))
+	ext.AppendLive(ctx, &res, extCtx, eventUpdate(roomA, `{"m.relates_to":{"rel_type":"m.thread","event_id":"$root4"}}`))
+	ext.AppendLive(ctx, &res, extCtx, eventUpdate(roomA, `{"m.relates_to":{"rel_type":"m.thread","event_id":"$root1"}}`))
+	// room C is subscribed to but not in scope for this extension
+	ext.AppendLive(ctx, &res, extCtx, eventUpdate(roomC, `{"m.relates_to":{"rel_type":"m.thread","event_id":"$root5"}}`))
+	if res.Threads == nil {
+		t.Fatalf("threads response is empty")
+	}
+	want := map[string][]string{
+		roomA: {"$root1", "$root4"},
+		roomB: {"$root2"},
+	}
+	if !reflect.DeepEqual(res.Threads.Rooms, want) {
+		t.Errorf("got %+v want %+v", res.Threads.Rooms, want)
+	}
+}
@@ -0,0 +1,195 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/matrix-org/sliding-sync/sync2"
+)
+
+// ErrUnknownToken is returned by an Authenticator when the access token is not valid.
+var ErrUnknownToken = errors.New("unknown access token")
+
+// Identity is who an access token belongs to.
+type Identity struct {
+	UserID   string
+	DeviceID string
+	// When the token stops being valid. The zero time means it is valid until the homeserver rejects it.
+	ExpiresAt time.Time
+}
+
+// Authenticator works out who an access token the proxy hasn't seen before belongs to.
+type Authenticator interface {
+	// Authenticate identifies the token, which was sent to the homeserver with this server name
+	// (empty for the default homeserver). client talks to that homeserver. Returns ErrUnknownToken
+	// if the token is not valid, or another error if it can't be identified right now.
+	Authenticate(ctx context.Context, accessToken, serverName string, client sync2.Client) (*Identity, error)
+}
+
+// AuthOptions controls how access tokens the proxy hasn't seen before are identified.
+type AuthOptions struct {
+	// Defaults to WhoAmIAuthenticator.
+	Authenticator Authenticator
+	// How long identified tokens are trusted for before they are checked again. If 0, they are
+	// trusted until they expire, or until the homeserver rejects them if they don't expire.
+	TokenTTL time.Duration
+	// How long rejected tokens are remembered for, so they aren't checked again. If 0, they
+	// are checked every time.
+	RejectedTokenTTL time.Duration
+}
+
+// SetAuthOptions changes how access tokens the proxy hasn't seen before are identified.
+func (h *SyncLiveHandler) SetAuthOptions(opts AuthOptions) {
+	if opts.Authenticator == nil {
+		opts.Authenticator = WhoAmIAuthenticator{}
+	}
+	h.auth = opts
+}
+
+// expiresAt returns when a token identified now should be checked again.
+func (o AuthOptions) expiresAt(identity *Identity, now time.Time) time.Time {
+	if o.TokenTTL <= 0 {
+		return identity.ExpiresAt
+	}
+	ttlExpiry := now.Add(o.TokenTTL)
+	if identity.ExpiresAt.IsZero() || ttlExpiry.Before(identity.ExpiresAt) {
+		return ttlExpiry
+	}
+	return identity.ExpiresAt
+}
+
+// WhoAmIAuthenticator asks the homeserver who owns the token via /whoami.
+type WhoAmIAuthenticator struct{}
+
+func (WhoAmIAuthenticator) Authenticate(ctx context.Context, accessToken, serverName string, client sync2.Client) (*Identity, error) {
+	userID, deviceID, err := client.WhoAmI(ctx, accessToken)
+	if err == sync2.HTTP401 {
+		return nil, ErrUnknownToken
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &Identity{UserID: userID, DeviceID: deviceID}, nil
+}
+
+// IntrospectionAuthenticator asks an OAuth 2.0 authorization server about the token, using
+// token introspection (RFC 7662). This works with homeservers which delegate authentication,
+// as in MSC3861.
+type IntrospectionAuthenticator struct {
+	// The introspection endpoint, and the client credentials to authenticate to it with.
+	Endpoint     string
+	ClientID     string
+	ClientSecret string
+	// The server name for users whose introspection response only has their localpart, when
+	// the token was sent to the default homeserver.
+	ServerName string
+	// Defaults to http.DefaultClient.
+	Client *http.Client
+}
+
+type introspectionResponse struct {
+	Active   bool   `json:"active"`
+	Scope    string `json:"scope"`
+	Username string `json:"username"`
+	Sub      string `json:"sub"`
+	Exp      int64  `json:"exp"`
+	DeviceID string `json:"device_id"`
+}
+
+func (a *IntrospectionAuthenticator) Authenticate(ctx context.Context, accessToken, serverName string, client sync2.Client) (*Identity, error) {
+	form := url.Values{
+		"token":           {accessToken},
+		"token_type_hint": {"access_token"},
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", a.Endpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	if a.ClientID != "" {
+		req.SetBasicAuth(url.QueryEscape(a.ClientID), url.QueryEscape(a.ClientSecret))
+	}
+	httpClient := a.Client
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+	res, err := httpClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("token introspection request failed: %w", err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != 200 {
+		return nil, fmt.Errorf("token introspection returned HTTP %d", res.StatusCode)
+	}
+	var body introspectionResponse
+	if err = json.NewDecoder(res.Body).Decode(&body); err != nil {
+		return nil, fmt.Errorf("failed to decode token introspection response: %w", err)
+	}
+	if !body.Active {
+		return nil, ErrUnknownToken
+	}
+	username := body.Username
+	if username == "" {
+		username = body.Sub
+	}
+	deviceID := body.DeviceID
+	if deviceID == "" {
+		deviceID = deviceIDFromScope(body.Scope)
+	}
+	identity, err := newIdentity(username, deviceID, defaulting(serverName, a.ServerName))
+	if err != nil {
+		return nil, fmt.Errorf("token introspection: %w", err)
+	}
+	if body.Exp > 0 {
+		identity.ExpiresAt = time.Unix(body.Exp, 0)
+	}
+	return identity, nil
+}
+
+// The scopes which MSC2967 uses to say which device a token is for.
+var deviceScopePrefixes = []string{"urn:matrix:org.matrix.msc2967.client:device:", "urn:matrix:client:device:"}
+
+// deviceIDFromScope returns the device ID in a space separated list of OAuth 2.0 scopes.
+func deviceIDFromScope(scope string) string {
+	for _, s := range strings.Fields(scope) {
+		for _, prefix := range deviceScopePrefixes {
+			if deviceID, ok := strings.CutPrefix(s, prefix); ok && deviceID != "" {
+				return deviceID
+			}
+		}
+	}
+	return ""
+}
+
+// newIdentity makes an identity for a user, who may be given as just a localpart on this server.
+// Tokens without a user or device are no use to the proxy, as it can't poll for them.
+func newIdentity(user, deviceID, serverName string) (*Identity, error) {
+	if user == "" {
+		return nil, fmt.Errorf("%w: token has no user", ErrUnknownToken)
+	}
+	if deviceID == "" {
+		return nil, fmt.Errorf("%w: token has no device", ErrUnknownToken)
+	}
+	userID := user
+	if !strings.HasPrefix(user, "@") {
+		if serverName == "" {
+			return nil, fmt.Errorf("token is for localpart %q but there is no server name for it", user)
+		}
+		userID = "@" + user + ":" + serverName
+	}
+	return &Identity{UserID: userID, DeviceID: deviceID}, nil
+}
+
+func defaulting(in, dft string) string {
+	if in == "" {
+		return dft
+	}
+	return in
+}
@@ -0,0 +1,282 @@
+package handler
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	_ "crypto/sha256" // register the hashes used by JWT algorithms
+	_ "crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/matrix-org/sliding-sync/sync2"
+)
+
+// How far out the clocks of the token issuer and the proxy can be when checking exp and nbf.
+const jwtLeeway = 30 * time.Second
+
+// JWTAuthenticator identifies access tokens which are JSON Web Tokens (RFC 7519), without asking
+// anyone, by checking they are signed by a key in a JSON Web Key Set (RFC 7517). The sub claim
+// is the user, and the device comes from a device_id claim or an MSC2967 device scope.
+type JWTAuthenticator struct {
+	// If set, the iss claim must be this.
+	Issuer string
+	// The server name for users whose sub claim is only their localpart, when the token was sent
+	// to the default homeserver.
+	ServerName string
+
+	keys []jwk
+	// for tests
+	now func() time.Time
+}
+
+type jwk struct {
+	kid string
+	key crypto.PublicKey
+}
+
+type jwtHeader struct {
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+}
+
+type jwtClaims struct {
+	Sub      string   `json:"sub"`
+	Iss      string   `json:"iss"`
+	Exp      *float64 `json:"exp"`
+	Nbf      *float64 `json:"nbf"`
+	Scope    string   `json:"scope"`
+	DeviceID string   `json:"device_id"`
+}
+
+// LoadJWTAuthenticator makes a JWTAuthenticator which trusts the keys in this JWKS file.
+func LoadJWTAuthenticator(path string) (*JWTAuthenticator, error) {
+	jwks, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return NewJWTAuthenticator(jwks)
+}
+
+// NewJWTAuthenticator makes a JWTAuthenticator which trusts the keys in this JWKS. RSA, EC and
+// Ed25519 keys are supported; other keys, and keys only for encryption, are ignored.
+func NewJWTAuthenticator(jwks []byte) (*JWTAuthenticator, error) {
+	var set struct {
+		Keys []map[string]string `json:"keys"`
+	}
+	if err := json.Unmarshal(jwks, &set); err != nil {
+		return nil, fmt.Errorf("failed to parse JWKS: %w", err)
+	}
+	a := &JWTAuthenticator{now: time.Now}
+	for i, k := range set.Keys {
+		if k["use"] == "enc" {
+			continue
+		}
+		key, err := parseJWK(k)
+		if err != nil {
+			return nil, fmt.Errorf("JWKS key %d: %w", i, err)
+		}
+		if key != nil {
+			a.keys = append(a.keys, jwk{kid: k["kid"], key: key})
+		}
+	}
+	if len(a.keys) == 0 {
+		return nil, fmt.Errorf("JWKS has no signing keys")
+	}
+	return a, nil
+}
+
+// parseJWK returns the public key in a JWK, or nil if it isn't a kind of key we support.
+func parseJWK(k map[string]string) (crypto.PublicKey, error) {
+	param := func(name string) (*big.Int, error) {
+		b, err := base64.RawURLEncoding.DecodeString(k[name])
+		if err != nil || len(b) == 0 {
+			return nil, fmt.Errorf("bad %q", name)
+		}
+		return new(big.Int).SetBytes(b), nil
+	}
+	switch k["kty"] {
+	case "RSA":
+		n, err := param("n")
+		if err != nil {
+			return nil, err
+		}
+		e, err := param("e")
+		if err != nil {
+			return nil, err
+		}
+		if !e.IsInt64() || e.Int64() > 1<<31-1 {
+			return nil, fmt.Errorf("bad \"e\"")
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch k["crv"] {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, nil
+		}
+		x, err := param("x")
+		if err != nil {
+			return nil, err
+		}
+		y, err := param("y")
+		if err != nil {
+			return nil, err
+		}
+		if !curve.IsOnCurve(x, y) {
+			return nil, fmt.Errorf("point is not on curve %s", k["crv"])
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	case "OKP":
+		if k["crv"] != "Ed25519" {
+			return nil, nil
+		}
+		x, err := base64.RawURLEncoding.DecodeString(k["x"])
+		if err != nil || len(x) != ed25519.PublicKeySize {
+			return nil, fmt.Errorf("bad \"x\"")
+		}
+		return ed25519.PublicKey(x), nil
+	}
+	return nil, nil
+}
+
+func (a *JWTAuthenticator) Authenticate(ctx context.Context, accessToken, serverName string, client sync2.Client) (*Identity, error) {
+	segments := strings.Split(accessToken, ".")
+	if len(segments) != 3 {
+		return nil, fmt.Errorf("%w: not a JWT", ErrUnknownToken)
+	}
+	var header jwtHeader
+	if err := decodeJWTSegment(segments[0], &header); err != nil {
+		return nil, fmt.Errorf("%w: bad JWT header: %s", ErrUnknownToken, err)
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(segments[2])
+	if err != nil {
+		return nil, fmt.Errorf("%w: bad JWT signature: %s", ErrUnknownToken, err)
+	}
+	if !a.verify(header, []byte(segments[0]+"."+segments[1]), sig) {
+		return nil, fmt.Errorf("%w: JWT signature does not match any key", ErrUnknownToken)
+	}
+	var claims jwtClaims
+	if err = decodeJWTSegment(segments[1], &claims); err != nil {
+		return nil, fmt.Errorf("%w: bad JWT claims: %s", ErrUnknownToken, err)
+	}
+	now := a.now()
+	if claims.Exp != nil && now.After(jwtTime(*claims.Exp).Add(jwtLeeway)) {
+		return nil, fmt.Errorf("%w: JWT has expired", ErrUnknownToken)
+	}
+	if claims.Nbf != nil && now.Before(jwtTime(*claims.Nbf).Add(-jwtLeeway)) {
+		return nil, fmt.Errorf("%w: JWT is not valid yet", ErrUnknownToken)
+	}
+	if a.Issuer != "" && claims.Iss != a.Issuer {
+		return nil, fmt.Errorf("%w: JWT has issuer %q", ErrUnknownToken, claims.Iss)
+	}
+	deviceID := claims.DeviceID
+	if deviceID == "" {
+		deviceID = deviceIDFromScope(claims.Scope)
+	}
+	identity, err := newIdentity(claims.Sub, deviceID, defaulting(serverName, a.ServerName))
+	if err != nil {
+		return nil, err
+	}
+	if claims.Exp != nil {
+		identity.ExpiresAt = jwtTime(*claims.Exp)
+	}
+	return identity, nil
+}
+
+// verify returns true if the signature was made by one of our keys, using the algorithm in the header.
+func (a *JWTAuthenticator) verify(header jwtHeader, signed, sig []byte) bool {
+	var hash crypto.Hash
+	switch header.Alg {
+	case "RS256", "PS256", "ES256":
+		hash = crypto.SHA256
+	case "RS384", "PS384", "ES384":
+		hash = crypto.SHA384
+	case "RS512", "PS512", "ES512":
+		hash = crypto.SHA512
+	case "EdDSA":
+	default:
+		// in particular, "none" is never accepted
+		return false
+	}
+	var digest []byte
+	if hash != 0 {
+		h := hash.New()
+		h.Write(signed)
+		digest = h.Sum(nil)
+	}
+	for _, k := range a.keys {
+		if header.Kid != "" && k.kid != "" && header.Kid != k.kid {
+			continue
+		}
+		switch key := k.key.(type) {
+		case *rsa.PublicKey:
+			var err error
+			if strings.HasPrefix(header.Alg, "RS") {
+				err = rsa.VerifyPKCS1v15(key, hash, digest, sig)
+			} else if strings.HasPrefix(header.Alg, "PS") {
+				err = rsa.VerifyPSS(key, hash, digest, sig, nil)
+			} else {
+				continue
+			}
+			if err == nil {
+				return true
+			}
+		case *ecdsa.PublicKey:
+			size := (key.Curve.Params().BitSize + 7) / 8
+			if !strings.HasPrefix(header.Alg, "ES") || len(sig) != 2*size || key.Curve.Params().BitSize != ecdsaBits(header.Alg) {
+				continue
+			}
+			r := new(big.Int).SetBytes(sig[:size])
+			s := new(big.Int).SetBytes(sig[size:])
+			if ecdsa.Verify(key, digest, r, s) {
+				return true
+			}
+		case ed25519.PublicKey:
+			if header.Alg == "EdDSA" && ed25519.Verify(key, signed, sig) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// ecdsaBits returns the size of the curve which this ES algorithm is for.
+func ecdsaBits(alg string) int {
+	switch alg {
+	case "ES256":
+		return 256
+	case "ES384":
+		return 384
+	case "ES512":
+		return 521
+	}
+	return 0
+}
+
+func decodeJWTSegment(segment string, v interface{}) error {
+	b, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
+
+// jwtTime converts a NumericDate, which is seconds since the epoch, to a time.
+func jwtTime(numericDate float64) time.Time {
+	return time.UnixMilli(int64(numericDate * 1000))
+}
@@ -0,0 +1,289 @@
+package handler
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/sliding-sync/sync2"
+)
+
+type whoAmIClient struct {
+	sync2.Client
+	userID, deviceID string
+	err              error
+}
+
+func (c *whoAmIClient) WhoAmI(ctx context.Context, accessToken string) (string, string, error) {
+	return c.userID, c.deviceID, c.err
+}
+
+func TestWhoAmIAuthenticator(t *testing.T) {
+	a := WhoAmIAuthenticator{}
+	identity, err := a.Authenticate(context.Background(), "token", "", &whoAmIClient{userID: "@alice:localhost", deviceID: "A"})
+	if err != nil {
+		t.Fatalf("Authenticate: %s", err)
+	}
+	if identity.UserID != "@alice:localhost" || identity.DeviceID != "A" || !identity.ExpiresAt.IsZero() {
+		t.Errorf("Authenticate: got %+v", identity)
+	}
+	_, err = a.Authenticate(context.Background(), "token", "", &whoAmIClient{err: sync2.HTTP401})
+	if !errors.Is(err, ErrUnknownToken) {
+		t.Errorf("Authenticate: got %v want ErrUnknownToken for a 401", err)
+	}
+	_, err = a.Authenticate(context.Background(), "token", "", &whoAmIClient{err: errors.New("connection refused")})
+	if err == nil || errors.Is(err, ErrUnknownToken) {
+		t.Errorf("Authenticate: got %v want a different error when the homeserver is down", err)
+	}
+}
+
+func TestIntrospectionAuthenticator(t *testing.T) {
+	responses := map[string]map[string]interface{}{
+		"active": {
+			"active": true, "username": "@alice:example.org", "device_id": "A", "exp": 1700000000,
+		},
+		"localpart-scope": {
+			"active": true, "username": "bob", "scope": "openid urn:matrix:org.matrix.msc2967.client:api:* urn:matrix:org.matrix.msc2967.client:device:B",
+		},
+		"no-device": {
+			"active": true, "username": "@alice:example.org",
+		},
+		"inactive": {
+			"active": false,
+		},
+	}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		clientID, clientSecret, _ := req.BasicAuth()
+		if clientID != "proxy" || clientSecret != "s3cret" {
+			w.WriteHeader(401)
+			return
+		}
+		res, ok := responses[req.PostFormValue("token")]
+		if !ok {
+			w.WriteHeader(500)
+			return
+		}
+		_ = json.NewEncoder(w).Encode(res)
+	}))
+	defer srv.Close()
+	a := &IntrospectionAuthenticator{
+		Endpoint:     srv.URL,
+		ClientID:     "proxy",
+		ClientSecret: "s3cret",
+		ServerName:   "example.org",
+	}
+
+	identity, err := a.Authenticate(context.Background(), "active", "", nil)
+	if err != nil {
+		t.Fatalf("Authenticate: %s", err)
+	}
+	if identity.UserID != "@alice:example.org" || identity.DeviceID != "A" || !identity.ExpiresAt.Equal(time.Unix(1700000000, 0)) {
+		t.Errorf("Authenticate: got %+v", identity)
+	}
+	identity, err = a.Authenticate(context.Background(), "localpart-scope", "", nil)
+	if err != nil {
+		t.Fatalf("Authenticate: %s", err)
+	}
+	if identity.UserID != "@bob:example.org" || identity.DeviceID != "B" || !identity.ExpiresAt.IsZero() {
+		t.Errorf("Authenticate: got %+v", identity)
+	}
+	// the server name the token was sent to wins over the configured one
+	identity, err = a.Authenticate(context.Background(), "localpart-scope", "other.org", nil)
+	if err != nil {
+		t.Fatalf("Authenticate: %s", err)
+	}
+	if identity.UserID != "@bob:other.org" {
+		t.Errorf("Authenticate: got user %s want @bob:other.org", identity.UserID)
+	}
+	for _, token := range []string{"no-device", "inactive"} {
+		if _, err = a.Authenticate(context.Background(), token, "", nil); !errors.Is(err, ErrUnknownToken) {
+			t.Errorf("Authenticate(%s): got %v want ErrUnknownToken", token, err)
+		}
+	}
+	// a broken authorization server isn't the token's fault
+	if _, err = a.Authenticate(context.Background(), "unexpected", "", nil); err == nil || errors.Is(err, ErrUnknownToken) {
+		t.Errorf("Authenticate: got %v want a different error for a 500", err)
+	}
+	a.ClientSecret = "wrong"
+	if _, err = a.Authenticate(context.Background(), "active", "", nil); err == nil || errors.Is(err, ErrUnknownToken) {
+		t.Errorf("Authenticate: got %v want a different error when the proxy can't authenticate", err)
+	}
+}
+
+type jwtSigner struct {
+	alg  string
+	kid  string
+	sign func(signed []byte) []byte
+}
+
+func (s jwtSigner) token(t *testing.T, claims map[string]interface{}) string {
+	t.Helper()
+	header, _ := json.Marshal(map[string]string{"alg": s.alg, "kid": s.kid, "typ": "JWT"})
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		t.Fatalf("failed to marshal claims: %s", err)
+	}
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	return signed + "." + base64.RawURLEncoding.EncodeToString(s.sign([]byte(signed)))
+}
+
+func sha256Sum(b []byte) []byte {
+	h := sha256.Sum256(b)
+	return h[:]
+}
+
+func b64(i *big.Int) string {
+	return base64.RawURLEncoding.EncodeToString(i.Bytes())
+}
+
+func TestJWTAuthenticator(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("GenerateKey: %s", err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("GenerateKey: %s", err)
+	}
+	edPub, edKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("GenerateKey: %s", err)
+	}
+	jwks, _ := json.Marshal(map[string]interface{}{
+		"keys": []map[string]string{
+			{"kty": "RSA", "kid": "rsa", "n": b64(rsaKey.N), "e": b64(big.NewInt(int64(rsaKey.E)))},
+			{"kty": "EC", "kid": "ec", "crv": "P-256", "x": b64(ecKey.X), "y": b64(ecKey.Y)},
+			{"kty": "OKP", "kid": "ed", "crv": "Ed25519", "x": base64.RawURLEncoding.EncodeToString(edPub)},
+			{"kty": "oct", "kid": "hmac", "k": "c2VjcmV0"},
+		},
+	})
+	a, err := NewJWTAuthenticator(jwks)
+	if err != nil {
+		t.Fatalf("NewJWTAuthenticator: %s", err)
+	}
+	a.Issuer = "https://auth.example.org/"
+	a.ServerName = "example.org"
+	now := time.Unix(1700000000, 0)
+	a.now = func() time.Time { return now }
+
+	signers := []jwtSigner{
+		{alg: "RS256", kid: "rsa", sign: func(signed []byte) []byte {
+			sig, _ := rsa.SignPKCS1v15(rand.Reader, rsaKey, crypto.SHA256, sha256Sum(signed))
+			return sig
+		}},
+		{alg: "PS256", kid: "rsa", sign: func(signed []byte) []byte {
+			sig, _ := rsa.SignPSS(rand.Reader, rsaKey, crypto.SHA256, sha256Sum(signed), nil)
+			return sig
+		}},
+		{alg: "ES256", kid: "ec", sign: func(signed []byte) []byte {
+			r, s, _ := ecdsa.Sign(rand.Reader, ecKey, sha256Sum(signed))
+			sig := make([]byte, 64)
+			r.FillBytes(sig[:32])
+			s.FillBytes(sig[32:])
+			return sig
+		}},
+		{alg: "EdDSA", kid: "ed", sign: func(signed []byte) []byte {
+			return ed25519.Sign(edKey, signed)
+		}},
+	}
+	validClaims := map[string]interface{}{
+		"iss":   "https://auth.example.org/",
+		"sub":   "alice",
+		"scope": "urn:matrix:client:device:A",
+		"exp":   now.Add(time.Hour).Unix(),
+	}
+	for _, s := range signers {
+		identity, err := a.Authenticate(context.Background(), s.token(t, validClaims), "", nil)
+		if err != nil {
+			t.Fatalf("%s: Authenticate: %s", s.alg, err)
+		}
+		if identity.UserID != "@alice:example.org" || identity.DeviceID != "A" || !identity.ExpiresAt.Equal(now.Add(time.Hour)) {
+			t.Errorf("%s: Authenticate: got %+v", s.alg, identity)
+		}
+	}
+
+	rs256 := signers[0]
+	withClaim := func(k string, v interface{}) map[string]interface{} {
+		claims := make(map[string]interface{})
+		for ck, cv := range validClaims {
+			claims[ck] = cv
+		}
+		if v == nil {
+			delete(claims, k)
+		} else {
+			claims[k] = v
+		}
+		return claims
+	}
+	validToken := []byte(rs256.token(t, validClaims))
+	tamperAt := len(validToken) / 2
+	if validToken[tamperAt] == 'x' {
+		validToken[tamperAt] = 'y'
+	} else {
+		validToken[tamperAt] = 'x'
+	}
+	noneToken := jwtSigner{alg: "none", sign: func([]byte) []byte { return nil }}.token(t, validClaims)
+	hmacToken := jwtSigner{alg: "HS256", kid: "hmac", sign: sha256Sum}.token(t, validClaims)
+	wrongKeyToken := jwtSigner{alg: "RS256", kid: "ec", sign: rs256.sign}.token(t, validClaims)
+	rejected := map[string]string{
+		"not a JWT":     "syt_abc",
+		"alg none":      noneToken,
+		"alg HS256":     hmacToken,
+		"wrong key":     wrongKeyToken,
+		"tampered":      string(validToken),
+		"expired":       rs256.token(t, withClaim("exp", now.Add(-time.Hour).Unix())),
+		"not valid yet": rs256.token(t, withClaim("nbf", now.Add(time.Hour).Unix())),
+		"wrong issuer":  rs256.token(t, withClaim("iss", "https://evil.example.org/")),
+		"no device":     rs256.token(t, withClaim("scope", nil)),
+		"no user":       rs256.token(t, withClaim("sub", nil)),
+	}
+	for name, token := range rejected {
+		if _, err = a.Authenticate(context.Background(), token, "", nil); !errors.Is(err, ErrUnknownToken) {
+			t.Errorf("%s: got %v want ErrUnknownToken", name, err)
+		}
+	}
+	// a little clock skew is fine
+	if _, err = a.Authenticate(context.Background(), rs256.token(t, withClaim("exp", now.Add(-time.Second).Unix())), "", nil); err != nil {
+		t.Errorf("Authenticate: got %v for a token which expired a second ago", err)
+	}
+
+	if _, err = NewJWTAuthenticator([]byte(`{"keys":[{"kty":"oct","k":"c2VjcmV0"}]}`)); err == nil {
+		t.Errorf("NewJWTAuthenticator: expected an error for a JWKS without signing keys")
+	}
+}
+
+func TestAuthOptionsExpiresAt(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	soon := &Identity{ExpiresAt: now.Add(time.Minute)}
+	later := &Identity{ExpiresAt: now.Add(24 * time.Hour)}
+	never := &Identity{}
+	testCases := []struct {
+		opts     AuthOptions
+		identity *Identity
+		want     time.Time
+	}{
+		{AuthOptions{}, never, time.Time{}},
+		{AuthOptions{}, soon, soon.ExpiresAt},
+		{AuthOptions{TokenTTL: time.Hour}, never, now.Add(time.Hour)},
+		{AuthOptions{TokenTTL: time.Hour}, soon, soon.ExpiresAt},
+		{AuthOptions{TokenTTL: time.Hour}, later, now.Add(time.Hour)},
+	}
+	for i, tc := range testCases {
+		if got := tc.opts.expiresAt(tc.identity, now); !got.Equal(tc.want) {
+			t.Errorf("case %d: got %v want %v", i, got, tc.want)
+		}
+	}
+}
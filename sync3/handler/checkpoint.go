@@ -0,0 +1,328 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+	"time"
+
+	"github.com/getsentry/sentry-go"
+	"github.com/matrix-org/sliding-sync/internal"
+	"github.com/matrix-org/sliding-sync/state"
+	"github.com/matrix-org/sliding-sync/sync3"
+	"github.com/rs/zerolog/log"
+)
+
+// Connection checkpoints let a connection survive a proxy restart. After every response the
+// ConnState is snapshotted and written to the database in the background. If a client then sends
+// a ?pos= for a connection we don't know about, but the checkpoint is at exactly that position,
+// the connection is recreated from the checkpoint instead of being expired. The first response
+// on the resumed connection only contains what changed whilst the proxy was down: windows whose
+// rooms have moved, and rooms with new events.
+
+// connCheckpoint is the part of a ConnState which is needed to resume a connection.
+type connCheckpoint struct {
+	// the muxed request, so sticky params survive the restart
+	Request *sync3.Request `json:"request"`
+	// confirmed room subscriptions
+	RoomSubscriptions map[string]sync3.RoomSubscription `json:"room_subscriptions"`
+	// list key -> what the client was last told about the list
+	Lists map[string]checkpointList `json:"lists"`
+	// room ID -> load position, for rooms which were visible in a list or subscribed to
+	LoadPositions map[string]int64 `json:"load_positions"`
+}
+
+type checkpointList struct {
+	Count int `json:"count"`
+	// The rooms in the list, from index 0 up to the end of the highest range. Only the indexes
+	// inside the ranges are known to the client.
+	RoomIDs []string `json:"room_ids"`
+}
+
+// Checkpoint implements sync3.Checkpointer. It is called with the conn lock held, so it is safe
+// to read the connection state here. The write itself happens in the background.
+func (s *ConnState) Checkpoint(cid sync3.ConnID, pos int64) {
+	if s.checkpointer == nil || s.muxedReq == nil || s.destroyed.Load() {
+		return
+	}
+	data, err := json.Marshal(s.checkpoint())
+	if err != nil {
+		log.Err(err).Str("conn", cid.String()).Msg("failed to marshal conn checkpoint")
+		sentry.CaptureException(err)
+		return
+	}
+	s.checkpointer.enqueue(state.ConnCheckpoint{
+		UserID:    cid.UserID,
+		DeviceID:  cid.DeviceID,
+		ConnID:    cid.CID,
+		Pos:       pos,
+		Data:      data,
+		UpdatedAt: time.Now().UnixMilli(),
+	})
+}
+
+func (s *ConnState) checkpoint() *connCheckpoint {
+	cp := &connCheckpoint{
+		Request:           s.muxedReq,
+		RoomSubscriptions: s.roomSubscriptions,
+		Lists:             make(map[string]checkpointList, len(s.muxedReq.Lists)),
+		LoadPositions:     make(map[string]int64),
+	}
+	for listKey, reqList := range s.muxedReq.Lists {
+		list := s.lists.Get(listKey)
+		if list == nil {
+			continue
+		}
+		roomIDs := list.RoomIDs()
+		ranges := reqList.Ranges
+		if reqList.ShouldGetAllRooms() {
+			ranges = sync3.SliceRanges{{0, int64(len(roomIDs)) - 1}}
+		}
+		var end int64
+		for _, r := range ranges {
+			if r[1]+1 > end {
+				end = r[1] + 1
+			}
+		}
+		if end > int64(len(roomIDs)) {
+			end = int64(len(roomIDs))
+		}
+		roomIDs = roomIDs[:end]
+		for i, roomID := range roomIDs {
+			if _, visible := ranges.Inside(int64(i)); visible {
+				cp.LoadPositions[roomID] = s.loadPositions[roomID]
+			}
+		}
+		cp.Lists[listKey] = checkpointList{
+			Count:   int(list.Len()),
+			RoomIDs: roomIDs,
+		}
+	}
+	for roomID := range s.roomSubscriptions {
+		cp.LoadPositions[roomID] = s.loadPositions[roomID]
+	}
+	return cp
+}
+
+// restore the request params from a checkpoint. The room data itself is not restored: load() has
+// fetched the current state of the world, which buildResumedRooms compares against the checkpoint.
+func (s *ConnState) restore(cp *connCheckpoint) {
+	s.muxedReq = cp.Request
+	for roomID, sub := range cp.RoomSubscriptions {
+		// the user may have left whilst we were down
+		if s.joinChecker.IsUserJoined(s.userID, roomID) {
+			s.roomSubscriptions[roomID] = sub
+		}
+	}
+}
+
+// buildResumedRooms works out what changed whilst the connection was not being served, by
+// comparing the windows in the checkpoint with the current windows. Windows which differ are
+// re-SYNCed, and rooms which are new to the client or have new events are added to the builder.
+// Lists which were re-sorted or re-filtered by this request have already been sent in full.
+func (s *ConnState) buildResumedRooms(ctx context.Context, builder *RoomsBuilder, cp *connCheckpoint, respLists map[string]sync3.ResponseList) {
+	ctx, span := internal.StartSpan(ctx, "buildResumedRooms")
+	defer span.End()
+	hasNewData := func(roomID string) bool {
+		prevLoadPos, ok := cp.LoadPositions[roomID]
+		return !ok || s.loadPositions[roomID] > prevLoadPos
+	}
+	for listKey, reqList := range s.muxedReq.Lists {
+		reqList := reqList
+		prevReqList, ok := cp.Request.Lists[listKey]
+		if !ok || prevReqList.SortOrderChanged(&reqList) || prevReqList.FiltersChanged(&reqList) {
+			continue
+		}
+		if _, sent := respLists[listKey]; sent && reqList.ShouldGetAllRooms() {
+			continue
+		}
+		prevList := cp.Lists[listKey]
+		roomList, _ := s.lists.AssignList(ctx, listKey, reqList.Filters, reqList.Sort, sync3.DoNotOverwrite)
+		roomIDs := roomList.RoomIDs()
+		ranges := reqList.Ranges
+		if reqList.ShouldGetAllRooms() {
+			ranges = sync3.SliceRanges{{0, int64(len(roomIDs)) - 1}}
+		}
+
+		var ops []sync3.ResponseOp
+		var roomsWithNewData []string
+		for _, r := range ranges {
+			changed := false
+			var window []string
+			for i := r[0]; i <= r[1]; i++ {
+				var prevRoomID, roomID string
+				if i < int64(len(prevList.RoomIDs)) {
+					prevRoomID = prevList.RoomIDs[i]
+				}
+				if i < int64(len(roomIDs)) {
+					roomID = roomIDs[i]
+				}
+				if prevRoomID == "" && roomID == "" {
+					break // past the end of both lists
+				}
+				if prevRoomID != roomID {
+					changed = true
+				}
+				if roomID == "" {
+					continue
+				}
+				window = append(window, roomID)
+				// rooms which moved within the visible windows are already known to the client
+				if hasNewData(roomID) {
+					roomsWithNewData = append(roomsWithNewData, roomID)
+				}
+			}
+			if !changed {
+				continue
+			}
+			if len(window) == 0 {
+				// the list has shrunk below this range, so everything the client has here is stale
+				if r[0] < int64(len(prevList.RoomIDs)) {
+					ops = append(ops, &sync3.ResponseOpRange{
+						Operation: sync3.OpInvalidate,
+						Range:     clampSliceRangeToListSize(ctx, r, int64(len(prevList.RoomIDs))),
+					})
+				}
+				continue
+			}
+			ops = append(ops, &sync3.ResponseOpRange{
+				Operation: sync3.OpSync,
+				Range:     clampSliceRangeToListSize(ctx, r, int64(len(roomIDs))),
+				RoomIDs:   window,
+			})
+		}
+		if len(roomsWithNewData) > 0 {
+			subID := builder.AddSubscription(reqList.RoomSubscription)
+			builder.AddRoomsToSubscription(ctx, subID, roomsWithNewData)
+		}
+		if len(ops) > 0 || prevList.Count != int(roomList.Len()) {
+			respList := respLists[listKey]
+			respList.Ops = append(respList.Ops, ops...)
+			respLists[listKey] = respList
+		}
+	}
+	for roomID, sub := range s.roomSubscriptions {
+		if hasNewData(roomID) {
+			subID := builder.AddSubscription(sub)
+			builder.AddRoomsToSubscription(ctx, subID, []string{roomID})
+		}
+	}
+}
+
+// checkpointStore is where checkpoints are written. It is a *state.ConnStateTable outside of tests.
+type checkpointStore interface {
+	Upsert(cp state.ConnCheckpoint) error
+	Select(userID, deviceID, connID string) (*state.ConnCheckpoint, error)
+	Delete(userID, deviceID, connID string) error
+}
+
+// connCheckpointer writes checkpoints to the database in the background. Only the latest write
+// for each connection is kept, so a busy connection does one write per flush rather than one
+// write per response.
+type connCheckpointer struct {
+	table checkpointStore
+	// checkpoints older than this are not resumed, as the connection would have expired anyway
+	maxAge time.Duration
+
+	mu *sync.Mutex
+	// the next write for each connection: a checkpoint to upsert, or nil to delete the checkpoint.
+	// Deletes are queued here rather than done separately so that they happen in order with the
+	// upserts. A connection which replaces a destroyed one with the same ID overwrites the delete
+	// with its own checkpoint, rather than having that checkpoint deleted after it is written.
+	pending  map[sync3.ConnID]*state.ConnCheckpoint
+	wake     chan struct{}
+	shutdown chan struct{}
+	done     chan struct{}
+}
+
+func newConnCheckpointer(table checkpointStore, maxAge time.Duration) *connCheckpointer {
+	return &connCheckpointer{
+		table:    table,
+		maxAge:   maxAge,
+		mu:       &sync.Mutex{},
+		pending:  make(map[sync3.ConnID]*state.ConnCheckpoint),
+		wake:     make(chan struct{}, 1),
+		shutdown: make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+}
+
+func (c *connCheckpointer) enqueue(cp state.ConnCheckpoint) {
+	c.write(sync3.ConnID{UserID: cp.UserID, DeviceID: cp.DeviceID, CID: cp.ConnID}, &cp)
+}
+
+func (c *connCheckpointer) write(cid sync3.ConnID, cp *state.ConnCheckpoint) {
+	c.mu.Lock()
+	c.pending[cid] = cp
+	c.mu.Unlock()
+	select {
+	case c.wake <- struct{}{}:
+	default:
+	}
+}
+
+// run writes checkpoints until teardown is called.
+func (c *connCheckpointer) run() {
+	defer internal.ReportPanicsToSentry()
+	defer close(c.done)
+	for {
+		select {
+		case <-c.wake:
+			c.flush()
+		case <-c.shutdown:
+			c.flush()
+			return
+		}
+	}
+}
+
+func (c *connCheckpointer) flush() {
+	c.mu.Lock()
+	pending := c.pending
+	c.pending = make(map[sync3.ConnID]*state.ConnCheckpoint)
+	c.mu.Unlock()
+	for cid, cp := range pending {
+		if cp == nil {
+			if err := c.table.Delete(cid.UserID, cid.DeviceID, cid.CID); err != nil {
+				log.Err(err).Str("conn", cid.String()).Msg("failed to delete conn checkpoint")
+				sentry.CaptureException(err)
+			}
+			continue
+		}
+		if err := c.table.Upsert(*cp); err != nil {
+			log.Err(err).Str("conn", cid.String()).Msg("failed to write conn checkpoint")
+			sentry.CaptureException(err)
+		}
+	}
+}
+
+// forget drops the checkpoint for a connection which has been destroyed, so it cannot be resumed.
+// The delete happens in the background as this is called with the ConnMap lock held.
+func (c *connCheckpointer) forget(cid sync3.ConnID) {
+	c.write(cid, nil)
+}
+
+// load the checkpoint for this connection, if it can be resumed from pos. Returns nil if not.
+func (c *connCheckpointer) load(cid sync3.ConnID, pos int64) (*connCheckpoint, error) {
+	row, err := c.table.Select(cid.UserID, cid.DeviceID, cid.CID)
+	if err != nil || row == nil {
+		return nil, err
+	}
+	if row.Pos != pos || time.Since(time.UnixMilli(row.UpdatedAt)) > c.maxAge {
+		return nil, nil
+	}
+	var cp connCheckpoint
+	if err = json.Unmarshal(row.Data, &cp); err != nil {
+		return nil, err
+	}
+	if cp.Request == nil {
+		return nil, nil
+	}
+	return &cp, nil
+}
+
+// teardown writes any pending checkpoints then stops the background writer.
+func (c *connCheckpointer) teardown() {
+	close(c.shutdown)
+	<-c.done
+}
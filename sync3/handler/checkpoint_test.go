@@ -0,0 +1,198 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/gomatrixserverlib/spec"
+	"github.com/matrix-org/sliding-sync/internal"
+	"github.com/matrix-org/sliding-sync/state"
+	"github.com/matrix-org/sliding-sync/sync3"
+	"github.com/matrix-org/sliding-sync/sync3/caches"
+)
+
+// newConnStateForRooms makes a ConnState for a user joined to these rooms, as if the proxy had
+// just started up.
+func newConnStateForRooms(userID string, rooms []internal.RoomMetadata, loadPositions map[string]int64) *ConnState {
+	metadata := make(map[string]internal.RoomMetadata, len(rooms))
+	joined := make(map[string][]string, len(rooms))
+	for _, r := range rooms {
+		metadata[r.RoomID] = r
+		joined[r.RoomID] = []string{userID}
+	}
+	globalCache := caches.NewGlobalCache(nil)
+	globalCache.Startup(metadata)
+	dispatcher := sync3.NewDispatcher()
+	dispatcher.Startup(joined)
+	globalCache.LoadJoinedRoomsOverride = func(userID string) (pos int64, joinedRooms map[string]*internal.RoomMetadata, joinTimings map[string]internal.EventMetadata, loadPos map[string]int64, err error) {
+		joinedRooms = make(map[string]*internal.RoomMetadata, len(rooms))
+		joinTimings = make(map[string]internal.EventMetadata, len(rooms))
+		for i := range rooms {
+			joinedRooms[rooms[i].RoomID] = &rooms[i]
+			joinTimings[rooms[i].RoomID] = internal.EventMetadata{NID: 1, Timestamp: 1}
+		}
+		return 100, joinedRooms, joinTimings, loadPositions, nil
+	}
+	userCache := caches.NewUserCache(userID, globalCache, &NopUserCacheStore{}, &NopTransactionFetcher{}, &joinChecker{})
+	dispatcher.Register(context.Background(), userCache.UserID, userCache)
+	dispatcher.Register(context.Background(), sync3.DispatcherAllUsers, globalCache)
+	userCache.LazyLoadTimelinesOverride = func(loadPos int64, roomIDs []string, maxTimelineEvents int) map[string]state.LatestEvents {
+		result := mockLazyRoomOverride(loadPos, roomIDs, maxTimelineEvents)
+		for roomID, latest := range result {
+			latest.LatestNID = loadPositions[roomID]
+			result[roomID] = latest
+		}
+		return result
+	}
+	return NewConnState(userID, "DEVICE", userCache, globalCache, &NopExtensionHandler{}, &NopJoinTracker{}, nil, nil, 1000, 0)
+}
+
+// Test that a connection resumed from a checkpoint only sends what changed whilst it wasn't being
+// served: windows whose rooms moved, and rooms the client hasn't seen yet.
+func TestConnStateResume(t *testing.T) {
+	userID := "@TestConnStateResume_alice:localhost"
+	cid := sync3.ConnID{UserID: userID, DeviceID: "DEVICE"}
+	now := time.Now()
+	// initial sort order B, C, A
+	roomA := newRoomMetadata("!a:localhost", spec.AsTimestamp(now.Add(-8*time.Second)))
+	roomB := newRoomMetadata("!b:localhost", spec.AsTimestamp(now))
+	roomC := newRoomMetadata("!c:localhost", spec.AsTimestamp(now.Add(-4*time.Second)))
+
+	cs := newConnStateForRooms(userID, []internal.RoomMetadata{roomA, roomB, roomC}, map[string]int64{
+		roomA.RoomID: 10, roomB.RoomID: 20, roomC.RoomID: 30,
+	})
+	_, err := cs.OnIncomingRequest(context.Background(), cid, &sync3.Request{
+		Lists: map[string]sync3.RequestList{"a": {
+			Sort:   []string{sync3.SortByRecency},
+			Ranges: sync3.SliceRanges{{0, 1}},
+			RoomSubscription: sync3.RoomSubscription{
+				TimelineLimit: 1,
+			},
+		}},
+	}, true, time.Now())
+	if err != nil {
+		t.Fatalf("OnIncomingRequest returned error: %s", err)
+	}
+	data, err := json.Marshal(cs.checkpoint())
+	if err != nil {
+		t.Fatalf("failed to marshal checkpoint: %s", err)
+	}
+	cs.Destroy()
+
+	// whilst the proxy is down, A gets a new event, bumping it to the top: A, B, C
+	roomA.LastMessageTimestamp = uint64(spec.AsTimestamp(now.Add(time.Second)))
+	resumed := newConnStateForRooms(userID, []internal.RoomMetadata{roomA, roomB, roomC}, map[string]int64{
+		roomA.RoomID: 11, roomB.RoomID: 20, roomC.RoomID: 30,
+	})
+	resumed.resumeFrom = &connCheckpoint{}
+	if err = json.Unmarshal(data, resumed.resumeFrom); err != nil {
+		t.Fatalf("failed to unmarshal checkpoint: %s", err)
+	}
+	// the client doesn't resend sticky params
+	req := &sync3.Request{}
+	req.SetTimeoutMSecs(1)
+	res, err := resumed.OnIncomingRequest(context.Background(), cid, req, false, time.Now())
+	if err != nil {
+		t.Fatalf("OnIncomingRequest returned error: %s", err)
+	}
+	checkResponse(t, true, res, &sync3.Response{
+		Lists: map[string]sync3.ResponseList{
+			"a": {
+				Count: 3,
+				Ops: []sync3.ResponseOp{
+					&sync3.ResponseOpRange{
+						Operation: sync3.OpSync,
+						Range:     [2]int64{0, 1},
+						RoomIDs:   []string{roomA.RoomID, roomB.RoomID},
+					},
+				},
+			},
+		},
+	})
+	// B was already in the window and has no new events, so only A is sent
+	gotRoomIDs := make([]string, 0, len(res.Rooms))
+	for roomID := range res.Rooms {
+		gotRoomIDs = append(gotRoomIDs, roomID)
+	}
+	sort.Strings(gotRoomIDs)
+	if len(gotRoomIDs) != 1 || gotRoomIDs[0] != roomA.RoomID {
+		t.Errorf("got rooms %v want [%s]", gotRoomIDs, roomA.RoomID)
+	}
+
+	// nothing has changed since the resume, so the next request has no list data
+	req = &sync3.Request{}
+	req.SetTimeoutMSecs(1)
+	res, err = resumed.OnIncomingRequest(context.Background(), cid, req, false, time.Now())
+	if err != nil {
+		t.Fatalf("OnIncomingRequest returned error: %s", err)
+	}
+	if res.ListOps() > 0 || len(res.Rooms) > 0 {
+		t.Errorf("got unexpected data after resuming: %+v", res)
+	}
+}
+
+type memoryCheckpointStore struct {
+	rows map[sync3.ConnID]state.ConnCheckpoint
+}
+
+func (s *memoryCheckpointStore) Upsert(cp state.ConnCheckpoint) error {
+	s.rows[sync3.ConnID{UserID: cp.UserID, DeviceID: cp.DeviceID, CID: cp.ConnID}] = cp
+	return nil
+}
+
+func (s *memoryCheckpointStore) Select(userID, deviceID, connID string) (*state.ConnCheckpoint, error) {
+	cp, ok := s.rows[sync3.ConnID{UserID: userID, DeviceID: deviceID, CID: connID}]
+	if !ok {
+		return nil, nil
+	}
+	return &cp, nil
+}
+
+func (s *memoryCheckpointStore) Delete(userID, deviceID, connID string) error {
+	delete(s.rows, sync3.ConnID{UserID: userID, DeviceID: deviceID, CID: connID})
+	return nil
+}
+
+// Test that destroying a connection deletes its checkpoint, but not the checkpoint of a new
+// connection with the same ID which replaced it before the delete was written.
+func TestConnCheckpointerForget(t *testing.T) {
+	store := &memoryCheckpointStore{rows: make(map[sync3.ConnID]state.ConnCheckpoint)}
+	c := newConnCheckpointer(store, time.Hour)
+	cid := sync3.ConnID{UserID: "@TestConnCheckpointerForget_alice:localhost", DeviceID: "DEVICE", CID: "room-list"}
+	checkpointAt := func(pos int64) state.ConnCheckpoint {
+		return state.ConnCheckpoint{
+			UserID: cid.UserID, DeviceID: cid.DeviceID, ConnID: cid.CID, Pos: pos,
+			Data: []byte(`{"request":{}}`), UpdatedAt: time.Now().UnixMilli(),
+		}
+	}
+	assertCheckpointPos := func(pos int64) {
+		t.Helper()
+		cp, err := c.load(cid, pos)
+		if err != nil {
+			t.Fatalf("load: %s", err)
+		}
+		if cp == nil {
+			t.Fatalf("load: no checkpoint at pos %d, rows: %+v", pos, store.rows)
+		}
+	}
+
+	c.enqueue(checkpointAt(5))
+	c.flush()
+	assertCheckpointPos(5)
+
+	// the connection is destroyed and replaced before the delete is written
+	c.forget(cid)
+	c.enqueue(checkpointAt(1))
+	c.flush()
+	assertCheckpointPos(1)
+
+	// the replacement is destroyed
+	c.forget(cid)
+	c.flush()
+	if len(store.rows) != 0 {
+		t.Fatalf("checkpoint was not deleted: %+v", store.rows)
+	}
+}
@@ -3,6 +3,9 @@ package handler
 import (
 	"context"
 	"encoding/json"
+	"reflect"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/matrix-org/sliding-sync/internal"
@@ -43,6 +46,9 @@ type ConnState struct {
 	anchorLoadPosition int64
 	// roomID -> latest load pos
 	loadPositions map[string]int64
+	// roomID -> the subscription used to build the room data the client holds, if that data is still
+	// up-to-date. Only tracked when a list uses deltas.
+	heldRooms map[string]sync3.RoomSubscription
 
 	txnIDWaiter *TxnIDWaiter
 	live        *connStateLive
@@ -57,6 +63,21 @@ type ConnState struct {
 	extensionsHandler   extensions.HandlerInterface
 	setupHistogramVec   *prometheus.HistogramVec
 	processHistogramVec *prometheus.HistogramVec
+
+	// a copy of the request params for Info(), which can be called from any goroutine
+	infoMu      *sync.Mutex
+	listRanges  map[string]sync3.SliceRanges
+	numRoomSubs int
+
+	// if set, the state is checkpointed after every response
+	checkpointer  *connCheckpointer
+	checkpointCID sync3.ConnID
+	// if set, this connection is being resumed from a checkpoint and hasn't processed a request yet
+	resumeFrom *connCheckpoint
+	destroyed  atomic.Bool
+
+	// if set, everything this connection processes is recorded so it can be replayed
+	recorder *connRecorder
 }
 
 func NewConnState(
@@ -71,6 +92,7 @@ func NewConnState(
 		deviceID:            deviceID,
 		anchorLoadPosition:  -1,
 		loadPositions:       make(map[string]int64),
+		heldRooms:           make(map[string]sync3.RoomSubscription),
 		roomSubscriptions:   make(map[string]sync3.RoomSubscription),
 		lists:               sync3.NewInternalRequestLists(),
 		extensionsHandler:   ex,
@@ -78,6 +100,7 @@ func NewConnState(
 		lazyCache:           NewLazyCache(),
 		setupHistogramVec:   setupHistVec,
 		processHistogramVec: histVec,
+		infoMu:              &sync.Mutex{},
 	}
 	cs.live = &connStateLive{
 		ConnState: cs,
@@ -164,6 +187,21 @@ func (s *ConnState) load(ctx context.Context, req *sync3.Request) error {
 		})
 	}
 
+	knocks := s.userCache.Knocks()
+	for _, urd := range knocks {
+		metadata := urd.Knock.RoomMetadata()
+		knockTimestampsByList := make(map[string]uint64, len(req.Lists))
+		for listKey := range req.Lists {
+			knockTimestampsByList[listKey] = metadata.LastMessageTimestamp
+		}
+		rooms = append(rooms, sync3.RoomConnMetadata{
+			RoomMetadata:                  *metadata,
+			UserRoomData:                  urd,
+			LastInterestedEventTimestamps: knockTimestampsByList,
+		})
+	}
+
+	s.recorder.recordLoad(initialLoadPosition, loadPositions, rooms)
 	for _, r := range rooms {
 		s.lists.SetRoom(r)
 	}
@@ -173,10 +211,24 @@ func (s *ConnState) load(ctx context.Context, req *sync3.Request) error {
 
 // OnIncomingRequest is guaranteed to be called sequentially (it's protected by a mutex in conn.go)
 func (s *ConnState) OnIncomingRequest(ctx context.Context, cid sync3.ConnID, req *sync3.Request, isInitial bool, start time.Time) (*sync3.Response, error) {
+	s.recorder.recordRequest(req, isInitial)
 	if s.anchorLoadPosition <= 0 {
 		// load() needs no ctx so drop it
 		_, region := internal.StartSpan(ctx, "load")
-		err := s.load(ctx, req)
+		loadReq := req
+		if s.resumeFrom != nil {
+			// the client won't resend sticky list params, so include the lists from the checkpoint
+			loadReq = &sync3.Request{
+				Lists: make(map[string]sync3.RequestList, len(s.resumeFrom.Request.Lists)+len(req.Lists)),
+			}
+			for listKey, list := range s.resumeFrom.Request.Lists {
+				loadReq.Lists[listKey] = list
+			}
+			for listKey, list := range req.Lists {
+				loadReq.Lists[listKey] = list
+			}
+		}
+		err := s.load(ctx, loadReq)
 		if err != nil {
 			// in practice this means DB hit failures. If we try again later maybe it'll work, and we will because
 			// anchorLoadPosition is unset.
@@ -186,7 +238,9 @@ func (s *ConnState) OnIncomingRequest(ctx context.Context, cid sync3.ConnID, req
 	}
 	setupTime := time.Since(start)
 	s.trackSetupDuration(ctx, setupTime, isInitial)
-	return s.onIncomingRequest(ctx, req, isInitial)
+	res, err := s.onIncomingRequest(ctx, req, isInitial)
+	s.recorder.recordResponse(res)
+	return res, err
 }
 
 // onIncomingRequest is a callback which fires when the client makes a request to the server. Whilst each request may
@@ -194,9 +248,15 @@ func (s *ConnState) OnIncomingRequest(ctx context.Context, cid sync3.ConnID, req
 // additional locking mechanisms.
 func (s *ConnState) onIncomingRequest(reqCtx context.Context, req *sync3.Request, isInitial bool) (*sync3.Response, error) {
 	start := time.Now()
+	resumed := s.resumeFrom
+	if resumed != nil {
+		s.resumeFrom = nil
+		s.restore(resumed)
+	}
 	// ApplyDelta works fine if s.muxedReq is nil
 	var delta *sync3.RequestDelta
 	s.muxedReq, delta = s.muxedReq.ApplyDelta(req)
+	s.updateInfo()
 	internal.Logf(reqCtx, "connstate", "new subs=%v unsubs=%v num_lists=%v", len(delta.Subs), len(delta.Unsubs), len(delta.Lists))
 	for key, l := range delta.Lists {
 		listData := ""
@@ -217,6 +277,10 @@ func (s *ConnState) onIncomingRequest(reqCtx context.Context, req *sync3.Request
 	s.buildRoomSubscriptions(reqCtx, builder, delta.Subs, delta.Unsubs)
 	// works out how rooms get moved about but doesn't pull room data
 	respLists := s.buildListSubscriptions(reqCtx, builder, delta.Lists)
+	if resumed != nil {
+		// works out what changed whilst we weren't serving this connection
+		s.buildResumedRooms(reqCtx, builder, resumed, respLists)
+	}
 
 	// pull room data and set changes on the response
 	response := &sync3.Response{
@@ -225,17 +289,22 @@ func (s *ConnState) onIncomingRequest(reqCtx context.Context, req *sync3.Request
 	}
 
 	// Handle extensions AFTER processing lists as extensions may need to know which rooms the client
-	// is being notified about (e.g. for room account data)
+	// is being notified about (e.g. for room account data). Extensions have no state to restore, so
+	// they start afresh on a resumed connection.
 	extCtx, region := internal.StartSpan(reqCtx, "extensions")
-	response.Extensions = s.extensionsHandler.Handle(extCtx, s.muxedReq.Extensions, extensions.Context{
+	extensionsCtx := extensions.Context{
 		UserID:             s.userID,
 		DeviceID:           s.deviceID,
 		RoomIDToTimeline:   response.RoomIDsToTimelineEventIDs(),
-		IsInitial:          isInitial,
+		IsInitial:          isInitial || resumed != nil,
 		RoomIDsToLists:     s.lists.ListsByVisibleRoomIDs(s.muxedReq.Lists),
 		AllSubscribedRooms: internal.Keys(s.roomSubscriptions),
 		AllLists:           s.muxedReq.ListKeys(),
-	})
+	}
+	if spaces := s.muxedReq.Extensions.Spaces; spaces != nil && extensions.ExtensionEnabled(spaces) {
+		extensionsCtx.JoinedSpaces = s.lists.JoinedSpaces()
+	}
+	response.Extensions = s.extensionsHandler.Handle(extCtx, s.muxedReq.Extensions, extensionsCtx)
 	region.End()
 
 	if response.ListOps() > 0 || len(response.Rooms) > 0 || response.Extensions.HasData(isInitial) {
@@ -264,6 +333,7 @@ func (s *ConnState) onIncomingRequest(reqCtx context.Context, req *sync3.Request
 	if response.Extensions.Typing != nil && response.Extensions.Typing.HasData(isInitial) {
 		s.lazyLoadTypingMembers(reqCtx, response)
 	}
+	s.releaseHeldRooms()
 	return response, nil
 }
 
@@ -308,11 +378,12 @@ func (s *ConnState) onIncomingListRequest(ctx context.Context, builder *RoomsBui
 		addedRanges = nextReqList.Ranges
 	}
 
+	useDeltas := nextReqList.ShouldUseDeltas()
 	sortChanged := prevReqList.SortOrderChanged(nextReqList)
 	filtersChanged := prevReqList.FiltersChanged(nextReqList)
 	if sortChanged || filtersChanged {
 		// the sort/filter operations have changed, invalidate everything (if there were previous syncs), re-sort and re-SYNC
-		if prevReqList != nil {
+		if prevReqList != nil && !useDeltas {
 			// there were previous syncs for this list, INVALIDATE the lot
 			log.Trace().Interface("range", prevRange).Msg("INVALIDATEing because sort/filter ops have changed")
 			allRoomIDs := roomList.RoomIDs()
@@ -341,6 +412,18 @@ func (s *ConnState) onIncomingListRequest(ctx context.Context, builder *RoomsBui
 		removedRanges = nil
 	}
 
+	// inform the builder about this list
+	subID := builder.AddSubscription(nextReqList.RoomSubscription)
+
+	if useDeltas {
+		// SHIFT the whole window rather than INVALIDATE/SYNC the ranges which changed, so we don't
+		// resend rooms the client already has
+		if len(addedRanges) > 0 || len(removedRanges) > 0 {
+			responseOperations = s.shiftListWindow(ctx, builder, subID, roomList, nextReqList)
+		}
+		addedRanges, removedRanges = nil, nil
+	}
+
 	// send INVALIDATE for these ranges
 	if len(removedRanges) > 0 {
 		log.Trace().Interface("range", removedRanges).Msg("INVALIDATEing because ranges were removed")
@@ -357,9 +440,6 @@ func (s *ConnState) onIncomingListRequest(ctx context.Context, builder *RoomsBui
 		})
 	}
 
-	// inform the builder about this list
-	subID := builder.AddSubscription(nextReqList.RoomSubscription)
-
 	// send full room data for these ranges
 	for i := range addedRanges {
 		sr := sync3.SliceRanges([][2]int64{addedRanges[i]})
@@ -382,12 +462,14 @@ func (s *ConnState) onIncomingListRequest(ctx context.Context, builder *RoomsBui
 	if prevReqList != nil {
 		// If nothing has changed ordering wise in this list (sort/filter) but the timeline limit / req_state has,
 		// we need to make a new subscription registering this change to include the new data.
-		timelineChanged := prevReqList.TimelineLimitChanged(nextReqList)
+		timelineChanged := prevReqList.TimelineLimitChanged(nextReqList) ||
+			prevReqList.RoomSubscription.TimelineFilterChanged(nextReqList.RoomSubscription)
 		reqStateChanged := prevReqList.RoomSubscription.RequiredStateChanged(nextReqList.RoomSubscription)
 		if !sortChanged && !filtersChanged && (timelineChanged || reqStateChanged) {
 			var newRS sync3.RoomSubscription
 			if timelineChanged {
 				newRS.TimelineLimit = nextReqList.TimelineLimit
+				newRS.TimelineFilter = nextReqList.TimelineFilter
 			}
 			if reqStateChanged {
 				newRS.RequiredState = nextReqList.RequiredState
@@ -410,6 +492,9 @@ func (s *ConnState) onIncomingListRequest(ctx context.Context, builder *RoomsBui
 					if !s.joinChecker.IsUserJoined(s.userID, roomID) {
 						continue
 					}
+					if useDeltas && s.holdsRoom(roomID, nextReqList.RoomSubscription) {
+						continue
+					}
 					joinedRoomIDs = append(joinedRoomIDs, roomID)
 				}
 				// the builder will populate this with the right room data
@@ -424,6 +509,97 @@ func (s *ConnState) onIncomingListRequest(ctx context.Context, builder *RoomsBui
 	}
 }
 
+// shiftListWindow returns SHIFT operations for every range in this list. Only rooms the client doesn't
+// already have are added to the builder.
+func (s *ConnState) shiftListWindow(ctx context.Context, builder *RoomsBuilder, subID int, roomList *sync3.FilteredSortableRooms, reqList *sync3.RequestList) (ops []sync3.ResponseOp) {
+	for _, r := range reqList.Ranges {
+		subslice := sync3.SliceRanges([][2]int64{r}).SliceInto(roomList)
+		if len(subslice) == 0 {
+			continue
+		}
+		roomIDs := subslice[0].(*sync3.SortableRooms).RoomIDs()
+		var newRoomIDs, unchangedRoomIDs []string
+		for _, roomID := range roomIDs {
+			if s.holdsRoom(roomID, reqList.RoomSubscription) {
+				unchangedRoomIDs = append(unchangedRoomIDs, roomID)
+			} else {
+				newRoomIDs = append(newRoomIDs, roomID)
+			}
+		}
+		builder.AddRoomsToSubscription(ctx, subID, newRoomIDs)
+		ops = append(ops, &sync3.ResponseOpRange{
+			Operation:        sync3.OpShift,
+			Range:            clampSliceRangeToListSize(ctx, r, roomList.Len()),
+			RoomIDs:          roomIDs,
+			UnchangedRoomIDs: unchangedRoomIDs,
+		})
+	}
+	return ops
+}
+
+// holdsRoom returns true if the client has up-to-date data for this room which includes everything
+// this subscription asks for.
+func (s *ConnState) holdsRoom(roomID string, sub sync3.RoomSubscription) bool {
+	held, ok := s.heldRooms[roomID]
+	if !ok {
+		return false
+	}
+	if held.TimelineLimit < sub.TimelineLimit || held.TimelineFilterChanged(sub) {
+		return false
+	}
+	if sub.IncludeHeroes() && !held.IncludeHeroes() {
+		return false
+	}
+	if sub.IncludeSummary() && !held.IncludeSummary() {
+		return false
+	}
+	if sub.IncludeOldRooms != nil && !reflect.DeepEqual(held.IncludeOldRooms, sub.IncludeOldRooms) {
+		return false
+	}
+	heldState := make(map[[2]string]struct{}, len(held.RequiredState))
+	for _, tuple := range held.RequiredState {
+		heldState[tuple] = struct{}{}
+	}
+	for _, tuple := range sub.RequiredState {
+		if _, ok := heldState[tuple]; !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// usesDeltas returns true if any list uses deltas, in which case we track which rooms the client holds.
+func (s *ConnState) usesDeltas() bool {
+	for _, list := range s.muxedReq.Lists {
+		if list.ShouldUseDeltas() {
+			return true
+		}
+	}
+	return false
+}
+
+// releaseHeldRooms forgets the rooms which are no longer in any list and aren't subscribed to, e.g
+// because the user left them. Rooms which have only scrolled out of a window stay held, as the client
+// keeps their data. Everything is forgotten once no list uses deltas, or the connection has been
+// destroyed: Destroy can be called whilst a request is being processed, so it leaves this to the request.
+func (s *ConnState) releaseHeldRooms() {
+	if len(s.heldRooms) == 0 {
+		return
+	}
+	if s.destroyed.Load() || !s.usesDeltas() {
+		s.heldRooms = make(map[string]sync3.RoomSubscription)
+		return
+	}
+	for roomID := range s.heldRooms {
+		if _, subscribed := s.roomSubscriptions[roomID]; subscribed {
+			continue
+		}
+		if s.lists.ReadOnlyRoom(roomID) == nil {
+			delete(s.heldRooms, roomID)
+		}
+	}
+}
+
 func (s *ConnState) buildListSubscriptions(ctx context.Context, builder *RoomsBuilder, listDeltas map[string]sync3.RequestListDelta) map[string]sync3.ResponseList {
 	ctx, span := internal.StartSpan(ctx, "buildListSubscriptions")
 	defer span.End()
@@ -475,6 +651,7 @@ func (s *ConnState) buildRooms(ctx context.Context, builtSubs []BuiltSubscriptio
 	for _, x := range s.muxedReq.Lists {
 		bumpEventTypes = append(bumpEventTypes, x.BumpEventTypes...)
 	}
+	trackHeldRooms := s.usesDeltas()
 
 	for _, bs := range builtSubs {
 		roomIDs := bs.RoomIDs
@@ -507,6 +684,9 @@ func (s *ConnState) buildRooms(ctx context.Context, builtSubs []BuiltSubscriptio
 				oldRooms := s.getInitialRoomData(ctx, *bs.RoomSubscription.IncludeOldRooms, bumpEventTypes, oldRoomIDs...)
 				for oldRoomID, oldRoom := range oldRooms {
 					result[oldRoomID] = oldRoom
+					if trackHeldRooms {
+						s.heldRooms[oldRoomID] = *bs.RoomSubscription.IncludeOldRooms
+					}
 				}
 			}
 		}
@@ -519,6 +699,9 @@ func (s *ConnState) buildRooms(ctx context.Context, builtSubs []BuiltSubscriptio
 		rooms := s.getInitialRoomData(ctx, bs.RoomSubscription, bumpEventTypes, roomIDs...)
 		for roomID, room := range rooms {
 			result[roomID] = room
+			if trackHeldRooms {
+				s.heldRooms[roomID] = bs.RoomSubscription
+			}
 		}
 	}
 	return result
@@ -566,7 +749,8 @@ func (s *ConnState) getInitialRoomData(ctx context.Context, roomSub sync3.RoomSu
 	// response to this call to assign new load positions for each room.
 	roomMetadatas := s.globalCache.LoadRooms(ctx, roomIDs...)
 	userRoomDatas := s.userCache.LoadRooms(roomIDs...)
-	timelines := s.userCache.LazyLoadTimelines(ctx, s.anchorLoadPosition, roomIDs, int(roomSub.TimelineLimit))
+	timelines := s.userCache.LazyLoadTimelines(ctx, s.anchorLoadPosition, roomIDs, int(roomSub.TimelineLimit), roomSub.TimelineFilter)
+	s.recorder.recordTimelines(timelines)
 
 	// 1. Prepare lazy loading data structures, txn IDs.
 	roomToUsersInTimeline := make(map[string][]string, len(timelines))
@@ -599,12 +783,12 @@ func (s *ConnState) getInitialRoomData(ctx context.Context, roomSub sync3.RoomSu
 
 	internal.Logf(ctx, "connstate", "getInitialRoomData for %d rooms, RequiredStateMap: %#v", len(roomIDs), rsm)
 
-	// Filter out rooms we are only invited to, as we don't need to fetch the state
-	// since we'll be using the invite_state only.
+	// Filter out rooms we are only invited to or have knocked on, as we don't need to fetch the state
+	// since we'll be using the invite_state or knock_state only.
 	loadRoomIDs := make([]string, 0, len(roomIDs))
 	for _, roomID := range roomIDs {
 		userRoomData, ok := userRoomDatas[roomID]
-		if !ok || !userRoomData.IsInvite {
+		if !ok || !(userRoomData.IsInvite || userRoomData.IsKnock) {
 			loadRoomIDs = append(loadRoomIDs, roomID)
 		}
 	}
@@ -625,7 +809,7 @@ func (s *ConnState) getInitialRoomData(ctx context.Context, roomSub sync3.RoomSu
 			userRoomData = caches.NewUserRoomData()
 		}
 		metadata := roomMetadatas[roomID]
-		var inviteState []json.RawMessage
+		var inviteState, knockState []json.RawMessage
 		// handle invites specially as we do not want to leak additional data beyond the invite_state and if
 		// we happen to have this room in the global cache we will do.
 		// Furthermore, rooms the proxy have been invited to for the first time ever will not be in the global cache yet,
@@ -633,10 +817,14 @@ func (s *ConnState) getInitialRoomData(ctx context.Context, roomSub sync3.RoomSu
 		if userRoomData.IsInvite {
 			metadata = userRoomData.Invite.RoomMetadata()
 			inviteState = userRoomData.Invite.InviteState
+		} else if userRoomData.IsKnock {
+			// the same goes for knocks
+			metadata = userRoomData.Knock.RoomMetadata()
+			knockState = userRoomData.Knock.InviteState
 		}
 		metadata.RemoveHero(s.userID)
 		var requiredState []json.RawMessage
-		if !userRoomData.IsInvite {
+		if !userRoomData.IsInvite && !userRoomData.IsKnock {
 			requiredState = roomIDToState[roomID]
 			if requiredState == nil {
 				requiredState = make([]json.RawMessage, 0)
@@ -675,23 +863,28 @@ func (s *ConnState) getInitialRoomData(ctx context.Context, roomSub sync3.RoomSu
 
 		roomName, calculated := internal.CalculateRoomName(metadata, 5) // TODO: customisable?
 		room := sync3.Room{
-			Name:              roomName,
-			AvatarChange:      sync3.NewAvatarChange(internal.CalculateAvatar(metadata, userRoomData.IsDM)),
-			NotificationCount: int64(userRoomData.NotificationCount),
-			HighlightCount:    int64(userRoomData.HighlightCount),
-			Timeline:          roomToTimeline[roomID],
-			RequiredState:     requiredState,
-			InviteState:       inviteState,
-			Initial:           true,
-			IsDM:              userRoomData.IsDM,
-			JoinedCount:       metadata.JoinCount,
-			InvitedCount:      &metadata.InviteCount,
-			PrevBatch:         timelines[roomID].PrevBatch,
-			Timestamp:         maxTs,
+			Name:                      roomName,
+			AvatarChange:              sync3.NewAvatarChange(internal.CalculateAvatar(metadata, userRoomData.IsDM)),
+			NotificationCount:         int64(userRoomData.NotificationCount),
+			HighlightCount:            int64(userRoomData.HighlightCount),
+			UnreadThreadNotifications: userRoomData.ThreadUnreadCounts,
+			Timeline:                  roomToTimeline[roomID],
+			RequiredState:             requiredState,
+			InviteState:               inviteState,
+			KnockState:                knockState,
+			Initial:                   true,
+			IsDM:                      userRoomData.IsDM,
+			JoinedCount:               metadata.JoinCount,
+			InvitedCount:              &metadata.InviteCount,
+			PrevBatch:                 timelines[roomID].PrevBatch,
+			Timestamp:                 maxTs,
 		}
 		if roomSub.IncludeHeroes() && calculated {
 			room.Heroes = metadata.Heroes
 		}
+		if roomSub.IncludeSummary() {
+			room.Summary = sync3.NewRoomSummary(metadata)
+		}
 		rooms[roomID] = room
 	}
 
@@ -724,7 +917,13 @@ func (s *ConnState) trackProcessDuration(ctx context.Context, dur time.Duration,
 
 // Called when the connection is torn down
 func (s *ConnState) Destroy() {
+	s.destroyed.Store(true)
+	if s.checkpointer != nil {
+		// the connection was deliberately expired, so the client must not be able to resume it
+		s.checkpointer.forget(s.checkpointCID)
+	}
 	s.userCache.Unsubscribe(s.userCacheID)
+	s.recorder.close()
 	log.Debug().Str("user_id", s.userID).Str("device_id", s.deviceID).Msg("cancelling any in-flight requests")
 	if s.cancelLatestReq != nil {
 		s.cancelLatestReq()
@@ -735,6 +934,29 @@ func (s *ConnState) Alive() bool {
 	return !s.live.bufferFull
 }
 
+// Info returns the lists and buffer depth of this connection. Safe to call from any goroutine.
+func (s *ConnState) Info() sync3.ConnInfo {
+	s.infoMu.Lock()
+	defer s.infoMu.Unlock()
+	return sync3.ConnInfo{
+		Lists:                s.listRanges,
+		NumRoomSubscriptions: s.numRoomSubs,
+		BufferDepth:          len(s.live.updates),
+	}
+}
+
+// updateInfo snapshots the muxed request for Info(). Must be called on the conn goroutine.
+func (s *ConnState) updateInfo() {
+	listRanges := make(map[string]sync3.SliceRanges, len(s.muxedReq.Lists))
+	for listKey, list := range s.muxedReq.Lists {
+		listRanges[listKey] = list.Ranges
+	}
+	s.infoMu.Lock()
+	defer s.infoMu.Unlock()
+	s.listRanges = listRanges
+	s.numRoomSubs = len(s.muxedReq.RoomSubscriptions)
+}
+
 func (s *ConnState) UserID() string {
 	return s.userID
 }
@@ -117,6 +117,7 @@ func (s *connStateLive) liveUpdate(
 
 func (s *connStateLive) processUpdate(ctx context.Context, update caches.Update, response *sync3.Response, ex extensions.Request) {
 	internal.Logf(ctx, "liveUpdate", "process live update %s", update.Type())
+	s.recorder.recordUpdate(update)
 	s.processLiveUpdate(ctx, update, response)
 	// pass event to extensions AFTER processing
 	roomIDsToLists := s.lists.ListsByVisibleRoomIDs(s.muxedReq.Lists)
@@ -181,6 +182,19 @@ func (s *connStateLive) processLiveUpdate(ctx context.Context, up caches.Update,
 		}
 		response.Lists[listKey] = resList
 	}
+	if spaceUpdate, ok := up.(*caches.SpaceUpdate); ok && s.refilterSubspace(ctx, builder, spaceUpdate.ChildRoomID, response) {
+		hasUpdates = true
+	}
+
+	if roomUpdate != nil && !hasUpdates {
+		switch up.(type) {
+		case *caches.TypingUpdate, *caches.ReceiptUpdate:
+			// these are sent by extensions and don't change the room data
+		default:
+			// the client isn't being told about this update, so its copy of the room is out of date
+			delete(s.heldRooms, roomUpdate.RoomID())
+		}
+	}
 
 	// add in initial rooms FIRST as we replace whatever is in the rooms key for these rooms.
 	// If we do it after appending live updates then we can lose updates because we replace what
@@ -221,8 +235,13 @@ func (s *connStateLive) processLiveUpdate(ctx context.Context, up caches.Update,
 
 		r.HighlightCount = int64(userRoomData.HighlightCount)
 		r.NotificationCount = int64(userRoomData.NotificationCount)
+		r.UnreadThreadNotifications = userRoomData.ThreadUnreadCounts
 		if roomEventUpdate != nil && roomEventUpdate.EventData.Event != nil {
-			r.NumLive++
+			// events which are filtered out still move the load position on, they just aren't sent
+			passesFilter := s.timelineFilterForRoom(roomEventUpdate.RoomID()).Include(roomEventUpdate.EventData.Event)
+			if passesFilter {
+				r.NumLive++
+			}
 			advancedPastEvent := false
 			if !roomEventUpdate.EventData.AlwaysProcess {
 				if roomEventUpdate.EventData.NID <= s.loadPositions[roomEventUpdate.RoomID()] {
@@ -236,7 +255,7 @@ func (s *connStateLive) processLiveUpdate(ctx context.Context, up caches.Update,
 			// - next request bumps a room from outside to inside the window
 			// - the initial:true room from BuildSubscriptions contains the latest live events in the timeline as it's pulled from the DB
 			// - we then process the live events in turn which adds them again.
-			if !advancedPastEvent {
+			if !advancedPastEvent && passesFilter {
 				roomIDtoTimeline := s.userCache.AnnotateWithTransactionIDs(ctx, s.userID, s.deviceID, map[string][]json.RawMessage{
 					roomEventUpdate.RoomID(): {roomEventUpdate.EventData.Event},
 				})
@@ -293,9 +312,12 @@ func (s *connStateLive) processLiveUpdate(ctx context.Context, up caches.Update,
 			if delta.JoinCountChanged {
 				thisRoom.JoinedCount = roomUpdate.GlobalRoomMetadata().JoinCount
 			}
+			if delta.SummaryChanged && s.shouldIncludeSummary(roomUpdate.RoomID()) {
+				thisRoom.Summary = sync3.NewRoomSummary(roomUpdate.GlobalRoomMetadata())
+			}
 			response.Rooms[roomUpdate.RoomID()] = thisRoom
 		}
-		if delta.HighlightCountChanged || delta.NotificationCountChanged {
+		if delta.HighlightCountChanged || delta.NotificationCountChanged || delta.ThreadCountsChanged {
 			if !exists {
 				// we need to make this room exist. Other deltas are caused by events so the room exists,
 				// but highlight/notif counts are silent
@@ -303,6 +325,7 @@ func (s *connStateLive) processLiveUpdate(ctx context.Context, up caches.Update,
 			}
 			thisRoom.NotificationCount = int64(roomUpdate.UserRoomMetadata().NotificationCount)
 			thisRoom.HighlightCount = int64(roomUpdate.UserRoomMetadata().HighlightCount)
+			thisRoom.UnreadThreadNotifications = roomUpdate.UserRoomMetadata().ThreadUnreadCounts
 			response.Rooms[roomUpdate.RoomID()] = thisRoom
 		}
 	}
@@ -381,6 +404,39 @@ func (s *connStateLive) processGlobalUpdates(ctx context.Context, builder *Rooms
 	return
 }
 
+// refilterSubspace checks the filters again for the rooms in a space which has just been added to
+// or removed from another space, as that changes whether they match lists which include subspaces.
+// Nothing else about the rooms has changed, so they are only added to or removed from lists.
+func (s *connStateLive) refilterSubspace(ctx context.Context, builder *RoomsBuilder, subspaceID string, response *sync3.Response) (hasUpdates bool) {
+	includesSubspaces := false
+	for _, list := range s.muxedReq.Lists {
+		if list.Filters != nil && list.Filters.IncludeSubspaces && len(list.Filters.Spaces) > 0 {
+			includesSubspaces = true
+			break
+		}
+	}
+	if !includesSubspaces {
+		return false
+	}
+	for _, roomID := range s.lists.RoomsInSpace(subspaceID) {
+		room := *s.lists.ReadOnlyRoom(roomID)
+		room.LastInterestedEventTimestamps = nil // don't bump the room
+		delta := s.lists.SetRoom(room)
+		for _, listDelta := range delta.Lists {
+			if listDelta.Op == sync3.ListOpChange {
+				continue
+			}
+			reqList := s.muxedReq.Lists[listDelta.ListKey]
+			resList := response.Lists[listDelta.ListKey]
+			ops, updated := s.resort(ctx, builder, &reqList, s.lists.Get(listDelta.ListKey), roomID, listDelta.Op)
+			resList.Ops = append(resList.Ops, ops...)
+			response.Lists[listDelta.ListKey] = resList
+			hasUpdates = hasUpdates || updated
+		}
+	}
+	return hasUpdates
+}
+
 func (s *connStateLive) processLiveUpdateForList(
 	ctx context.Context, builder *RoomsBuilder, up caches.Update, listOp sync3.ListOp,
 	reqList *sync3.RequestList, intList *sync3.FilteredSortableRooms, resList *sync3.ResponseList,
@@ -402,8 +458,8 @@ func (s *connStateLive) processLiveUpdateForList(
 		// ops which causes duplicate rooms to appear.
 	}
 
-	// only room updates can cause the rooms to reshuffle e.g events, room account data, tags
-	// because we need a room ID to move.
+	// only room updates can cause the rooms to reshuffle e.g events, joins, room account data (tags,
+	// marked unread) because we need a room ID to move.
 	rup, ok := up.(caches.RoomUpdate)
 	if !ok {
 		return false
@@ -462,16 +518,65 @@ func (s *connStateLive) resort(
 // shouldIncludeHeroes returns whether the given roomID is in a list or direct
 // subscription which should return heroes.
 func (s *connStateLive) shouldIncludeHeroes(roomID string) bool {
-	if s.roomSubscriptions[roomID].IncludeHeroes() {
+	return s.shouldInclude(roomID, sync3.RoomSubscription.IncludeHeroes)
+}
+
+// shouldIncludeSummary returns whether the given roomID is in a list or direct
+// subscription which should return the room summary.
+func (s *connStateLive) shouldIncludeSummary(roomID string) bool {
+	return s.shouldInclude(roomID, sync3.RoomSubscription.IncludeSummary)
+}
+
+// shouldInclude returns whether the given roomID is in a list or direct subscription for which
+// include returns true.
+func (s *connStateLive) shouldInclude(roomID string, include func(sync3.RoomSubscription) bool) bool {
+	if include(s.roomSubscriptions[roomID]) {
 		return true
 	}
 	roomIDsToLists := s.lists.ListsByVisibleRoomIDs(s.muxedReq.Lists)
 	for _, listKey := range roomIDsToLists[roomID] {
-		// check if this list should include heroes
-		if !s.muxedReq.Lists[listKey].IncludeHeroes() {
+		// check if this list should include it
+		if !include(s.muxedReq.Lists[listKey].RoomSubscription) {
 			continue
 		}
 		return true
 	}
 	return false
 }
+
+// timelineFilterForRoom returns the filter to apply to live timeline events in the given room, or
+// nil to send everything. The room subscription and every list the room is visible in are
+// combined, in the same way as they are when loading the initial room data.
+func (s *connStateLive) timelineFilterForRoom(roomID string) *internal.TimelineFilter {
+	// fast path: most connections don't use timeline filters at all
+	anyFilters := false
+	for _, rs := range s.roomSubscriptions {
+		anyFilters = anyFilters || rs.TimelineFilter.Filters()
+	}
+	for _, list := range s.muxedReq.Lists {
+		anyFilters = anyFilters || list.TimelineFilter.Filters()
+	}
+	if !anyFilters {
+		return nil
+	}
+	var combined *sync3.RoomSubscription
+	combine := func(rs sync3.RoomSubscription) {
+		if combined == nil {
+			combined = &rs
+		} else {
+			crs := combined.Combine(rs)
+			combined = &crs
+		}
+	}
+	if rs, ok := s.roomSubscriptions[roomID]; ok {
+		combine(rs)
+	}
+	roomIDsToLists := s.lists.ListsByVisibleRoomIDs(s.muxedReq.Lists)
+	for _, listKey := range roomIDsToLists[roomID] {
+		combine(s.muxedReq.Lists[listKey].RoomSubscription)
+	}
+	if combined == nil {
+		return nil
+	}
+	return combined.TimelineFilter
+}
@@ -5,6 +5,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"reflect"
+	"sort"
 	"testing"
 	"time"
 
@@ -38,7 +39,7 @@ type NopUserCacheStore struct{}
 func (s *NopUserCacheStore) GetClosestPrevBatch(roomID string, eventNID int64) (prevBatch string) {
 	return
 }
-func (s *NopUserCacheStore) LatestEventsInRooms(userID string, roomIDs []string, to int64, limit int) (map[string]*state.LatestEvents, error) {
+func (s *NopUserCacheStore) LatestEventsInRooms(userID string, roomIDs []string, to int64, limit int, filter *internal.TimelineFilter) (map[string]*state.LatestEvents, error) {
 	return nil, nil
 }
 
@@ -521,6 +522,128 @@ func TestBumpToOutsideRange(t *testing.T) {
 	}
 }
 
+// Test that lists with deltas enabled SHIFT the window when the ranges change, and only send rooms
+// which the client doesn't already have up-to-date data for.
+func TestConnStateDeltas(t *testing.T) {
+	ConnID := sync3.ConnID{
+		DeviceID: "d",
+	}
+	userID := "@TestConnStateDeltas_alice:localhost"
+	deviceID := "yep"
+	timestampNow := spec.Timestamp(1632131678061)
+	var roomIDs []string
+	rooms := make(map[string]internal.RoomMetadata)
+	joinTimings := make(map[string]internal.EventMetadata)
+	for i := 0; i < 6; i++ {
+		// room 0 is the most recent
+		room := newRoomMetadata(fmt.Sprintf("!%d:localhost", i), timestampNow-spec.Timestamp(i*1000))
+		roomIDs = append(roomIDs, room.RoomID)
+		rooms[room.RoomID] = room
+		joinTimings[room.RoomID] = internal.EventMetadata{NID: int64(i + 1), Timestamp: uint64(i + 1)}
+	}
+	globalCache := caches.NewGlobalCache(nil)
+	globalCache.Startup(rooms)
+	dispatcher := sync3.NewDispatcher()
+	roomToUsers := make(map[string][]string)
+	for _, roomID := range roomIDs {
+		roomToUsers[roomID] = []string{userID}
+	}
+	dispatcher.Startup(roomToUsers)
+	globalCache.LoadJoinedRoomsOverride = func(userID string) (pos int64, joinedRooms map[string]*internal.RoomMetadata, joinTimingsByRoomID map[string]internal.EventMetadata, loadPositions map[string]int64, err error) {
+		joinedRooms = make(map[string]*internal.RoomMetadata)
+		for roomID := range rooms {
+			room := rooms[roomID]
+			joinedRooms[roomID] = &room
+		}
+		return 1, joinedRooms, joinTimings, nil, nil
+	}
+	userCache := caches.NewUserCache(userID, globalCache, &NopUserCacheStore{}, &NopTransactionFetcher{}, &joinChecker{})
+	userCache.LazyLoadTimelinesOverride = mockLazyRoomOverride
+	dispatcher.Register(context.Background(), userCache.UserID, userCache)
+	dispatcher.Register(context.Background(), sync3.DispatcherAllUsers, globalCache)
+	cs := NewConnState(userID, deviceID, userCache, globalCache, &NopExtensionHandler{}, &NopJoinTracker{}, nil, nil, 1000, 0)
+
+	deltas := true
+	request := func(ranges [][2]int64) *sync3.Response {
+		t.Helper()
+		// expire the context so we don't wait for live updates when there is nothing to send
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+		res, err := cs.OnIncomingRequest(ctx, ConnID, &sync3.Request{
+			Lists: map[string]sync3.RequestList{"a": {
+				Sort:   []string{sync3.SortByRecency},
+				Ranges: sync3.SliceRanges(ranges),
+				Deltas: &deltas,
+			}},
+		}, false, time.Now())
+		if err != nil {
+			t.Fatalf("OnIncomingRequest returned error : %s", err)
+		}
+		return res
+	}
+	checkShift := func(res *sync3.Response, wantRange [2]int64, wantRoomIDs, wantUnchanged, wantRooms []string) {
+		t.Helper()
+		ops := res.Lists["a"].Ops
+		if len(ops) != 1 {
+			t.Fatalf("got %d ops, want 1: %v", len(ops), serialise(t, ops))
+		}
+		op, ok := ops[0].(*sync3.ResponseOpRange)
+		if !ok || op.Op() != sync3.OpShift {
+			t.Fatalf("got op %v, want SHIFT", serialise(t, ops[0]))
+		}
+		if op.Range != wantRange {
+			t.Errorf("SHIFT: got range %v want %v", op.Range, wantRange)
+		}
+		if !reflect.DeepEqual(op.RoomIDs, wantRoomIDs) {
+			t.Errorf("SHIFT: got rooms %v want %v", op.RoomIDs, wantRoomIDs)
+		}
+		if !reflect.DeepEqual(op.UnchangedRoomIDs, wantUnchanged) {
+			t.Errorf("SHIFT: got unchanged rooms %v want %v", op.UnchangedRoomIDs, wantUnchanged)
+		}
+		var gotRooms []string
+		for roomID := range res.Rooms {
+			gotRooms = append(gotRooms, roomID)
+		}
+		sort.Strings(gotRooms)
+		if !reflect.DeepEqual(gotRooms, wantRooms) {
+			t.Errorf("got room data for %v want %v", gotRooms, wantRooms)
+		}
+	}
+
+	// the initial window sends everything
+	res := request([][2]int64{{0, 5}})
+	checkShift(res, [2]int64{0, 5}, roomIDs, nil, roomIDs)
+
+	// shrinking the window doesn't need an INVALIDATE, and the rooms are unchanged
+	res = request([][2]int64{{0, 2}})
+	checkShift(res, [2]int64{0, 2}, roomIDs[0:3], roomIDs[0:3], nil)
+
+	// room 4 gets a new event whilst outside the window, without changing position
+	newEvent := testutils.NewEvent(t, "unimportant", "me", struct{}{}, testutils.WithTimestamp(spec.Timestamp(rooms[roomIDs[4]].LastMessageTimestamp).Time()))
+	dispatcher.OnNewEvent(context.Background(), roomIDs[4], newEvent, 10)
+	res = request([][2]int64{{0, 2}})
+	if len(res.Lists["a"].Ops) > 0 {
+		t.Fatalf("got ops %v, want none", serialise(t, res.Lists["a"].Ops))
+	}
+
+	// so when we scroll back to it, only room 4 is sent again
+	res = request([][2]int64{{3, 5}})
+	checkShift(res, [2]int64{3, 5}, roomIDs[3:6], []string{roomIDs[3], roomIDs[5]}, []string{roomIDs[4]})
+
+	// rooms which are no longer in any list are forgotten
+	cs.lists.RemoveRoom(roomIDs[5])
+	request([][2]int64{{0, 2}})
+	if len(cs.heldRooms) != 5 {
+		t.Errorf("got %d held rooms, want 5", len(cs.heldRooms))
+	}
+	// as is everything once deltas are turned off
+	deltas = false
+	request([][2]int64{{0, 2}})
+	if len(cs.heldRooms) != 0 {
+		t.Errorf("got %d held rooms, want 0", len(cs.heldRooms))
+	}
+}
+
 // Test that room subscriptions can be made and that events are pushed for them.
 func TestConnStateRoomSubscriptions(t *testing.T) {
 	ConnID := sync3.ConnID{
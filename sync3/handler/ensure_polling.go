@@ -167,6 +167,14 @@ func (p *EnsurePoller) OnInitialSyncComplete(payload *pubsub.V2InitialSyncComple
 	close(ch)
 }
 
+// isPolling returns true if a poller has already been started for this device.
+func (p *EnsurePoller) isPolling(pid sync2.PollerID) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	pending := p.pendingPolls[pid]
+	return pending.done && !pending.expired
+}
+
 func (p *EnsurePoller) OnExpiredToken(payload *pubsub.V2ExpiredToken) {
 	pid := sync2.PollerID{UserID: payload.UserID, DeviceID: payload.DeviceID}
 	p.mu.Lock()
@@ -184,6 +192,16 @@ func (p *EnsurePoller) OnExpiredToken(payload *pubsub.V2ExpiredToken) {
 	// by signalling via the expired flag.
 }
 
+// ExpireToken asks the pollers to expire this device's access token, which the authenticator has
+// rejected. A V2ExpiredToken is sent back once it has been expired.
+func (p *EnsurePoller) ExpireToken(pid sync2.PollerID, tokenHash string) {
+	p.notifier.Notify(p.chanName, &pubsub.V3ExpiredToken{
+		UserID:          pid.UserID,
+		DeviceID:        pid.DeviceID,
+		AccessTokenHash: tokenHash,
+	})
+}
+
 func (p *EnsurePoller) Teardown() {
 	p.notifier.Close()
 	if p.numPendingEnsurePolling != nil {
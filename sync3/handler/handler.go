@@ -15,6 +15,8 @@ import (
 	"time"
 
 	"github.com/getsentry/sentry-go"
+	"github.com/gorilla/mux"
+	"github.com/gorilla/websocket"
 	"github.com/jmoiron/sqlx"
 	"github.com/matrix-org/sliding-sync/sqlutil"
 
@@ -36,7 +38,8 @@ const DefaultSessionID = "default"
 // This is a net.http Handler for sync v3. It is responsible for pairing requests to Conns and to
 // ensure that the sync v2 poller is running for this client.
 type SyncLiveHandler struct {
-	V2           sync2.Client
+	// which homeserver to talk to for each user
+	Upstreams    *sync2.Upstreams
 	Storage      *state.Storage
 	V2Store      *sync2.Storage
 	V2Sub        *pubsub.V2Sub
@@ -53,6 +56,20 @@ type SyncLiveHandler struct {
 	GlobalCache            *caches.GlobalCache
 	maxPendingEventUpdates int
 	maxTransactionIDDelay  time.Duration
+	// EnableWebSockets allows clients to upgrade the sync endpoint to a WebSocket.
+	EnableWebSockets bool
+	// if set, connections are checkpointed so they can be resumed after a restart
+	checkpointer *connCheckpointer
+	// if set, requests to the sync endpoint are rate limited
+	rateLimiter *rateLimiter
+	// if set, new connections are recorded to files in this directory
+	recordDir string
+	// if set, only these users' connections are recorded
+	recordUsers map[string]bool
+	// server name => *upstreamHealth, as reported by the pollers
+	upstreamHealth *sync.Map
+	// how access tokens we haven't seen before are identified
+	auth AuthOptions
 
 	setupHistVec *prometheus.HistogramVec
 	histVec      *prometheus.HistogramVec
@@ -62,8 +79,14 @@ type SyncLiveHandler struct {
 	// TODO: could make this a CounterVec labelled by reason, to track expiry due
 	//       to update buffer filling, expiry due to inactivity, etc.
 	destroyedConns prometheus.Counter
+	throttledReqs  *prometheus.CounterVec
+	// upstreamDegradedReqs is the number of requests rejected because the upstream homeserver is unhealthy.
+	upstreamDegradedReqs prometheus.Counter
 }
 
+// How long a connection can go without requests before it is expired.
+const connExpiry = 30 * time.Minute
+
 func NewSync3Handler(
 	store *state.Storage, storev2 *sync2.Storage, v2Client sync2.Client, secret string,
 	pub pubsub.Notifier, sub pubsub.Listener, enablePrometheus bool, maxPendingEventUpdates int,
@@ -71,15 +94,17 @@ func NewSync3Handler(
 ) (*SyncLiveHandler, error) {
 	log.Info().Msg("creating handler")
 	sh := &SyncLiveHandler{
-		V2:                     v2Client,
+		Upstreams:              sync2.NewUpstreams(v2Client),
 		Storage:                store,
 		V2Store:                storev2,
-		ConnMap:                sync3.NewConnMap(enablePrometheus, 30*time.Minute),
+		ConnMap:                sync3.NewConnMap(enablePrometheus, connExpiry),
 		userCaches:             &sync.Map{},
+		upstreamHealth:         &sync.Map{},
 		Dispatcher:             sync3.NewDispatcher(),
 		GlobalCache:            caches.NewGlobalCache(store),
 		maxPendingEventUpdates: maxPendingEventUpdates,
 		maxTransactionIDDelay:  maxTransactionIDDelay,
+		auth:                   AuthOptions{Authenticator: WhoAmIAuthenticator{}},
 	}
 	sh.Extensions = &extensions.Handler{
 		Store:       store,
@@ -122,8 +147,19 @@ func (h *SyncLiveHandler) Listen() {
 	}()
 }
 
+// EnableConnCheckpoints saves connection state to the database after every response, so clients
+// can resume their connections after the proxy restarts.
+func (h *SyncLiveHandler) EnableConnCheckpoints() {
+	h.checkpointer = newConnCheckpointer(h.Storage.ConnStateTable, connExpiry)
+	go h.checkpointer.run()
+}
+
 // used in tests to close postgres connections
 func (h *SyncLiveHandler) Teardown() {
+	if h.checkpointer != nil {
+		// write out pending checkpoints before the DB goes away
+		h.checkpointer.teardown()
+	}
 	// tear down DB conns
 	h.Storage.Teardown()
 	h.V2Sub.Teardown()
@@ -141,6 +177,12 @@ func (h *SyncLiveHandler) Teardown() {
 	if h.destroyedConns != nil {
 		prometheus.Unregister(h.destroyedConns)
 	}
+	if h.throttledReqs != nil {
+		prometheus.Unregister(h.throttledReqs)
+	}
+	if h.upstreamDegradedReqs != nil {
+		prometheus.Unregister(h.upstreamDegradedReqs)
+	}
 }
 
 func (h *SyncLiveHandler) addPrometheusMetrics() {
@@ -170,19 +212,46 @@ func (h *SyncLiveHandler) addPrometheusMetrics() {
 		Name:      "destroyed_conns",
 		Help:      "Counter of conns that were destroyed.",
 	})
+	h.throttledReqs = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "sliding_sync",
+		Subsystem: "api",
+		Name:      "throttled_requests",
+		Help:      "Counter of requests rejected by rate limiting, labelled by the limit which was exceeded.",
+	}, []string{"scope"})
+	h.upstreamDegradedReqs = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "sliding_sync",
+		Subsystem: "api",
+		Name:      "upstream_degraded_requests",
+		Help:      "Counter of requests rejected because the upstream homeserver is unhealthy.",
+	})
 
 	prometheus.MustRegister(h.setupHistVec)
 	prometheus.MustRegister(h.histVec)
 	prometheus.MustRegister(h.slowReqs)
 	prometheus.MustRegister(h.destroyedConns)
+	prometheus.MustRegister(h.throttledReqs)
+	prometheus.MustRegister(h.upstreamDegradedReqs)
 }
 
 func (h *SyncLiveHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
-	if req.Method != "POST" {
-		w.WriteHeader(http.StatusMethodNotAllowed)
+	if h.EnableWebSockets && websocket.IsWebSocketUpgrade(req) {
+		h.serveWebSocket(w, req)
 		return
 	}
-	err := h.serve(w, req)
+	var err error
+	if roomID := mux.Vars(req)["roomID"]; roomID != "" {
+		if req.Method != "GET" {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		err = h.serveMessages(w, req, roomID)
+	} else {
+		if req.Method != "POST" {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		err = h.serve(w, req)
+	}
 	if err != nil {
 		herr, ok := err.(*internal.HandlerError)
 		if !ok {
@@ -191,13 +260,18 @@ func (h *SyncLiveHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 				Err:        err,
 			}
 		}
-		if herr.ErrCode != "M_UNKNOWN_POS" {
+		if herr.ErrCode != "M_UNKNOWN_POS" && herr.StatusCode != http.StatusTooManyRequests && herr.RetryAfterMS == 0 {
 			// artificially wait a bit before sending back the error
 			// this guards against tightlooping when the client hammers the server with invalid requests,
 			// but not for M_UNKNOWN_POS which we expect to send back after expiring a client's connection.
-			// We want to recover rapidly in that scenario, hence not sleeping.
+			// We want to recover rapidly in that scenario, hence not sleeping. Nor do we sleep when we
+			// tell the client when to retry, as holding onto the request would only add to the load
+			// the client is being told to back off from.
 			time.Sleep(time.Second)
 		}
+		if herr.RetryAfterMS > 0 {
+			w.Header().Set("Retry-After", strconv.FormatInt((herr.RetryAfterMS+999)/1000, 10))
+		}
 		w.WriteHeader(herr.StatusCode)
 		w.Write(herr.JSON())
 	}
@@ -225,12 +299,9 @@ func (h *SyncLiveHandler) serve(w http.ResponseWriter, req *http.Request) error
 				Err:        err,
 			}
 		}
-		if err := requestBody.Validate(); err != nil {
-			return &internal.HandlerError{
-				StatusCode: 400,
-				Err:        err,
-			}
-		}
+	}
+	if herr := validateRequest(&requestBody); herr != nil {
+		return herr
 	}
 	if requestBody.ConnID != "" {
 		req = req.WithContext(internal.SetAttributeOnContext(req.Context(), internal.OTLPTagConnID, requestBody.ConnID))
@@ -242,15 +313,6 @@ func (h *SyncLiveHandler) serve(w http.ResponseWriter, req *http.Request) error
 		c.Str("txn_id", requestBody.TxnID)
 		return c
 	})
-	for listKey, l := range requestBody.Lists {
-		if l.Ranges != nil && !l.Ranges.Valid() {
-			return &internal.HandlerError{
-				StatusCode: 400,
-				Err:        fmt.Errorf("list[%v] invalid ranges %v", listKey, l.Ranges),
-			}
-		}
-	}
-
 	logErrorOrWarning := func(msg string, herr *internal.HandlerError) {
 		if herr.StatusCode >= 500 {
 			hlog.FromRequest(req).Err(herr).Msg(msg)
@@ -335,6 +397,25 @@ func (h *SyncLiveHandler) serve(w http.ResponseWriter, req *http.Request) error
 	return nil
 }
 
+// validateRequest checks the request body is sane before it is handed to a connection.
+func validateRequest(requestBody *sync3.Request) *internal.HandlerError {
+	if err := requestBody.Validate(); err != nil {
+		return &internal.HandlerError{
+			StatusCode: 400,
+			Err:        err,
+		}
+	}
+	for listKey, l := range requestBody.Lists {
+		if l.Ranges != nil && !l.Ranges.Valid() {
+			return &internal.HandlerError{
+				StatusCode: 400,
+				Err:        fmt.Errorf("list[%v] invalid ranges %v", listKey, l.Ranges),
+			}
+		}
+	}
+	return nil
+}
+
 // setupConnection associates this request with an existing connection or makes a new connection.
 // It also sets a v2 sync poll loop going if one didn't exist already for this user.
 // When this function returns, the connection is alive and active.
@@ -343,57 +424,27 @@ func (h *SyncLiveHandler) setupConnection(req *http.Request, cancel context.Canc
 	req = req.WithContext(ctx)
 	defer task.End()
 	var conn *sync3.Conn
-	// Extract an access token
-	accessToken, err := internal.ExtractAccessToken(req)
-	if err != nil || accessToken == "" {
-		hlog.FromRequest(req).Warn().Err(err).Msg("failed to get access token from request")
-		return req, nil, &internal.HandlerError{
-			StatusCode: http.StatusUnauthorized,
-			Err:        err,
-		}
-	}
-
-	// Try to lookup a record of this token
-	var token *sync2.Token
-	token, err = h.V2Store.TokensTable.Token(accessToken)
-	if err != nil {
-		if err == sql.ErrNoRows {
-			hlog.FromRequest(req).Info().Msg("Received connection from unknown access token, querying with homeserver")
-			newToken, herr := h.identifyUnknownAccessToken(req.Context(), accessToken, hlog.FromRequest(req))
-			if herr != nil {
-				return req, nil, herr
-			}
-			token = newToken
-		} else {
-			hlog.FromRequest(req).Err(err).Msg("Failed to lookup access token")
-			return req, nil, &internal.HandlerError{
-				StatusCode: http.StatusInternalServerError,
-				Err:        err,
-			}
-		}
+	req, token, herr := h.authenticate(req)
+	if herr != nil {
+		return req, nil, herr
 	}
-	req = req.WithContext(internal.SetAttributeOnContext(req.Context(), internal.OTLPTagUserID, token.UserID))
-	req = req.WithContext(internal.SetAttributeOnContext(req.Context(), internal.OTLPTagDeviceID, token.DeviceID))
 	log := hlog.FromRequest(req).With().
 		Str("user", token.UserID).
 		Str("device", token.DeviceID).
 		Str("conn", syncReq.ConnID).
 		Logger()
-	req = req.WithContext(internal.AssociateUserIDWithRequest(req.Context(), token.UserID, token.DeviceID))
-	internal.Logf(req.Context(), "setupConnection", "identified access token as user=%s device=%s", token.UserID, token.DeviceID)
-
-	// Record the fact that we've recieved a request from this token
-	err = h.V2Store.TokensTable.MaybeUpdateLastSeen(token, time.Now())
-	if err != nil {
-		// Not fatal---log and continue.
-		log.Warn().Err(err).Msg("Unable to update last seen timestamp")
-	}
 
 	connID := sync3.ConnID{
 		UserID:   token.UserID,
 		DeviceID: token.DeviceID,
 		CID:      syncReq.ConnID,
 	}
+	if herr := h.checkRateLimit(connID, !containsPos); herr != nil {
+		log.Warn().Bool("initial", !containsPos).Int64("retry_after_ms", herr.RetryAfterMS).Msg("rate limited")
+		return req, nil, herr
+	}
+	var resumeFrom *connCheckpoint
+	var resumePos int64
 	// client thinks they have a connection
 	if containsPos {
 		// Lookup the connection
@@ -403,11 +454,19 @@ func (h *SyncLiveHandler) setupConnection(req *http.Request, cancel context.Canc
 			log.Trace().Str("conn", conn.ConnID.String()).Msg("reusing conn")
 			return req, conn, nil
 		}
-		// conn doesn't exist, we probably nuked it.
-		return req, nil, internal.ExpiredSessionError()
+		resumeFrom, resumePos = h.loadCheckpoint(req, connID)
+		if resumeFrom == nil {
+			// conn doesn't exist, we probably nuked it.
+			return req, nil, internal.ExpiredSessionError()
+		}
+		log.Info().Int64("pos", resumePos).Msg("resuming connection from checkpoint")
 	}
 
 	pid := sync2.PollerID{UserID: token.UserID, DeviceID: token.DeviceID}
+	if herr := h.checkUpstreamHealth(pid); herr != nil {
+		log.Warn().Int64("retry_after_ms", herr.RetryAfterMS).Msg("upstream homeserver is unhealthy, rejecting request")
+		return req, nil, herr
+	}
 	log.Trace().Any("pid", pid).Msg("checking poller exists and is running")
 	expiredToken := h.EnsurePoller.EnsurePolling(req.Context(), pid, token.AccessTokenHash)
 	if expiredToken {
@@ -448,38 +507,195 @@ func (h *SyncLiveHandler) setupConnection(req *http.Request, cancel context.Canc
 	// to check for an existing connection though, as it's possible for the client to call /sync
 	// twice for a new connection.
 	conn = h.ConnMap.CreateConn(connID, cancel, func() sync3.ConnHandler {
-		return NewConnState(token.UserID, token.DeviceID, userCache, h.GlobalCache, h.Extensions, h.Dispatcher, h.setupHistVec, h.histVec, h.maxPendingEventUpdates, h.maxTransactionIDDelay)
+		cs := NewConnState(token.UserID, token.DeviceID, userCache, h.GlobalCache, h.Extensions, h.Dispatcher, h.setupHistVec, h.histVec, h.maxPendingEventUpdates, h.maxTransactionIDDelay)
+		if h.checkpointer != nil {
+			cs.checkpointer = h.checkpointer
+			cs.checkpointCID = connID
+			cs.resumeFrom = resumeFrom
+		}
+		if resumeFrom == nil {
+			// resumed connections start from a checkpoint rather than a load, so can't be replayed
+			cs.recorder = h.newRecorder(connID)
+		}
+		return cs
 	})
+	if resumeFrom != nil {
+		conn.Resume(resumePos)
+	}
 	log.Info().Msg("created new connection")
 	return req, conn, nil
 }
 
-func (h *SyncLiveHandler) identifyUnknownAccessToken(ctx context.Context, accessToken string, logger *zerolog.Logger) (*sync2.Token, *internal.HandlerError) {
-	// We don't recognise the given accessToken. Ask the homeserver who owns it.
-	userID, deviceID, err := h.V2.WhoAmI(ctx, accessToken)
+// authenticate works out which device made this request from its access token, asking the
+// authenticator if we haven't seen the token before, or it has expired. The returned request is
+// associated with the device.
+func (h *SyncLiveHandler) authenticate(req *http.Request) (*http.Request, *sync2.Token, *internal.HandlerError) {
+	// Extract an access token
+	accessToken, err := internal.ExtractAccessToken(req)
+	if err != nil || accessToken == "" {
+		hlog.FromRequest(req).Warn().Err(err).Msg("failed to get access token from request")
+		return req, nil, &internal.HandlerError{
+			StatusCode: http.StatusUnauthorized,
+			Err:        err,
+		}
+	}
+
+	// Requests to a host which is mapped to a homeserver can only be for users on that homeserver.
+	serverName, client := h.Upstreams.ForHost(req.Host)
+
+	// Try to lookup a record of this token
+	var token, expiredToken *sync2.Token
+	token, err = h.V2Store.TokensTable.Token(accessToken)
+	if err == nil && token.Expired(time.Now()) {
+		hlog.FromRequest(req).Info().Str("user", token.UserID).Msg("access token has expired, checking it again")
+		expiredToken = token
+		err = sql.ErrNoRows
+	}
+	if err == nil && serverName != "" && h.Upstreams.ServerFor(token.UserID) != serverName {
+		hlog.FromRequest(req).Warn().Str("user", token.UserID).Str("host", req.Host).Msg("access token is for a different homeserver")
+		return req, nil, &internal.HandlerError{
+			StatusCode: http.StatusUnauthorized,
+			Err:        fmt.Errorf("access token is for a different homeserver"),
+			ErrCode:    "M_UNKNOWN_TOKEN",
+		}
+	}
+	if err != nil {
+		if err == sql.ErrNoRows {
+			if herr := h.checkRejectedToken(accessToken); herr != nil {
+				return req, nil, herr
+			}
+			hlog.FromRequest(req).Info().Msg("Received connection from unknown access token, querying with homeserver")
+			newToken, herr := h.identifyUnknownAccessToken(req.Context(), accessToken, expiredToken, serverName, client)
+			if herr != nil {
+				return req, nil, herr
+			}
+			token = newToken
+		} else {
+			hlog.FromRequest(req).Err(err).Msg("Failed to lookup access token")
+			return req, nil, &internal.HandlerError{
+				StatusCode: http.StatusInternalServerError,
+				Err:        err,
+			}
+		}
+	}
+	req = req.WithContext(internal.SetAttributeOnContext(req.Context(), internal.OTLPTagUserID, token.UserID))
+	req = req.WithContext(internal.SetAttributeOnContext(req.Context(), internal.OTLPTagDeviceID, token.DeviceID))
+	req = req.WithContext(internal.AssociateUserIDWithRequest(req.Context(), token.UserID, token.DeviceID))
+	internal.Logf(req.Context(), "authenticate", "identified access token as user=%s device=%s", token.UserID, token.DeviceID)
+
+	// Record the fact that we've recieved a request from this token
+	err = h.V2Store.TokensTable.MaybeUpdateLastSeen(token, time.Now())
+	if err != nil {
+		// Not fatal---log and continue.
+		hlog.FromRequest(req).Warn().Err(err).Str("user", token.UserID).Str("device", token.DeviceID).Msg("Unable to update last seen timestamp")
+	}
+	return req, token, nil
+}
+
+// loadCheckpoint returns the checkpoint to resume this connection from, if checkpoints are enabled
+// and there is one at the position the client sent. Returns nil if the connection cannot be resumed.
+func (h *SyncLiveHandler) loadCheckpoint(req *http.Request, connID sync3.ConnID) (*connCheckpoint, int64) {
+	if h.checkpointer == nil {
+		return nil, 0
+	}
+	pos, herr := parseIntFromQuery(req.URL, "pos")
+	if herr != nil {
+		return nil, 0
+	}
+	cp, err := h.checkpointer.load(connID, pos)
+	if err != nil {
+		hlog.FromRequest(req).Err(err).Str("conn", connID.String()).Msg("failed to load conn checkpoint")
+		internal.GetSentryHubFromContextOrDefault(req.Context()).CaptureException(err)
+		return nil, 0
+	}
+	return cp, pos
+}
+
+// checkRejectedToken returns an error if the authenticator rejected this token recently.
+func (h *SyncLiveHandler) checkRejectedToken(accessToken string) *internal.HandlerError {
+	if h.auth.RejectedTokenTTL <= 0 {
+		return nil
+	}
+	rejected, err := h.V2Store.TokensTable.Rejected(accessToken, time.Now())
+	if err != nil {
+		// Not fatal---we'll just ask the authenticator again.
+		log.Warn().Err(err).Msg("failed to check for rejected access token")
+		return nil
+	}
+	if rejected {
+		return &internal.HandlerError{
+			StatusCode: http.StatusUnauthorized,
+			Err:        fmt.Errorf("access token was rejected recently"),
+			ErrCode:    "M_UNKNOWN_TOKEN",
+		}
+	}
+	return nil
+}
+
+// identifyUnknownAccessToken asks the authenticator who owns the access token, which was sent to
+// the homeserver with this server name. client talks to that homeserver. expiredToken is our record
+// of the access token if it is being checked again because it has expired, else nil.
+func (h *SyncLiveHandler) identifyUnknownAccessToken(ctx context.Context, accessToken string, expiredToken *sync2.Token, serverName string, client sync2.Client) (*sync2.Token, *internal.HandlerError) {
+	// We don't recognise the given accessToken. Ask who owns it.
+	now := time.Now()
+	identity, err := h.auth.Authenticator.Authenticate(ctx, accessToken, serverName, client)
+	if err == nil && h.Upstreams.ServerFor(identity.UserID) != serverName {
+		// Don't let one homeserver vouch for users on another homeserver we talk to.
+		log.Warn().Str("user", identity.UserID).Str("homeserver", serverName).Msg("authenticator returned a user on a different homeserver")
+		return nil, &internal.HandlerError{
+			StatusCode: http.StatusUnauthorized,
+			Err:        fmt.Errorf("authenticator returned a user on a different homeserver"),
+			ErrCode:    "M_UNKNOWN_TOKEN",
+		}
+	}
 	if err != nil {
-		if err == sync2.HTTP401 {
+		if errors.Is(err, ErrUnknownToken) {
+			if h.auth.RejectedTokenTTL > 0 {
+				if rerr := h.V2Store.TokensTable.Reject(accessToken, now.Add(h.auth.RejectedTokenTTL)); rerr != nil {
+					log.Warn().Err(rerr).Msg("failed to remember rejected access token")
+				}
+			}
+			if expiredToken != nil {
+				h.expireToken(expiredToken)
+			}
 			return nil, &internal.HandlerError{
 				StatusCode: 401,
-				Err:        fmt.Errorf("/whoami returned HTTP 401"),
+				Err:        err,
 				ErrCode:    "M_UNKNOWN_TOKEN",
 			}
 		}
-		log.Warn().Err(err).Msg("failed to get user ID from device ID")
+		log.Warn().Err(err).Msg("failed to identify access token")
 		return nil, &internal.HandlerError{
 			StatusCode: http.StatusBadGateway,
 			Err:        err,
 		}
 	}
+	userID, deviceID := identity.UserID, identity.DeviceID
+	if expiredToken != nil && (expiredToken.UserID != userID || expiredToken.DeviceID != deviceID) {
+		// We would otherwise keep using the token for the device we stored it for.
+		log.Warn().Str("user", expiredToken.UserID).Str("device", expiredToken.DeviceID).
+			Str("new_user", userID).Str("new_device", deviceID).Msg("access token now belongs to a different device")
+		h.expireToken(expiredToken)
+		return nil, &internal.HandlerError{
+			StatusCode: http.StatusUnauthorized,
+			Err:        fmt.Errorf("access token now belongs to a different device"),
+			ErrCode:    "M_UNKNOWN_TOKEN",
+		}
+	}
 
 	var token *sync2.Token
 	err = sqlutil.WithTransaction(h.V2Store.DB, func(txn *sqlx.Tx) error {
-		// Create a brand-new row for this token.
-		token, err = h.V2Store.TokensTable.Insert(txn, accessToken, userID, deviceID, time.Now())
+		// Create a brand-new row for this token, unless we're checking an expired one again.
+		token, err = h.V2Store.TokensTable.Insert(txn, accessToken, userID, deviceID, now)
 		if err != nil {
 			log.Warn().Err(err).Str("user", userID).Str("device", deviceID).Msg("failed to insert v2 token")
 			return err
 		}
+		err = h.V2Store.TokensTable.SetExpiry(txn, token, h.auth.expiresAt(identity, now))
+		if err != nil {
+			log.Warn().Err(err).Str("user", userID).Str("device", deviceID).Msg("failed to set v2 token expiry")
+			return err
+		}
 
 		// Ensure we have a device row for this token.
 		err = h.V2Store.DevicesTable.InsertDevice(txn, userID, deviceID)
@@ -497,6 +713,14 @@ func (h *SyncLiveHandler) identifyUnknownAccessToken(ctx context.Context, access
 	return token, nil
 }
 
+// expireToken cleans up a stored access token which the authenticator no longer accepts, in the
+// same way as a token which the homeserver rejected whilst polling: the token is deleted, the
+// device's poller is stopped if it is using the token, and the device's connections are closed.
+func (h *SyncLiveHandler) expireToken(token *sync2.Token) {
+	pid := sync2.PollerID{UserID: token.UserID, DeviceID: token.DeviceID}
+	h.EnsurePoller.ExpireToken(pid, token.AccessTokenHash)
+}
+
 func (h *SyncLiveHandler) CacheForUser(userID string) *caches.UserCache {
 	c, ok := h.userCaches.Load(userID)
 	if ok {
@@ -524,12 +748,21 @@ func (h *SyncLiveHandler) userCache(userID string) (*caches.UserCache, error) {
 	}
 	uc := caches.NewUserCache(userID, h.GlobalCache, h.Storage, h, h.Dispatcher)
 	// select all non-zero highlight or notif counts and set them, as this is less costly than looping every room/user pair
-	err := h.Storage.UnreadTable.SelectAllNonZeroCountsForUser(userID, func(roomID string, highlightCount, notificationCount int) {
-		uc.OnUnreadCounts(context.Background(), roomID, &highlightCount, &notificationCount)
+	threadCounts, err := h.Storage.UnreadTable.SelectAllThreadCountsForUser(userID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load thread unread counts: %s", err)
+	}
+	err = h.Storage.UnreadTable.SelectAllNonZeroCountsForUser(userID, func(roomID string, highlightCount, notificationCount int) {
+		uc.OnUnreadCounts(context.Background(), roomID, &highlightCount, &notificationCount, threadCounts[roomID])
+		delete(threadCounts, roomID)
 	})
 	if err != nil {
 		return nil, fmt.Errorf("failed to load unread counts: %s", err)
 	}
+	// rooms can have unread threads without any unread notifications in the main timeline
+	for roomID, counts := range threadCounts {
+		uc.OnUnreadCounts(context.Background(), roomID, nil, nil, counts)
+	}
 	// select the DM account data event and set DM room status
 	directEvent, err := h.Storage.AccountData(userID, sync2.AccountDataGlobalRoom, []string{"m.direct"})
 	if err != nil {
@@ -557,6 +790,18 @@ func (h *SyncLiveHandler) userCache(userID string) (*caches.UserCache, error) {
 		uc.OnAccountData(context.Background(), tagEvents)
 	}
 
+	// select all rooms marked as unread and set them. Load the unstable prefix first so the
+	// stable event type wins if a client has written both.
+	for _, markedUnreadType := range []string{"com.famedly.marked_unread", "m.marked_unread"} {
+		markedUnreadEvents, err := h.Storage.RoomAccountDatasWithType(userID, markedUnreadType)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load marked unread rooms: %s", err)
+		}
+		if len(markedUnreadEvents) > 0 {
+			uc.OnAccountData(context.Background(), markedUnreadEvents)
+		}
+	}
+
 	// select outstanding invites
 	invites, err := h.Storage.InvitesTable.SelectAllInvitesForUser(userID)
 	if err != nil {
@@ -566,6 +811,15 @@ func (h *SyncLiveHandler) userCache(userID string) (*caches.UserCache, error) {
 		uc.OnInvite(context.Background(), roomID, inviteState)
 	}
 
+	// select outstanding knocks
+	knocks, err := h.Storage.KnocksTable.SelectAllKnocksForUser(userID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load outstanding knocks for user: %s", err)
+	}
+	for roomID, knockState := range knocks {
+		uc.OnKnock(context.Background(), roomID, knockState)
+	}
+
 	// use LoadOrStore here else we can race as 2 brand new /sync conns can both get to this point
 	// at the same time
 	actualUC, loaded := h.userCaches.LoadOrStore(userID, uc)
@@ -693,7 +947,7 @@ func (h *SyncLiveHandler) OnUnreadCounts(p *pubsub.V2UnreadCounts) {
 	if !ok {
 		return
 	}
-	userCache.(*caches.UserCache).OnUnreadCounts(ctx, p.RoomID, p.HighlightCount, p.NotificationCount)
+	userCache.(*caches.UserCache).OnUnreadCounts(ctx, p.RoomID, p.HighlightCount, p.NotificationCount, p.ThreadUnreadCounts)
 }
 
 // push device data updates on waiting conns (otk counts, device list changes)
@@ -737,6 +991,22 @@ func (h *SyncLiveHandler) OnInvite(p *pubsub.V2InviteRoom) {
 	userCache.(*caches.UserCache).OnInvite(ctx, p.RoomID, inviteState)
 }
 
+func (h *SyncLiveHandler) OnKnock(p *pubsub.V2KnockRoom) {
+	ctx, task := internal.StartTask(context.Background(), "OnKnock")
+	defer task.End()
+	userCache, ok := h.userCaches.Load(p.UserID)
+	if !ok {
+		return
+	}
+	knockState, err := h.Storage.KnocksTable.SelectKnockState(p.UserID, p.RoomID)
+	if err != nil {
+		log.Err(err).Str("user", p.UserID).Str("room", p.RoomID).Msg("failed to get knock state")
+		internal.GetSentryHubFromContextOrDefault(ctx).CaptureException(err)
+		return
+	}
+	userCache.(*caches.UserCache).OnKnock(ctx, p.RoomID, knockState)
+}
+
 func (h *SyncLiveHandler) OnLeftRoom(p *pubsub.V2LeaveRoom) {
 	ctx, task := internal.StartTask(context.Background(), "OnLeftRoom")
 	defer task.End()
@@ -791,6 +1061,12 @@ func (h *SyncLiveHandler) OnTyping(p *pubsub.V2Typing) {
 	h.Dispatcher.OnEphemeralEvent(ctx, p.RoomID, p.EphemeralEvent)
 }
 
+func (h *SyncLiveHandler) OnPresence(p *pubsub.V2Presence) {
+	ctx, task := internal.StartTask(context.Background(), "OnPresence")
+	defer task.End()
+	h.Dispatcher.OnPresence(ctx, p.Presence)
+}
+
 func (h *SyncLiveHandler) OnAccountData(p *pubsub.V2AccountData) {
 	ctx, task := internal.StartTask(context.Background(), "OnAccountData")
 	defer task.End()
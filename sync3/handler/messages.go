@@ -0,0 +1,133 @@
+package handler
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/matrix-org/sliding-sync/internal"
+	"github.com/matrix-org/sliding-sync/sync2"
+	"github.com/rs/zerolog/hlog"
+)
+
+// Room history backfill. Clients page back through a room using the prev_batch token from a
+// sliding sync response. Rather than sending every page to the homeserver, the proxy serves the
+// events it already has in its event store and only asks the homeserver for the events before a
+// gap in the proxy's timeline. The response has the same shape as a backwards /messages request.
+//
+// Pagination tokens minted by the proxy point at an event NID. Any other token is a homeserver
+// token, which we either map back onto the proxy's timeline or pass through to the homeserver.
+
+const (
+	defaultMessagesLimit = 10
+	maxMessagesLimit     = 100
+	// prefixes tokens minted by the proxy, so they can be told apart from homeserver tokens
+	proxyMessagesTokenPrefix = "ss_"
+)
+
+func (h *SyncLiveHandler) serveMessages(w http.ResponseWriter, req *http.Request, roomID string) error {
+	req, token, herr := h.authenticate(req)
+	if herr != nil {
+		return herr
+	}
+	query := req.URL.Query()
+	if dir := query.Get("dir"); dir != "" && dir != "b" {
+		return &internal.HandlerError{
+			StatusCode: 400,
+			Err:        fmt.Errorf("only dir=b is supported"),
+			ErrCode:    "M_INVALID_PARAM",
+		}
+	}
+	limit64, herr := parseIntFromQuery(req.URL, "limit")
+	if herr != nil {
+		return herr
+	}
+	limit := int(limit64)
+	if limit <= 0 {
+		limit = defaultMessagesLimit
+	} else if limit > maxMessagesLimit {
+		limit = maxMessagesLimit
+	}
+
+	from := query.Get("from")
+	var beforeNID int64
+	var err error
+	if strings.HasPrefix(from, proxyMessagesTokenPrefix) {
+		beforeNID, err = strconv.ParseInt(strings.TrimPrefix(from, proxyMessagesTokenPrefix), 10, 64)
+		if err != nil || beforeNID <= 0 {
+			return &internal.HandlerError{
+				StatusCode: 400,
+				Err:        fmt.Errorf("invalid from: %s", from),
+				ErrCode:    "M_INVALID_PARAM",
+			}
+		}
+	} else if from != "" {
+		beforeNID, err = h.Storage.PrevBatchPosition(roomID, from)
+		if err != nil {
+			return fmt.Errorf("failed to look up prev_batch position: %w", err)
+		}
+		if beforeNID == 0 {
+			// the proxy doesn't have the events before this token
+			return h.proxyMessages(w, req, token, roomID, from, limit)
+		}
+	} else {
+		latestNID, err := h.Storage.LatestEventNID()
+		if err != nil {
+			return fmt.Errorf("failed to load latest event NID: %w", err)
+		}
+		beforeNID = latestNID + 1
+		from = proxyMessagesToken(beforeNID)
+	}
+
+	page, err := h.Storage.Backfill(token.UserID, roomID, beforeNID, limit)
+	if err != nil {
+		return fmt.Errorf("failed to backfill: %w", err)
+	}
+	if len(page.Events) == 0 {
+		if page.PrevBatch == "" {
+			// we have nothing to give the homeserver to carry on from, so this is the end of the room
+			return writeMessagesResponse(w, &sync2.MessagesResponse{Chunk: []json.RawMessage{}, Start: from})
+		}
+		return h.proxyMessages(w, req, token, roomID, page.PrevBatch, limit)
+	}
+	res := &sync2.MessagesResponse{
+		Chunk: page.Events,
+		Start: from,
+		End:   page.PrevBatch,
+	}
+	if page.Complete {
+		res.End = proxyMessagesToken(page.EarliestNID)
+	}
+	hlog.FromRequest(req).Trace().Str("room", roomID).Int("events", len(res.Chunk)).Msg("served messages from the proxy")
+	return writeMessagesResponse(w, res)
+}
+
+// proxyMessages serves the request from the homeserver, starting at this homeserver token.
+func (h *SyncLiveHandler) proxyMessages(w http.ResponseWriter, req *http.Request, token *sync2.Token, roomID, from string, limit int) error {
+	res, statusCode, err := h.Upstreams.ForUser(token.UserID).Messages(req.Context(), token.AccessToken, roomID, from, limit)
+	if err != nil {
+		if statusCode == 0 {
+			statusCode = http.StatusBadGateway
+		}
+		return &internal.HandlerError{
+			StatusCode: statusCode,
+			Err:        err,
+		}
+	}
+	if res.Chunk == nil {
+		res.Chunk = []json.RawMessage{}
+	}
+	return writeMessagesResponse(w, res)
+}
+
+func writeMessagesResponse(w http.ResponseWriter, res *sync2.MessagesResponse) error {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(200)
+	return json.NewEncoder(w).Encode(res)
+}
+
+func proxyMessagesToken(beforeNID int64) string {
+	return proxyMessagesTokenPrefix + strconv.FormatInt(beforeNID, 10)
+}
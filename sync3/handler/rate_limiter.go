@@ -0,0 +1,238 @@
+package handler
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/matrix-org/sliding-sync/internal"
+	"github.com/matrix-org/sliding-sync/sync3"
+)
+
+// Rate limiting stops a single misbehaving client from hammering the proxy and the database by
+// looping on the sync endpoint. Each request takes a token from a bucket for the user, the device
+// and the connection it is for. Initial syncs (no ?pos=) are far more expensive than incremental
+// ones, so they take from a separate set of buckets. If any bucket is empty the request is
+// rejected with M_LIMIT_EXCEEDED and told how long to wait, and no tokens are taken.
+
+// RateLimit is a token bucket: requests are allowed at PerSecond on average, in bursts of up to
+// Burst requests. The zero value means no limit.
+type RateLimit struct {
+	PerSecond float64
+	Burst     int
+}
+
+func (l RateLimit) enabled() bool {
+	return l.PerSecond > 0 && l.Burst > 0
+}
+
+// RateLimits configures rate limiting on the sync endpoint.
+type RateLimits struct {
+	// budgets for requests with a ?pos=
+	User   RateLimit
+	Device RateLimit
+	Conn   RateLimit
+	// budgets for initial syncs
+	InitialUser   RateLimit
+	InitialDevice RateLimit
+	InitialConn   RateLimit
+}
+
+// rateLimitScopes are the names used for each limit in ParseRateLimits and in metrics.
+var rateLimitScopes = []string{"user", "device", "conn", "initial_user", "initial_device", "initial_conn"}
+
+func (r *RateLimits) limit(scope string) *RateLimit {
+	switch scope {
+	case "user":
+		return &r.User
+	case "device":
+		return &r.Device
+	case "conn":
+		return &r.Conn
+	case "initial_user":
+		return &r.InitialUser
+	case "initial_device":
+		return &r.InitialDevice
+	case "initial_conn":
+		return &r.InitialConn
+	}
+	return nil
+}
+
+// ParseRateLimits parses a comma separated list of scope=rate/burst e.g. "user=10/20,initial_device=0.1/3",
+// where rate is the number of requests per second. Scopes which are not listed are not limited.
+func ParseRateLimits(s string) (RateLimits, error) {
+	var limits RateLimits
+	for _, item := range strings.Split(s, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		scope, value, ok := strings.Cut(item, "=")
+		if !ok {
+			return limits, fmt.Errorf("rate limit %q: missing '='", item)
+		}
+		limit := limits.limit(strings.TrimSpace(scope))
+		if limit == nil {
+			return limits, fmt.Errorf("rate limit %q: unknown scope, must be one of %s", item, strings.Join(rateLimitScopes, ", "))
+		}
+		rate, burst, ok := strings.Cut(value, "/")
+		if !ok {
+			return limits, fmt.Errorf("rate limit %q: value must be rate/burst", item)
+		}
+		perSecond, err := strconv.ParseFloat(strings.TrimSpace(rate), 64)
+		if err != nil || perSecond <= 0 {
+			return limits, fmt.Errorf("rate limit %q: rate must be a positive number", item)
+		}
+		burstSize, err := strconv.Atoi(strings.TrimSpace(burst))
+		if err != nil || burstSize <= 0 {
+			return limits, fmt.Errorf("rate limit %q: burst must be a positive integer", item)
+		}
+		*limit = RateLimit{PerSecond: perSecond, Burst: burstSize}
+	}
+	return limits, nil
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// refill tops up the bucket for the time elapsed since it was last used.
+func (b *tokenBucket) refill(limit RateLimit, now time.Time) {
+	b.tokens = math.Min(float64(limit.Burst), b.tokens+now.Sub(b.last).Seconds()*limit.PerSecond)
+	b.last = now
+}
+
+// buckets which have been unused for this long are full again, so can be forgotten
+const rateLimiterSweepInterval = 5 * time.Minute
+
+type rateLimiter struct {
+	limits RateLimits
+	mu     sync.Mutex
+	// scope => key => bucket
+	buckets   map[string]map[string]*tokenBucket
+	lastSweep time.Time
+	// for tests
+	now func() time.Time
+}
+
+func newRateLimiter(limits RateLimits) *rateLimiter {
+	return &rateLimiter{
+		limits:    limits,
+		buckets:   make(map[string]map[string]*tokenBucket),
+		lastSweep: time.Now(),
+		now:       time.Now,
+	}
+}
+
+// allow takes a token from every bucket this request falls into. If any of them is empty, no
+// tokens are taken and it returns the scope which was exhausted and how long until it has a token.
+func (r *rateLimiter) allow(connID sync3.ConnID, initial bool) (scope string, retryAfter time.Duration) {
+	type check struct {
+		scope string
+		key   string
+		limit RateLimit
+	}
+	userKey := connID.UserID
+	deviceKey := connID.UserID + "|" + connID.DeviceID
+	connKey := connID.String()
+	checks := []check{
+		{"user", userKey, r.limits.User},
+		{"device", deviceKey, r.limits.Device},
+		{"conn", connKey, r.limits.Conn},
+	}
+	if initial {
+		checks = []check{
+			{"initial_user", userKey, r.limits.InitialUser},
+			{"initial_device", deviceKey, r.limits.InitialDevice},
+			{"initial_conn", connKey, r.limits.InitialConn},
+		}
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	now := r.now()
+	r.maybeSweep(now)
+	buckets := make([]*tokenBucket, 0, len(checks))
+	for _, c := range checks {
+		if !c.limit.enabled() {
+			continue
+		}
+		scopeBuckets := r.buckets[c.scope]
+		if scopeBuckets == nil {
+			scopeBuckets = make(map[string]*tokenBucket)
+			r.buckets[c.scope] = scopeBuckets
+		}
+		b := scopeBuckets[c.key]
+		if b == nil {
+			b = &tokenBucket{tokens: float64(c.limit.Burst), last: now}
+			scopeBuckets[c.key] = b
+		}
+		b.refill(c.limit, now)
+		if b.tokens < 1 {
+			wait := time.Duration((1 - b.tokens) / c.limit.PerSecond * float64(time.Second))
+			if wait > retryAfter {
+				scope = c.scope
+				retryAfter = wait
+			}
+		}
+		buckets = append(buckets, b)
+	}
+	if scope != "" {
+		return scope, retryAfter
+	}
+	for _, b := range buckets {
+		b.tokens--
+	}
+	return "", 0
+}
+
+// maybeSweep forgets buckets which have refilled completely, so the maps don't grow forever.
+func (r *rateLimiter) maybeSweep(now time.Time) {
+	if now.Sub(r.lastSweep) < rateLimiterSweepInterval {
+		return
+	}
+	r.lastSweep = now
+	for scope, scopeBuckets := range r.buckets {
+		limit := *r.limits.limit(scope)
+		for key, b := range scopeBuckets {
+			b.refill(limit, now)
+			if b.tokens >= float64(limit.Burst) {
+				delete(scopeBuckets, key)
+			}
+		}
+	}
+}
+
+// EnableRateLimiting limits how often clients can hit the sync endpoint.
+func (h *SyncLiveHandler) EnableRateLimiting(limits RateLimits) {
+	h.rateLimiter = newRateLimiter(limits)
+}
+
+func (h *SyncLiveHandler) checkRateLimit(connID sync3.ConnID, initial bool) *internal.HandlerError {
+	if h.rateLimiter == nil {
+		return nil
+	}
+	scope, retryAfter := h.rateLimiter.allow(connID, initial)
+	if scope == "" {
+		return nil
+	}
+	if h.throttledReqs != nil {
+		h.throttledReqs.WithLabelValues(scope).Inc()
+	}
+	retryAfterMS := retryAfter.Milliseconds()
+	if retryAfterMS == 0 {
+		retryAfterMS = 1
+	}
+	return &internal.HandlerError{
+		StatusCode:   http.StatusTooManyRequests,
+		Err:          fmt.Errorf("too many requests: %s rate limit exceeded", scope),
+		ErrCode:      "M_LIMIT_EXCEEDED",
+		RetryAfterMS: retryAfterMS,
+	}
+}
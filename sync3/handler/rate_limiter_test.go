@@ -0,0 +1,72 @@
+package handler
+
+import (
+	"testing"
+	"time"
+
+	"github.com/matrix-org/sliding-sync/sync3"
+)
+
+func TestParseRateLimits(t *testing.T) {
+	limits, err := ParseRateLimits("user=10/20, initial_device=0.5/3")
+	if err != nil {
+		t.Fatalf("ParseRateLimits returned error: %s", err)
+	}
+	want := RateLimits{
+		User:          RateLimit{PerSecond: 10, Burst: 20},
+		InitialDevice: RateLimit{PerSecond: 0.5, Burst: 3},
+	}
+	if limits != want {
+		t.Fatalf("ParseRateLimits: got %+v want %+v", limits, want)
+	}
+	for _, invalid := range []string{"user", "nope=1/1", "user=1", "user=0/1", "user=1/0", "user=x/1"} {
+		if _, err := ParseRateLimits(invalid); err == nil {
+			t.Errorf("ParseRateLimits(%q): expected an error", invalid)
+		}
+	}
+}
+
+func TestRateLimiter(t *testing.T) {
+	now := time.Now()
+	rl := newRateLimiter(RateLimits{
+		Device:      RateLimit{PerSecond: 1, Burst: 2},
+		Conn:        RateLimit{PerSecond: 1, Burst: 3},
+		InitialUser: RateLimit{PerSecond: 0.1, Burst: 1},
+	})
+	rl.now = func() time.Time { return now }
+	phone := sync3.ConnID{UserID: "@alice:localhost", DeviceID: "phone", CID: "room-list"}
+	laptop := sync3.ConnID{UserID: "@alice:localhost", DeviceID: "laptop", CID: "room-list"}
+
+	assertAllowed := func(connID sync3.ConnID, initial bool, wantScope string, wantRetryAfter time.Duration) {
+		t.Helper()
+		scope, retryAfter := rl.allow(connID, initial)
+		if scope != wantScope || retryAfter != wantRetryAfter {
+			t.Fatalf("allow(%v, %v): got (%q, %v) want (%q, %v)", connID, initial, scope, retryAfter, wantScope, wantRetryAfter)
+		}
+	}
+
+	// the device bucket is smaller than the conn bucket, so runs out first
+	assertAllowed(phone, false, "", 0)
+	assertAllowed(phone, false, "", 0)
+	assertAllowed(phone, false, "device", time.Second)
+	// other devices have their own budget
+	assertAllowed(laptop, false, "", 0)
+
+	// initial syncs have a separate budget, shared by all of the user's devices
+	assertAllowed(phone, true, "", 0)
+	assertAllowed(laptop, true, "initial_user", 10*time.Second)
+
+	// rejected requests don't take tokens, so after half a second the device bucket is still
+	// half a token short
+	now = now.Add(500 * time.Millisecond)
+	assertAllowed(phone, false, "device", 500*time.Millisecond)
+	now = now.Add(500 * time.Millisecond)
+	assertAllowed(phone, false, "", 0)
+
+	// buckets are forgotten once they have refilled
+	now = now.Add(rateLimiterSweepInterval)
+	assertAllowed(laptop, false, "", 0)
+	if len(rl.buckets["device"]) != 1 {
+		t.Fatalf("expected full buckets to be swept, got %d device buckets", len(rl.buckets["device"]))
+	}
+}
@@ -0,0 +1,349 @@
+package handler
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sync"
+	"time"
+
+	"github.com/getsentry/sentry-go"
+	"github.com/matrix-org/sliding-sync/internal"
+	"github.com/matrix-org/sliding-sync/state"
+	"github.com/matrix-org/sliding-sync/sync3"
+	"github.com/matrix-org/sliding-sync/sync3/caches"
+	"github.com/rs/zerolog/log"
+	"github.com/tidwall/gjson"
+)
+
+// Connection recordings. When recording is enabled, everything a connection processes is written
+// to its own file, one JSON object per line, in the order the conn goroutine processed it: the
+// room list loaded for the connection, then every request, every live update consumed whilst
+// handling that request, and the response. This is everything ConnState needs to rebuild its
+// lists, so Replay can feed a recording back into a ConnState without a database and check that
+// it produces the same list operations.
+
+const (
+	recordKindConn     = "conn"
+	recordKindLoad     = "load"
+	recordKindRequest  = "request"
+	recordKindUpdate   = "update"
+	recordKindTimeline = "timeline"
+	recordKindResponse = "response"
+)
+
+// recordEntry is a single line in a recording.
+type recordEntry struct {
+	Kind string `json:"kind"`
+	// unix millis
+	Timestamp int64 `json:"ts"`
+
+	// kind=conn
+	Conn *sync3.ConnID `json:"conn,omitempty"`
+	// kind=load
+	Load *recordedLoad `json:"load,omitempty"`
+	// kind=request
+	Request      *sync3.Request `json:"request,omitempty"`
+	TimeoutMSecs int            `json:"timeout_ms,omitempty"`
+	IsInitial    bool           `json:"initial,omitempty"`
+	// kind=update
+	Update *recordedUpdate `json:"update,omitempty"`
+	// kind=timeline: room ID -> the latest NID of the timeline loaded for this room
+	LoadPositions map[string]int64 `json:"load_positions,omitempty"`
+	// kind=response
+	Response *sync3.Response `json:"response,omitempty"`
+}
+
+// recordedLoad is the result of ConnState.load
+type recordedLoad struct {
+	AnchorLoadPosition int64                    `json:"anchor_load_position"`
+	LoadPositions      map[string]int64         `json:"load_positions"`
+	Rooms              []sync3.RoomConnMetadata `json:"rooms"`
+}
+
+// recordedUpdate is a caches.Update which can be written to a recording.
+type recordedUpdate struct {
+	Type string `json:"type"`
+	// for room updates
+	RoomID         string                 `json:"room_id,omitempty"`
+	GlobalRoomData *internal.RoomMetadata `json:"global_room_data,omitempty"`
+	UserRoomData   *caches.UserRoomData   `json:"user_room_data,omitempty"`
+	// type specific fields
+	EventData         *caches.EventData   `json:"event_data,omitempty"`
+	HasCountDecreased bool                `json:"has_count_decreased,omitempty"`
+	Receipt           *internal.Receipt   `json:"receipt,omitempty"`
+	AccountData       []state.AccountData `json:"account_data,omitempty"`
+	Presence          *internal.Presence  `json:"presence,omitempty"`
+	SharedRoomIDs     []string            `json:"shared_room_ids,omitempty"`
+	Space             *caches.SpaceUpdate `json:"space,omitempty"`
+}
+
+func newRecordedUpdate(up caches.Update) *recordedUpdate {
+	var ru recordedUpdate
+	if roomUpdate, ok := up.(caches.RoomUpdate); ok {
+		ru.RoomID = roomUpdate.RoomID()
+		ru.GlobalRoomData = roomUpdate.GlobalRoomMetadata()
+		ru.UserRoomData = roomUpdate.UserRoomMetadata()
+	}
+	switch update := up.(type) {
+	case *caches.RoomEventUpdate:
+		ru.Type = "room_event"
+		// Content is a parsed copy of the event's content, so is rebuilt on replay
+		eventData := *update.EventData
+		eventData.Content = gjson.Result{}
+		ru.EventData = &eventData
+	case *caches.InviteUpdate:
+		ru.Type = "invite"
+	case *caches.KnockUpdate:
+		ru.Type = "knock"
+	case *caches.TypingUpdate:
+		ru.Type = "typing"
+	case *caches.ReceiptUpdate:
+		ru.Type = "receipt"
+		ru.Receipt = &update.Receipt
+	case *caches.UnreadCountUpdate:
+		ru.Type = "unread_count"
+		ru.HasCountDecreased = update.HasCountDecreased
+	case *caches.RoomAccountDataUpdate:
+		ru.Type = "room_account_data"
+		ru.AccountData = update.AccountData
+	case *caches.AccountDataUpdate:
+		ru.Type = "account_data"
+		ru.AccountData = update.AccountData
+	case *caches.PresenceUpdate:
+		ru.Type = "presence"
+		ru.Presence = &update.Presence
+		ru.SharedRoomIDs = update.SharedRoomIDs
+	case *caches.SpaceUpdate:
+		ru.Type = "space"
+		ru.Space = update
+	case caches.DeviceDataUpdate:
+		ru.Type = "device_data"
+	case caches.DeviceEventsUpdate:
+		ru.Type = "device_events"
+	default:
+		ru.Type = up.Type()
+	}
+	return &ru
+}
+
+// update converts the recorded update back into a caches.Update. Invites and knocks don't include
+// their invite_state.
+func (ru *recordedUpdate) update() (caches.Update, error) {
+	roomUpdate := &recordedRoomUpdate{
+		roomID:         ru.RoomID,
+		globalRoomData: ru.GlobalRoomData,
+		userRoomData:   ru.UserRoomData,
+	}
+	if roomUpdate.globalRoomData == nil {
+		roomUpdate.globalRoomData = internal.NewRoomMetadata(ru.RoomID)
+	}
+	if roomUpdate.userRoomData == nil {
+		urd := caches.NewUserRoomData()
+		roomUpdate.userRoomData = &urd
+	}
+	switch ru.Type {
+	case "room_event":
+		if ru.EventData == nil {
+			return nil, fmt.Errorf("room_event update is missing event_data")
+		}
+		eventData := *ru.EventData
+		eventData.Content = gjson.GetBytes(eventData.Event, "content")
+		return &caches.RoomEventUpdate{RoomUpdate: roomUpdate, EventData: &eventData}, nil
+	case "invite":
+		return &caches.InviteUpdate{RoomUpdate: roomUpdate}, nil
+	case "knock":
+		return &caches.KnockUpdate{RoomUpdate: roomUpdate}, nil
+	case "typing":
+		return &caches.TypingUpdate{RoomUpdate: roomUpdate}, nil
+	case "receipt":
+		update := &caches.ReceiptUpdate{RoomUpdate: roomUpdate}
+		if ru.Receipt != nil {
+			update.Receipt = *ru.Receipt
+		}
+		return update, nil
+	case "unread_count":
+		return &caches.UnreadCountUpdate{RoomUpdate: roomUpdate, HasCountDecreased: ru.HasCountDecreased}, nil
+	case "room_account_data":
+		return &caches.RoomAccountDataUpdate{RoomUpdate: roomUpdate, AccountData: ru.AccountData}, nil
+	case "account_data":
+		return &caches.AccountDataUpdate{AccountData: ru.AccountData}, nil
+	case "presence":
+		update := &caches.PresenceUpdate{SharedRoomIDs: ru.SharedRoomIDs}
+		if ru.Presence != nil {
+			update.Presence = *ru.Presence
+		}
+		return update, nil
+	case "space":
+		if ru.Space == nil {
+			return nil, fmt.Errorf("space update is missing space")
+		}
+		update := *ru.Space
+		return &update, nil
+	case "device_data":
+		return caches.DeviceDataUpdate{}, nil
+	case "device_events":
+		return caches.DeviceEventsUpdate{}, nil
+	}
+	return nil, fmt.Errorf("unknown update type %q", ru.Type)
+}
+
+// recordedRoomUpdate implements caches.RoomUpdate for replayed updates.
+type recordedRoomUpdate struct {
+	roomID         string
+	globalRoomData *internal.RoomMetadata
+	userRoomData   *caches.UserRoomData
+}
+
+func (u *recordedRoomUpdate) Type() string {
+	return "recordedRoomUpdate"
+}
+func (u *recordedRoomUpdate) RoomID() string {
+	return u.roomID
+}
+func (u *recordedRoomUpdate) GlobalRoomMetadata() *internal.RoomMetadata {
+	return u.globalRoomData
+}
+func (u *recordedRoomUpdate) UserRoomMetadata() *caches.UserRoomData {
+	return u.userRoomData
+}
+
+// EnableRecording records new connections to files in dir, for Replay. If userIDs is empty, every
+// user's connections are recorded.
+func (h *SyncLiveHandler) EnableRecording(dir string, userIDs []string) error {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return fmt.Errorf("failed to create recording directory: %w", err)
+	}
+	h.recordDir = dir
+	if len(userIDs) > 0 {
+		h.recordUsers = make(map[string]bool, len(userIDs))
+		for _, userID := range userIDs {
+			h.recordUsers[userID] = true
+		}
+	}
+	return nil
+}
+
+// newRecorder returns a recorder for this connection, or nil if it shouldn't be recorded.
+func (h *SyncLiveHandler) newRecorder(connID sync3.ConnID) *connRecorder {
+	if h.recordDir == "" || (h.recordUsers != nil && !h.recordUsers[connID.UserID]) {
+		return nil
+	}
+	recorder, err := newConnFileRecorder(h.recordDir, connID)
+	if err != nil {
+		log.Err(err).Str("conn", connID.String()).Msg("failed to create connection recording")
+		return nil
+	}
+	log.Info().Str("conn", connID.String()).Msg("recording connection")
+	return recorder
+}
+
+// connRecorder writes a recording for a single connection. Methods are safe to call on a nil
+// connRecorder, and do nothing.
+type connRecorder struct {
+	mu sync.Mutex
+	w  io.WriteCloser
+	// set when writing fails, after which nothing more is recorded
+	failed bool
+}
+
+var unsafeFilenameChars = regexp.MustCompile(`[^A-Za-z0-9._-]`)
+
+// newConnFileRecorder creates a recording file for this connection in dir.
+func newConnFileRecorder(dir string, cid sync3.ConnID) (*connRecorder, error) {
+	name := fmt.Sprintf("%s_%s_%s_%d.jsonl", cid.UserID, cid.DeviceID, cid.CID, time.Now().UnixMilli())
+	f, err := os.OpenFile(filepath.Join(dir, unsafeFilenameChars.ReplaceAllString(name, "_")), os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return newConnRecorder(f, cid), nil
+}
+
+func newConnRecorder(w io.WriteCloser, cid sync3.ConnID) *connRecorder {
+	r := &connRecorder{w: w}
+	r.write(recordEntry{Kind: recordKindConn, Conn: &cid})
+	return r
+}
+
+func (r *connRecorder) write(entry recordEntry) {
+	if r == nil {
+		return
+	}
+	entry.Timestamp = time.Now().UnixMilli()
+	data, err := json.Marshal(entry)
+	if err == nil {
+		data = append(data, '\n')
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.failed || r.w == nil {
+		return
+	}
+	if err == nil {
+		_, err = r.w.Write(data)
+	}
+	if err != nil {
+		// don't keep trying, else the recording will have holes in it which make it unreplayable
+		r.failed = true
+		log.Err(err).Str("kind", entry.Kind).Msg("failed to record connection, giving up recording it")
+		sentry.CaptureException(err)
+	}
+}
+
+func (r *connRecorder) recordLoad(anchorLoadPosition int64, loadPositions map[string]int64, rooms []sync3.RoomConnMetadata) {
+	if r == nil {
+		return
+	}
+	r.write(recordEntry{Kind: recordKindLoad, Load: &recordedLoad{
+		AnchorLoadPosition: anchorLoadPosition,
+		LoadPositions:      loadPositions,
+		Rooms:              rooms,
+	}})
+}
+
+func (r *connRecorder) recordRequest(req *sync3.Request, isInitial bool) {
+	if r == nil {
+		return
+	}
+	r.write(recordEntry{Kind: recordKindRequest, Request: req, TimeoutMSecs: req.TimeoutMSecs(), IsInitial: isInitial})
+}
+
+func (r *connRecorder) recordUpdate(up caches.Update) {
+	if r == nil {
+		return
+	}
+	r.write(recordEntry{Kind: recordKindUpdate, Update: newRecordedUpdate(up)})
+}
+
+func (r *connRecorder) recordTimelines(timelines map[string]state.LatestEvents) {
+	if r == nil || len(timelines) == 0 {
+		return
+	}
+	loadPositions := make(map[string]int64, len(timelines))
+	for roomID, latestEvents := range timelines {
+		loadPositions[roomID] = latestEvents.LatestNID
+	}
+	r.write(recordEntry{Kind: recordKindTimeline, LoadPositions: loadPositions})
+}
+
+func (r *connRecorder) recordResponse(res *sync3.Response) {
+	if r == nil || res == nil {
+		return
+	}
+	r.write(recordEntry{Kind: recordKindResponse, Response: res})
+}
+
+func (r *connRecorder) close() {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.w != nil {
+		r.w.Close()
+		r.w = nil
+	}
+}
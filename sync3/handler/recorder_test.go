@@ -0,0 +1,121 @@
+package handler
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/gomatrixserverlib/spec"
+	"github.com/matrix-org/sliding-sync/internal"
+	"github.com/matrix-org/sliding-sync/sync3"
+	"github.com/matrix-org/sliding-sync/sync3/caches"
+	"github.com/matrix-org/sliding-sync/testutils"
+)
+
+type nopCloser struct {
+	io.Writer
+}
+
+func (nopCloser) Close() error { return nil }
+
+// Test that a recorded connection replays to the same responses, and that the replay notices
+// when it doesn't.
+func TestRecordAndReplay(t *testing.T) {
+	connID := sync3.ConnID{UserID: "@TestRecordAndReplay_alice:localhost", DeviceID: "d", CID: "room-list"}
+	userID := connID.UserID
+	timestampNow := spec.Timestamp(1632131678061).Time()
+	roomA := newRoomMetadata("!a:localhost", spec.AsTimestamp(timestampNow.Add(-8*time.Second)))
+	roomB := newRoomMetadata("!b:localhost", spec.AsTimestamp(timestampNow))
+	roomC := newRoomMetadata("!c:localhost", spec.AsTimestamp(timestampNow.Add(-4*time.Second)))
+	globalCache := caches.NewGlobalCache(nil)
+	globalCache.Startup(map[string]internal.RoomMetadata{
+		roomA.RoomID: roomA,
+		roomB.RoomID: roomB,
+		roomC.RoomID: roomC,
+	})
+	dispatcher := sync3.NewDispatcher()
+	dispatcher.Startup(map[string][]string{
+		roomA.RoomID: {userID},
+		roomB.RoomID: {userID},
+		roomC.RoomID: {userID},
+	})
+	globalCache.LoadJoinedRoomsOverride = func(userID string) (pos int64, joinedRooms map[string]*internal.RoomMetadata, joinTimings map[string]internal.EventMetadata, loadPositions map[string]int64, err error) {
+		return 1, map[string]*internal.RoomMetadata{
+			roomA.RoomID: &roomA,
+			roomB.RoomID: &roomB,
+			roomC.RoomID: &roomC,
+		}, map[string]internal.EventMetadata{
+			roomA.RoomID: {NID: 123, Timestamp: 123},
+			roomB.RoomID: {NID: 456, Timestamp: 456},
+			roomC.RoomID: {NID: 780, Timestamp: 789},
+		}, nil, nil
+	}
+	userCache := caches.NewUserCache(userID, globalCache, &NopUserCacheStore{}, &NopTransactionFetcher{}, &joinChecker{})
+	dispatcher.Register(context.Background(), userCache.UserID, userCache)
+	dispatcher.Register(context.Background(), sync3.DispatcherAllUsers, globalCache)
+	userCache.LazyLoadTimelinesOverride = mockLazyRoomOverride
+	cs := NewConnState(userID, connID.DeviceID, userCache, globalCache, &NopExtensionHandler{}, &NopJoinTracker{}, nil, nil, 1000, 0)
+	var recording bytes.Buffer
+	cs.recorder = newConnRecorder(nopCloser{&recording}, connID)
+
+	request := func(isInitial bool, ranges sync3.SliceRanges) *sync3.Response {
+		t.Helper()
+		req := &sync3.Request{
+			Lists: map[string]sync3.RequestList{"a": {
+				Sort:   []string{sync3.SortByRecency},
+				Ranges: ranges,
+			}},
+		}
+		req.SetTimeoutMSecs(1)
+		res, err := cs.OnIncomingRequest(context.Background(), connID, req, isInitial, time.Now())
+		if err != nil {
+			t.Fatalf("OnIncomingRequest returned error : %s", err)
+		}
+		return res
+	}
+	request(true, sync3.SliceRanges{{0, 1}})
+	// bump A into the window, which pushes C out
+	dispatcher.OnNewEvent(context.Background(), roomA.RoomID, testutils.NewEvent(t, "unimportant", "me", struct{}{}, testutils.WithTimestamp(timestampNow.Add(1*time.Second))), 1)
+	res := request(false, sync3.SliceRanges{{0, 1}})
+	if res.ListOps() == 0 {
+		t.Fatalf("expected list ops when A moved into the window, got none")
+	}
+	// widen the window, which sends C again
+	request(false, sync3.SliceRanges{{0, 2}})
+	cs.Destroy()
+
+	result, err := Replay(context.Background(), bytes.NewReader(recording.Bytes()))
+	if err != nil {
+		t.Fatalf("Replay returned error: %s", err)
+	}
+	if result.Conn != connID {
+		t.Errorf("Replay: got conn %v want %v", result.Conn, connID)
+	}
+	if len(result.Responses) != 3 {
+		t.Fatalf("Replay: got %d responses want 3", len(result.Responses))
+	}
+	if len(result.Mismatches) > 0 {
+		t.Fatalf("Replay: got mismatches %+v", result.Mismatches)
+	}
+
+	// without the event which bumped A, the responses diverge from the second one onwards
+	var tampered bytes.Buffer
+	for _, line := range strings.SplitAfter(recording.String(), "\n") {
+		var entry recordEntry
+		if line != "" && json.Unmarshal([]byte(line), &entry) == nil && entry.Kind == recordKindUpdate {
+			continue
+		}
+		tampered.WriteString(line)
+	}
+	result, err = Replay(context.Background(), &tampered)
+	if err != nil {
+		t.Fatalf("Replay returned error: %s", err)
+	}
+	if len(result.Mismatches) == 0 || result.Mismatches[0].Response != 1 {
+		t.Fatalf("Replay: got mismatches %+v, want the first for response 1", result.Mismatches)
+	}
+}
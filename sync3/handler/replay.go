@@ -0,0 +1,239 @@
+package handler
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+	"sort"
+	"time"
+
+	"github.com/matrix-org/sliding-sync/internal"
+	"github.com/matrix-org/sliding-sync/state"
+	"github.com/matrix-org/sliding-sync/sync3"
+	"github.com/matrix-org/sliding-sync/sync3/caches"
+	"github.com/matrix-org/sliding-sync/sync3/extensions"
+)
+
+// ReplayMismatch is a response which came out differently when a recording was replayed.
+type ReplayMismatch struct {
+	// which response in the recording this is, starting from 0
+	Response int
+	Diffs    []string
+}
+
+// ReplayResult is the outcome of Replay.
+type ReplayResult struct {
+	Conn sync3.ConnID
+	// the responses the replayed ConnState produced, in order
+	Responses  []*sync3.Response
+	Mismatches []ReplayMismatch
+}
+
+// replayEntry is a recordEntry whose response is only decoded as far as Replay compares it.
+type replayEntry struct {
+	recordEntry
+	Response *struct {
+		Lists map[string]json.RawMessage `json:"lists"`
+		Rooms map[string]json.RawMessage `json:"rooms"`
+	} `json:"response,omitempty"`
+}
+
+// Replay feeds a recording made by EnableRecording into a new ConnState backed by in-memory caches,
+// and compares each response it produces with the recorded one. Only what ConnState works out for
+// itself is replayed: room data isn't recorded, so rooms are compared by room ID alone, extensions
+// aren't run, and the user is assumed to be joined to every room they subscribe to.
+func Replay(ctx context.Context, r io.Reader) (*ReplayResult, error) {
+	var entries []replayEntry
+	dec := json.NewDecoder(r)
+	for {
+		var entry replayEntry
+		err := dec.Decode(&entry)
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read recording entry %d: %w", len(entries), err)
+		}
+		entries = append(entries, entry)
+	}
+	if len(entries) == 0 || entries[0].Kind != recordKindConn || entries[0].Conn == nil {
+		return nil, fmt.Errorf("recording does not start with a conn entry")
+	}
+	result := &ReplayResult{
+		Conn: *entries[0].Conn,
+	}
+	var load *recordedLoad
+	numUpdates := 0
+	for _, entry := range entries {
+		switch entry.Kind {
+		case recordKindLoad:
+			if load == nil {
+				load = entry.Load
+			}
+		case recordKindUpdate:
+			numUpdates++
+		}
+	}
+
+	globalCache := caches.NewGlobalCache(nil)
+	globalCache.LoadJoinedRoomsOverride = func(userID string) (int64, map[string]*internal.RoomMetadata, map[string]internal.EventMetadata, map[string]int64, error) {
+		return 0, map[string]*internal.RoomMetadata{}, map[string]internal.EventMetadata{}, map[string]int64{}, nil
+	}
+	if load != nil {
+		metadata := make(map[string]internal.RoomMetadata, len(load.Rooms))
+		for _, room := range load.Rooms {
+			metadata[room.RoomID] = room.RoomMetadata
+		}
+		if err := globalCache.Startup(metadata); err != nil {
+			return nil, err
+		}
+	}
+	// room ID -> the latest NIDs of the timelines loaded for it, in the order they were loaded
+	timelineLoadPositions := make(map[string][]int64)
+	userCache := caches.NewUserCache(result.Conn.UserID, globalCache, replayStore{}, replayStore{}, replayStore{})
+	userCache.LazyLoadTimelinesOverride = func(loadPos int64, roomIDs []string, maxTimelineEvents int) map[string]state.LatestEvents {
+		timelines := make(map[string]state.LatestEvents, len(roomIDs))
+		for _, roomID := range roomIDs {
+			latestNID := loadPos
+			if nids := timelineLoadPositions[roomID]; len(nids) > 0 {
+				latestNID = nids[0]
+				timelineLoadPositions[roomID] = nids[1:]
+			}
+			timelines[roomID] = state.LatestEvents{LatestNID: latestNID}
+		}
+		return timelines
+	}
+	cs := NewConnState(
+		result.Conn.UserID, result.Conn.DeviceID, userCache, globalCache, replayExtensions{}, replayStore{},
+		nil, nil, numUpdates+1, 0,
+	)
+	defer cs.Destroy()
+	if load != nil && load.AnchorLoadPosition > 0 {
+		// restore the load directly, as the user cache doesn't have the user's room data
+		for roomID, pos := range load.LoadPositions {
+			cs.loadPositions[roomID] = pos
+		}
+		for _, room := range load.Rooms {
+			cs.lists.SetRoom(room)
+		}
+		cs.anchorLoadPosition = load.AnchorLoadPosition
+	}
+
+	for i := 0; i < len(entries); i++ {
+		if entries[i].Kind != recordKindRequest || entries[i].Request == nil {
+			continue
+		}
+		req := entries[i]
+		// queue up everything the connection processed whilst handling this request
+		var recordedRes *replayEntry
+		numQueued := 0
+		for ; i+1 < len(entries) && entries[i+1].Kind != recordKindRequest; i++ {
+			entry := entries[i+1]
+			switch entry.Kind {
+			case recordKindUpdate:
+				up, err := entry.Update.update()
+				if err != nil {
+					return nil, fmt.Errorf("entry %d: %w", i+1, err)
+				}
+				cs.live.updates <- up
+				numQueued++
+			case recordKindTimeline:
+				for roomID, nid := range entry.LoadPositions {
+					timelineLoadPositions[roomID] = append(timelineLoadPositions[roomID], nid)
+				}
+			case recordKindResponse:
+				recordedRes = &entries[i+1]
+			}
+		}
+		// we know exactly which updates to process, so don't wait around for more
+		req.Request.SetTimeoutMSecs(0)
+		res, err := cs.OnIncomingRequest(ctx, result.Conn, req.Request, req.IsInitial, time.Now())
+		if err != nil {
+			return nil, fmt.Errorf("replaying request %d: %w", len(result.Responses), err)
+		}
+		if recordedRes == nil {
+			// the connection went away before responding
+			continue
+		}
+		diffs := diffResponses(recordedRes, res)
+		if n := len(cs.live.updates); n > 0 {
+			diffs = append(diffs, fmt.Sprintf("%d of %d recorded updates were not processed", n, numQueued))
+			for len(cs.live.updates) > 0 {
+				<-cs.live.updates
+			}
+		}
+		if len(diffs) > 0 {
+			result.Mismatches = append(result.Mismatches, ReplayMismatch{
+				Response: len(result.Responses),
+				Diffs:    diffs,
+			})
+		}
+		result.Responses = append(result.Responses, res)
+	}
+	return result, nil
+}
+
+// diffResponses compares the lists and room IDs in a replayed response with the recorded response.
+func diffResponses(recorded *replayEntry, replayed *sync3.Response) (diffs []string) {
+	listKeys := make(map[string]struct{})
+	for listKey := range recorded.Response.Lists {
+		listKeys[listKey] = struct{}{}
+	}
+	for listKey := range replayed.Lists {
+		listKeys[listKey] = struct{}{}
+	}
+	sortedListKeys := internal.Keys(listKeys)
+	sort.Strings(sortedListKeys)
+	for _, listKey := range sortedListKeys {
+		want := recorded.Response.Lists[listKey]
+		if want == nil {
+			want = json.RawMessage("null")
+		}
+		got := []byte("null")
+		if list, ok := replayed.Lists[listKey]; ok {
+			got, _ = json.Marshal(list)
+		}
+		if !bytes.Equal(want, got) {
+			diffs = append(diffs, fmt.Sprintf("list %q: recorded %s, replayed %s", listKey, want, got))
+		}
+	}
+	wantRoomIDs := internal.Keys(recorded.Response.Rooms)
+	gotRoomIDs := internal.Keys(replayed.Rooms)
+	sort.Strings(wantRoomIDs)
+	sort.Strings(gotRoomIDs)
+	if len(wantRoomIDs) > 0 || len(gotRoomIDs) > 0 {
+		if !reflect.DeepEqual(wantRoomIDs, gotRoomIDs) {
+			diffs = append(diffs, fmt.Sprintf("rooms: recorded %v, replayed %v", wantRoomIDs, gotRoomIDs))
+		}
+	}
+	return diffs
+}
+
+// replayStore stands in for the database when replaying.
+type replayStore struct{}
+
+func (replayStore) LatestEventsInRooms(userID string, roomIDs []string, to int64, limit int, filter *internal.TimelineFilter) (map[string]*state.LatestEvents, error) {
+	return nil, nil
+}
+func (replayStore) GetClosestPrevBatch(roomID string, eventNID int64) string {
+	return ""
+}
+func (replayStore) TransactionIDForEvents(userID, deviceID string, eventIDs []string) map[string]string {
+	return nil
+}
+func (replayStore) IsUserJoined(userID, roomID string) bool {
+	return true
+}
+
+// replayExtensions doesn't run extensions, as they read from the database.
+type replayExtensions struct{}
+
+func (replayExtensions) Handle(ctx context.Context, req extensions.Request, extCtx extensions.Context) (res extensions.Response) {
+	return
+}
+func (replayExtensions) HandleLiveUpdate(ctx context.Context, update caches.Update, req extensions.Request, res *extensions.Response, extCtx extensions.Context) {
+}
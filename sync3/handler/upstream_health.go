@@ -0,0 +1,55 @@
+package handler
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/matrix-org/sliding-sync/internal"
+	"github.com/matrix-org/sliding-sync/pubsub"
+	"github.com/matrix-org/sliding-sync/sync2"
+	"github.com/rs/zerolog/log"
+)
+
+// upstreamHealth is the last health of an upstream homeserver reported by the pollers.
+type upstreamHealth struct {
+	degraded bool
+	// when the pollers will next try the homeserver
+	retryAt time.Time
+}
+
+func (h *SyncLiveHandler) OnUpstreamHealth(p *pubsub.V2UpstreamHealth) {
+	log.Info().Str("homeserver", p.ServerName).Bool("degraded", p.Degraded).Int64("retry_after_ms", p.RetryAfterMS).Msg("upstream homeserver health changed")
+	h.upstreamHealth.Store(p.ServerName, &upstreamHealth{
+		degraded: p.Degraded,
+		retryAt:  time.Now().Add(time.Duration(p.RetryAfterMS) * time.Millisecond),
+	})
+}
+
+// checkUpstreamHealth rejects requests which need a new poller whilst the upstream homeserver is
+// unhealthy, rather than blocking them until it recovers. Devices which are already being polled
+// can carry on syncing, as they are served from the proxy's own data.
+func (h *SyncLiveHandler) checkUpstreamHealth(pid sync2.PollerID) *internal.HandlerError {
+	val, ok := h.upstreamHealth.Load(h.Upstreams.ServerFor(pid.UserID))
+	if !ok {
+		return nil
+	}
+	health := val.(*upstreamHealth)
+	if !health.degraded || h.EnsurePoller.isPolling(pid) {
+		return nil
+	}
+	if h.upstreamDegradedReqs != nil {
+		h.upstreamDegradedReqs.Inc()
+	}
+	// always tell clients to wait a little, even if the pollers are due to try again now
+	retryAfterMS := time.Until(health.retryAt).Milliseconds()
+	if retryAfterMS < 1000 {
+		retryAfterMS = 1000
+	}
+	return &internal.HandlerError{
+		StatusCode:   http.StatusServiceUnavailable,
+		Err:          fmt.Errorf("upstream homeserver is unavailable"),
+		ErrCode:      "M_UNKNOWN",
+		RetryAfterMS: retryAfterMS,
+	}
+}
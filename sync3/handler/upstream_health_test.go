@@ -0,0 +1,37 @@
+package handler
+
+import (
+	"net/http"
+	"sync"
+	"testing"
+
+	"github.com/matrix-org/sliding-sync/pubsub"
+	"github.com/matrix-org/sliding-sync/sync2"
+)
+
+func TestCheckUpstreamHealth(t *testing.T) {
+	h := &SyncLiveHandler{
+		Upstreams:      sync2.NewUpstreams(nil),
+		EnsurePoller:   NewEnsurePoller(nil, false),
+		upstreamHealth: &sync.Map{},
+	}
+	polling := sync2.PollerID{UserID: "@alice:localhost", DeviceID: "polling"}
+	newDevice := sync2.PollerID{UserID: "@alice:localhost", DeviceID: "new"}
+	h.EnsurePoller.pendingPolls[polling] = pendingInfo{done: true}
+
+	if herr := h.checkUpstreamHealth(newDevice); herr != nil {
+		t.Fatalf("checkUpstreamHealth: got %v before any health was reported", herr)
+	}
+	h.OnUpstreamHealth(&pubsub.V2UpstreamHealth{Degraded: true, RetryAfterMS: 30000})
+	if herr := h.checkUpstreamHealth(polling); herr != nil {
+		t.Fatalf("checkUpstreamHealth: got %v for a device which is already polling", herr)
+	}
+	herr := h.checkUpstreamHealth(newDevice)
+	if herr == nil || herr.StatusCode != http.StatusServiceUnavailable || herr.RetryAfterMS <= 29000 || herr.RetryAfterMS > 30000 {
+		t.Fatalf("checkUpstreamHealth: got %+v want a 503 with retry_after_ms ~30000", herr)
+	}
+	h.OnUpstreamHealth(&pubsub.V2UpstreamHealth{Degraded: false})
+	if herr := h.checkUpstreamHealth(newDevice); herr != nil {
+		t.Fatalf("checkUpstreamHealth: got %v after the upstream recovered", herr)
+	}
+}
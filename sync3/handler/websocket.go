@@ -0,0 +1,304 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/matrix-org/sliding-sync/internal"
+	"github.com/matrix-org/sliding-sync/sync3"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/hlog"
+)
+
+// WebSocket transport for sliding sync. Instead of making a new long-poll request for every
+// response, the client upgrades the sync endpoint to a WebSocket then sends sync3.Request deltas
+// as text frames. The server pushes a sync3.Response frame every time the connection has new data,
+// or when the timeout expires. Every request still goes through the same sync3.Conn as HTTP
+// requests do, with the server acknowledging each response it has written on the client's behalf.
+// This means clients can reconnect with ?pos= set to the last position they saw and will be sent
+// anything they missed. Every request frame counts towards the rate limits. A frame over the limit
+// is dropped and answered with an M_LIMIT_EXCEEDED error frame, but the socket stays open.
+
+const (
+	// the largest request frame we will read from a client
+	maxWebSocketFrameBytes = 1024 * 1024
+	// how many request frames we will buffer before we stop reading from the client
+	maxQueuedWebSocketFrames = 8
+	// how long we will wait for the client to accept a frame before giving up on it
+	webSocketWriteTimeout = 10 * time.Second
+)
+
+var webSocketUpgrader = websocket.Upgrader{
+	// Clients authenticate with an access token, not cookies, so it is safe to accept connections
+	// from any origin. This matches the CORS headers we send for HTTP requests.
+	CheckOrigin: func(r *http.Request) bool { return true },
+}
+
+type webSocketFrame struct {
+	req  *sync3.Request
+	herr *internal.HandlerError
+}
+
+// webSocketSession pumps request frames from a WebSocket into a sync3.Conn and writes the
+// responses back to the client.
+type webSocketSession struct {
+	ws     *websocket.Conn
+	frames chan webSocketFrame
+	logger *zerolog.Logger
+	// checks every request frame after the first against the rate limits, as each one is a new
+	// request. Returns an error if the frame should be rejected. Optional.
+	checkRateLimit func() *internal.HandlerError
+
+	// cancels the request which is currently being processed, so new request data from the
+	// client is not stuck behind a long poll. Frames are numbered in the order they are read, and
+	// only frames which came after the request started can cancel it, as a frame which arrives
+	// while the next request is being set up may well be the frame that request is for.
+	interruptMu sync.Mutex
+	interrupt   context.CancelFunc
+	// how many frames had been taken off the queue when the current request started
+	interruptTaken int
+	// how many frames have been taken off the queue. Only used by the goroutine calling run.
+	framesTaken int
+}
+
+func newWebSocketSession(ws *websocket.Conn, logger *zerolog.Logger) *webSocketSession {
+	ws.SetReadLimit(maxWebSocketFrameBytes)
+	return &webSocketSession{
+		ws:     ws,
+		frames: make(chan webSocketFrame, maxQueuedWebSocketFrames),
+		logger: logger,
+	}
+}
+
+// readLoop reads request frames from the client until the socket closes or the context is
+// cancelled. It calls cancel when the client goes away.
+func (s *webSocketSession) readLoop(ctx context.Context, cancel context.CancelFunc, logger *zerolog.Logger) {
+	defer cancel()
+	framesRead := 0
+	for {
+		_, data, err := s.ws.ReadMessage()
+		if err != nil {
+			if !websocket.IsCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway) && ctx.Err() == nil {
+				logger.Warn().Err(err).Msg("failed to read websocket frame")
+			}
+			return
+		}
+		var frame webSocketFrame
+		var req sync3.Request
+		if err = json.Unmarshal(data, &req); err != nil {
+			frame.herr = &internal.HandlerError{
+				StatusCode: 400,
+				Err:        err,
+			}
+		} else {
+			frame.req = &req
+			frame.herr = validateRequest(&req)
+		}
+		select {
+		case s.frames <- frame:
+		case <-ctx.Done():
+			return
+		}
+		framesRead++
+		s.interruptBefore(framesRead)
+	}
+}
+
+// setInterrupt makes cancel the way to interrupt the current request, which includes every
+// frame taken off the queue so far.
+func (s *webSocketSession) setInterrupt(cancel context.CancelFunc) {
+	s.interruptMu.Lock()
+	defer s.interruptMu.Unlock()
+	s.interrupt = cancel
+	s.interruptTaken = s.framesTaken
+}
+
+// interruptBefore cancels the current request, unless the request already includes the frame
+// with this number.
+func (s *webSocketSession) interruptBefore(frameNum int) {
+	s.interruptMu.Lock()
+	defer s.interruptMu.Unlock()
+	if s.interrupt != nil && s.interruptTaken < frameNum {
+		s.interrupt()
+	}
+}
+
+// nextFrame blocks until the client sends a request frame.
+func (s *webSocketSession) nextFrame(ctx context.Context) (*sync3.Request, *internal.HandlerError) {
+	select {
+	case frame := <-s.frames:
+		s.framesTaken++
+		return frame.req, frame.herr
+	case <-ctx.Done():
+		return nil, nil
+	}
+}
+
+// run processes requests on the connection until the context is cancelled or an error occurs.
+// pos is the position the client last saw, or 0 for a new connection.
+func (s *webSocketSession) run(ctx context.Context, conn *sync3.Conn, firstReq *sync3.Request, pos int64, timeout int) {
+	req := firstReq
+	for {
+		reqCtx, reqCancel := context.WithCancel(ctx)
+		s.setInterrupt(reqCancel)
+
+		req.ConnID = firstReq.ConnID
+		req.SetPos(pos)
+		req.SetTimeoutMSecs(timeout)
+		if len(s.frames) > 0 {
+			// the client has more request data queued up, don't wait around for new events
+			req.SetTimeoutMSecs(1)
+		}
+		resp, herr := conn.OnIncomingRequest(reqCtx, req, time.Now())
+		reqCancel()
+		if ctx.Err() != nil {
+			return // the client went away or the connection was destroyed
+		}
+		if herr != nil {
+			s.writeError(herr)
+			return
+		}
+		if err := s.writeJSON(resp); err != nil {
+			s.logger.Warn().Err(err).Msg("failed to write websocket frame")
+			return
+		}
+		// by writing the response we have ACKed it on the client's behalf
+		pos = resp.PosInt()
+
+		select {
+		case frame := <-s.frames:
+			s.framesTaken++
+			if frame.herr != nil {
+				s.writeError(frame.herr)
+				return
+			}
+			if s.checkRateLimit != nil {
+				if herr := s.checkRateLimit(); herr != nil {
+					// drop the frame, the client can send it again once retry_after_ms has passed
+					s.logger.Warn().Int64("retry_after_ms", herr.RetryAfterMS).Msg("rate limited")
+					if err := s.writeErrorFrame(herr); err != nil {
+						s.logger.Warn().Err(err).Msg("failed to write websocket frame")
+						return
+					}
+					req = &sync3.Request{}
+					continue
+				}
+			}
+			req = frame.req
+		default:
+			// request params are sticky, so no new frame means nothing has changed
+			req = &sync3.Request{}
+		}
+	}
+}
+
+func (s *webSocketSession) writeJSON(v interface{}) error {
+	s.ws.SetWriteDeadline(time.Now().Add(webSocketWriteTimeout))
+	return s.ws.WriteJSON(v)
+}
+
+// writeErrorFrame sends the error to the client in the same format as HTTP error responses.
+func (s *webSocketSession) writeErrorFrame(herr *internal.HandlerError) error {
+	s.ws.SetWriteDeadline(time.Now().Add(webSocketWriteTimeout))
+	return s.ws.WriteMessage(websocket.TextMessage, herr.JSON())
+}
+
+// writeError sends the error to the client in the same format as HTTP error responses, then
+// closes the socket.
+func (s *webSocketSession) writeError(herr *internal.HandlerError) {
+	if herr.StatusCode >= 500 {
+		s.logger.Err(herr).Msg("websocket request failed")
+	} else {
+		s.logger.Warn().Err(herr).Msg("websocket request failed")
+	}
+	if err := s.writeErrorFrame(herr); err != nil {
+		return
+	}
+	closeCode := websocket.ClosePolicyViolation
+	if herr.StatusCode >= 500 {
+		closeCode = websocket.CloseInternalServerErr
+	}
+	s.ws.WriteControl(
+		websocket.CloseMessage, websocket.FormatCloseMessage(closeCode, herr.ErrCode),
+		time.Now().Add(webSocketWriteTimeout),
+	)
+}
+
+// serveWebSocket upgrades the request to a WebSocket and serves sliding sync over it until either
+// side closes the socket. The first frame from the client sets up the connection, like the first
+// request on HTTP.
+func (h *SyncLiveHandler) serveWebSocket(w http.ResponseWriter, req *http.Request) {
+	// Browsers cannot set headers when opening a WebSocket, so accept the token as a query param.
+	if req.Header.Get("Authorization") == "" && req.URL.Query().Get("access_token") != "" {
+		req.Header.Set("Authorization", "Bearer "+req.URL.Query().Get("access_token"))
+	}
+	writeHTTPError := func(herr *internal.HandlerError) {
+		w.WriteHeader(herr.StatusCode)
+		w.Write(herr.JSON())
+	}
+	if _, err := internal.ExtractAccessToken(req); err != nil {
+		writeHTTPError(&internal.HandlerError{
+			StatusCode: http.StatusUnauthorized,
+			Err:        err,
+		})
+		return
+	}
+	pos, herr := parseIntFromQuery(req.URL, "pos")
+	if herr != nil {
+		writeHTTPError(herr)
+		return
+	}
+	timeout := sync3.DefaultTimeoutMSecs
+	if req.URL.Query().Get("timeout") != "" {
+		timeout64, herr := parseIntFromQuery(req.URL, "timeout")
+		if herr != nil {
+			writeHTTPError(herr)
+			return
+		}
+		timeout = int(timeout64)
+	}
+
+	ws, err := webSocketUpgrader.Upgrade(w, req, nil)
+	if err != nil {
+		// the upgrader has already sent an HTTP error response
+		hlog.FromRequest(req).Warn().Err(err).Msg("failed to upgrade to websocket")
+		return
+	}
+	defer ws.Close()
+
+	// cancelling this context closes the socket, which happens when the client goes away or
+	// when the connection is destroyed e.g because the update buffer filled up
+	ctx, cancel := context.WithCancel(req.Context())
+	defer cancel()
+	req = req.WithContext(ctx)
+	session := newWebSocketSession(ws, hlog.FromRequest(req))
+	go session.readLoop(ctx, cancel, hlog.FromRequest(req))
+
+	firstReq, herr := session.nextFrame(ctx)
+	if herr != nil {
+		session.writeError(herr)
+		return
+	}
+	if firstReq == nil {
+		return // the client went away before sending anything
+	}
+	if firstReq.ConnID != "" {
+		req = req.WithContext(internal.SetAttributeOnContext(req.Context(), internal.OTLPTagConnID, firstReq.ConnID))
+	}
+	req, conn, herr := h.setupConnection(req, cancel, firstReq, req.URL.Query().Get("pos") != "")
+	if herr != nil {
+		session.writeError(herr)
+		return
+	}
+	logger := hlog.FromRequest(req).With().Str("user", conn.UserID).Str("conn", conn.CID).Logger()
+	session.logger = &logger
+	session.checkRateLimit = func() *internal.HandlerError {
+		return h.checkRateLimit(conn.ConnID, false)
+	}
+	logger.Info().Int64("pos", pos).Msg("serving sync over websocket")
+	session.run(req.Context(), conn, firstReq, pos, timeout)
+}
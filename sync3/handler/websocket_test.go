@@ -0,0 +1,215 @@
+package handler
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/matrix-org/sliding-sync/internal"
+	"github.com/matrix-org/sliding-sync/sync3"
+	"github.com/matrix-org/sliding-sync/sync3/caches"
+	"github.com/rs/zerolog"
+)
+
+// echoConnHandler responds immediately to requests with a txn_id, else it waits for the timeout
+// and responds with no data.
+type echoConnHandler struct {
+	mu        sync.Mutex
+	isInitial []bool
+}
+
+func (h *echoConnHandler) OnIncomingRequest(ctx context.Context, cid sync3.ConnID, req *sync3.Request, isInitial bool, start time.Time) (*sync3.Response, error) {
+	h.mu.Lock()
+	h.isInitial = append(h.isInitial, isInitial)
+	h.mu.Unlock()
+	if req.TxnID != "" {
+		return &sync3.Response{}, nil
+	}
+	select {
+	case <-ctx.Done():
+	case <-time.After(time.Duration(req.TimeoutMSecs()) * time.Millisecond):
+	}
+	return &sync3.Response{}, nil
+}
+func (h *echoConnHandler) OnUpdate(ctx context.Context, update caches.Update) {}
+func (h *echoConnHandler) PublishEventsUpTo(roomID string, nid int64)         {}
+func (h *echoConnHandler) Destroy()                                           {}
+func (h *echoConnHandler) Alive() bool                                        { return true }
+func (h *echoConnHandler) SetCancelCallback(cancel context.CancelFunc)        {}
+func (h *echoConnHandler) Info() sync3.ConnInfo                               { return sync3.ConnInfo{} }
+
+func TestWebSocketSession(t *testing.T) {
+	connHandler := &echoConnHandler{}
+	conn := sync3.NewConn(sync3.ConnID{UserID: "@alice:localhost", DeviceID: "DEVICE"}, connHandler)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		ws, err := webSocketUpgrader.Upgrade(w, req, nil)
+		if err != nil {
+			t.Errorf("failed to upgrade: %s", err)
+			return
+		}
+		defer ws.Close()
+		ctx, cancel := context.WithCancel(req.Context())
+		defer cancel()
+		logger := zerolog.Nop()
+		session := newWebSocketSession(ws, &logger)
+		go session.readLoop(ctx, cancel, &logger)
+		firstReq, herr := session.nextFrame(ctx)
+		if herr != nil || firstReq == nil {
+			t.Errorf("failed to read first frame: %v", herr)
+			return
+		}
+		// a long timeout, so responses for later frames must be sent by interrupting the long poll
+		session.run(ctx, conn, firstReq, 0, 60*1000)
+	}))
+	defer srv.Close()
+
+	ws, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http"), nil)
+	if err != nil {
+		t.Fatalf("failed to dial: %s", err)
+	}
+	defer ws.Close()
+	ws.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+	// each frame should be processed straight away, advancing the position each time
+	for i, txnID := range []string{"first", "second", "third"} {
+		if err = ws.WriteJSON(map[string]string{"txn_id": txnID}); err != nil {
+			t.Fatalf("failed to write frame: %s", err)
+		}
+		var resp sync3.Response
+		for resp.TxnID != txnID {
+			if err = ws.ReadJSON(&resp); err != nil {
+				t.Fatalf("failed to read response for %s: %s", txnID, err)
+			}
+		}
+		if resp.PosInt() <= int64(i) {
+			t.Errorf("response for %s has pos %d, want > %d", txnID, resp.PosInt(), i)
+		}
+	}
+
+	connHandler.mu.Lock()
+	defer connHandler.mu.Unlock()
+	if len(connHandler.isInitial) == 0 || !connHandler.isInitial[0] {
+		t.Errorf("first request was not initial")
+	}
+	for i, isInitial := range connHandler.isInitial[1:] {
+		if isInitial {
+			t.Errorf("request %d was initial, the position was not advanced", i+1)
+		}
+	}
+}
+
+// Test that frames over the rate limit are rejected with an error frame, without closing the socket.
+func TestWebSocketSessionRateLimit(t *testing.T) {
+	connHandler := &echoConnHandler{}
+	conn := sync3.NewConn(sync3.ConnID{UserID: "@alice:localhost", DeviceID: "DEVICE"}, connHandler)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		ws, err := webSocketUpgrader.Upgrade(w, req, nil)
+		if err != nil {
+			t.Errorf("failed to upgrade: %s", err)
+			return
+		}
+		defer ws.Close()
+		ctx, cancel := context.WithCancel(req.Context())
+		defer cancel()
+		logger := zerolog.Nop()
+		session := newWebSocketSession(ws, &logger)
+		// only the frame after the first is over the limit
+		numChecks := 0
+		session.checkRateLimit = func() *internal.HandlerError {
+			numChecks++
+			if numChecks != 1 {
+				return nil
+			}
+			return &internal.HandlerError{
+				StatusCode:   http.StatusTooManyRequests,
+				Err:          fmt.Errorf("too many requests"),
+				ErrCode:      "M_LIMIT_EXCEEDED",
+				RetryAfterMS: 500,
+			}
+		}
+		go session.readLoop(ctx, cancel, &logger)
+		firstReq, herr := session.nextFrame(ctx)
+		if herr != nil || firstReq == nil {
+			t.Errorf("failed to read first frame: %v", herr)
+			return
+		}
+		session.run(ctx, conn, firstReq, 0, 60*1000)
+	}))
+	defer srv.Close()
+
+	ws, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http"), nil)
+	if err != nil {
+		t.Fatalf("failed to dial: %s", err)
+	}
+	defer ws.Close()
+	ws.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+	// read frames until one has this txn_id or errcode, skipping the responses to interrupted requests
+	waitFor := func(field, want string) map[string]interface{} {
+		t.Helper()
+		for {
+			var frame map[string]interface{}
+			if err := ws.ReadJSON(&frame); err != nil {
+				t.Fatalf("failed to read frame waiting for %s=%s: %s", field, want, err)
+			}
+			if frame[field] == want {
+				return frame
+			}
+		}
+	}
+	for _, txnID := range []string{"first", "throttled", "third"} {
+		if err = ws.WriteJSON(map[string]string{"txn_id": txnID}); err != nil {
+			t.Fatalf("failed to write frame: %s", err)
+		}
+		if txnID != "throttled" {
+			waitFor("txn_id", txnID)
+			continue
+		}
+		errFrame := waitFor("errcode", "M_LIMIT_EXCEEDED")
+		if errFrame["retry_after_ms"] != float64(500) {
+			t.Errorf("error frame has retry_after_ms %v, want 500", errFrame["retry_after_ms"])
+		}
+	}
+}
+
+// Test that a frame only interrupts requests which started before it was taken off the queue.
+func TestWebSocketSessionInterrupt(t *testing.T) {
+	s := &webSocketSession{
+		frames: make(chan webSocketFrame, maxQueuedWebSocketFrames),
+	}
+	// frame 1 starts the first request
+	s.frames <- webSocketFrame{req: &sync3.Request{}}
+	s.nextFrame(context.Background())
+	ctx1, cancel1 := context.WithCancel(context.Background())
+	s.setInterrupt(cancel1)
+	s.interruptBefore(1)
+	if ctx1.Err() != nil {
+		t.Fatalf("request was interrupted by the frame it is for")
+	}
+	// frame 2 arrives during the first request, interrupting it
+	s.frames <- webSocketFrame{req: &sync3.Request{}}
+	s.interruptBefore(2)
+	if ctx1.Err() == nil {
+		t.Fatalf("request was not interrupted by a later frame")
+	}
+	// frame 3 is taken off the queue for the next request before the reader gets to interrupt
+	s.frames <- webSocketFrame{req: &sync3.Request{}}
+	s.nextFrame(context.Background())
+	s.nextFrame(context.Background())
+	ctx2, cancel2 := context.WithCancel(context.Background())
+	s.setInterrupt(cancel2)
+	s.interruptBefore(3)
+	if ctx2.Err() != nil {
+		t.Fatalf("request was interrupted by a frame it had already taken")
+	}
+	s.interruptBefore(4)
+	if ctx2.Err() == nil {
+		t.Fatalf("request was not interrupted by a later frame")
+	}
+}
@@ -37,8 +37,10 @@ type RoomDelta struct {
 	RoomAvatarChanged        bool
 	JoinCountChanged         bool
 	InviteCountChanged       bool
+	SummaryChanged           bool
 	NotificationCountChanged bool
 	HighlightCountChanged    bool
+	ThreadCountsChanged      bool
 	Lists                    []RoomListDelta
 }
 
@@ -66,8 +68,10 @@ func (s *InternalRequestLists) SetRoom(r RoomConnMetadata) (delta RoomDelta) {
 		if existing.HighlightCount != r.HighlightCount {
 			delta.HighlightCountChanged = true
 		}
+		delta.ThreadCountsChanged = !internal.SameThreadUnreadCounts(existing.ThreadUnreadCounts, r.ThreadUnreadCounts)
 		delta.InviteCountChanged = !existing.SameInviteCount(&r.RoomMetadata)
 		delta.JoinCountChanged = !existing.SameJoinCount(&r.RoomMetadata)
+		delta.SummaryChanged = !existing.SameSummary(&r.RoomMetadata)
 		delta.RoomNameChanged = !existing.SameRoomName(&r.RoomMetadata)
 		if delta.RoomNameChanged {
 			// update the canonical name to allow room name sorting to continue to work
@@ -172,6 +176,29 @@ func (s *InternalRequestLists) ReadOnlyRoom(roomID string) *RoomConnMetadata {
 	return s.allRooms[roomID]
 }
 
+// RoomsInSpace returns the rooms in this space, including those in its subspaces.
+func (s *InternalRequestLists) RoomsInSpace(spaceID string) []string {
+	spaces := []string{spaceID}
+	var roomIDs []string
+	for roomID, r := range s.allRooms {
+		if inSpaces(r, spaces, true, s) {
+			roomIDs = append(roomIDs, roomID)
+		}
+	}
+	return roomIDs
+}
+
+// JoinedSpaces returns the spaces the user is joined to.
+func (s *InternalRequestLists) JoinedSpaces() []string {
+	var roomIDs []string
+	for roomID, r := range s.allRooms {
+		if r.IsSpace() && !r.IsInvite && !r.IsKnock && !r.HasLeft {
+			roomIDs = append(roomIDs, roomID)
+		}
+	}
+	return roomIDs
+}
+
 // Get returns the sorted list of rooms. Returns a shared pointer, not a copy.
 // It is only safe to read this data, never to write.
 func (s *InternalRequestLists) Get(listKey string) *FilteredSortableRooms {
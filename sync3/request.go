@@ -8,6 +8,7 @@ import (
 
 	"github.com/matrix-org/sliding-sync/internal"
 	"github.com/matrix-org/sliding-sync/sync3/extensions"
+	"golang.org/x/exp/slices"
 )
 
 var (
@@ -16,7 +17,11 @@ var (
 	SortByNotificationLevel = "by_notification_level"
 	SortByNotificationCount = "by_notification_count" // deprecated
 	SortByHighlightCount    = "by_highlight_count"    // deprecated
-	SortBy                  = []string{SortByHighlightCount, SortByName, SortByNotificationCount, SortByRecency, SortByNotificationLevel}
+	SortByRelevance         = "by_relevance"
+	SortByJoinTime          = "by_join_time"
+	SortByMarkedUnread      = "by_marked_unread"
+	// All known sort orders, populated by RegisterSortComparator.
+	SortBy []string
 
 	Wildcard     = "*"
 	StateKeyLazy = "$LAZY"
@@ -46,6 +51,9 @@ func (r *Request) Validate() error {
 	if len(r.TxnID) > 64 {
 		return fmt.Errorf("txn_id is too long: %d > 64", len(r.TxnID))
 	}
+	if r.Extensions.Receipts != nil && !r.Extensions.Receipts.ValidScope() {
+		return fmt.Errorf("extensions.receipts.scope is invalid: %q", r.Extensions.Receipts.Scope)
+	}
 	return nil
 }
 
@@ -57,12 +65,18 @@ type RequestList struct {
 	SlowGetAllRooms *bool           `json:"slow_get_all_rooms,omitempty"`
 	Deleted         bool            `json:"deleted,omitempty"`
 	BumpEventTypes  []string        `json:"bump_event_types"`
+	// Deltas opts into SHIFT operations when the window moves, see OpShift.
+	Deltas *bool `json:"deltas,omitempty"`
 }
 
 func (rl *RequestList) ShouldGetAllRooms() bool {
 	return rl.SlowGetAllRooms != nil && *rl.SlowGetAllRooms
 }
 
+func (rl *RequestList) ShouldUseDeltas() bool {
+	return rl.Deltas != nil && *rl.Deltas
+}
+
 func (rl *RequestList) SortOrderChanged(next *RequestList) bool {
 	prevLen := 0
 	if rl != nil {
@@ -398,6 +412,18 @@ func (r *Request) ApplyDelta(nextReq *Request) (result *Request, delta *RequestD
 		if heroes == nil {
 			heroes = existingList.Heroes
 		}
+		summary := nextList.Summary
+		if summary == nil {
+			summary = existingList.Summary
+		}
+		timelineFilter := nextList.TimelineFilter
+		if timelineFilter == nil {
+			timelineFilter = existingList.TimelineFilter
+		}
+		deltas := nextList.Deltas
+		if deltas == nil {
+			deltas = existingList.Deltas
+		}
 
 		calculatedLists[listKey] = RequestList{
 			RoomSubscription: RoomSubscription{
@@ -405,12 +431,15 @@ func (r *Request) ApplyDelta(nextReq *Request) (result *Request, delta *RequestD
 				TimelineLimit:   timelineLimit,
 				IncludeOldRooms: includeOldRooms,
 				Heroes:          heroes,
+				Summary:         summary,
+				TimelineFilter:  timelineFilter,
 			},
 			Ranges:          rooms,
 			Sort:            sort,
 			Filters:         filters,
 			SlowGetAllRooms: slowGetAllRooms,
 			BumpEventTypes:  bumpEventTypes,
+			Deltas:          deltas,
 		}
 	}
 	result.Lists = calculatedLists
@@ -464,7 +493,7 @@ func (r *Request) ApplyDelta(nextReq *Request) (result *Request, delta *RequestD
 		if oldSub, ok := r.RoomSubscriptions[roomID]; ok {
 			// if the subscription is different, mark it as a delta, else skip it as it hasn't changed
 			newSub := resultSubs[roomID]
-			if oldSub.RequiredStateChanged(newSub) || oldSub.TimelineLimit != newSub.TimelineLimit {
+			if oldSub.RequiredStateChanged(newSub) || oldSub.TimelineLimit != newSub.TimelineLimit || oldSub.TimelineFilterChanged(newSub) {
 				delta.Subs = append(delta.Subs, roomID)
 			}
 			continue // already subscribed
@@ -490,14 +519,23 @@ type RequestFilters struct {
 	IsDM           *bool     `json:"is_dm"`
 	IsEncrypted    *bool     `json:"is_encrypted"`
 	IsInvite       *bool     `json:"is_invite"`
+	IsKnock        *bool     `json:"is_knock"`
 	IsTombstoned   *bool     `json:"is_tombstoned"` // deprecated
 	RoomTypes      []*string `json:"room_types"`
 	NotRoomTypes   []*string `json:"not_room_types"`
 	RoomNameFilter string    `json:"room_name_like"`
 	Tags           []string  `json:"tags"`
 	NotTags        []string  `json:"not_tags"`
-
-	// TODO options to control which events should be live-streamed e.g not_types, types from sync v2
+	// RoomNameSearch matches tokens in the room name, canonical alias and DM hero names,
+	// ignoring case and diacritics. Use with the by_relevance sort to rank results.
+	RoomNameSearch string `json:"room_name_search"`
+	// JoinRules and NotJoinRules match the room's m.room.join_rules e.g ["public"]. Rooms without
+	// a join rule are treated as "invite", which is what the spec says they are.
+	JoinRules    []string `json:"join_rules"`
+	NotJoinRules []string `json:"not_join_rules"`
+	// IncludeSubspaces makes Spaces also match rooms in subspaces of those spaces, at any depth.
+	// Only subspaces the user is joined to are followed.
+	IncludeSubspaces bool `json:"include_subspaces"`
 }
 
 func (rf *RequestFilters) Include(r *RoomConnMetadata, finder RoomFinder) bool {
@@ -506,7 +544,7 @@ func (rf *RequestFilters) Include(r *RoomConnMetadata, finder RoomFinder) bool {
 		// should we exclude this room? If we have _joined_ the successor room then yes because
 		// this room must therefore be old, else no.
 		nextRoom := finder.ReadOnlyRoom(*r.UpgradedRoomID)
-		if nextRoom != nil && !nextRoom.HasLeft && !nextRoom.IsInvite {
+		if nextRoom != nil && !nextRoom.HasLeft && !nextRoom.IsInvite && !nextRoom.IsKnock {
 			return false
 		}
 	}
@@ -522,10 +560,16 @@ func (rf *RequestFilters) Include(r *RoomConnMetadata, finder RoomFinder) bool {
 	if rf.IsInvite != nil && *rf.IsInvite != r.IsInvite {
 		return false
 	}
+	if rf.IsKnock != nil && *rf.IsKnock != r.IsKnock {
+		return false
+	}
 	roomName, _ := internal.CalculateRoomName(&r.RoomMetadata, 5)
 	if rf.RoomNameFilter != "" && !strings.Contains(strings.ToLower(roomName), strings.ToLower(rf.RoomNameFilter)) {
 		return false
 	}
+	if rf.RoomNameSearch != "" && RoomSearchScore(r, rf.RoomNameSearch) == 0 {
+		return false
+	}
 	if len(rf.NotTags) > 0 {
 		for _, t := range rf.NotTags {
 			if _, ok := r.Tags[t]; ok {
@@ -545,6 +589,18 @@ func (rf *RequestFilters) Include(r *RoomConnMetadata, finder RoomFinder) bool {
 			return false
 		}
 	}
+	if len(rf.JoinRules) > 0 || len(rf.NotJoinRules) > 0 {
+		joinRule := r.JoinRule
+		if joinRule == "" {
+			joinRule = "invite"
+		}
+		if slices.Contains(rf.NotJoinRules, joinRule) {
+			return false
+		}
+		if len(rf.JoinRules) > 0 && !slices.Contains(rf.JoinRules, joinRule) {
+			return false
+		}
+	}
 	// read not_room_types first as it takes priority
 	if nullableStringExists(rf.NotRoomTypes, r.RoomType) {
 		return false // explicitly excluded
@@ -555,14 +611,45 @@ func (rf *RequestFilters) Include(r *RoomConnMetadata, finder RoomFinder) bool {
 	}
 	if len(rf.Spaces) > 0 {
 		// ensure this room is a member of one of these spaces
-		for _, s := range rf.Spaces {
-			if _, ok := r.UserRoomData.Spaces[s]; ok {
+		return inSpaces(r, rf.Spaces, rf.IncludeSubspaces, finder)
+	}
+	return true
+}
+
+// inSpaces returns true if the room is a child of one of these spaces. If recursive, the room's
+// parents are followed up the space graph, which may contain cycles, so rooms in subspaces match too.
+func inSpaces(r *RoomConnMetadata, spaces []string, recursive bool, finder RoomFinder) bool {
+	for _, s := range spaces {
+		if _, ok := r.UserRoomData.Spaces[s]; ok {
+			return true
+		}
+	}
+	if !recursive {
+		return false
+	}
+	visited := map[string]struct{}{
+		r.RoomID: {},
+	}
+	parents := internal.Keys(r.UserRoomData.Spaces)
+	for len(parents) > 0 {
+		parentID := parents[len(parents)-1]
+		parents = parents[:len(parents)-1]
+		if _, seen := visited[parentID]; seen {
+			continue
+		}
+		visited[parentID] = struct{}{}
+		parent := finder.ReadOnlyRoom(parentID)
+		if parent == nil {
+			continue // we only know the parents of rooms the user is in
+		}
+		for grandparentID := range parent.UserRoomData.Spaces {
+			if slices.Contains(spaces, grandparentID) {
 				return true
 			}
+			parents = append(parents, grandparentID)
 		}
-		return false
 	}
-	return true
+	return false
 }
 
 type RoomSubscription struct {
@@ -570,6 +657,10 @@ type RoomSubscription struct {
 	TimelineLimit   int64             `json:"timeline_limit"`
 	IncludeOldRooms *RoomSubscription `json:"include_old_rooms"`
 	Heroes          *bool             `json:"include_heroes"`
+	Summary         *bool             `json:"include_summary"`
+	// TimelineFilter restricts which events are returned in the timeline, both initially and
+	// when live streaming.
+	TimelineFilter *internal.TimelineFilter `json:"timeline_filter,omitempty"`
 }
 
 func (rs RoomSubscription) RequiredStateChanged(other RoomSubscription) bool {
@@ -584,6 +675,10 @@ func (rs RoomSubscription) RequiredStateChanged(other RoomSubscription) bool {
 	return false
 }
 
+func (rs RoomSubscription) TimelineFilterChanged(other RoomSubscription) bool {
+	return !rs.TimelineFilter.Same(other.TimelineFilter)
+}
+
 func (rs RoomSubscription) LazyLoadMembers() bool {
 	for _, tuple := range rs.RequiredState {
 		if tuple[0] == "m.room.member" && tuple[1] == StateKeyLazy {
@@ -597,6 +692,10 @@ func (rs RoomSubscription) IncludeHeroes() bool {
 	return rs.Heroes != nil && *rs.Heroes
 }
 
+func (rs RoomSubscription) IncludeSummary() bool {
+	return rs.Summary != nil && *rs.Summary
+}
+
 // Combine this subcription with another, returning a union of both as a copy.
 func (rs RoomSubscription) Combine(other RoomSubscription) RoomSubscription {
 	return rs.combineRecursive(other, true)
@@ -613,6 +712,15 @@ func (rs RoomSubscription) combineRecursive(other RoomSubscription, checkOldRoom
 	}
 	// combine together required_state fields, we'll union them later
 	result.RequiredState = append(rs.RequiredState, other.RequiredState...)
+	if rs.IncludeSummary() || other.IncludeSummary() {
+		includeSummary := true
+		result.Summary = &includeSummary
+	}
+	// Only keep the timeline filter if both subscriptions agree on it. Filters cannot be
+	// unioned in general, and we must not drop events which either subscription wants.
+	if !rs.TimelineFilterChanged(other) {
+		result.TimelineFilter = rs.TimelineFilter
+	}
 
 	if checkOldRooms {
 		// set include_old_rooms if it is unset
@@ -6,6 +6,9 @@ import (
 	"reflect"
 	"sort"
 	"testing"
+
+	"github.com/matrix-org/sliding-sync/internal"
+	"github.com/matrix-org/sliding-sync/sync3/caches"
 )
 
 func TestRoomSubscriptionUnion(t *testing.T) {
@@ -219,6 +222,43 @@ func TestRoomSubscriptionRequiredStateChanged(t *testing.T) {
 	assertBool(t, "reordered required_state", a.RequiredStateChanged(c), true)
 }
 
+func TestRoomSubscriptionTimelineFilter(t *testing.T) {
+	messages := &internal.TimelineFilter{Types: []string{"m.room.message"}}
+	a := RoomSubscription{TimelineLimit: 5, TimelineFilter: messages}
+	b := RoomSubscription{TimelineLimit: 5, TimelineFilter: &internal.TimelineFilter{Types: []string{"m.room.message"}}}
+	c := RoomSubscription{TimelineLimit: 5}
+	assertBool(t, "same timeline_filter", a.TimelineFilterChanged(b), false)
+	assertBool(t, "removed timeline_filter", a.TimelineFilterChanged(c), true)
+	// combining subscriptions which agree keeps the filter
+	if combined := a.Combine(b); !combined.TimelineFilter.Same(messages) {
+		t.Errorf("Combine: got filter %+v want %+v", combined.TimelineFilter, messages)
+	}
+	// combining subscriptions which disagree must send everything
+	if combined := a.Combine(c); combined.TimelineFilter.Filters() {
+		t.Errorf("Combine: got filter %+v want none", combined.TimelineFilter)
+	}
+	// the filter is sticky on lists
+	prev := &Request{Lists: map[string]RequestList{"a": {RoomSubscription: a}}}
+	next, _ := prev.ApplyDelta(&Request{Lists: map[string]RequestList{"a": {}}})
+	if !next.Lists["a"].TimelineFilter.Same(messages) {
+		t.Errorf("ApplyDelta: timeline_filter was not sticky, got %+v", next.Lists["a"].TimelineFilter)
+	}
+}
+
+func TestRoomSubscriptionSummary(t *testing.T) {
+	boolTrue := true
+	a := RoomSubscription{TimelineLimit: 5, Summary: &boolTrue}
+	b := RoomSubscription{TimelineLimit: 5}
+	// either subscription asking for the summary is enough
+	assertBool(t, "a+b include_summary", a.Combine(b).IncludeSummary(), true)
+	assertBool(t, "b+a include_summary", b.Combine(a).IncludeSummary(), true)
+	assertBool(t, "b+b include_summary", b.Combine(b).IncludeSummary(), false)
+	// include_summary is sticky on lists
+	prev := &Request{Lists: map[string]RequestList{"a": {RoomSubscription: a}}}
+	next, _ := prev.ApplyDelta(&Request{Lists: map[string]RequestList{"a": {}}})
+	assertBool(t, "sticky include_summary", next.Lists["a"].IncludeSummary(), true)
+}
+
 type testData struct {
 	name string
 	next Request
@@ -1131,3 +1171,73 @@ func jsonEqual(t *testing.T, name string, got, want interface{}) {
 func listPtr(l RequestList) *RequestList {
 	return &l
 }
+
+func TestRequestFiltersSpaces(t *testing.T) {
+	newRoom := func(roomID string, parents ...string) *RoomConnMetadata {
+		urd := caches.NewUserRoomData()
+		for _, p := range parents {
+			urd.Spaces[p] = struct{}{}
+		}
+		return &RoomConnMetadata{
+			RoomMetadata: internal.RoomMetadata{RoomID: roomID},
+			UserRoomData: urd,
+		}
+	}
+	// !top contains !sub, which contains !room. !loopA and !loopB contain each other, and !loopA
+	// contains !looped.
+	rooms := []*RoomConnMetadata{
+		newRoom("!top"),
+		newRoom("!sub", "!top"),
+		newRoom("!room", "!sub"),
+		newRoom("!loopA", "!loopB"),
+		newRoom("!loopB", "!loopA"),
+		newRoom("!looped", "!loopA"),
+		newRoom("!elsewhere"),
+	}
+	f := newFinder(rooms)
+	testCases := []struct {
+		filters RequestFilters
+		want    []string
+	}{
+		{
+			filters: RequestFilters{Spaces: []string{"!top"}},
+			want:    []string{"!sub"},
+		},
+		{
+			filters: RequestFilters{Spaces: []string{"!top"}, IncludeSubspaces: true},
+			want:    []string{"!sub", "!room"},
+		},
+		{
+			// !loopB is its own grandparent, so it is in its own space
+			filters: RequestFilters{Spaces: []string{"!sub", "!loopB"}, IncludeSubspaces: true},
+			want:    []string{"!room", "!loopA", "!loopB", "!looped"},
+		},
+		{
+			filters: RequestFilters{Spaces: []string{"!nope"}, IncludeSubspaces: true},
+			want:    []string{},
+		},
+	}
+	for _, tc := range testCases {
+		got := []string{}
+		for _, r := range rooms {
+			if tc.filters.Include(r, f) {
+				got = append(got, r.RoomID)
+			}
+		}
+		sort.Strings(got)
+		sort.Strings(tc.want)
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%+v: got %v want %v", tc.filters, got, tc.want)
+		}
+	}
+
+	lists := NewInternalRequestLists()
+	for _, r := range rooms {
+		lists.SetRoom(*r)
+	}
+	got := lists.RoomsInSpace("!top")
+	sort.Strings(got)
+	if want := []string{"!room", "!sub"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("RoomsInSpace: got %v want %v", got, want)
+	}
+}
@@ -13,6 +13,11 @@ const (
 	OpInvalidate = "INVALIDATE"
 	OpInsert     = "INSERT"
 	OpDelete     = "DELETE"
+	// OpShift replaces the window for a range on lists with deltas enabled. Unlike SYNC, positions
+	// outside every range are dropped without an INVALIDATE, and clients keep the data for rooms
+	// which leave the window. Rooms in the range which the client already has up-to-date data for
+	// are listed in UnchangedRoomIDs and are not sent again.
+	OpShift = "SHIFT"
 )
 
 type Response struct {
@@ -113,6 +118,9 @@ type ResponseOpRange struct {
 	Operation string   `json:"op"`
 	Range     [2]int64 `json:"range,omitempty"`
 	RoomIDs   []string `json:"room_ids,omitempty"`
+	// For SHIFT: the rooms in RoomIDs whose data is not included in the response, as the client
+	// already has it.
+	UnchangedRoomIDs []string `json:"unchanged_room_ids,omitempty"`
 }
 
 func (r *ResponseOpRange) Op() string {
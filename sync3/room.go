@@ -12,18 +12,42 @@ type Room struct {
 	Name              string            `json:"name,omitempty"`
 	AvatarChange      AvatarChange      `json:"avatar,omitempty"`
 	Heroes            []internal.Hero   `json:"heroes,omitempty"`
+	Summary           *RoomSummary      `json:"summary,omitempty"`
 	RequiredState     []json.RawMessage `json:"required_state,omitempty"`
 	Timeline          []json.RawMessage `json:"timeline,omitempty"`
 	InviteState       []json.RawMessage `json:"invite_state,omitempty"`
+	KnockState        []json.RawMessage `json:"knock_state,omitempty"`
 	NotificationCount int64             `json:"notification_count"`
 	HighlightCount    int64             `json:"highlight_count"`
-	Initial           bool              `json:"initial,omitempty"`
-	IsDM              bool              `json:"is_dm,omitempty"`
-	JoinedCount       int               `json:"joined_count,omitempty"`
-	InvitedCount      *int              `json:"invited_count,omitempty"`
-	PrevBatch         string            `json:"prev_batch,omitempty"`
-	NumLive           int               `json:"num_live,omitempty"`
-	Timestamp         uint64            `json:"timestamp,omitempty"`
+	// thread root -> counts. Omitted if no threads have unread notifications, which like the
+	// room counts means every thread has been read.
+	UnreadThreadNotifications map[string]internal.UnreadCounts `json:"unread_thread_notifications,omitempty"`
+	Initial                   bool                             `json:"initial,omitempty"`
+	IsDM                      bool                             `json:"is_dm,omitempty"`
+	JoinedCount               int                              `json:"joined_count,omitempty"`
+	InvitedCount              *int                             `json:"invited_count,omitempty"`
+	PrevBatch                 string                           `json:"prev_batch,omitempty"`
+	NumLive                   int                              `json:"num_live,omitempty"`
+	Timestamp                 uint64                           `json:"timestamp,omitempty"`
+}
+
+// RoomSummary describes a room using the state events which clients commonly show in room
+// previews. It is only sent to subscriptions which set include_summary, initially and then
+// whenever any of it changes, in which case it replaces the previous summary entirely.
+type RoomSummary struct {
+	Topic             string `json:"topic,omitempty"`
+	JoinRule          string `json:"join_rule,omitempty"`
+	HistoryVisibility string `json:"history_visibility,omitempty"`
+	GuestAccess       string `json:"guest_access,omitempty"`
+}
+
+func NewRoomSummary(metadata *internal.RoomMetadata) *RoomSummary {
+	return &RoomSummary{
+		Topic:             metadata.Topic,
+		JoinRule:          metadata.JoinRule,
+		HistoryVisibility: metadata.HistoryVisibility,
+		GuestAccess:       metadata.GuestAccess,
+	}
 }
 
 // RoomConnMetadata represents a room as seen by one specific connection (hence one
@@ -0,0 +1,99 @@
+package sync3
+
+import (
+	"strings"
+	"unicode"
+
+	"golang.org/x/text/unicode/norm"
+
+	"github.com/matrix-org/sliding-sync/internal"
+)
+
+// Weights applied to a matching token depending on where it came from. A hit on the
+// room name is worth more than a hit on the canonical alias, which in turn is worth
+// more than a hit on the display name of a DM hero.
+const (
+	searchWeightName  = 3
+	searchWeightAlias = 2
+	searchWeightHero  = 1
+)
+
+// NormaliseForSearch lower-cases the string and strips diacritics, so "Ça Va" becomes "ca va".
+// Everything which is not a letter or a digit is replaced with a space.
+func NormaliseForSearch(s string) string {
+	var sb strings.Builder
+	sb.Grow(len(s))
+	for _, r := range norm.NFD.String(s) {
+		switch {
+		case unicode.Is(unicode.Mn, r):
+			// combining mark i.e the accent from a decomposed character, drop it
+			continue
+		case unicode.IsLetter(r) || unicode.IsDigit(r):
+			sb.WriteRune(unicode.ToLower(r))
+		default:
+			sb.WriteRune(' ')
+		}
+	}
+	return sb.String()
+}
+
+// tokeniseForSearch normalises the string and splits it into tokens.
+func tokeniseForSearch(s string) []string {
+	return strings.Fields(NormaliseForSearch(s))
+}
+
+type searchField struct {
+	tokens []string
+	weight int
+}
+
+// RoomSearchScore returns how well this room matches the search query. Every token in the
+// query must be a prefix of at least one token in the room name, canonical alias or (for DMs)
+// hero display names, else the score is 0. Higher scores are better matches.
+func RoomSearchScore(r *RoomConnMetadata, query string) int {
+	queryTokens := tokeniseForSearch(query)
+	if len(queryTokens) == 0 {
+		return 0
+	}
+	roomName, _ := internal.CalculateRoomName(&r.RoomMetadata, 5)
+	fields := []searchField{
+		{tokens: tokeniseForSearch(roomName), weight: searchWeightName},
+		{tokens: tokeniseForSearch(r.CanonicalAlias), weight: searchWeightAlias},
+	}
+	if r.IsDM {
+		for _, h := range r.Heroes {
+			fields = append(fields, searchField{tokens: tokeniseForSearch(h.Name), weight: searchWeightHero})
+		}
+	}
+
+	score := 0
+	for _, qt := range queryTokens {
+		best := 0
+		for _, f := range fields {
+			for _, t := range f.tokens {
+				var s int
+				if t == qt {
+					s = 2 * f.weight // exact token match
+				} else if strings.HasPrefix(t, qt) {
+					s = f.weight
+				}
+				if s > best {
+					best = s
+				}
+			}
+		}
+		if best == 0 {
+			return 0
+		}
+		score += best
+	}
+	// reward names which start with the whole query, so "foo b" prefers "Foo Bar" over "Bar Foo Baz"
+	normName := strings.Join(fields[0].tokens, " ")
+	normQuery := strings.Join(queryTokens, " ")
+	if normName == normQuery {
+		score += 10
+	} else if strings.HasPrefix(normName, normQuery) {
+		score += 5
+	}
+	return score
+}
@@ -0,0 +1,117 @@
+package sync3
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/matrix-org/sliding-sync/internal"
+	"github.com/matrix-org/sliding-sync/sync3/caches"
+)
+
+func TestNormaliseForSearch(t *testing.T) {
+	testCases := map[string]string{
+		"Ça Va":          "ca va",
+		"CAFÉ crème":     "cafe creme",
+		"#foo:localhost": " foo localhost",
+		"Zoë's room!":    "zoe s room ",
+	}
+	for input, want := range testCases {
+		if got := NormaliseForSearch(input); got != want {
+			t.Errorf("NormaliseForSearch(%q): got %q want %q", input, got, want)
+		}
+	}
+}
+
+func TestRoomSearchScore(t *testing.T) {
+	cafe := &RoomConnMetadata{
+		RoomMetadata: internal.RoomMetadata{
+			RoomID:    "!cafe:localhost",
+			NameEvent: "Café Society",
+		},
+	}
+	alias := &RoomConnMetadata{
+		RoomMetadata: internal.RoomMetadata{
+			RoomID:         "!alias:localhost",
+			NameEvent:      "Something else",
+			CanonicalAlias: "#cafe-chat:localhost",
+		},
+	}
+	dm := &RoomConnMetadata{
+		RoomMetadata: internal.RoomMetadata{
+			RoomID: "!dm:localhost",
+			Heroes: []internal.Hero{{ID: "@zoe:localhost", Name: "Zoë Cafferty"}},
+		},
+		UserRoomData: caches.UserRoomData{IsDM: true},
+	}
+	testCases := []struct {
+		query     string
+		room      *RoomConnMetadata
+		wantMatch bool
+	}{
+		{query: "cafe", room: cafe, wantMatch: true},
+		{query: "CAFÉ SOC", room: cafe, wantMatch: true},
+		{query: "society cafe", room: cafe, wantMatch: true},
+		{query: "cafe bar", room: cafe, wantMatch: false},
+		{query: "ciety", room: cafe, wantMatch: false}, // not a token prefix
+		{query: "cafe", room: alias, wantMatch: true},
+		{query: "chat", room: alias, wantMatch: true},
+		{query: "zoe", room: dm, wantMatch: true},
+		{query: "caff", room: dm, wantMatch: true},
+		{query: "", room: cafe, wantMatch: false},
+	}
+	for _, tc := range testCases {
+		score := RoomSearchScore(tc.room, tc.query)
+		if (score > 0) != tc.wantMatch {
+			t.Errorf("RoomSearchScore(%s, %q): got score %d, want match=%v", tc.room.RoomID, tc.query, score, tc.wantMatch)
+		}
+	}
+	// a hit on the room name beats a hit on the alias
+	if RoomSearchScore(cafe, "cafe") <= RoomSearchScore(alias, "cafe") {
+		t.Errorf("RoomSearchScore: name match did not outrank alias match")
+	}
+}
+
+func TestSortByRelevance(t *testing.T) {
+	const listKey = "my_list"
+	rooms := []*RoomConnMetadata{
+		{
+			RoomMetadata: internal.RoomMetadata{
+				RoomID:         "!alias:localhost",
+				NameEvent:      "General",
+				CanonicalAlias: "#project-x:localhost",
+			},
+			LastInterestedEventTimestamps: map[string]uint64{listKey: 300},
+		},
+		{
+			RoomMetadata: internal.RoomMetadata{
+				RoomID:    "!prefix:localhost",
+				NameEvent: "Projects and more",
+			},
+			LastInterestedEventTimestamps: map[string]uint64{listKey: 200},
+		},
+		{
+			RoomMetadata: internal.RoomMetadata{
+				RoomID:    "!exact:localhost",
+				NameEvent: "Project",
+			},
+			LastInterestedEventTimestamps: map[string]uint64{listKey: 100},
+		},
+		{
+			RoomMetadata: internal.RoomMetadata{
+				RoomID:    "!nomatch:localhost",
+				NameEvent: "Random",
+			},
+			LastInterestedEventTimestamps: map[string]uint64{listKey: 400},
+		},
+	}
+	f := newFinder(rooms)
+	filter := &RequestFilters{RoomNameSearch: "project"}
+	sr := NewFilteredSortableRooms(f, listKey, f.roomIDs, filter)
+	if err := sr.Sort([]string{SortByRelevance, SortByRecency}); err != nil {
+		t.Fatalf("Sort: %s", err)
+	}
+	want := []string{"!exact:localhost", "!prefix:localhost", "!alias:localhost"}
+	if got := sr.RoomIDs(); !reflect.DeepEqual(got, want) {
+		t.Errorf("by_relevance: got %v want %v", got, want)
+	}
+}
@@ -18,6 +18,10 @@ type SortableRooms struct {
 	listKey       string
 	roomIDs       []string
 	roomIDToIndex map[string]int // room_id -> index in rooms
+	// the room_name_search query to rank rooms by when sorting by relevance
+	searchQuery string
+	// room_id -> search score, calculated at the start of each relevance sort
+	relevance map[string]int
 }
 
 func NewSortableRooms(finder RoomFinder, listKey string, rooms []string) *SortableRooms {
@@ -89,26 +93,21 @@ func (s *SortableRooms) Subslice(i, j int64) Subslicer {
 func (s *SortableRooms) Sort(sortBy []string) error {
 	// TODO: find a way to plumb a context into this assert
 	internal.Assert("sortBy is not empty", len(sortBy) != 0)
-	comparators := []func(i, j int) int{}
+	comparators := make([]SortComparator, 0, len(sortBy))
 	for _, sort := range sortBy {
-		switch sort {
-		case SortByHighlightCount:
-			comparators = append(comparators, s.comparatorSortByHighlightCount)
-		case SortByNotificationCount:
-			comparators = append(comparators, s.comparatorSortByNotificationCount)
-		case SortByName:
-			comparators = append(comparators, s.comparatorSortByName)
-		case SortByRecency:
-			comparators = append(comparators, s.comparatorSortByRecency)
-		case SortByNotificationLevel:
-			comparators = append(comparators, s.comparatorSortByNotificationLevel)
-		default:
+		c, ok := sortComparators[sort]
+		if !ok {
 			return fmt.Errorf("unknown sort order: %s", sort)
 		}
+		if c.Prepare != nil {
+			c.Prepare(s)
+		}
+		comparators = append(comparators, c)
 	}
 	sort.SliceStable(s.roomIDs, func(i, j int) bool {
-		for _, fn := range comparators {
-			val := fn(i, j)
+		ri, rj := s.resolveRooms(i, j)
+		for _, c := range comparators {
+			val := c.Compare(s, ri, rj)
 			if val == 1 {
 				return true
 			} else if val == -1 {
@@ -126,6 +125,43 @@ func (s *SortableRooms) Sort(sortBy []string) error {
 	return nil
 }
 
+// SortComparator is a named ordering which clients can request via the `sort` field of a list.
+type SortComparator struct {
+	// Prepare is called once at the start of every sort before any comparisons are made, so
+	// comparators which need expensive per-room data can calculate it up front. May be nil.
+	Prepare func(s *SortableRooms)
+	// Compare returns +1 if ri should be sorted before rj, -1 if rj should be sorted before ri,
+	// and 0 if they are equal, in which case the next comparator in the sort order is consulted.
+	Compare func(s *SortableRooms, ri, rj *RoomConnMetadata) int
+}
+
+// sort_name -> comparator
+var sortComparators = map[string]SortComparator{}
+
+// RegisterSortComparator makes a new sort order available to clients. Panics if the name is
+// already registered, as this is always a programming error.
+func RegisterSortComparator(sortBy string, c SortComparator) {
+	if _, exists := sortComparators[sortBy]; exists {
+		panic("RegisterSortComparator: duplicate sort order " + sortBy)
+	}
+	sortComparators[sortBy] = c
+	SortBy = append(SortBy, sortBy)
+}
+
+func init() {
+	RegisterSortComparator(SortByHighlightCount, SortComparator{Compare: (*SortableRooms).comparatorSortByHighlightCount})
+	RegisterSortComparator(SortByName, SortComparator{Compare: (*SortableRooms).comparatorSortByName})
+	RegisterSortComparator(SortByNotificationCount, SortComparator{Compare: (*SortableRooms).comparatorSortByNotificationCount})
+	RegisterSortComparator(SortByRecency, SortComparator{Compare: (*SortableRooms).comparatorSortByRecency})
+	RegisterSortComparator(SortByNotificationLevel, SortComparator{Compare: (*SortableRooms).comparatorSortByNotificationLevel})
+	RegisterSortComparator(SortByRelevance, SortComparator{
+		Prepare: (*SortableRooms).calculateRelevance,
+		Compare: (*SortableRooms).comparatorSortByRelevance,
+	})
+	RegisterSortComparator(SortByJoinTime, SortComparator{Compare: (*SortableRooms).comparatorSortByJoinTime})
+	RegisterSortComparator(SortByMarkedUnread, SortComparator{Compare: (*SortableRooms).comparatorSortByMarkedUnread})
+}
+
 // Comparator functions: -1 = false, +1 = true, 0 = match
 
 func (s *SortableRooms) resolveRooms(i, j int) (ri, rj *RoomConnMetadata) {
@@ -134,8 +170,7 @@ func (s *SortableRooms) resolveRooms(i, j int) (ri, rj *RoomConnMetadata) {
 	return
 }
 
-func (s *SortableRooms) comparatorSortByName(i, j int) int {
-	ri, rj := s.resolveRooms(i, j)
+func (s *SortableRooms) comparatorSortByName(ri, rj *RoomConnMetadata) int {
 	if ri.CanonicalisedName == rj.CanonicalisedName {
 		return 0
 	}
@@ -145,8 +180,7 @@ func (s *SortableRooms) comparatorSortByName(i, j int) int {
 	return -1
 }
 
-func (s *SortableRooms) comparatorSortByRecency(i, j int) int {
-	ri, rj := s.resolveRooms(i, j)
+func (s *SortableRooms) comparatorSortByRecency(ri, rj *RoomConnMetadata) int {
 	tsRi := ri.GetLastInterestedEventTimestamp(s.listKey)
 	tsRj := rj.GetLastInterestedEventTimestamp(s.listKey)
 	if tsRi == tsRj {
@@ -158,8 +192,7 @@ func (s *SortableRooms) comparatorSortByRecency(i, j int) int {
 	return -1
 }
 
-func (s *SortableRooms) comparatorSortByHighlightCount(i, j int) int {
-	ri, rj := s.resolveRooms(i, j)
+func (s *SortableRooms) comparatorSortByHighlightCount(ri, rj *RoomConnMetadata) int {
 	if ri.HighlightCount == rj.HighlightCount {
 		return 0
 	}
@@ -169,8 +202,7 @@ func (s *SortableRooms) comparatorSortByHighlightCount(i, j int) int {
 	return -1
 }
 
-func (s *SortableRooms) comparatorSortByNotificationLevel(i, j int) int {
-	ri, rj := s.resolveRooms(i, j)
+func (s *SortableRooms) comparatorSortByNotificationLevel(ri, rj *RoomConnMetadata) int {
 	// highlight rooms come first
 	if ri.HighlightCount > 0 && rj.HighlightCount > 0 {
 		return 0
@@ -202,8 +234,35 @@ func (s *SortableRooms) comparatorSortByNotificationLevel(i, j int) int {
 	return 0
 }
 
-func (s *SortableRooms) comparatorSortByNotificationCount(i, j int) int {
-	ri, rj := s.resolveRooms(i, j)
+// calculateRelevance scores every room against the search query up front, as scoring is
+// far too expensive to do on every comparison.
+func (s *SortableRooms) calculateRelevance() {
+	s.relevance = make(map[string]int, len(s.roomIDs))
+	if s.searchQuery == "" {
+		return
+	}
+	for _, roomID := range s.roomIDs {
+		r := s.finder.ReadOnlyRoom(roomID)
+		if r == nil {
+			continue
+		}
+		s.relevance[roomID] = RoomSearchScore(r, s.searchQuery)
+	}
+}
+
+func (s *SortableRooms) comparatorSortByRelevance(ri, rj *RoomConnMetadata) int {
+	scoreRi := s.relevance[ri.RoomID]
+	scoreRj := s.relevance[rj.RoomID]
+	if scoreRi == scoreRj {
+		return 0
+	}
+	if scoreRi > scoreRj {
+		return 1
+	}
+	return -1
+}
+
+func (s *SortableRooms) comparatorSortByNotificationCount(ri, rj *RoomConnMetadata) int {
 	if ri.NotificationCount == rj.NotificationCount {
 		return 0
 	}
@@ -213,6 +272,29 @@ func (s *SortableRooms) comparatorSortByNotificationCount(i, j int) int {
 	return -1
 }
 
+// comparatorSortByJoinTime puts the rooms we joined most recently first. Rooms without a join
+// e.g invites have no join timing so will be sorted last.
+func (s *SortableRooms) comparatorSortByJoinTime(ri, rj *RoomConnMetadata) int {
+	if ri.JoinTiming.NID == rj.JoinTiming.NID {
+		return 0
+	}
+	if ri.JoinTiming.NID > rj.JoinTiming.NID {
+		return 1
+	}
+	return -1
+}
+
+// comparatorSortByMarkedUnread puts rooms the user has explicitly marked as unread first.
+func (s *SortableRooms) comparatorSortByMarkedUnread(ri, rj *RoomConnMetadata) int {
+	if ri.MarkedUnread == rj.MarkedUnread {
+		return 0
+	}
+	if ri.MarkedUnread {
+		return 1
+	}
+	return -1
+}
+
 // FilteredSortableRooms is SortableRooms but where rooms are filtered before being added to the list.
 // Updates to room metadata may result in rooms being added/removed.
 type FilteredSortableRooms struct {
@@ -231,8 +313,10 @@ func NewFilteredSortableRooms(finder RoomFinder, listKey string, roomIDs []strin
 			filteredRooms = append(filteredRooms, roomID)
 		}
 	}
+	sortableRooms := NewSortableRooms(finder, listKey, filteredRooms)
+	sortableRooms.searchQuery = filter.RoomNameSearch
 	return &FilteredSortableRooms{
-		SortableRooms: NewSortableRooms(finder, listKey, filteredRooms),
+		SortableRooms: sortableRooms,
 		filter:        filter,
 	}
 }
@@ -387,3 +387,106 @@ func TestSortByNotificationLevel(t *testing.T) {
 		t.Errorf("want: %v", wantRoomIDs)
 	}
 }
+
+func TestSortByJoinTimeAndMarkedUnread(t *testing.T) {
+	const listKey = "my_list"
+	roomOld := "!old:localhost"
+	roomNew := "!new:localhost"
+	roomUnread := "!unread:localhost"
+	roomInvite := "!invite:localhost"
+	rooms := []*RoomConnMetadata{
+		{
+			RoomMetadata: internal.RoomMetadata{RoomID: roomOld},
+			UserRoomData: caches.UserRoomData{
+				JoinTiming: internal.EventMetadata{NID: 10, Timestamp: 1000},
+			},
+			LastInterestedEventTimestamps: map[string]uint64{listKey: 400},
+		},
+		{
+			RoomMetadata: internal.RoomMetadata{RoomID: roomNew},
+			UserRoomData: caches.UserRoomData{
+				JoinTiming: internal.EventMetadata{NID: 30, Timestamp: 3000},
+			},
+			LastInterestedEventTimestamps: map[string]uint64{listKey: 300},
+		},
+		{
+			RoomMetadata: internal.RoomMetadata{RoomID: roomUnread},
+			UserRoomData: caches.UserRoomData{
+				JoinTiming:   internal.EventMetadata{NID: 20, Timestamp: 2000},
+				MarkedUnread: true,
+			},
+			LastInterestedEventTimestamps: map[string]uint64{listKey: 200},
+		},
+		{
+			RoomMetadata: internal.RoomMetadata{RoomID: roomInvite},
+			UserRoomData: caches.UserRoomData{
+				IsInvite: true,
+			},
+			LastInterestedEventTimestamps: map[string]uint64{listKey: 100},
+		},
+	}
+	f := newFinder(rooms)
+	sr := NewSortableRooms(f, listKey, f.roomIDs)
+	testCases := []struct {
+		SortBy  []string
+		WantIDs []string
+	}{
+		{
+			SortBy:  []string{SortByJoinTime},
+			WantIDs: []string{roomNew, roomUnread, roomOld, roomInvite},
+		},
+		{
+			SortBy:  []string{SortByMarkedUnread, SortByRecency},
+			WantIDs: []string{roomUnread, roomOld, roomNew, roomInvite},
+		},
+		{
+			SortBy:  []string{SortByMarkedUnread, SortByJoinTime},
+			WantIDs: []string{roomUnread, roomNew, roomOld, roomInvite},
+		},
+	}
+	for _, tc := range testCases {
+		if err := sr.Sort(tc.SortBy); err != nil {
+			t.Fatalf("Sort: %s", err)
+		}
+		if got := sr.RoomIDs(); !reflect.DeepEqual(got, tc.WantIDs) {
+			t.Errorf("%v: got %v want %v", tc.SortBy, got, tc.WantIDs)
+		}
+	}
+}
+
+func TestRegisterSortComparator(t *testing.T) {
+	const listKey = "my_list"
+	const sortByRoomID = "test_by_room_id_desc"
+	RegisterSortComparator(sortByRoomID, SortComparator{
+		Compare: func(s *SortableRooms, ri, rj *RoomConnMetadata) int {
+			if ri.RoomID == rj.RoomID {
+				return 0
+			}
+			if ri.RoomID > rj.RoomID {
+				return 1
+			}
+			return -1
+		},
+	})
+	defer func() {
+		delete(sortComparators, sortByRoomID)
+		SortBy = SortBy[:len(SortBy)-1]
+	}()
+	rooms := []*RoomConnMetadata{
+		{RoomMetadata: internal.RoomMetadata{RoomID: "!a:localhost"}},
+		{RoomMetadata: internal.RoomMetadata{RoomID: "!c:localhost"}},
+		{RoomMetadata: internal.RoomMetadata{RoomID: "!b:localhost"}},
+	}
+	f := newFinder(rooms)
+	sr := NewSortableRooms(f, listKey, f.roomIDs)
+	if err := sr.Sort([]string{sortByRoomID}); err != nil {
+		t.Fatalf("Sort: %s", err)
+	}
+	want := []string{"!c:localhost", "!b:localhost", "!a:localhost"}
+	if got := sr.RoomIDs(); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v want %v", got, want)
+	}
+	if err := sr.Sort([]string{"not_a_real_sort"}); err == nil {
+		t.Errorf("Sort: expected error for unknown sort order")
+	}
+}
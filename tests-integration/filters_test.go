@@ -2,6 +2,8 @@ package syncv3
 
 import (
 	"encoding/json"
+	"fmt"
+	"reflect"
 	"testing"
 	"time"
 
@@ -623,3 +625,139 @@ func TestFiltersTags(t *testing.T) {
 		m.MatchV3InsertOp(3, fav2RoomID),
 	)))
 }
+
+func TestFiltersKnock(t *testing.T) {
+	boolTrue := true
+	boolFalse := false
+	pqString := testutils.PrepareDBConnectionString()
+	v2 := runTestV2Server(t)
+	v3 := runTestServer(t, v2, pqString)
+	defer v2.close()
+	defer v3.close()
+	roomID := "!TestFiltersKnock:localhost"
+	creator := "@creator:other"
+	knockState := []json.RawMessage{
+		testutils.NewStateEvent(t, "m.room.name", "", creator, map[string]interface{}{"name": "Knock knock"}),
+		testutils.NewStateEvent(t, "m.room.join_rules", "", creator, map[string]interface{}{"join_rule": "knock"}),
+		testutils.NewStateEvent(t, "m.room.member", alice, alice, map[string]interface{}{"membership": "knock"}),
+	}
+	t.Log("Alice knocks on a room.")
+	v2.addAccount(t, alice, aliceToken)
+	v2.queueResponse(alice, sync2.SyncResponse{
+		Rooms: sync2.SyncRoomsResponse{
+			Knock: map[string]sync2.SyncV2KnockResponse{
+				roomID: {KnockState: sync2.EventsResponse{Events: knockState}},
+			},
+		},
+	})
+
+	t.Log("Alice sliding syncs, requesting two separate lists: knocks and everything else.")
+	res := v3.mustDoV3Request(t, aliceToken, sync3.Request{
+		Lists: map[string]sync3.RequestList{
+			"knock": {
+				Ranges:  sync3.SliceRanges{{0, 20}},
+				Filters: &sync3.RequestFilters{IsKnock: &boolTrue},
+			},
+			"noknock": {
+				Ranges:  sync3.SliceRanges{{0, 20}},
+				Filters: &sync3.RequestFilters{IsKnock: &boolFalse},
+			},
+		},
+	})
+	t.Log("Alice should see the room with its knock_state in the knocks list only.")
+	m.MatchResponse(t, res, m.MatchLists(map[string][]m.ListMatcher{
+		"knock": {
+			m.MatchV3Count(1),
+			m.MatchV3Ops(m.MatchV3SyncOp(0, 0, []string{roomID})),
+		},
+		"noknock": {
+			m.MatchV3Count(0),
+		},
+	}), m.MatchRoomSubscription(roomID, m.MatchRoomName("Knock knock"), func(r sync3.Room) error {
+		if !reflect.DeepEqual(r.KnockState, knockState) {
+			return fmt.Errorf("knock_state: got %v want %v", r.KnockState, knockState)
+		}
+		if len(r.InviteState) > 0 || len(r.RequiredState) > 0 {
+			return fmt.Errorf("knocked room has invite_state or required_state: %+v", r)
+		}
+		return nil
+	}))
+
+	t.Log("Alice's knock is rejected.")
+	var leave sync2.SyncV2LeaveResponse
+	leave.Timeline.Events = []json.RawMessage{
+		testutils.NewStateEvent(t, "m.room.member", alice, creator, map[string]interface{}{"membership": "leave"}),
+	}
+	v2.queueResponse(alice, sync2.SyncResponse{
+		Rooms: sync2.SyncRoomsResponse{
+			Leave: map[string]sync2.SyncV2LeaveResponse{roomID: leave},
+		},
+	})
+	v2.waitUntilEmpty(t, alice)
+	res = v3.mustDoV3RequestWithPos(t, aliceToken, res.Pos, sync3.Request{})
+	m.MatchResponse(t, res, m.MatchList("knock", m.MatchV3Count(0), m.MatchV3Ops(m.MatchV3DeleteOp(0))))
+}
+
+// Test that join rule filters work initially and whilst streamed.
+func TestFiltersJoinRules(t *testing.T) {
+	rig := NewTestRig(t)
+	defer rig.Finish()
+	publicRoomID := "!public:localhost"
+	privateRoomID := "!private:localhost"
+	// rig rooms are public to begin with
+	rig.SetupV2RoomsForUser(t, alice, NoFlush, map[string]RoomDescriptor{
+		publicRoomID:  {},
+		privateRoomID: {},
+	})
+	aliceToken := rig.Token(alice)
+	joinRulesReq := sync3.Request{
+		Lists: map[string]sync3.RequestList{
+			"public": {
+				Ranges:  sync3.SliceRanges{{0, 20}},
+				Filters: &sync3.RequestFilters{JoinRules: []string{"public"}},
+			},
+			"private": {
+				Ranges:  sync3.SliceRanges{{0, 20}},
+				Filters: &sync3.RequestFilters{NotJoinRules: []string{"public"}},
+			},
+		},
+	}
+	res := rig.V3.mustDoV3Request(t, aliceToken, joinRulesReq)
+	m.MatchResponse(t, res, m.MatchLists(map[string][]m.ListMatcher{
+		"public": {
+			m.MatchV3Count(2),
+		},
+		"private": {
+			m.MatchV3Count(0),
+		},
+	}))
+
+	t.Log("The older room becomes invite-only, so moves to the private list.")
+	rig.FlushEvent(t, alice, privateRoomID, testutils.NewStateEvent(t, "m.room.join_rules", "", alice, map[string]interface{}{
+		"join_rule": "invite",
+	}))
+	res = rig.V3.mustDoV3RequestWithPos(t, aliceToken, res.Pos, sync3.Request{})
+	m.MatchResponse(t, res, m.MatchLists(map[string][]m.ListMatcher{
+		"public": {
+			m.MatchV3Count(1),
+			m.MatchV3Ops(m.MatchV3DeleteOp(1)),
+		},
+		"private": {
+			m.MatchV3Count(1),
+			m.MatchV3Ops(m.MatchV3DeleteOp(0), m.MatchV3InsertOp(0, privateRoomID)),
+		},
+	}))
+
+	t.Log("A new connection sees the same lists from the start.")
+	res = rig.V3.mustDoV3Request(t, aliceToken, joinRulesReq)
+	m.MatchResponse(t, res, m.MatchLists(map[string][]m.ListMatcher{
+		"public": {
+			m.MatchV3Count(1),
+			m.MatchV3Ops(m.MatchV3SyncOp(0, 0, []string{publicRoomID})),
+		},
+		"private": {
+			m.MatchV3Count(1),
+			m.MatchV3Ops(m.MatchV3SyncOp(0, 0, []string{privateRoomID})),
+		},
+	}))
+}
@@ -0,0 +1,63 @@
+package syncv3
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	syncv3 "github.com/matrix-org/sliding-sync"
+	"github.com/matrix-org/sliding-sync/sync2"
+	"github.com/matrix-org/sliding-sync/sync3"
+	"github.com/matrix-org/sliding-sync/testutils"
+	"github.com/matrix-org/sliding-sync/testutils/m"
+)
+
+// Test that users on another homeserver are polled from that homeserver, and that new access tokens
+// for requests made to a mapped host are only accepted if they belong to that host's homeserver.
+func TestSeveralHomeservers(t *testing.T) {
+	pqString := testutils.PrepareDBConnectionString()
+	v2 := runTestV2Server(t)
+	v2Org := runTestV2Server(t)
+	v3 := runTestServer(t, v2, pqString, syncv3.Opts{
+		Homeservers: map[string]string{"example.org": v2Org.url()},
+		// the test server listens on 127.0.0.1
+		HomeserverHosts: map[string]string{"127.0.0.1": "example.org"},
+	})
+	defer v2.close()
+	defer v2Org.close()
+	defer v3.close()
+
+	orgUser := "@bob:example.org"
+	orgToken := "BOB_BEARER_TOKEN_TestSeveralHomeservers"
+	roomID := "!TestSeveralHomeservers:example.org"
+	v2Org.addAccount(t, orgUser, orgToken)
+	v2Org.queueResponse(orgUser, sync2.SyncResponse{
+		Rooms: sync2.SyncRoomsResponse{
+			Join: v2JoinTimeline(roomEvents{
+				roomID: roomID,
+				events: createRoomState(t, orgUser, time.Now()),
+			}),
+		},
+	})
+	res := v3.mustDoV3Request(t, orgToken, sync3.Request{
+		Lists: map[string]sync3.RequestList{
+			"a": {Ranges: sync3.SliceRanges{{0, 10}}},
+		},
+	})
+	m.MatchResponse(t, res, m.MatchList("a", m.MatchV3Count(1)))
+
+	t.Log("A user on the default homeserver is rejected, as this host belongs to example.org.")
+	v2.addAccount(t, alice, aliceToken)
+	v2.queueResponse(alice, sync2.SyncResponse{})
+	_, body, code := v3.doV3Request(t, context.Background(), aliceToken, "", sync3.Request{})
+	if code != 401 {
+		t.Fatalf("got HTTP %d want 401: %s", code, string(body))
+	}
+
+	t.Log("example.org cannot vouch for a user on the default homeserver either.")
+	v2Org.addAccount(t, alice, "EVIL_TOKEN_TestSeveralHomeservers")
+	_, body, code = v3.doV3Request(t, context.Background(), "EVIL_TOKEN_TestSeveralHomeservers", "", sync3.Request{})
+	if code != 401 {
+		t.Fatalf("got HTTP %d want 401: %s", code, string(body))
+	}
+}
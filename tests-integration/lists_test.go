@@ -194,6 +194,96 @@ func TestUnreadCountMisordering(t *testing.T) {
 	)))
 }
 
+// Test that lists sorted by by_marked_unread and by_join_time are resorted when rooms are marked
+// as unread or joined.
+func TestSortByMarkedUnreadAndJoinTimeLive(t *testing.T) {
+	pqString := testutils.PrepareDBConnectionString()
+	v2 := runTestV2Server(t)
+	v3 := runTestServer(t, v2, pqString)
+	defer v2.close()
+	defer v3.close()
+	roomA := "!a:localhost"
+	roomB := "!b:localhost"
+	roomC := "!c:localhost"
+	roomD := "!d:localhost"
+	// sorted by recency: B, A, C
+	latestTimestamps := map[string]time.Time{
+		roomA: time.Now().Add(20 * time.Second),
+		roomB: time.Now().Add(30 * time.Second),
+		roomC: time.Now().Add(10 * time.Second),
+	}
+	var re []roomEvents
+	for roomID, ts := range latestTimestamps {
+		re = append(re, roomEvents{
+			roomID: roomID,
+			state:  createRoomState(t, alice, time.Now()),
+			events: []json.RawMessage{
+				testutils.NewEvent(t, "m.room.message", alice, map[string]interface{}{"body": "latest msg"}, testutils.WithTimestamp(ts)),
+			},
+		})
+	}
+	v2.addAccount(t, alice, aliceToken)
+	v2.queueResponse(alice, sync2.SyncResponse{
+		Rooms: sync2.SyncRoomsResponse{
+			Join: v2JoinTimeline(re...),
+		},
+	})
+	req := sync3.Request{
+		Lists: map[string]sync3.RequestList{
+			"unread": {
+				Ranges: sync3.SliceRanges{{0, 10}},
+				Sort:   []string{sync3.SortByMarkedUnread, sync3.SortByRecency},
+			},
+			"joined": {
+				Ranges: sync3.SliceRanges{{0, 10}},
+				Sort:   []string{sync3.SortByJoinTime},
+			},
+		},
+	}
+	res := v3.mustDoV3Request(t, aliceToken, req)
+	m.MatchResponse(t, res, m.MatchList("unread", m.MatchV3Count(3), m.MatchV3Ops(
+		m.MatchV3SyncOp(0, 2, []string{roomB, roomA, roomC}),
+	)), m.MatchList("joined", m.MatchV3Count(3)))
+
+	// marking C as unread moves it to the top
+	v2.queueResponse(alice, sync2.SyncResponse{
+		Rooms: sync2.SyncRoomsResponse{
+			Join: map[string]sync2.SyncV2JoinResponse{
+				roomC: {
+					AccountData: sync2.EventsResponse{
+						Events: []json.RawMessage{
+							testutils.NewAccountData(t, "m.marked_unread", map[string]interface{}{"unread": true}),
+						},
+					},
+				},
+			},
+		},
+	})
+	v2.waitUntilEmpty(t, alice)
+	res = v3.mustDoV3RequestWithPos(t, aliceToken, res.Pos, req)
+	m.MatchResponse(t, res, m.MatchList("unread", m.MatchV3Count(3), m.MatchV3Ops(
+		m.MatchV3DeleteOp(2), m.MatchV3InsertOp(0, roomC),
+	)))
+
+	// joining D puts it at the top of the rooms sorted by join time
+	v2.queueResponse(alice, sync2.SyncResponse{
+		Rooms: sync2.SyncRoomsResponse{
+			Join: v2JoinTimeline(roomEvents{
+				roomID: roomD,
+				state:  createRoomState(t, "@creator:localhost", time.Now())[:1],
+				events: []json.RawMessage{
+					testutils.NewJoinEvent(t, alice),
+				},
+			}),
+		},
+	})
+	v2.waitUntilEmpty(t, alice)
+	res = v3.mustDoV3RequestWithPos(t, aliceToken, res.Pos, req)
+	m.MatchResponse(t, res, m.MatchList("joined", m.MatchV3Count(4), m.MatchV3Ops(
+		m.MatchV3DeleteOp(3), m.MatchV3InsertOp(0, roomD),
+	)))
+}
+
 func TestBumpEventTypesOnStartup(t *testing.T) {
 	const room1ID = "!room1:localhost"
 	const room2ID = "!room2:localhost"
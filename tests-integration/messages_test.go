@@ -0,0 +1,194 @@
+package syncv3
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/sliding-sync/sync2"
+	"github.com/matrix-org/sliding-sync/sync3"
+	"github.com/matrix-org/sliding-sync/testutils"
+	"github.com/tidwall/gjson"
+)
+
+// Test that /messages is served from the proxy's event store, and only goes to the homeserver
+// once the proxy runs out of events.
+func TestMessagesBackfill(t *testing.T) {
+	pqString := testutils.PrepareDBConnectionString()
+	v2 := runTestV2Server(t)
+	v3 := runTestServer(t, v2, pqString)
+	defer v2.close()
+	defer v3.close()
+	roomID := "!TestMessagesBackfill:localhost"
+	prevBatch := "upstream_prev_batch"
+	var messages []json.RawMessage
+	for i := 1; i <= 4; i++ {
+		messages = append(messages, testutils.NewEvent(t, "m.room.message", alice, map[string]interface{}{"body": fmt.Sprintf("%d", i)}))
+	}
+	v2.addAccount(t, alice, aliceToken)
+	v2.queueResponse(alice, sync2.SyncResponse{
+		Rooms: sync2.SyncRoomsResponse{
+			Join: v2JoinTimeline(roomEvents{
+				roomID:    roomID,
+				state:     createRoomState(t, alice, time.Now()),
+				events:    messages,
+				prevBatch: prevBatch,
+			}),
+		},
+	})
+	v3.mustDoV3Request(t, aliceToken, sync3.Request{
+		RoomSubscriptions: map[string]sync3.RoomSubscription{
+			roomID: {TimelineLimit: 1},
+		},
+	})
+	var upstreamFroms []string
+	v2.SetMessages(func(token, gotRoomID string, req *http.Request) sync2.MessagesResponse {
+		if gotRoomID != roomID {
+			t.Errorf("upstream /messages: got room %s want %s", gotRoomID, roomID)
+		}
+		from := req.URL.Query().Get("from")
+		upstreamFroms = append(upstreamFroms, from)
+		return sync2.MessagesResponse{
+			Chunk: []json.RawMessage{testutils.NewEvent(t, "m.room.message", alice, map[string]interface{}{"body": "0"})},
+			Start: from,
+		}
+	})
+
+	// the first page comes from the proxy
+	res := doMessagesRequest(t, v3, aliceToken, roomID, "", 3)
+	assertMessageBodies(t, res, []string{"4", "3", "2"})
+	if res.End == "" || res.End == prevBatch {
+		t.Fatalf("first page: got end %q, want a proxy token", res.End)
+	}
+	// the second page runs out of events, so hands over to the homeserver
+	res = doMessagesRequest(t, v3, aliceToken, roomID, res.End, 3)
+	assertMessageBodies(t, res, []string{"1"})
+	if res.End != prevBatch {
+		t.Fatalf("second page: got end %q want %q", res.End, prevBatch)
+	}
+	if len(upstreamFroms) != 0 {
+		t.Fatalf("proxy went to the homeserver for events it has: %v", upstreamFroms)
+	}
+	// the third page comes from the homeserver
+	res = doMessagesRequest(t, v3, aliceToken, roomID, res.End, 3)
+	assertMessageBodies(t, res, []string{"0"})
+	if !reflect.DeepEqual(upstreamFroms, []string{prevBatch}) {
+		t.Fatalf("upstream /messages: got from %v want [%s]", upstreamFroms, prevBatch)
+	}
+}
+
+// Test that paging back through a timeline which arrived in two syncs hands over to the homeserver
+// at the earlier sync's prev_batch, so no events are returned twice.
+func TestMessagesBackfillAcrossBatches(t *testing.T) {
+	pqString := testutils.PrepareDBConnectionString()
+	v2 := runTestV2Server(t)
+	v3 := runTestServer(t, v2, pqString)
+	defer v2.close()
+	defer v3.close()
+	roomID := "!TestMessagesBackfillAcrossBatches:localhost"
+	message := func(body string) json.RawMessage {
+		return testutils.NewEvent(t, "m.room.message", alice, map[string]interface{}{"body": body})
+	}
+	v2.addAccount(t, alice, aliceToken)
+	v2.queueResponse(alice, sync2.SyncResponse{
+		Rooms: sync2.SyncRoomsResponse{
+			Join: v2JoinTimeline(roomEvents{
+				roomID:    roomID,
+				state:     createRoomState(t, alice, time.Now()),
+				events:    []json.RawMessage{message("1"), message("2")},
+				prevBatch: "first_prev_batch",
+			}),
+		},
+	})
+	v3.mustDoV3Request(t, aliceToken, sync3.Request{})
+	v2.queueResponse(alice, sync2.SyncResponse{
+		Rooms: sync2.SyncRoomsResponse{
+			Join: v2JoinTimeline(roomEvents{
+				roomID:    roomID,
+				events:    []json.RawMessage{message("3"), message("4")},
+				prevBatch: "second_prev_batch",
+			}),
+		},
+	})
+	v2.waitUntilEmpty(t, alice)
+	// the homeserver returns the events before each token
+	v2.SetMessages(func(token, gotRoomID string, req *http.Request) sync2.MessagesResponse {
+		from := req.URL.Query().Get("from")
+		res := sync2.MessagesResponse{Start: from}
+		switch from {
+		case "first_prev_batch":
+			res.Chunk = []json.RawMessage{message("0")}
+		case "second_prev_batch":
+			res.Chunk = []json.RawMessage{message("2"), message("1")}
+		default:
+			t.Errorf("upstream /messages: unexpected from %s", from)
+		}
+		return res
+	})
+
+	var got []string
+	from := ""
+	for i := 0; i < 3; i++ {
+		res := doMessagesRequest(t, v3, aliceToken, roomID, from, 3)
+		for _, ev := range res.Chunk {
+			body := gjson.GetBytes(ev, "content.body").Str
+			if gjson.GetBytes(ev, "type").Str == "m.room.message" {
+				got = append(got, body)
+			}
+		}
+		from = res.End
+	}
+	if want := []string{"4", "3", "2", "1", "0"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("paging back: got messages %v want %v", got, want)
+	}
+}
+
+func doMessagesRequest(t *testing.T, v3 *testV3Server, token, roomID, from string, limit int) *sync2.MessagesResponse {
+	t.Helper()
+	qps := url.Values{}
+	qps.Set("dir", "b")
+	qps.Set("limit", fmt.Sprintf("%d", limit))
+	if from != "" {
+		qps.Set("from", from)
+	}
+	req, err := http.NewRequest("GET", fmt.Sprintf(
+		"%s/_matrix/client/unstable/org.matrix.msc3575/rooms/%s/messages?%s", v3.srv.URL, url.PathEscape(roomID), qps.Encode(),
+	), nil)
+	if err != nil {
+		t.Fatalf("failed to make NewRequest: %s", err)
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	resp, err := v3.srv.Client().Do(req)
+	if err != nil {
+		t.Fatalf("failed to Do request: %s", err)
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("failed to read response body: %s", err)
+	}
+	if resp.StatusCode != 200 {
+		t.Fatalf("/messages returned HTTP %d: %s", resp.StatusCode, string(body))
+	}
+	var res sync2.MessagesResponse
+	if err := json.Unmarshal(body, &res); err != nil {
+		t.Fatalf("failed to decode /messages response: %s", err)
+	}
+	return &res
+}
+
+func assertMessageBodies(t *testing.T, res *sync2.MessagesResponse, want []string) {
+	t.Helper()
+	var got []string
+	for _, ev := range res.Chunk {
+		got = append(got, gjson.GetBytes(ev, "content.body").Str)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("/messages: got bodies %v want %v", got, want)
+	}
+}
@@ -3,13 +3,20 @@ package syncv3
 import (
 	"encoding/json"
 	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
 	"testing"
 	"time"
 
+	syncv3 "github.com/matrix-org/sliding-sync"
+	"github.com/matrix-org/sliding-sync/notifier"
 	"github.com/matrix-org/sliding-sync/sync2"
 	"github.com/matrix-org/sliding-sync/sync3"
 	"github.com/matrix-org/sliding-sync/testutils"
 	"github.com/matrix-org/sliding-sync/testutils/m"
+	"github.com/tidwall/gjson"
 )
 
 // Test that sort operations that favour notif counts always appear at the start of the list.
@@ -162,3 +169,100 @@ func TestNotificationsOnTop(t *testing.T) {
 		}),
 	)))
 }
+
+// Test that the webhook is called when unread counts go up, but not when they are first seen.
+func TestNotificationWebhook(t *testing.T) {
+	secret := "webhook_secret"
+	notifications := make(chan notifier.Notification, 10)
+	webhook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body, _ := io.ReadAll(req.Body)
+		if sig := req.Header.Get(notifier.SignatureHeader); sig != notifier.Sign([]byte(secret), body) {
+			t.Errorf("webhook called with bad signature %q", sig)
+		}
+		var n notifier.Notification
+		if err := json.Unmarshal(body, &n); err != nil {
+			t.Errorf("webhook called with bad body %s: %s", body, err)
+		}
+		notifications <- n
+	}))
+	defer webhook.Close()
+	pqString := testutils.PrepareDBConnectionString()
+	v2 := runTestV2Server(t)
+	v3 := runTestServer(t, v2, pqString, syncv3.Opts{
+		WebhookURL:    webhook.URL,
+		WebhookSecret: secret,
+	})
+	defer v2.close()
+	defer v3.close()
+	bob := "@TestNotificationWebhook_bob:localhost"
+	roomID := "!TestNotificationWebhook:localhost"
+	v2.addAccount(t, alice, aliceToken)
+	v2.queueResponse(alice, sync2.SyncResponse{
+		Rooms: sync2.SyncRoomsResponse{
+			Join: map[string]sync2.SyncV2JoinResponse{
+				roomID: {
+					UnreadNotifications: sync2.UnreadNotifications{
+						HighlightCount:    ptr(0),
+						NotificationCount: ptr(1),
+					},
+					Timeline: sync2.TimelineResponse{
+						Events: append(createRoomState(t, alice, time.Now()),
+							testutils.NewStateEvent(t, "m.room.name", "", alice, map[string]interface{}{"name": "Webhooks"}),
+						),
+					},
+				},
+			},
+		},
+	})
+	v3.mustDoV3Request(t, aliceToken, sync3.Request{
+		Lists: map[string]sync3.RequestList{"a": {
+			Ranges: sync3.SliceRanges{{0, 10}},
+		}},
+	})
+
+	bingEvent := testutils.NewEvent(t, "m.room.message", bob, map[string]interface{}{"body": "BING!"})
+	v2.queueResponse(alice, sync2.SyncResponse{
+		Rooms: sync2.SyncRoomsResponse{
+			Join: map[string]sync2.SyncV2JoinResponse{
+				roomID: {
+					UnreadNotifications: sync2.UnreadNotifications{
+						HighlightCount:    ptr(1),
+						NotificationCount: ptr(2),
+					},
+					Timeline: sync2.TimelineResponse{
+						Events: []json.RawMessage{bingEvent},
+					},
+				},
+			},
+		},
+	})
+	v2.waitUntilEmpty(t, alice)
+
+	var got notifier.Notification
+	select {
+	case got = <-notifications:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("timed out waiting for the webhook to be called")
+	}
+	want := notifier.Notification{
+		UserID:            alice,
+		RoomID:            roomID,
+		RoomName:          "Webhooks",
+		HighlightCount:    1,
+		NotificationCount: 2,
+		Event: &notifier.Event{
+			EventID: gjson.GetBytes(bingEvent, "event_id").Str,
+			Type:    "m.room.message",
+			Sender:  bob,
+		},
+		TS: got.TS,
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("webhook: got %+v want %+v", got, want)
+	}
+	select {
+	case n := <-notifications:
+		t.Fatalf("webhook called more than once, also got %+v", n)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
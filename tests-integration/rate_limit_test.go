@@ -0,0 +1,50 @@
+package syncv3
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	syncv3 "github.com/matrix-org/sliding-sync"
+	"github.com/matrix-org/sliding-sync/sync2"
+	"github.com/matrix-org/sliding-sync/sync3"
+	"github.com/matrix-org/sliding-sync/sync3/handler"
+	"github.com/matrix-org/sliding-sync/testutils"
+	"github.com/tidwall/gjson"
+)
+
+// Test that clients which exceed their initial sync budget are told to back off with M_LIMIT_EXCEEDED,
+// whilst incremental syncs on an existing connection have their own budget.
+func TestRateLimitInitialSyncs(t *testing.T) {
+	pqString := testutils.PrepareDBConnectionString()
+	v2 := runTestV2Server(t)
+	v3 := runTestServer(t, v2, pqString, syncv3.Opts{
+		RateLimits: &handler.RateLimits{
+			InitialDevice: handler.RateLimit{PerSecond: 0.01, Burst: 1},
+		},
+	})
+	defer v2.close()
+	defer v3.close()
+	v2.addAccount(t, alice, aliceToken)
+	v2.queueResponse(alice, sync2.SyncResponse{})
+
+	res := v3.mustDoV3Request(t, aliceToken, sync3.Request{})
+	// the existing connection is not limited
+	v3.mustDoV3RequestWithPos(t, aliceToken, res.Pos, sync3.Request{})
+
+	start := time.Now()
+	_, body, code := v3.doV3Request(t, context.Background(), aliceToken, "", sync3.Request{})
+	// the client is told when to retry, so the response should not be held back like other errors
+	if took := time.Since(start); took >= time.Second {
+		t.Errorf("429 response took %v, want less than 1s", took)
+	}
+	if code != 429 {
+		t.Fatalf("second initial sync: got HTTP %d want 429: %s", code, string(body))
+	}
+	if errcode := gjson.GetBytes(body, "errcode").Str; errcode != "M_LIMIT_EXCEEDED" {
+		t.Errorf("got errcode %q want M_LIMIT_EXCEEDED", errcode)
+	}
+	if retryAfter := gjson.GetBytes(body, "retry_after_ms").Int(); retryAfter <= 0 || retryAfter > 100000 {
+		t.Errorf("got retry_after_ms %d, want between 0 and 100000", retryAfter)
+	}
+}
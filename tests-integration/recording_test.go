@@ -0,0 +1,109 @@
+package syncv3
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	syncv3 "github.com/matrix-org/sliding-sync"
+	"github.com/matrix-org/sliding-sync/sync2"
+	"github.com/matrix-org/sliding-sync/sync3"
+	"github.com/matrix-org/sliding-sync/sync3/handler"
+	"github.com/matrix-org/sliding-sync/testutils"
+	"github.com/matrix-org/sliding-sync/testutils/m"
+)
+
+// Test that a connection recorded by the proxy replays to the same list operations.
+func TestRecordingReplays(t *testing.T) {
+	pqString := testutils.PrepareDBConnectionString()
+	recordDir := t.TempDir()
+	v2 := runTestV2Server(t)
+	v3 := runTestServer(t, v2, pqString, syncv3.Opts{
+		RecordDir:   recordDir,
+		RecordUsers: []string{alice},
+	})
+	defer v2.close()
+	defer v3.close()
+	one := 1
+	roomA := "!a_TestRecordingReplays:localhost"
+	roomB := "!b_TestRecordingReplays:localhost"
+	roomC := "!c_TestRecordingReplays:localhost"
+	var rooms []roomEvents
+	for i, roomID := range []string{roomA, roomB, roomC} {
+		rooms = append(rooms, roomEvents{
+			roomID: roomID,
+			state:  createRoomState(t, alice, time.Now()),
+			events: []json.RawMessage{
+				testutils.NewEvent(t, "m.room.message", alice, map[string]interface{}{"body": "hi"}, testutils.WithTimestamp(time.Now().Add(time.Duration(-i)*time.Second))),
+			},
+		})
+	}
+	v2.addAccount(t, alice, aliceToken)
+	v2.queueResponse(alice, sync2.SyncResponse{
+		Rooms: sync2.SyncRoomsResponse{
+			Join: v2JoinTimeline(rooms...),
+		},
+	})
+	res := v3.mustDoV3Request(t, aliceToken, sync3.Request{
+		Lists: map[string]sync3.RequestList{
+			"a": {
+				Ranges: [][2]int64{{0, 1}},
+				Sort:   []string{sync3.SortByNotificationLevel, sync3.SortByRecency},
+			},
+		},
+	})
+	m.MatchResponse(t, res, m.MatchList("a", m.MatchV3Count(3), m.MatchV3Ops(
+		m.MatchV3SyncOp(0, 1, []string{roomA, roomB}),
+	)))
+
+	// a notification in C moves it to the top
+	v2.queueResponse(alice, sync2.SyncResponse{
+		Rooms: sync2.SyncRoomsResponse{
+			Join: v2JoinTimeline(roomEvents{
+				roomID: roomC,
+				events: []json.RawMessage{
+					testutils.NewEvent(t, "m.room.message", alice, map[string]interface{}{"body": "ping"}, testutils.WithTimestamp(time.Now().Add(-time.Hour))),
+				},
+				notifCount: &one,
+			}),
+		},
+	})
+	v2.waitUntilEmpty(t, aliceToken)
+	res = v3.mustDoV3RequestWithPos(t, aliceToken, res.Pos, sync3.Request{})
+	m.MatchResponse(t, res, m.MatchList("a", m.MatchV3Count(3), m.MatchV3Ops(
+		m.MatchV3DeleteOp(1), m.MatchV3InsertOp(0, roomC),
+	)))
+	res = v3.mustDoV3RequestWithPos(t, aliceToken, res.Pos, sync3.Request{
+		Lists: map[string]sync3.RequestList{
+			"a": {
+				Ranges: [][2]int64{{0, 2}},
+			},
+		},
+	})
+	m.MatchResponse(t, res, m.MatchList("a", m.MatchV3Count(3), m.MatchV3Ops(
+		m.MatchV3SyncOp(2, 2, []string{roomB}),
+	)))
+
+	recordings, err := filepath.Glob(filepath.Join(recordDir, "*.jsonl"))
+	if err != nil || len(recordings) != 1 {
+		t.Fatalf("got recordings %v (%v), want 1", recordings, err)
+	}
+	f, err := os.Open(recordings[0])
+	if err != nil {
+		t.Fatalf("failed to open recording: %s", err)
+	}
+	defer f.Close()
+	result, err := handler.Replay(context.Background(), f)
+	if err != nil {
+		t.Fatalf("Replay returned error: %s", err)
+	}
+	if len(result.Responses) != 3 {
+		t.Fatalf("Replay: got %d responses want 3", len(result.Responses))
+	}
+	if len(result.Mismatches) > 0 {
+		t.Fatalf("Replay: got mismatches %+v", result.Mismatches)
+	}
+}
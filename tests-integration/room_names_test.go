@@ -3,6 +3,7 @@ package syncv3
 import (
 	"encoding/json"
 	"fmt"
+	"reflect"
 	"testing"
 	"time"
 
@@ -198,3 +199,67 @@ func TestRoomNameUpdates(t *testing.T) {
 		},
 	}))
 }
+
+// Test that the room summary is only sent to subscriptions which ask for it, and is sent again when it changes.
+func TestRoomSummary(t *testing.T) {
+	boolTrue := true
+	rig := NewTestRig(t)
+	defer rig.Finish()
+	summaryRoomID := "!summary:localhost"
+	plainRoomID := "!plain:localhost"
+	rig.SetupV2RoomsForUser(t, alice, NoFlush, map[string]RoomDescriptor{
+		summaryRoomID: {},
+		plainRoomID:   {},
+	})
+	aliceToken := rig.Token(alice)
+	matchSummary := func(want *sync3.RoomSummary) m.RoomMatcher {
+		return func(r sync3.Room) error {
+			if !reflect.DeepEqual(r.Summary, want) {
+				return fmt.Errorf("summary: got %+v want %+v", r.Summary, want)
+			}
+			return nil
+		}
+	}
+
+	res := rig.V3.mustDoV3Request(t, aliceToken, sync3.Request{
+		RoomSubscriptions: map[string]sync3.RoomSubscription{
+			summaryRoomID: {
+				TimelineLimit: 1,
+				Summary:       &boolTrue,
+			},
+			plainRoomID: {
+				TimelineLimit: 1,
+			},
+		},
+	})
+	m.MatchResponse(t, res, m.MatchRoomSubscriptionsStrict(map[string][]m.RoomMatcher{
+		summaryRoomID: {matchSummary(&sync3.RoomSummary{JoinRule: "public"})},
+		plainRoomID:   {matchSummary(nil)},
+	}))
+
+	t.Log("The topic and history visibility change in both rooms.")
+	for _, roomID := range []string{summaryRoomID, plainRoomID} {
+		rig.FlushEvent(t, alice, roomID, testutils.NewStateEvent(t, "m.room.topic", "", alice, map[string]interface{}{
+			"topic": "All about summaries",
+		}))
+		rig.FlushEvent(t, alice, roomID, testutils.NewStateEvent(t, "m.room.history_visibility", "", alice, map[string]interface{}{
+			"history_visibility": "joined",
+		}))
+	}
+	res = rig.V3.mustDoV3RequestWithPos(t, aliceToken, res.Pos, sync3.Request{})
+	m.MatchResponse(t, res, m.MatchRoomSubscriptionsStrict(map[string][]m.RoomMatcher{
+		summaryRoomID: {matchSummary(&sync3.RoomSummary{
+			Topic:             "All about summaries",
+			JoinRule:          "public",
+			HistoryVisibility: "joined",
+		})},
+		plainRoomID: {matchSummary(nil)},
+	}))
+
+	t.Log("Messages which don't change the summary don't resend it.")
+	rig.FlushText(t, alice, summaryRoomID, "hello")
+	res = rig.V3.mustDoV3RequestWithPos(t, aliceToken, res.Pos, sync3.Request{})
+	m.MatchResponse(t, res, m.MatchRoomSubscriptionsStrict(map[string][]m.RoomMatcher{
+		summaryRoomID: {matchSummary(nil)},
+	}))
+}
@@ -0,0 +1,76 @@
+package syncv3
+
+import (
+	"encoding/json"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	syncv3 "github.com/matrix-org/sliding-sync"
+	"github.com/matrix-org/sliding-sync/sqlutil"
+	"github.com/matrix-org/sliding-sync/sync2"
+	"github.com/matrix-org/sliding-sync/sync3"
+	"github.com/matrix-org/sliding-sync/testutils"
+	"github.com/matrix-org/sliding-sync/testutils/m"
+)
+
+// Test that an API instance can serve clients whilst a separate poller instance polls for them,
+// with the two talking over Postgres.
+func TestPollerAndAPIInstances(t *testing.T) {
+	pqString := testutils.PrepareDBConnectionString()
+	if strings.HasPrefix(pqString, sqlutil.SQLiteURIPrefix) {
+		t.Skip("Postgres pubsub needs a Postgres database")
+	}
+	v2 := runTestV2Server(t)
+	defer v2.close()
+	poller, _ := syncv3.Setup(v2.url(), pqString, os.Getenv("SYNCV3_SECRET"), syncv3.Opts{
+		MaxPendingEventUpdates: 200,
+		PostgresPubSub:         true,
+		Role:                   syncv3.RolePoller,
+	})
+	defer poller.Teardown()
+	api := runTestServer(t, v2, pqString, syncv3.Opts{
+		PostgresPubSub: true,
+		Role:           syncv3.RoleAPI,
+	})
+	defer api.close()
+	if api.h2 != nil {
+		t.Fatalf("API instance created a v2 handler")
+	}
+
+	roomID := "!TestPollerAndAPIInstances:localhost"
+	v2.addAccount(t, alice, aliceToken)
+	v2.queueResponse(alice, sync2.SyncResponse{
+		Rooms: sync2.SyncRoomsResponse{
+			Join: v2JoinTimeline(roomEvents{
+				roomID: roomID,
+				state:  createRoomState(t, alice, time.Now()),
+			}),
+		},
+	})
+	req := sync3.Request{
+		RoomSubscriptions: map[string]sync3.RoomSubscription{
+			roomID: {TimelineLimit: 1},
+		},
+	}
+	// the initial sync is done by the poller instance
+	res := api.mustDoV3Request(t, aliceToken, req)
+	m.MatchResponse(t, res, m.MatchRoomSubscriptionsStrict(map[string][]m.RoomMatcher{
+		roomID: {},
+	}))
+
+	// live events are polled by the poller instance and sent to the API instance
+	ev := testutils.NewMessageEvent(t, alice, "hello from the poller")
+	v2.queueResponse(alice, sync2.SyncResponse{
+		Rooms: sync2.SyncRoomsResponse{
+			Join: v2JoinTimeline(roomEvents{
+				roomID: roomID,
+				events: []json.RawMessage{ev},
+			}),
+		},
+	})
+	v2.waitUntilEmpty(t, alice)
+	res = api.mustDoV3RequestWithPos(t, aliceToken, res.Pos, req)
+	m.MatchResponse(t, res, m.MatchRoomSubscription(roomID, m.MatchRoomTimelineMostRecent(1, []json.RawMessage{ev})))
+}
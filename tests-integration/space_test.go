@@ -2,11 +2,13 @@ package syncv3
 
 import (
 	"encoding/json"
+	"reflect"
 	"testing"
 	"time"
 
 	"github.com/matrix-org/sliding-sync/sync2"
 	"github.com/matrix-org/sliding-sync/sync3"
+	"github.com/matrix-org/sliding-sync/sync3/extensions"
 	"github.com/matrix-org/sliding-sync/testutils"
 	"github.com/matrix-org/sliding-sync/testutils/m"
 )
@@ -64,3 +66,163 @@ func TestBecomingASpaceDoesntCrash(t *testing.T) {
 		},
 	}))
 }
+
+// Test that space filters can include rooms in subspaces, and that the spaces extension returns
+// the space graph, as the graph changes.
+func TestSpacesNested(t *testing.T) {
+	rig := NewTestRig(t)
+	defer rig.Finish()
+	topSpace := "!top:localhost"
+	subSpace := "!sub:localhost"
+	otherSpace := "!other-space:localhost"
+	directRoom := "!direct:localhost"
+	nestedRoom := "!nested:localhost"
+	rig.SetupV2RoomsForUser(t, alice, NoFlush, map[string]RoomDescriptor{
+		topSpace:   {RoomType: "m.space"},
+		subSpace:   {RoomType: "m.space"},
+		otherSpace: {RoomType: "m.space"},
+		directRoom: {},
+		nestedRoom: {},
+	})
+	aliceToken := rig.Token(alice)
+	// do a request to start the poller
+	rig.V3.mustDoV3Request(t, aliceToken, sync3.Request{})
+	spaceChild := func(childRoomID string, content map[string]interface{}) json.RawMessage {
+		return testutils.NewStateEvent(t, "m.space.child", childRoomID, alice, content)
+	}
+	via := []string{"localhost"}
+	rig.FlushEvent(t, alice, topSpace, spaceChild(directRoom, map[string]interface{}{"via": via, "order": "a", "suggested": true}))
+	rig.FlushEvent(t, alice, topSpace, spaceChild(subSpace, map[string]interface{}{"via": via, "order": "b"}))
+	rig.FlushEvent(t, alice, subSpace, spaceChild(nestedRoom, map[string]interface{}{"via": via}))
+	rig.FlushEvent(t, alice, subSpace, testutils.NewStateEvent(t, "m.space.parent", topSpace, alice, map[string]interface{}{"via": via}))
+
+	req := sync3.Request{
+		Lists: map[string]sync3.RequestList{
+			"direct": {
+				Ranges: sync3.SliceRanges{{0, 20}},
+				Filters: &sync3.RequestFilters{
+					Spaces: []string{topSpace},
+				},
+			},
+			"nested": {
+				Ranges: sync3.SliceRanges{{0, 20}},
+				Filters: &sync3.RequestFilters{
+					Spaces:           []string{topSpace},
+					IncludeSubspaces: true,
+				},
+			},
+		},
+		Extensions: extensions.Request{
+			Spaces: &extensions.SpacesRequest{
+				Core: extensions.Core{Enabled: &boolTrue},
+			},
+		},
+	}
+	res := rig.V3.mustDoV3Request(t, aliceToken, req)
+	m.MatchResponse(t, res, m.MatchLists(map[string][]m.ListMatcher{
+		"direct": {m.MatchV3Count(2)},
+		"nested": {m.MatchV3Count(3)},
+	}))
+	matchSpaces(t, res, map[string]*extensions.Space{
+		topSpace: {
+			Children: []extensions.SpaceChild{
+				{RoomID: directRoom, Order: "a", Suggested: true},
+				{RoomID: subSpace, Order: "b"},
+			},
+			Parents: []string{},
+		},
+		subSpace: {
+			Children: []extensions.SpaceChild{{RoomID: nestedRoom}},
+			Parents:  []string{topSpace},
+		},
+		otherSpace: {
+			Children: []extensions.SpaceChild{},
+			Parents:  []string{},
+		},
+	})
+
+	// move the subspace to the other space: its rooms leave the nested list
+	rig.FlushEvent(t, alice, topSpace, spaceChild(subSpace, map[string]interface{}{}))
+	rig.FlushEvent(t, alice, otherSpace, spaceChild(subSpace, map[string]interface{}{"via": via}))
+	res = rig.V3.mustDoV3RequestWithPos(t, aliceToken, res.Pos, req)
+	m.MatchResponse(t, res, m.MatchLists(map[string][]m.ListMatcher{
+		"direct": {m.MatchV3Count(1)},
+		"nested": {m.MatchV3Count(1)},
+	}))
+	matchSpaces(t, res, map[string]*extensions.Space{
+		topSpace: {
+			Children: []extensions.SpaceChild{{RoomID: directRoom, Order: "a", Suggested: true}},
+			Parents:  []string{},
+		},
+		otherSpace: {
+			Children: []extensions.SpaceChild{{RoomID: subSpace}},
+			Parents:  []string{},
+		},
+	})
+}
+
+// Test that the spaces extension sends the whole graph when it is enabled part way through a
+// connection, and again if it is disabled and then re-enabled.
+func TestSpacesEnabledLater(t *testing.T) {
+	rig := NewTestRig(t)
+	defer rig.Finish()
+	space := "!space:localhost"
+	room := "!room:localhost"
+	rig.SetupV2RoomsForUser(t, alice, NoFlush, map[string]RoomDescriptor{
+		space: {RoomType: "m.space"},
+		room:  {},
+	})
+	aliceToken := rig.Token(alice)
+	res := rig.V3.mustDoV3Request(t, aliceToken, sync3.Request{})
+	rig.FlushEvent(t, alice, space, testutils.NewStateEvent(t, "m.space.child", room, alice, map[string]interface{}{
+		"via": []string{"localhost"},
+	}))
+	res = rig.V3.mustDoV3RequestWithPos(t, aliceToken, res.Pos, sync3.Request{})
+	if res.Extensions.Spaces != nil {
+		t.Fatalf("got spaces extension before it was enabled: %+v", res.Extensions.Spaces)
+	}
+
+	wantGraph := map[string]*extensions.Space{
+		space: {
+			Children: []extensions.SpaceChild{{RoomID: room}},
+			Parents:  []string{},
+		},
+	}
+	enable := func(enabled bool) sync3.Request {
+		return sync3.Request{
+			Extensions: extensions.Request{
+				Spaces: &extensions.SpacesRequest{
+					Core: extensions.Core{Enabled: &enabled},
+				},
+			},
+		}
+	}
+	t.Log("Alice enables the spaces extension and gets the whole graph.")
+	res = rig.V3.mustDoV3RequestWithPos(t, aliceToken, res.Pos, enable(true))
+	matchSpaces(t, res, wantGraph)
+
+	t.Log("Nothing has changed, so the graph isn't sent again.")
+	req := sync3.Request{}
+	req.SetTimeoutMSecs(100)
+	res = rig.V3.mustDoV3RequestWithPos(t, aliceToken, res.Pos, req)
+	if res.Extensions.Spaces != nil {
+		t.Fatalf("got spaces extension with nothing new: %+v", res.Extensions.Spaces)
+	}
+
+	t.Log("Alice disables the extension, then enables it again and gets the whole graph again.")
+	res = rig.V3.mustDoV3RequestWithPos(t, aliceToken, res.Pos, enable(false))
+	res = rig.V3.mustDoV3RequestWithPos(t, aliceToken, res.Pos, enable(true))
+	matchSpaces(t, res, wantGraph)
+}
+
+func matchSpaces(t *testing.T, res *sync3.Response, want map[string]*extensions.Space) {
+	t.Helper()
+	if res.Extensions.Spaces == nil {
+		t.Fatalf("missing spaces extension")
+	}
+	if got := res.Extensions.Spaces.Spaces; !reflect.DeepEqual(got, want) {
+		gotJSON, _ := json.Marshal(got)
+		wantJSON, _ := json.Marshal(want)
+		t.Errorf("spaces extension: got %s want %s", gotJSON, wantJSON)
+	}
+}
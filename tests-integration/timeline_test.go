@@ -1388,7 +1388,7 @@ func TestSensibleLimitToTimelineLimit(t *testing.T) {
 func TestSeeCreateEvent(t *testing.T) {
 	// setup code
 	pqString := testutils.PrepareDBConnectionString()
-	db, err := sqlx.Open("postgres", pqString)
+	db, err := sqlutil.Open(pqString)
 	if err != nil {
 		t.Fatalf("failed to open postgres: %s", err)
 	}
@@ -2,15 +2,19 @@ package syncv3
 
 import (
 	"context"
+	"database/sql"
 	"encoding/json"
 	"net/http"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	"github.com/tidwall/gjson"
 
+	syncv3 "github.com/matrix-org/sliding-sync"
 	"github.com/matrix-org/sliding-sync/sync2"
 	"github.com/matrix-org/sliding-sync/sync3"
+	"github.com/matrix-org/sliding-sync/sync3/handler"
 	"github.com/matrix-org/sliding-sync/testutils"
 	"github.com/matrix-org/sliding-sync/testutils/m"
 )
@@ -184,3 +188,120 @@ func TestSyncWithNewTokenBeforeOldExpires(t *testing.T) {
 	)
 
 }
+
+// countingAuthenticator counts how many tokens the proxy asks the homeserver about.
+type countingAuthenticator struct {
+	handler.WhoAmIAuthenticator
+	calls atomic.Int32
+}
+
+func (a *countingAuthenticator) Authenticate(ctx context.Context, accessToken, serverName string, client sync2.Client) (*handler.Identity, error) {
+	a.calls.Add(1)
+	return a.WhoAmIAuthenticator.Authenticate(ctx, accessToken, serverName, client)
+}
+
+// Test that rejected tokens are remembered, and that identified tokens are checked again once
+// their TTL is up.
+func TestAuthenticationCaching(t *testing.T) {
+	pqString := testutils.PrepareDBConnectionString()
+	v2 := runTestV2Server(t)
+	auth := &countingAuthenticator{}
+	v3 := runTestServer(t, v2, pqString, syncv3.Opts{
+		Auth: handler.AuthOptions{
+			Authenticator:    auth,
+			TokenTTL:         time.Second,
+			RejectedTokenTTL: time.Minute,
+		},
+	})
+	defer v2.close()
+	defer v3.close()
+
+	t.Log("A bad token is rejected, and rejected again without asking the homeserver.")
+	for i := 0; i < 2; i++ {
+		_, _, code := v3.doV3Request(t, context.Background(), "bad_token", "", sync3.Request{})
+		if code != 401 {
+			t.Fatalf("got HTTP %d want 401", code)
+		}
+	}
+	if calls := auth.calls.Load(); calls != 1 {
+		t.Fatalf("got %d calls to the authenticator want 1", calls)
+	}
+
+	t.Log("Alice's token is identified, then trusted until its TTL is up.")
+	v2.addAccount(t, alice, aliceToken)
+	v2.queueResponse(aliceToken, sync2.SyncResponse{})
+	v3.mustDoV3Request(t, aliceToken, sync3.Request{})
+	v3.mustDoV3Request(t, aliceToken, sync3.Request{})
+	if calls := auth.calls.Load(); calls != 2 {
+		t.Fatalf("got %d calls to the authenticator want 2", calls)
+	}
+	time.Sleep(1100 * time.Millisecond)
+	v3.mustDoV3Request(t, aliceToken, sync3.Request{})
+	if calls := auth.calls.Load(); calls != 3 {
+		t.Fatalf("got %d calls to the authenticator want 3 once the TTL was up", calls)
+	}
+
+	t.Log("Once Alice's token is revoked, it is rejected when it is checked again.")
+	v2.invalidateTokenImmediately(aliceToken)
+	time.Sleep(1100 * time.Millisecond)
+	_, _, code := v3.doV3Request(t, context.Background(), aliceToken, "", sync3.Request{})
+	if code != 401 {
+		t.Fatalf("got HTTP %d want 401", code)
+	}
+	t.Log("Alice's token is expired as if the homeserver had rejected it whilst polling.")
+	waitForTokenDeleted(t, v3, aliceToken)
+}
+
+// Test that a token which the authenticator says belongs to a different device when it is checked
+// again is rejected, rather than being used for the device we stored it for.
+func TestExpiredTokenForDifferentDevice(t *testing.T) {
+	pqString := testutils.PrepareDBConnectionString()
+	v2 := runTestV2Server(t)
+	v3 := runTestServer(t, v2, pqString, syncv3.Opts{
+		Auth: handler.AuthOptions{
+			Authenticator: handler.WhoAmIAuthenticator{},
+			TokenTTL:      time.Second,
+		},
+	})
+	defer v2.close()
+	defer v3.close()
+
+	t.Log("Alice's token is identified as device A.")
+	v2.addAccountWithDeviceID(alice, "A", aliceToken)
+	v2.queueResponse(aliceToken, sync2.SyncResponse{})
+	v3.mustDoV3Request(t, aliceToken, sync3.Request{})
+
+	t.Log("Once its TTL is up, the homeserver says the token is for device B, so it is rejected.")
+	v2.addAccountWithDeviceID(alice, "B", aliceToken)
+	time.Sleep(1100 * time.Millisecond)
+	_, _, code := v3.doV3Request(t, context.Background(), aliceToken, "", sync3.Request{})
+	if code != 401 {
+		t.Fatalf("got HTTP %d want 401", code)
+	}
+	waitForTokenDeleted(t, v3, aliceToken)
+
+	t.Log("The token is then identified afresh, as device B.")
+	v2.queueResponse(aliceToken, sync2.SyncResponse{})
+	v3.mustDoV3Request(t, aliceToken, sync3.Request{})
+	token, err := v3.handler.V2Store.TokensTable.Token(aliceToken)
+	if err != nil {
+		t.Fatalf("Token: %s", err)
+	}
+	if token.DeviceID != "B" {
+		t.Errorf("got device %s want B", token.DeviceID)
+	}
+}
+
+// waitForTokenDeleted waits for the proxy to delete its record of this token, which happens in the
+// background once the token has been expired.
+func waitForTokenDeleted(t *testing.T, v3 *testV3Server, accessToken string) {
+	t.Helper()
+	for i := 0; i < 50; i++ {
+		_, err := v3.handler.V2Store.TokensTable.Token(accessToken)
+		if err == sql.ErrNoRows {
+			return
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	t.Fatalf("token %s was not deleted", accessToken)
+}
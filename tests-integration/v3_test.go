@@ -57,7 +57,9 @@ type testV2Server struct {
 	//
 	// checkRequest is called before we lookup a user for the given token. Tests can
 	// use this to invalidate the token right before a poll is made.
-	checkRequest            func(token string, req *http.Request)
+	checkRequest func(token string, req *http.Request)
+	// messages generates the response to a /messages request, if set.
+	messages                func(token, roomID string, req *http.Request) sync2.MessagesResponse
 	mu                      *sync.Mutex
 	tokenToUser             map[string]string
 	tokenToDevice           map[string]string
@@ -74,6 +76,12 @@ func (s *testV2Server) SetCheckRequest(fn func(token string, req *http.Request))
 	s.checkRequest = fn
 }
 
+func (s *testV2Server) SetMessages(fn func(token, roomID string, req *http.Request) sync2.MessagesResponse) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.messages = fn
+}
+
 // Most tests only use a single device per user. Give them this helper so they don't
 // have to care about providing a device name.
 func (s *testV2Server) addAccount(t testutils.TestBenchInterface, userID, token string) {
@@ -306,6 +314,24 @@ func runTestV2Server(t testutils.TestBenchInterface) *testV2Server {
 		w.WriteHeader(200)
 		w.Write(body)
 	})
+	r.HandleFunc("/_matrix/client/v3/rooms/{roomID}/messages", func(w http.ResponseWriter, req *http.Request) {
+		token := strings.TrimPrefix(req.Header.Get("Authorization"), "Bearer ")
+		server.mu.Lock()
+		fn := server.messages
+		server.mu.Unlock()
+		if fn == nil || server.userID(token) == "" {
+			w.WriteHeader(404)
+			return
+		}
+		body, err := json.Marshal(fn(token, mux.Vars(req)["roomID"], req))
+		if err != nil {
+			w.WriteHeader(500)
+			t.Errorf("failed to marshal response: %s", err)
+			return
+		}
+		w.WriteHeader(200)
+		w.Write(body)
+	})
 	srv := httptest.NewServer(r)
 	server.srv = srv
 	return server
@@ -320,7 +346,9 @@ type testV3Server struct {
 func (s *testV3Server) close() {
 	s.srv.Close()
 	s.handler.Teardown()
-	s.h2.Teardown()
+	if s.h2 != nil {
+		s.h2.Teardown()
+	}
 }
 
 func (s *testV3Server) restart(t *testing.T, v2 *testV2Server, pq string, opts ...syncv3.Opts) {
@@ -410,6 +438,17 @@ func runTestServer(t testutils.TestBenchInterface, v2Server *testV2Server, postg
 		combinedOpts.DBConnMaxIdleTime = opt.DBConnMaxIdleTime
 		combinedOpts.DBMaxConns = opt.DBMaxConns
 		combinedOpts.MaxTransactionIDDelay = opt.MaxTransactionIDDelay
+		combinedOpts.PostgresPubSub = opt.PostgresPubSub
+		combinedOpts.Role = opt.Role
+		combinedOpts.RateLimits = opt.RateLimits
+		combinedOpts.Homeservers = opt.Homeservers
+		combinedOpts.HomeserverHosts = opt.HomeserverHosts
+		combinedOpts.RecordDir = opt.RecordDir
+		combinedOpts.RecordUsers = opt.RecordUsers
+		combinedOpts.ToDeviceLimits = opt.ToDeviceLimits
+		combinedOpts.WebhookURL = opt.WebhookURL
+		combinedOpts.WebhookSecret = opt.WebhookSecret
+		combinedOpts.Auth = opt.Auth
 		if opt.MaxPendingEventUpdates > 0 {
 			combinedOpts.MaxPendingEventUpdates = opt.MaxPendingEventUpdates
 			handler.BufferWaitTime = 5 * time.Millisecond
@@ -421,6 +460,7 @@ func runTestServer(t testutils.TestBenchInterface, v2Server *testV2Server, postg
 	r.Use(hlog.NewHandler(logger))
 	r.Handle("/_matrix/client/v3/sync", h3)
 	r.Handle("/_matrix/client/unstable/org.matrix.msc3575/sync", h3)
+	r.Handle("/_matrix/client/unstable/org.matrix.msc3575/rooms/{roomID}/messages", h3)
 	srv := httptest.NewServer(r)
 	if !testutils.Quiet {
 		t.Logf("v2 @ %s", v2Server.url())
@@ -7,6 +7,7 @@ import (
 	"os"
 	"os/exec"
 	"os/user"
+	"path/filepath"
 	"time"
 )
 
@@ -36,7 +37,12 @@ func currentUser() string {
 	return user.Username
 }
 
+// PrepareDBConnectionString returns a connection string for an empty database. Tests run against
+// Postgres unless SYNCV3_TEST_SQLITE is set, in which case they use a new SQLite database file.
 func PrepareDBConnectionString() (connStr string) {
+	if os.Getenv("SYNCV3_TEST_SQLITE") != "" {
+		return prepareSQLiteConnectionString()
+	}
 	// Required vars: user and db
 	// We'll try to infer from the local env if they are missing
 	user := os.Getenv("POSTGRES_USER")
@@ -76,3 +82,11 @@ func PrepareDBConnectionString() (connStr string) {
 	db.Close()
 	return
 }
+
+func prepareSQLiteConnectionString() string {
+	dir, err := os.MkdirTemp("", "syncv3_test")
+	if err != nil {
+		panic(err)
+	}
+	return "sqlite:" + filepath.Join(dir, "syncv3_test.db")
+}
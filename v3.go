@@ -2,7 +2,9 @@ package slidingsync
 
 import (
 	"context"
+	"crypto/rand"
 	"embed"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -16,10 +18,14 @@ import (
 	"github.com/getsentry/sentry-go"
 	"github.com/gorilla/mux"
 	"github.com/jmoiron/sqlx"
+	"github.com/matrix-org/sliding-sync/admin"
 	"github.com/matrix-org/sliding-sync/internal"
+	"github.com/matrix-org/sliding-sync/notifier"
 	"github.com/matrix-org/sliding-sync/pubsub"
+	"github.com/matrix-org/sliding-sync/sqlutil"
 	"github.com/matrix-org/sliding-sync/state"
 	_ "github.com/matrix-org/sliding-sync/state/migrations"
+	_ "github.com/matrix-org/sliding-sync/state/migrations/sqlite"
 	"github.com/matrix-org/sliding-sync/sync2"
 	"github.com/matrix-org/sliding-sync/sync2/handler2"
 	"github.com/matrix-org/sliding-sync/sync3/handler"
@@ -33,6 +39,16 @@ var EmbedMigrations embed.FS
 
 var Version string
 
+// Migrations prepares goose to migrate this database, returning the directory in EmbedMigrations
+// to run. SQLite databases have their own migrations, as the Postgres ones do not apply to them.
+func Migrations(db *sqlx.DB) (string, error) {
+	goose.SetBaseFS(EmbedMigrations)
+	if sqlutil.IsSQLite(db) {
+		return "state/migrations/sqlite", goose.SetDialect("sqlite3")
+	}
+	return "state/migrations", goose.SetDialect("postgres")
+}
+
 type Opts struct {
 	AddPrometheusMetrics bool
 	// The max number of events the client is eligible to read (unfiltered) which we are willing to
@@ -54,8 +70,65 @@ type Opts struct {
 	HTTPTimeout time.Duration
 	// HTTPLongTimeout is used for initial sync requests
 	HTTPLongTimeout time.Duration
+
+	// EnablePresence makes pollers request presence from the upstream homeserver, which
+	// is then served via the presence extension.
+	EnablePresence bool
+	// EnableWebSockets lets clients upgrade the sync endpoint to a WebSocket, so responses are
+	// pushed to them rather than the client making a new long-poll request for each one.
+	EnableWebSockets bool
+	// AdminBindAddr is the address to serve the admin API on. If empty, the admin API is disabled.
+	AdminBindAddr string
+	// AdminSecret must be sent as a bearer token on every admin API request.
+	AdminSecret string
+	// CheckpointConnections saves connection state to the database after every response, so
+	// clients can resume their connections with an existing ?pos= after the proxy restarts.
+	CheckpointConnections bool
+	// PostgresPubSub sends payloads between the poller and API halves of the proxy over Postgres
+	// LISTEN/NOTIFY rather than in memory, so several instances can share one database. It is
+	// required when Role is not RoleAll. Each poller instance only de-duplicates typing notifications
+	// for its own pollers, so clients may see the same typing update twice.
+	PostgresPubSub bool
+	// Role is which half of the proxy this instance runs, one of RoleAll, RolePoller or RoleAPI.
+	// Defaults to RoleAll.
+	Role string
+	// RateLimits limits how often each user, device and connection can hit the sync endpoint.
+	// If nil, requests are not rate limited.
+	RateLimits *handler.RateLimits
+	// Retention controls which old timeline events are purged from the database. Its ProxyUsers
+	// is filled in by Setup.
+	Retention state.RetentionPolicy
+	// Homeservers maps server names to the CS API URL of their homeserver, for users who aren't
+	// on the destination homeserver passed to Setup.
+	Homeservers map[string]string
+	// HomeserverHosts maps the Host which requests are made to onto a server name in Homeservers.
+	// Requests with an access token the proxy hasn't seen before are checked against that homeserver.
+	HomeserverHosts map[string]string
+	// RecordDir is a directory to record connections to, so they can be replayed by syncv3-replay.
+	// If empty, connections are not recorded.
+	RecordDir string
+	// RecordUsers limits recording to these users' connections. If empty, everyone is recorded.
+	RecordUsers []string
+	// ToDeviceLimits bounds how many to-device messages are queued for each device, and for how long.
+	ToDeviceLimits state.ToDeviceLimits
+	// WebhookURL is called by pollers whenever a user's highlight or notification count in a room
+	// goes up, with requests signed by WebhookSecret. If empty, no webhook is called.
+	WebhookURL    string
+	WebhookSecret string
+	// Auth controls how access tokens the proxy hasn't seen before are identified. By default, the
+	// homeserver is asked via /whoami, and tokens are trusted until the homeserver rejects them.
+	Auth handler.AuthOptions
 }
 
+const (
+	// RoleAll runs pollers and serves clients.
+	RoleAll = "all"
+	// RolePoller runs pollers but does not serve clients.
+	RolePoller = "poller"
+	// RoleAPI serves clients, asking poller instances to poll on its behalf.
+	RoleAPI = "api"
+)
+
 type server struct {
 	chain []func(next http.Handler) http.Handler
 	final http.Handler
@@ -86,14 +159,29 @@ func allowCORS(next http.Handler) http.HandlerFunc {
 func Setup(destHomeserver, postgresURI, secret string, opts Opts) (*handler2.Handler, http.Handler) {
 	// Setup shared DB and HTTP client
 	v2Client := sync2.NewHTTPClient(opts.HTTPTimeout, opts.HTTPLongTimeout, destHomeserver)
+	v2Client.EnablePresence = opts.EnablePresence
 
 	// Sanity check that we can contact the upstream homeserver.
 	_, err := v2Client.Versions(context.Background())
 	if err != nil {
 		log.Warn().Err(err).Str("dest", destHomeserver).Msg("Could not contact upstream homeserver. Is SYNCV3_SERVER set correctly?")
 	}
+	upstreams := sync2.NewUpstreams(v2Client)
+	for serverName, url := range opts.Homeservers {
+		client := sync2.NewHTTPClient(opts.HTTPTimeout, opts.HTTPLongTimeout, url)
+		client.EnablePresence = opts.EnablePresence
+		if _, err = client.Versions(context.Background()); err != nil {
+			log.Warn().Err(err).Str("server_name", serverName).Str("dest", url).Msg("Could not contact upstream homeserver. Is SYNCV3_HOMESERVERS set correctly?")
+		}
+		upstreams.AddHomeserver(serverName, client)
+	}
+	for host, serverName := range opts.HomeserverHosts {
+		if err = upstreams.AddHost(host, serverName); err != nil {
+			panic(err)
+		}
+	}
 
-	db, err := sqlx.Open("postgres", postgresURI)
+	db, err := sqlutil.Open(postgresURI)
 	if err != nil {
 		sentry.CaptureException(err)
 		// TODO: if we panic(), will sentry have a chance to flush the event?
@@ -112,10 +200,15 @@ func Setup(destHomeserver, postgresURI, secret string, opts Opts) (*handler2.Han
 	}
 	store := state.NewStorageWithDB(db, opts.AddPrometheusMetrics)
 	storev2 := sync2.NewStoreWithDB(db, secret)
+	store.Retention = opts.Retention
+	store.Retention.ProxyUsers = storev2.DevicesTable.AllUserIDs
+	store.ToDeviceTable.Limits = opts.ToDeviceLimits
 
 	// Automatically execute migrations
-	goose.SetBaseFS(EmbedMigrations)
-	err = goose.Up(db.DB, "state/migrations", goose.WithAllowMissing())
+	migrationsDir, err := Migrations(db)
+	if err == nil {
+		err = goose.Up(db.DB, migrationsDir, goose.WithAllowMissing())
+	}
 	if err != nil {
 		log.Panic().Err(err).Msg("failed to execute migrations")
 	}
@@ -129,40 +222,108 @@ func Setup(destHomeserver, postgresURI, secret string, opts Opts) (*handler2.Han
 	if opts.MaxPendingEventUpdates == 0 {
 		opts.MaxPendingEventUpdates = 2000
 	}
-	pubSub := pubsub.NewPubSub(bufferSize)
+	var pubSub interface {
+		pubsub.Notifier
+		pubsub.Listener
+	}
+	if opts.PostgresPubSub {
+		if sqlutil.IsSQLite(db) {
+			log.Panic().Msg("Postgres pubsub cannot be used with an SQLite database")
+		}
+		pubSub = pubsub.NewPostgresPubSub(db, postgresURI)
+	} else {
+		pubSub = pubsub.NewPubSub(bufferSize)
+	}
 
-	pMap := sync2.NewPollerMap(v2Client, opts.AddPrometheusMetrics)
-	// create v2 handler
-	h2, err := handler2.NewHandler(pMap, storev2, store, pubSub, pubSub, opts.AddPrometheusMetrics, deviceDataUpdateFrequency)
-	if err != nil {
-		panic(err)
+	var h2 *handler2.Handler
+	var pMap *sync2.PollerMap
+	if opts.Role != RoleAPI {
+		pMap = sync2.NewPollerMap(v2Client, opts.AddPrometheusMetrics)
+		pMap.SetUpstreams(upstreams)
+		// create v2 handler
+		h2, err = handler2.NewHandler(pMap, storev2, store, pubSub, pubSub, opts.AddPrometheusMetrics, deviceDataUpdateFrequency)
+		if err != nil {
+			panic(err)
+		}
+		pMap.SetCallbacks(h2)
+		if opts.PostgresPubSub {
+			h2.EnablePollerLeases(newInstanceID())
+		}
+		if opts.WebhookURL != "" {
+			webhook := notifier.NewWebhook(opts.WebhookURL, opts.WebhookSecret)
+			webhook.Start(4)
+			h2.EnableNotifier(webhook)
+		}
 	}
-	pMap.SetCallbacks(h2)
 
-	// create v3 handler
-	h3, err := handler.NewSync3Handler(store, storev2, v2Client, secret, pubSub, pubSub, opts.AddPrometheusMetrics, opts.MaxPendingEventUpdates, opts.MaxTransactionIDDelay)
-	if err != nil {
-		panic(err)
+	var h3 *handler.SyncLiveHandler
+	if opts.Role != RolePoller {
+		// create v3 handler
+		h3, err = handler.NewSync3Handler(store, storev2, v2Client, secret, pubSub, pubSub, opts.AddPrometheusMetrics, opts.MaxPendingEventUpdates, opts.MaxTransactionIDDelay)
+		if err != nil {
+			panic(err)
+		}
+		h3.Upstreams = upstreams
+		h3.EnableWebSockets = opts.EnableWebSockets
+		h3.SetAuthOptions(opts.Auth)
+		if opts.CheckpointConnections {
+			h3.EnableConnCheckpoints()
+		}
+		if opts.RateLimits != nil {
+			h3.EnableRateLimiting(*opts.RateLimits)
+		}
+		if opts.RecordDir != "" {
+			if err = h3.EnableRecording(opts.RecordDir, opts.RecordUsers); err != nil {
+				panic(err)
+			}
+		}
+		storeSnapshot, err := store.GlobalSnapshot()
+		if err != nil {
+			panic(err)
+		}
+		log.Info().Msg("retrieved global snapshot from database")
+		h3.Startup(&storeSnapshot)
 	}
-	storeSnapshot, err := store.GlobalSnapshot()
-	if err != nil {
-		panic(err)
+
+	if opts.AdminBindAddr != "" {
+		// don't pass typed nils, so the admin API can tell which parts this instance has
+		var conns admin.ConnMap
+		var pollers admin.PollerMap
+		if h3 != nil {
+			conns = h3.ConnMap
+		}
+		if pMap != nil {
+			pollers = pMap
+		}
+		go runAdminServer(admin.NewHandler(opts.AdminSecret, conns, pollers, store.ToDeviceTable), opts.AdminBindAddr)
 	}
-	log.Info().Msg("retrieved global snapshot from database")
-	h3.Startup(&storeSnapshot)
 
 	// begin consuming from these positions
-	h2.Listen()
+	if h2 != nil {
+		h2.Listen()
+	}
+	if h3 == nil {
+		return h2, nil
+	}
 	h3.Listen()
 	return h2, h3
 }
 
+// newInstanceID returns an ID which is unique to this process, for poller leases.
+func newInstanceID() string {
+	hostname, _ := os.Hostname()
+	b := make([]byte, 4)
+	_, _ = rand.Read(b)
+	return fmt.Sprintf("%s-%d-%s", hostname, os.Getpid(), hex.EncodeToString(b))
+}
+
 // RunSyncV3Server is the main entry point to the server
 func RunSyncV3Server(h http.Handler, bindAddr, destV2Server, tlsCert, tlsKey string) {
 	// HTTP path routing
 	r := mux.NewRouter()
 	r.Handle("/_matrix/client/v3/sync", allowCORS(h))
 	r.Handle("/_matrix/client/unstable/org.matrix.msc3575/sync", allowCORS(h))
+	r.Handle("/_matrix/client/unstable/org.matrix.msc3575/rooms/{roomID}/messages", allowCORS(h))
 
 	serverJSON, _ := json.Marshal(struct {
 		Server  string `json:"server"`
@@ -235,6 +396,14 @@ func RunSyncV3Server(h http.Handler, bindAddr, destV2Server, tlsCert, tlsKey str
 	}
 }
 
+func runAdminServer(h http.Handler, bindAddr string) {
+	log.Info().Msgf("admin API listening on %s", bindAddr)
+	if err := http.ListenAndServe(bindAddr, hlog.NewHandler(log.Logger)(h)); err != nil {
+		sentry.CaptureException(err)
+		log.Fatal().Err(err).Msg("failed to listen and serve admin API")
+	}
+}
+
 func unixSocketListener(bindAddr string) net.Listener {
 	err := os.Remove(bindAddr)
 	if err != nil && !errors.Is(err, fs.ErrNotExist) {